@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Role is what a token allows doing through Server.
+type Role int
+
+const (
+	// RoleReadOnly allows listing pools and reading stats.
+	RoleReadOnly Role = iota
+	// RoleAllocate also allows allocating and releasing subnets.
+	RoleAllocate
+	// RoleAdmin allows everything, in every pool, including static
+	// allocations outside of the pools.
+	RoleAdmin
+)
+
+// ACL is what the holder of a token is allowed to do, see WithTokens.
+type ACL struct {
+	// Actor identifies the holder of the token, see WithActor. It's only
+	// used when the client isn't identified by a TLS certificate.
+	Actor string
+	Role  Role
+	// Pools lists the names of the pools the token gives access to. Nil
+	// means all of them. It's ignored for RoleAdmin.
+	Pools []string
+}
+
+// allows tells whether acl gives access to pool.
+func (acl ACL) allows(pool Pool) bool {
+	return acl.Role == RoleAdmin || acl.Pools == nil || slices.Contains(acl.Pools, pool.Name)
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithTokens makes the server require a bearer token on every request, and
+// enforce the ACL it maps to. Requests with a missing or unknown token are
+// rejected with a 401, and those the ACL doesn't allow with a 403.
+func WithTokens(tokens map[string]ACL) ServerOption {
+	return func(s *Server) {
+		s.tokens = make(map[[sha256.Size]byte]ACL, len(tokens))
+		for token, acl := range tokens {
+			// Tokens are looked up by hash, such that lookups don't leak
+			// how much of a token matched.
+			s.tokens[sha256.Sum256([]byte(token))] = acl
+		}
+	}
+}
+
+type aclKey struct{}
+
+// authenticate returns the ACL of the token r carries. ok is false, and an
+// error was sent, if r isn't allowed to go through.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.tokens == nil {
+		return r, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	acl, known := s.tokens[sha256.Sum256([]byte(token))]
+	if !ok || !known {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), aclKey{}, acl)), true
+}
+
+// requestACL returns the ACL r was authenticated with. Without tokens, every
+// request is an admin one.
+func requestACL(r *http.Request) ACL {
+	if acl, ok := r.Context().Value(aclKey{}).(ACL); ok {
+		return acl
+	}
+	return ACL{Role: RoleAdmin}
+}
+
+// requestActor returns who sent r: the identity of its TLS certificate, or
+// the actor of its token.
+func requestActor(r *http.Request) string {
+	if actor := ClientIdentity(r); actor != "" {
+		return actor
+	}
+	return requestACL(r).Actor
+}
+
+// errForbidden is returned for requests the ACL of their token doesn't allow.
+var errForbidden = errors.New("forbidden by the token ACL")
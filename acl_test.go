@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestServerTokens(t *testing.T) {
+	s := &auditStore{}
+	a := mustNewAllocator(t, []Pool{
+		{Name: "a", Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24},
+		{Name: "b", Prefix: netip.MustParsePrefix("10.1.0.0/23"), Size: 24},
+	}, WithStore(s), WithAudit())
+	srv := NewServer(a, &sync.Mutex{}, WithTokens(map[string]ACL{
+		"reader": {Role: RoleReadOnly, Pools: []string{"a"}},
+		"ci":     {Actor: "ci", Role: RoleAllocate, Pools: []string{"b"}},
+		"ops":    {Actor: "ops", Role: RoleAllocate},
+		"root":   {Actor: "root", Role: RoleAdmin, Pools: []string{"a"}},
+	}))
+
+	testcases := []struct {
+		name      string
+		token     string
+		method    string
+		path      string
+		body      string
+		expStatus int
+		expBody   string
+	}{
+		{
+			name:      "no token",
+			method:    http.MethodGet,
+			path:      "/pools",
+			expStatus: http.StatusUnauthorized,
+			expBody:   `{"error":"missing or invalid token"}`,
+		},
+		{
+			name:      "unknown token",
+			token:     "readers",
+			method:    http.MethodGet,
+			path:      "/pools",
+			expStatus: http.StatusUnauthorized,
+		},
+		{
+			name:      "read-only pools",
+			token:     "reader",
+			method:    http.MethodGet,
+			path:      "/pools",
+			expStatus: http.StatusOK,
+			expBody:   `[{"name":"a","prefix":"10.0.0.0/23","size":24}]`,
+		},
+		{
+			name:      "read-only allocate",
+			token:     "reader",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{}`,
+			expStatus: http.StatusForbidden,
+			expBody:   `{"error":"forbidden by the token ACL"}`,
+		},
+		{
+			name:      "allocate from the permitted pools",
+			token:     "ci",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{}`,
+			expStatus: http.StatusCreated,
+			expBody:   `{"prefix":"10.1.0.0/24","pool":"10.1.0.0/23"}`,
+		},
+		{
+			name:      "allocate from another pool",
+			token:     "ci",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"pool": "a"}`,
+			expStatus: http.StatusForbidden,
+		},
+		{
+			name:      "static allocation in another pool",
+			token:     "ci",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"prefix": "10.0.1.0/24"}`,
+			expStatus: http.StatusForbidden,
+		},
+		{
+			name:      "static allocation in a permitted pool",
+			token:     "ci",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"prefix": "10.1.1.0/24"}`,
+			expStatus: http.StatusCreated,
+			expBody:   `{"prefix":"10.1.1.0/24","pool":"10.1.0.0/23"}`,
+		},
+		{
+			name:      "static allocation with access to every pool",
+			token:     "ops",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"prefix": "10.0.1.0/24"}`,
+			expStatus: http.StatusCreated,
+			expBody:   `{"prefix":"10.0.1.0/24","pool":"10.0.0.0/23"}`,
+		},
+		{
+			name:      "static allocation outside of the pools",
+			token:     "ci",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"prefix": "192.168.0.0/24"}`,
+			expStatus: http.StatusForbidden,
+		},
+		{
+			name:      "admin allocates anywhere",
+			token:     "root",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"prefix": "192.168.0.0/24"}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			name:      "list the permitted pools",
+			token:     "ci",
+			method:    http.MethodGet,
+			path:      "/allocations",
+			expStatus: http.StatusOK,
+			expBody:   `[{"prefix":"10.1.0.0/24"},{"prefix":"10.1.1.0/24"}]`,
+		},
+		{
+			name:      "dashboard without a token",
+			method:    http.MethodGet,
+			path:      "/",
+			expStatus: http.StatusOK,
+		},
+		{
+			name:      "release in another pool",
+			token:     "ci",
+			method:    http.MethodDelete,
+			path:      "/allocations/192.168.0.0/24",
+			expStatus: http.StatusForbidden,
+		},
+		{
+			name:      "release",
+			token:     "ci",
+			method:    http.MethodDelete,
+			path:      "/allocations/10.1.0.0/24",
+			expStatus: http.StatusNoContent,
+		},
+		{
+			name:      "read-only stats",
+			token:     "reader",
+			method:    http.MethodGet,
+			path:      "/stats",
+			expStatus: http.StatusOK,
+			expBody:   `{"capacity":2,"allocated":1,"reserved":0,"free":1,"pools":[{"name":"a","prefix":"10.0.0.0/23","capacity":2,"allocated":1,"reserved":0,"free":1,"fragmentation":0}]}`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Code, tc.expStatus)
+			if tc.expStatus == http.StatusUnauthorized {
+				assert.Equal(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+			if tc.expBody != "" {
+				assert.Equal(t, strings.TrimSpace(rec.Body.String()), tc.expBody)
+			}
+		})
+	}
+
+	var actors []string
+	for _, e := range s.audit {
+		actors = append(actors, e.Actor+" "+string(e.Action)+" "+e.Prefix.String())
+	}
+	assert.DeepEqual(t, actors, []string{
+		"ci allocate 10.1.0.0/24",
+		"ci allocate-static 10.1.1.0/24",
+		"ops allocate-static 10.0.1.0/24",
+		"root allocate-static 192.168.0.0/24",
+		"ci deallocate 10.1.0.0/24",
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// AdmissionRequest describes an allocation about to be made, see
+// AdmissionPolicy.
+type AdmissionRequest struct {
+	Prefix netip.Prefix
+	// Pool is the pool Prefix comes from. It's the zero value for static
+	// allocations outside of any pool.
+	Pool  Pool
+	Owner string
+	// Actor is who asked for the allocation, see WithActor.
+	Actor  string
+	Labels map[string]string
+}
+
+// AdmissionPolicy decides whether an allocation can be made, e.g. to enforce
+// rules such as "team X may only allocate from pool Y". It returns an error
+// to deny the allocation. Otherwise, it returns the name of the pool to
+// allocate from instead, or "" to admit the request as is.
+//
+// When a request is redirected to another pool, the policy is asked again
+// about the subnet picked from that pool, and can't redirect it again.
+// Static allocations, and those made by AllocateN, can't be redirected.
+type AdmissionPolicy func(req AdmissionRequest) (pool string, err error)
+
+// WithAdmissionPolicy makes the allocator ask p before making any allocation,
+// whichever method makes it, Tx ones included. Restoring allocations, e.g.
+// with Restore or Undo, doesn't ask p.
+func WithAdmissionPolicy(p AdmissionPolicy) Option {
+	return func(a *Allocator) {
+		a.admission = p
+	}
+}
+
+// admit asks the admission policy about the allocation of p, and returns the
+// pool to allocate from instead, if any.
+func (a *Allocator) admit(p netip.Prefix, owner, actor string, labels map[string]string) (string, error) {
+	req := AdmissionRequest{Prefix: p, Owner: owner, Actor: actor, Labels: labels}
+	if poolID, ok := a.poolIndex(p); ok {
+		req.Pool = a.pools[poolID].clone()
+	}
+
+	redirect, err := a.admission(req)
+	if err != nil {
+		return "", fmt.Errorf("allocation of %s %w: %w", p, ErrDenied, err)
+	}
+	if redirect == req.Pool.Name {
+		return "", nil
+	}
+	return redirect, nil
+}
+
+// admitStatic asks the admission policy about the allocation of p, which
+// can't be redirected to another pool, e.g. because it's static.
+func (a *Allocator) admitStatic(p netip.Prefix, owner, actor string, labels map[string]string) error {
+	if a.admission == nil {
+		return nil
+	}
+	redirect, err := a.admit(p, owner, actor, labels)
+	if err != nil {
+		return err
+	}
+	if redirect != "" {
+		return fmt.Errorf("allocation of %s %w: it can't be redirected to pool %q", p, ErrDenied, redirect)
+	}
+	return nil
+}
+
+// Validator checks a candidate subnet before it's allocated, e.g. against the
+// IPAM of record of a corporate network. It returns false to veto the
+// candidate, in which case Allocate moves on to the next one. Errors, e.g.
+// when the IPAM can't be reached, make the allocation fail.
+type Validator func(alloc Allocation) (bool, error)
+
+// WithValidator makes the allocator call v before making an allocation, once
+// it's admitted by the admission policy, if any. Like the admission policy, it
+// applies to every method making allocations, see WithAdmissionPolicy. Static
+// allocations fail when they're vetoed.
+func WithValidator(v Validator) Option {
+	return func(a *Allocator) {
+		a.validator = v
+	}
+}
+
+// maxVetoes is the number of candidates in a row the validator can veto
+// before Allocate gives up.
+const maxVetoes = 64
+
+// validate asks the validator about the allocation of p.
+func (a *Allocator) validate(p netip.Prefix) (bool, error) {
+	var pool Pool
+	if poolID, ok := a.poolIndex(p); ok {
+		pool = a.pools[poolID].clone()
+	}
+	ok, err := a.validator(Allocation{Prefix: p, Pool: pool})
+	if err != nil {
+		return false, fmt.Errorf("validating %s: %w", p, err)
+	}
+	return ok, nil
+}
+
+// validateStatic asks the validator, if any, about the allocation of p, which
+// fails if it's vetoed.
+func (a *Allocator) validateStatic(p netip.Prefix) error {
+	if a.validator == nil {
+		return nil
+	}
+	ok, err := a.validate(p)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("allocation of %s %w", p, ErrVetoed)
+	}
+	return nil
+}
+
+// pickAdmitted is the same as pick, but the subnet it returns was admitted by
+// the admission policy, and by the validator, if any.
+func (a *Allocator) pickAdmitted(o allocateOptions) (netip.Prefix, int, error) {
+	var redirect string
+	var vetoes int
+	for {
+		p, poolID, err := a.pick(o)
+		if err != nil {
+			return netip.Prefix{}, 0, err
+		}
+
+		if a.admission != nil {
+			pool, err := a.admit(p, o.owner, o.actor, o.labels)
+			if err != nil {
+				return netip.Prefix{}, 0, err
+			}
+			if pool != "" {
+				if redirect != "" {
+					return netip.Prefix{}, 0, fmt.Errorf("allocation of %s %w: redirected to pool %q, and then to pool %q", p, ErrDenied, redirect, pool)
+				}
+				if _, ok := a.Pool(pool); !ok {
+					return netip.Prefix{}, 0, fmt.Errorf("allocation of %s redirected to unknown pool %q", p, pool)
+				}
+				if a.logger != nil {
+					a.logger.Debug("admission policy redirected the allocation", "subnet", p, "pool", pool)
+				}
+				redirect, o.pool = pool, pool
+				continue
+			}
+		}
+
+		if a.validator != nil {
+			ok, err := a.validate(p)
+			if err != nil {
+				return netip.Prefix{}, 0, err
+			}
+			if !ok {
+				if a.logger != nil {
+					a.logger.Debug("validator vetoed subnet", "subnet", p)
+				}
+				if vetoes++; vetoes == maxVetoes {
+					return netip.Prefix{}, 0, fmt.Errorf("%d candidates in a row were %w", vetoes, ErrVetoed)
+				}
+				// Don't append to the caller's slice.
+				o.reserved = append(o.reserved[:len(o.reserved):len(o.reserved)], p)
+				continue
+			}
+		}
+
+		return p, poolID, nil
+	}
+}
+
+// suggestAdmitted returns n free subnets, like suggest, admitted by the
+// admission policy, and by the validator, if any. Subnets are picked in a
+// single pass, so they can't be redirected. Vetoed candidates are replaced by
+// the next free ones, and the whole batch is picked again such that pool
+// quotas still hold. Each candidate is only checked once.
+func (a *Allocator) suggestAdmitted(n int, o allocateOptions, sel selector) ([]netip.Prefix, error) {
+	var checked map[netip.Prefix]bool
+	var vetoes int
+	for {
+		prefixes := a.suggest(n, o, sel)
+		if len(prefixes) < n {
+			return nil, a.exhausted(o.size, sel)
+		}
+		if a.admission == nil && a.validator == nil {
+			return prefixes, nil
+		}
+		if checked == nil {
+			checked = map[netip.Prefix]bool{}
+		}
+
+		vetoed := false
+		for _, p := range prefixes {
+			if checked[p] {
+				continue
+			}
+			if err := a.admitStatic(p, o.owner, o.actor, o.labels); err != nil {
+				return nil, err
+			}
+			if a.validator != nil {
+				ok, err := a.validate(p)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					if a.logger != nil {
+						a.logger.Debug("validator vetoed subnet", "subnet", p)
+					}
+					if vetoes++; vetoes == maxVetoes {
+						return nil, fmt.Errorf("%d candidates were %w", vetoes, ErrVetoed)
+					}
+					// Don't append to the caller's slice.
+					o.reserved = append(o.reserved[:len(o.reserved):len(o.reserved)], p)
+					vetoed = true
+					continue
+				}
+			}
+			checked[p] = true
+		}
+		if !vetoed {
+			return prefixes, nil
+		}
+	}
+}
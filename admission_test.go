@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAdmissionPolicy(t *testing.T) {
+	pools := []Pool{
+		{Name: "shared", Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24},
+		{Name: "team-x", Prefix: netip.MustParsePrefix("10.1.0.0/16"), Size: 24},
+		{Name: "team-y", Prefix: netip.MustParsePrefix("10.2.0.0/16"), Size: 24},
+	}
+
+	// Team X may only allocate from its own pool, and team Y can't allocate
+	// at all.
+	var reqs []AdmissionRequest
+	policy := func(req AdmissionRequest) (string, error) {
+		reqs = append(reqs, req)
+		switch req.Owner {
+		case "team-x":
+			return "team-x", nil
+		case "team-y":
+			return "", errors.New("team-y is over budget")
+		case "loop":
+			return req.Pool.Name + "-again", nil
+		}
+		return "", nil
+	}
+	a := mustNewAllocator(t, pools, WithAdmissionPolicy(policy))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+
+	alloc, err := a.AllocateWithPool(WithOwner("team-x"), WithLabels(map[string]string{"env": "prod"}))
+	assert.NilError(t, err)
+	assert.Equal(t, alloc.Prefix, netip.MustParsePrefix("10.1.0.0/24"))
+	assert.Equal(t, alloc.Pool.Name, "team-x")
+	assert.Equal(t, len(reqs), 3)
+	assert.Equal(t, reqs[1].Prefix, netip.MustParsePrefix("10.0.1.0/24"))
+	assert.Equal(t, reqs[1].Pool.Name, "shared")
+	assert.DeepEqual(t, reqs[1].Labels, map[string]string{"env": "prod"})
+	assert.Equal(t, reqs[2].Prefix, netip.MustParsePrefix("10.1.0.0/24"))
+
+	_, err = a.AllocateNamed("net1", WithOwner("team-y"))
+	assert.ErrorIs(t, err, ErrDenied)
+	assert.Error(t, err, "allocation of 10.0.1.0/24 denied by the admission policy: team-y is over budget")
+
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.128.0/24"), WithOwner("team-x"))
+	assert.Error(t, err, `allocation of 10.0.128.0/24 denied by the admission policy: it can't be redirected to pool "team-x"`)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.1.128.0/24"), WithOwner("team-x")))
+
+	_, err = a.Allocate(WithOwner("loop"))
+	assert.Error(t, err, `allocation of 10.0.1.0/24 redirected to unknown pool "shared-again"`)
+
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.1.0.0/24"),
+		netip.MustParsePrefix("10.1.128.0/24"),
+	}, cmpPrefix)
+}
+
+func TestAdmissionPolicyAllPaths(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	var reqs []AdmissionRequest
+	denyAll := func(req AdmissionRequest) (string, error) {
+		reqs = append(reqs, req)
+		return "", errors.New("frozen")
+	}
+	a := mustNewAllocator(t, pools, WithAdmissionPolicy(denyAll))
+
+	_, err := a.AllocateN(2, WithOwner("ctr1"))
+	assert.ErrorIs(t, err, ErrDenied)
+
+	tx := a.Begin()
+	_, err = tx.Allocate()
+	assert.ErrorIs(t, err, ErrDenied)
+	assert.ErrorIs(t, tx.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")), ErrDenied)
+	assert.NilError(t, tx.Commit())
+
+	labels := map[string]string{"env": "prod"}
+	_, err = a.AllocateIndex(netip.MustParsePrefix("10.0.0.0/16"), 3, WithOwner("ctr1"), WithActor("alice"), WithLabels(labels))
+	assert.ErrorIs(t, err, ErrDenied)
+	last := reqs[len(reqs)-1]
+	assert.Equal(t, last.Owner, "ctr1")
+	assert.Equal(t, last.Actor, "alice")
+	assert.DeepEqual(t, last.Labels, labels)
+
+	assert.Equal(t, len(a.Allocated()), 0)
+}
+
+func TestValidator(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+
+	// The IPAM of record already has 10.0.0.0/24 and 10.0.1.0/24.
+	taken := map[netip.Prefix]bool{
+		netip.MustParsePrefix("10.0.0.0/24"): true,
+		netip.MustParsePrefix("10.0.1.0/24"): true,
+	}
+	var down bool
+	validator := func(alloc Allocation) (bool, error) {
+		if down {
+			return false, errors.New("ipam is down")
+		}
+		return !taken[alloc.Prefix], nil
+	}
+	a := mustNewAllocator(t, pools, WithValidator(validator))
+
+	// Vetoed candidates aren't appended to the caller's slice.
+	reserved := make([]netip.Prefix, 0, 10)
+	p, err := a.Allocate(WithReserved(reserved...))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.2.0/24"))
+	assert.Equal(t, reserved[:1][0], netip.Prefix{})
+	p, err = a.Allocate(WithHint(netip.MustParsePrefix("10.0.1.0/24")))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.3.0/24"))
+
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/24"))
+	assert.ErrorIs(t, err, ErrVetoed)
+	assert.Error(t, err, "allocation of 10.0.0.0/24 vetoed by the validator")
+
+	down = true
+	_, err = a.Allocate()
+	assert.Error(t, err, "validating 10.0.0.0/24: ipam is down")
+	down = false
+
+	// Allocate gives up after too many vetoes.
+	for i := range uint64(maxVetoes) {
+		taken[netip.PrefixFrom(Add(netip.MustParseAddr("10.0.4.0"), i, 8), 24)] = true
+	}
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrVetoed)
+	assert.Error(t, err, "64 candidates in a row were vetoed by the validator")
+	assert.Equal(t, len(a.Allocated()), 2)
+}
+
+func TestValidatorAllPaths(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	taken := map[netip.Prefix]bool{
+		netip.MustParsePrefix("10.0.0.0/24"): true,
+		netip.MustParsePrefix("10.0.1.0/24"): true,
+		netip.MustParsePrefix("10.0.4.0/24"): true,
+	}
+	var calls int
+	validator := func(alloc Allocation) (bool, error) {
+		calls++
+		return !taken[alloc.Prefix], nil
+	}
+	a := mustNewAllocator(t, pools, WithValidator(validator))
+
+	// Vetoed candidates are replaced, and others are only checked once.
+	prefixes, err := a.AllocateN(2)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prefixes, []netip.Prefix{
+		netip.MustParsePrefix("10.0.2.0/24"),
+		netip.MustParsePrefix("10.0.3.0/24"),
+	}, cmpPrefix)
+	assert.Equal(t, calls, 4)
+
+	tx := a.Begin()
+	p, err := tx.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.5.0/24"))
+	assert.ErrorIs(t, tx.AllocateStatic(netip.MustParsePrefix("10.0.0.0/24")), ErrVetoed)
+	assert.NilError(t, tx.Commit())
+
+	vetoAll := mustNewAllocator(t, pools, WithValidator(func(Allocation) (bool, error) { return false, nil }))
+	_, err = vetoAll.AllocateN(2)
+	assert.ErrorIs(t, err, ErrVetoed)
+	assert.Equal(t, len(vetoAll.Allocated()), 0)
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"errors"
 	"net/netip"
+	"slices"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"gotest.tools/v3/assert"
 )
 
+// cmpPrefix lets assert.DeepEqual compare netip values, which have unexported
+// fields.
+var cmpPrefix = cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })
+
+func mustNewAllocator(t testing.TB, pools []Pool, opts ...Option) *Allocator {
+	t.Helper()
+	a, err := NewAllocator(pools, opts...)
+	assert.NilError(t, err)
+	return a
+}
+
 func TestAllocate(t *testing.T) {
 	testcases := map[string]*struct {
 		allocator *Allocator
@@ -18,12 +32,12 @@ func TestAllocate(t *testing.T) {
 				pools: []Pool{
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					// Partial overlap with enough space remaining
 					netip.MustParsePrefix("192.168.0.0/24"),
 					netip.MustParsePrefix("192.168.1.0/24"),
 					netip.MustParsePrefix("192.168.2.3/30"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("192.168.3.0/24"),
 		},
@@ -33,11 +47,11 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("172.16.0.0/15"), Size: 16},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					netip.MustParsePrefix("172.16.0.0/16"),
 					// Partial overlap with enough space remaining
 					netip.MustParsePrefix("192.168.0.0/24"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("172.17.0.0/16"),
 		},
@@ -47,12 +61,12 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("172.16.0.0/15"), Size: 16},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					netip.MustParsePrefix("172.16.0.0/16"),
 					netip.MustParsePrefix("172.17.0.0/16"),
 					// Partial overlap with enough space remaining
 					netip.MustParsePrefix("192.168.0.0/24"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("192.168.1.0/24"),
 		},
@@ -62,10 +76,10 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("30.0.0.0/31"), Size: 31},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					// Partial overlap but not enough space left
 					netip.MustParsePrefix("30.0.0.0/32"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("192.168.0.0/24"),
 		},
@@ -75,11 +89,11 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("40.0.0.0/31"), Size: 31},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					// Fully overlap with smaller allocations
 					netip.MustParsePrefix("40.0.0.0/32"),
 					netip.MustParsePrefix("40.0.0.1/32"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("192.168.0.0/24"),
 		},
@@ -89,10 +103,10 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("50.0.0.0/31"), Size: 31},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					// Fully overlap with same-size allocation
 					netip.MustParsePrefix("50.0.0.0/31"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("192.168.0.0/24"),
 		},
@@ -102,23 +116,73 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 24},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					// Fully overlap with bigger allocation
 					netip.MustParsePrefix("172.0.0.0/8"),
-				},
+				),
 			},
 			expPrefix: netip.MustParsePrefix("192.168.0.0/24"),
 		},
+		"Gap in the middle of a pool": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/24"),
+					netip.MustParsePrefix("192.168.2.0/24"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("192.168.1.0/24"),
+		},
+		"Pool too big for a bitmap": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("10.0.0.0/28"),
+					netip.MustParsePrefix("10.0.0.16/28"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("10.0.0.32/28"),
+		},
+		"Pool too big for a bitmap, gap after a bigger allocation": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("10.0.0.0/24"),
+					netip.MustParsePrefix("10.0.1.3/32"),
+					netip.MustParsePrefix("10.0.1.16/28"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("10.0.1.32/28"),
+		},
+		"Pools with and without a bitmap": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 9},
+					{Prefix: netip.MustParsePrefix("20.0.0.0/8"), Size: 28},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("10.0.0.0/9"),
+					netip.MustParsePrefix("10.128.0.0/9"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("20.0.0.0/28"),
+		},
 		"Extra allocations, no pool left": {
 			allocator: &Allocator{
 				pools: []Pool{
 					{Prefix: netip.MustParsePrefix("172.16.0.0/15"), Size: 16},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					netip.MustParsePrefix("172.16.0.0/16"),
 					netip.MustParsePrefix("172.17.0.0/16"),
 					netip.MustParsePrefix("192.168.0.0/24"),
-				},
+				),
 			},
 			expErr: ErrNoFreePool,
 		},
@@ -128,12 +192,12 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("172.16.0.0/15"), Size: 16},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					netip.MustParsePrefix("172.16.0.0/16"),
 					netip.MustParsePrefix("172.17.0.0/16"),
 					netip.MustParsePrefix("192.168.0.0/24"),
 					netip.MustParsePrefix("192.168.1.0/24"),
-				},
+				),
 			},
 			expErr: ErrNoFreePool,
 		},
@@ -143,12 +207,12 @@ func TestAllocate(t *testing.T) {
 					{Prefix: netip.MustParsePrefix("172.16.0.0/15"), Size: 16},
 					{Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 24},
 				},
-				allocated: []netip.Prefix{
+				allocated: newPrefixList(
 					netip.MustParsePrefix("172.16.0.0/16"),
 					netip.MustParsePrefix("172.17.0.0/16"),
 					netip.MustParsePrefix("192.168.0.0/24"),
 					netip.MustParsePrefix("192.168.1.1/31"),
-				},
+				),
 			},
 			expErr: ErrNoFreePool,
 		},
@@ -174,7 +238,7 @@ func BenchmarkAllocate(b *testing.B) {
 			{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 24},
 			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
 		},
-		allocated: []netip.Prefix{
+		allocated: newPrefixList(
 			// Partial overlap but not enough space remaining
 			netip.MustParsePrefix("30.0.0.0/32"),
 			// Fully overlap with smaller allocations
@@ -188,7 +252,7 @@ func BenchmarkAllocate(b *testing.B) {
 			netip.MustParsePrefix("192.168.0.0/24"),
 			netip.MustParsePrefix("192.168.1.0/24"),
 			netip.MustParsePrefix("192.168.2.3/30"),
-		},
+		),
 	}
 
 	p, err := a.Allocate()
@@ -204,7 +268,6 @@ func BenchmarkEmpty(b *testing.B) {
 		pools: []Pool{
 			{Prefix: netip.MustParsePrefix("30.0.0.0/31"), Size: 31},
 		},
-		allocated: []netip.Prefix{},
 	}
 
 	p, err := a.Allocate()
@@ -220,7 +283,6 @@ func BenchmarkSerial(b *testing.B) {
 		pools: []Pool{
 			{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
 		},
-		allocated: []netip.Prefix{},
 	}
 
 	// 10,000 -> 600ms
@@ -236,5 +298,829 @@ func BenchmarkSerial(b *testing.B) {
 		}
 	}
 
-	assert.Equal(b, len(a.allocated), imax)
+	assert.Equal(b, a.allocated.len(), imax)
+}
+
+func TestAllocateZeroAllocs(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+	})
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := a.Allocate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, allocs, float64(0))
+}
+
+func BenchmarkAllocateFastPath(b *testing.B) {
+	a := mustNewAllocator(b, []Pool{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+		{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 24},
+	})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Allocate(); err != nil {
+			// Pools are exhausted, start over.
+			b.StopTimer()
+			a.allocated = prefixList{}
+			a.trie = nil
+			b.StartTimer()
+		}
+	}
+}
+
+func TestAllocateN(t *testing.T) {
+	testcases := map[string]*struct {
+		allocator   *Allocator
+		n           int
+		expPrefixes []netip.Prefix
+		expErr      error
+	}{
+		"Across pools": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("172.16.0.0/23"), Size: 24},
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("172.16.0.0/24"),
+					netip.MustParsePrefix("192.168.1.0/24"),
+				),
+			},
+			n: 3,
+			expPrefixes: []netip.Prefix{
+				netip.MustParsePrefix("172.16.1.0/24"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.2.0/24"),
+			},
+		},
+		"Pool too big for a bitmap": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("10.0.0.16/28"),
+				),
+			},
+			n: 2,
+			expPrefixes: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/28"),
+				netip.MustParsePrefix("10.0.0.32/28"),
+			},
+		},
+		"Not enough space left": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/24"),
+				),
+			},
+			n:      2,
+			expErr: ErrNoFreePool,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			before := tc.allocator.allocated.slice()
+
+			prefixes, err := tc.allocator.AllocateN(tc.n)
+
+			assert.ErrorIs(t, err, tc.expErr)
+			assert.DeepEqual(t, prefixes, tc.expPrefixes, cmpPrefix)
+			if err != nil {
+				// All or nothing.
+				assert.DeepEqual(t, tc.allocator.allocated.slice(), before, cmpPrefix)
+			} else {
+				assert.Equal(t, tc.allocator.allocated.len(), len(before)+tc.n)
+			}
+		})
+	}
+}
+
+func TestAllocateNOptions(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("192.168.0.0/22"), Size: 24}},
+		WithOwnerQuota("ctr1", OwnerQuota{MaxAllocations: 2}))
+
+	prefixes, err := a.AllocateN(2, WithReserved(netip.MustParsePrefix("192.168.0.0/24")), WithOwner("ctr1"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prefixes, []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("192.168.2.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, a.LookupByOwner("ctr1"), prefixes, cmpPrefix)
+
+	_, err = a.AllocateN(1, WithOwner("ctr1"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = a.AllocateN(1, WithSelector("!!"))
+	assert.ErrorContains(t, err, "invalid selector")
+	_, err = a.AllocateN(2, WithReserved(netip.MustParsePrefix("192.168.0.0/24")))
+	assert.ErrorIs(t, err, ErrNoFreePool)
+	assert.Equal(t, a.allocated.len(), 2)
+}
+
+func TestDeallocate(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+	})
+
+	_, err := a.AllocateN(3)
+	assert.NilError(t, err)
+
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("10.0.0.16/28")))
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("10.0.0.0/28")))
+	assert.Error(t, a.Deallocate(netip.MustParsePrefix("10.0.0.0/28")), "prefix 10.0.0.0/28 is not allocated")
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/28"))
+}
+
+func TestDeallocateBitmap(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.0.0/24"),
+			netip.MustParsePrefix("192.168.1.0/25"),
+			netip.MustParsePrefix("192.168.1.128/25"),
+		),
+	}
+
+	// The subnet is still partially allocated.
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("192.168.1.0/25")))
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.2.0/24"))
+
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("192.168.1.128/25")))
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.1.0/24"))
+}
+
+func TestDeallocateAll(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	})
+
+	prefixes, err := a.AllocateN(4)
+	assert.NilError(t, err)
+
+	err = a.DeallocateAll([]netip.Prefix{prefixes[0], netip.MustParsePrefix("10.0.0.0/8")})
+	assert.Error(t, err, "prefix 10.0.0.0/8 is not allocated")
+	assert.Equal(t, a.allocated.len(), 4)
+
+	err = a.DeallocateAll([]netip.Prefix{prefixes[0], prefixes[0]})
+	assert.Error(t, err, "prefix 192.168.0.0/24 is listed more than once")
+	assert.Equal(t, a.allocated.len(), 4)
+
+	assert.NilError(t, a.DeallocateAll(prefixes[1:3]))
+	assert.DeepEqual(t, a.allocated.slice(), []netip.Prefix{prefixes[0], prefixes[3]}, cmpPrefix)
+
+	assert.NilError(t, a.Reset())
+	assert.Equal(t, a.allocated.len(), 0)
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, prefixes[0])
+}
+
+func TestSuggest(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("172.16.0.0/23"), Size: 24},
+			{Prefix: netip.MustParsePrefix("192.168.0.0/30"), Size: 31},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("172.16.0.0/24"),
+		),
+	}
+
+	suggested := a.Suggest(5)
+	assert.DeepEqual(t, suggested, []netip.Prefix{
+		netip.MustParsePrefix("172.16.1.0/24"),
+		netip.MustParsePrefix("192.168.0.0/31"),
+		netip.MustParsePrefix("192.168.0.2/31"),
+	}, cmpPrefix)
+
+	// Nothing was allocated.
+	assert.Equal(t, a.allocated.len(), 1)
+	assert.DeepEqual(t, a.Suggest(1), suggested[:1], cmpPrefix)
+	assert.Assert(t, a.Suggest(0) == nil)
+
+	// Options choosing where subnets come from apply.
+	assert.DeepEqual(t, a.Suggest(2, WithReserved(netip.MustParsePrefix("172.16.1.0/24"), netip.MustParsePrefix("192.168.0.0/31"))),
+		[]netip.Prefix{netip.MustParsePrefix("192.168.0.2/31")}, cmpPrefix)
+	assert.DeepEqual(t, a.Suggest(1, WithReverse()), []netip.Prefix{netip.MustParsePrefix("192.168.0.2/31")}, cmpPrefix)
+	assert.Assert(t, a.Suggest(1, WithSelector("!!")) == nil)
+}
+
+func TestAllocateStatic(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.0.0/24"),
+		),
+	}
+
+	err := a.AllocateStatic(netip.MustParsePrefix("192.168.0.128/25"))
+	assert.Error(t, err, "prefix 192.168.0.128/25 overlaps with allocated prefix 192.168.0.0/24")
+
+	err = a.AllocateStatic(netip.MustParsePrefix("192.0.0.0/8"))
+	assert.Error(t, err, "prefix 192.0.0.0/8 overlaps with allocated prefix 192.168.0.0/24")
+
+	err = a.AllocateStatic(netip.MustParsePrefix("fd00::/64"))
+	assert.Error(t, err, "invalid prefix fd00::/64")
+
+	// Static allocations don't have to be part of a pool.
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/8")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.1.1/25")))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.2.0/24"))
+}
+
+func TestAllocateWithHint(t *testing.T) {
+	testcases := map[string]*struct {
+		hint      netip.Prefix
+		expPrefix netip.Prefix
+	}{
+		"Free hint": {
+			hint:      netip.MustParsePrefix("192.168.10.0/24"),
+			expPrefix: netip.MustParsePrefix("192.168.10.0/24"),
+		},
+		"Conflicting hint": {
+			hint:      netip.MustParsePrefix("192.168.0.0/24"),
+			expPrefix: netip.MustParsePrefix("192.168.1.0/24"),
+		},
+		"Hint outside of pools": {
+			hint:      netip.MustParsePrefix("10.0.0.0/24"),
+			expPrefix: netip.MustParsePrefix("192.168.1.0/24"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			a := &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/24"),
+				),
+			}
+
+			p, err := a.Allocate(WithHint(tc.hint))
+
+			assert.NilError(t, err)
+			assert.Equal(t, p, tc.expPrefix)
+			assert.Equal(t, a.allocated.len(), 2)
+		})
+	}
+}
+
+func TestAllocateIndex(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 16},
+			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.3.0/24"),
+		),
+	}
+
+	p, err := a.AllocateIndex(netip.MustParsePrefix("192.168.0.0/16"), 2)
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.2.0/24"))
+
+	p, err = a.AllocateIndex(netip.MustParsePrefix("172.16.0.0/12"), 15)
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("172.31.0.0/16"))
+
+	_, err = a.AllocateIndex(netip.MustParsePrefix("192.168.0.0/16"), 3)
+	assert.Error(t, err, "prefix 192.168.3.0/24 overlaps with allocated prefix 192.168.3.0/24")
+
+	_, err = a.AllocateIndex(netip.MustParsePrefix("172.16.0.0/12"), 16)
+	assert.Error(t, err, "pool 172.16.0.0/12 has no subnet at index 16")
+
+	_, err = a.AllocateIndex(netip.MustParsePrefix("10.0.0.0/8"), 0)
+	assert.Error(t, err, "no pool 10.0.0.0/8")
+}
+
+func TestAllocateReverse(t *testing.T) {
+	testcases := map[string]*struct {
+		allocator *Allocator
+		expPrefix netip.Prefix
+		expErr    error
+	}{
+		"Empty pool": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 16},
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+			},
+			expPrefix: netip.MustParsePrefix("192.168.255.0/24"),
+		},
+		"Gap in the middle": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.128.0/17"),
+					netip.MustParsePrefix("192.168.127.3/32"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("192.168.126.0/24"),
+		},
+		"Last pool full": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 16},
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/16"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("172.31.0.0/16"),
+		},
+		"Pool too big for a bitmap": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("10.255.255.0/24"),
+					netip.MustParsePrefix("10.255.254.240/28"),
+					netip.MustParsePrefix("10.255.254.225/32"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("10.255.254.208/28"),
+		},
+		"Pool at the start of the address space": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("0.0.0.0/8"), Size: 28},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("0.0.0.16/28"),
+					netip.MustParsePrefix("0.0.0.32/27"),
+					netip.MustParsePrefix("0.0.0.64/26"),
+					netip.MustParsePrefix("0.0.0.128/25"),
+					netip.MustParsePrefix("0.0.1.0/24"),
+					netip.MustParsePrefix("0.0.2.0/23"),
+					netip.MustParsePrefix("0.0.4.0/22"),
+					netip.MustParsePrefix("0.0.8.0/21"),
+					netip.MustParsePrefix("0.0.16.0/20"),
+					netip.MustParsePrefix("0.0.32.0/19"),
+					netip.MustParsePrefix("0.0.64.0/18"),
+					netip.MustParsePrefix("0.0.128.0/17"),
+					netip.MustParsePrefix("0.1.0.0/16"),
+					netip.MustParsePrefix("0.2.0.0/15"),
+					netip.MustParsePrefix("0.4.0.0/14"),
+					netip.MustParsePrefix("0.8.0.0/13"),
+					netip.MustParsePrefix("0.16.0.0/12"),
+					netip.MustParsePrefix("0.32.0.0/11"),
+					netip.MustParsePrefix("0.64.0.0/10"),
+					netip.MustParsePrefix("0.128.0.0/9"),
+				),
+			},
+			expPrefix: netip.MustParsePrefix("0.0.0.0/28"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			p, err := tc.allocator.Allocate(WithReverse())
+
+			assert.ErrorIs(t, err, tc.expErr)
+			assert.Equal(t, p, tc.expPrefix)
+		})
+	}
+}
+
+func TestAllocateWithAlignment(t *testing.T) {
+	testcases := map[string]*struct {
+		allocator *Allocator
+		align     int
+		reverse   bool
+		expPrefix netip.Prefix
+		expErr    error
+	}{
+		"Skip partially allocated blocks": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 26},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/26"),
+					netip.MustParsePrefix("192.168.1.128/26"),
+				),
+			},
+			align:     24,
+			expPrefix: netip.MustParsePrefix("192.168.1.0/26"),
+		},
+		"Skip bigger allocations": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 26},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/23"),
+					netip.MustParsePrefix("192.168.2.1/32"),
+				),
+			},
+			align:     24,
+			expPrefix: netip.MustParsePrefix("192.168.3.0/26"),
+		},
+		"Reverse": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 26},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.255.0/26"),
+				),
+			},
+			align:     24,
+			reverse:   true,
+			expPrefix: netip.MustParsePrefix("192.168.254.0/26"),
+		},
+		"Alignment bigger than the pool": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 26},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/26"),
+				),
+			},
+			align:  16,
+			expErr: ErrNoFreePool,
+		},
+		"Alignment smaller than the subnet size": {
+			allocator: &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				},
+				allocated: newPrefixList(
+					netip.MustParsePrefix("192.168.0.0/24"),
+				),
+			},
+			align:     28,
+			expPrefix: netip.MustParsePrefix("192.168.1.0/24"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			opts := []AllocateOption{WithAlignment(tc.align)}
+			if tc.reverse {
+				opts = append(opts, WithReverse())
+			}
+
+			p, err := tc.allocator.Allocate(opts...)
+
+			assert.ErrorIs(t, err, tc.expErr)
+			assert.Equal(t, p, tc.expPrefix)
+		})
+	}
+}
+
+func TestAllocateWithPool(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "private", Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 24},
+		{Name: "overlay", Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 16},
+	})
+
+	alloc, err := a.AllocateWithPool()
+	assert.NilError(t, err)
+	assert.Equal(t, alloc.Prefix, netip.MustParsePrefix("10.0.0.0/16"))
+	assert.Equal(t, alloc.Pool.Name, "overlay")
+
+	alloc, err = a.AllocateWithPool(WithHint(netip.MustParsePrefix("192.168.1.0/24")))
+	assert.NilError(t, err)
+	assert.Equal(t, alloc.Prefix, netip.MustParsePrefix("192.168.1.0/24"))
+	assert.Equal(t, alloc.Pool.Name, "private")
+	assert.Equal(t, alloc.Pool.Prefix, netip.MustParsePrefix("192.168.0.0/23"))
+	assert.Equal(t, alloc.Pool.Size, 24)
+}
+
+func TestAllocateWithSelector(t *testing.T) {
+	newAllocator := func() *Allocator {
+		return mustNewAllocator(t, []Pool{
+			{
+				Prefix: netip.MustParsePrefix("10.0.0.0/8"),
+				Size:   24,
+				Labels: map[string]string{"zone": "us", "class": "overlay"},
+			},
+			{
+				Prefix: netip.MustParsePrefix("172.16.0.0/12"),
+				Size:   24,
+				Labels: map[string]string{"zone": "eu", "class": "bridge"},
+			},
+			{
+				Prefix: netip.MustParsePrefix("192.168.0.0/16"),
+				Size:   24,
+				Labels: map[string]string{"zone": "eu", "class": "overlay"},
+			},
+		})
+	}
+
+	testcases := map[string]*struct {
+		selector  string
+		hint      netip.Prefix
+		expPrefix netip.Prefix
+		expErr    string
+	}{
+		"No selector": {
+			expPrefix: netip.MustParsePrefix("10.0.0.0/24"),
+		},
+		"Single match": {
+			selector:  "zone=eu, class=overlay",
+			expPrefix: netip.MustParsePrefix("192.168.0.0/24"),
+		},
+		"First match": {
+			selector:  "zone=eu",
+			expPrefix: netip.MustParsePrefix("172.16.0.0/24"),
+		},
+		"Hint in a pool that doesn't match": {
+			selector:  "zone=eu",
+			hint:      netip.MustParsePrefix("10.1.0.0/24"),
+			expPrefix: netip.MustParsePrefix("172.16.0.0/24"),
+		},
+		"No match": {
+			selector: "zone=ap",
+			expErr:   "no free address pools",
+		},
+		"Invalid selector": {
+			selector: "zone",
+			expErr:   `invalid selector: invalid requirement "zone": expected key=value or key!=value`,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			p, err := newAllocator().Allocate(WithSelector(tc.selector), WithHint(tc.hint))
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+				return
+			}
+
+			assert.NilError(t, err)
+			assert.Equal(t, p, tc.expPrefix)
+		})
+	}
+}
+
+func TestPoolsMetadata(t *testing.T) {
+	pools := []Pool{
+		{
+			Name:     "overlay",
+			Prefix:   netip.MustParsePrefix("10.1.2.3/8"),
+			Size:     24,
+			Labels:   map[string]string{"zone": "eu"},
+			Metadata: map[string]any{"owner": "netops", "vlan": 42},
+		},
+		{
+			Name:   "bridge",
+			Prefix: netip.MustParsePrefix("172.16.0.0/12"),
+			Size:   24,
+		},
+	}
+	a := mustNewAllocator(t, pools)
+
+	// The allocator keeps its own copy of pools.
+	pools[0].Labels["zone"] = "us"
+	pools[0].Metadata["vlan"] = 43
+
+	got := a.Pools()
+	assert.Equal(t, len(got), 2)
+	assert.Equal(t, got[0].Name, "overlay")
+	assert.Equal(t, got[0].Prefix, netip.MustParsePrefix("10.0.0.0/8"))
+	assert.DeepEqual(t, got[0].Labels, map[string]string{"zone": "eu"})
+	assert.DeepEqual(t, got[0].Metadata, map[string]any{"owner": "netops", "vlan": 42})
+	assert.Equal(t, got[1].Name, "bridge")
+
+	// Neither can callers modify pools through query APIs.
+	got[0].Labels["zone"] = "us"
+	p, ok := a.Pool("overlay")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, p.Labels, map[string]string{"zone": "eu"})
+
+	alloc, err := a.AllocateWithPool()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, alloc.Pool.Metadata, map[string]any{"owner": "netops", "vlan": 42})
+
+	_, ok = a.Pool("unknown")
+	assert.Assert(t, !ok)
+}
+
+func TestAllocateOverflowPools(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("100.64.0.0/23"), Size: 24, Overflow: true},
+		{Prefix: netip.MustParsePrefix("172.16.0.0/23"), Size: 24},
+		{Prefix: netip.MustParsePrefix("192.168.0.0/24"), Size: 24},
+	})
+
+	prefixes, err := a.AllocateN(4)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prefixes, []netip.Prefix{
+		netip.MustParsePrefix("172.16.0.0/24"),
+		netip.MustParsePrefix("172.16.1.0/24"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+		netip.MustParsePrefix("100.64.0.0/24"),
+	}, cmpPrefix)
+
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("172.16.1.0/24")))
+
+	// Primary pools are always preferred, even in reverse.
+	p, err := a.Allocate(WithReverse())
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("172.16.1.0/24"))
+
+	p, err = a.Allocate(WithReverse())
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("100.64.1.0/24"))
+}
+
+func TestWithHostID(t *testing.T) {
+	testcases := []struct {
+		name string
+		pool Pool
+		opts []AllocateOption
+	}{
+		{
+			name: "bitmap",
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 28},
+		},
+		{
+			name: "bitmap, reverse",
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 28},
+			opts: []AllocateOption{WithReverse()},
+		},
+		{
+			name: "trie",
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 28},
+			opts: []AllocateOption{WithAlignment(26)},
+		},
+		{
+			name: "trie, reverse",
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 28},
+			opts: []AllocateOption{WithAlignment(26), WithReverse()},
+		},
+		{
+			name: "static reserve",
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 28, StaticReserve: 50},
+		},
+	}
+
+	allocateAll := func(t *testing.T, a *Allocator, opts []AllocateOption) []netip.Prefix {
+		var prefixes []netip.Prefix
+		for {
+			p, err := a.Allocate(opts...)
+			if errors.Is(err, ErrNoFreePool) {
+				return prefixes
+			}
+			assert.NilError(t, err)
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			want := allocateAll(t, mustNewAllocator(t, []Pool{tc.pool}), tc.opts)
+
+			a := mustNewAllocator(t, []Pool{tc.pool}, WithHostID("host1"))
+			got := allocateAll(t, a, tc.opts)
+
+			// Subnets are handed out in the same order, but starting
+			// somewhere else.
+			assert.Assert(t, len(got) > 0)
+			i := slices.Index(want, got[0])
+			assert.Assert(t, i > 0, "host ID has no effect")
+			assert.DeepEqual(t, got, append(want[i:], want[:i]...), cmpPrefix)
+
+			// The offset only depends on the host ID.
+			b := mustNewAllocator(t, []Pool{tc.pool}, WithHostID("host1"))
+			assert.DeepEqual(t, allocateAll(t, b, tc.opts), got, cmpPrefix)
+		})
+	}
+
+	// Different hosts start at different offsets.
+	pool := Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24}
+	p1, err := mustNewAllocator(t, []Pool{pool}, WithHostID("host1")).Allocate()
+	assert.NilError(t, err)
+	p2, err := mustNewAllocator(t, []Pool{pool}, WithHostID("host2")).Allocate()
+	assert.NilError(t, err)
+	assert.Check(t, p1 != p2)
+}
+
+func TestAllocateWithIdempotencyKey(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+
+	p1, err := a.Allocate(WithIdempotencyKey("req1"))
+	assert.NilError(t, err)
+	assert.Equal(t, p1, netip.MustParsePrefix("10.0.0.0/24"))
+
+	// Retrying returns the same subnet, whatever the other options.
+	gen := a.Generation()
+	alloc, err := a.AllocateWithPool(WithIdempotencyKey("req1"), WithReverse())
+	assert.NilError(t, err)
+	assert.Equal(t, alloc.Prefix, p1)
+	assert.Equal(t, alloc.Pool.Prefix, netip.MustParsePrefix("10.0.0.0/16"))
+	assert.Equal(t, a.Generation(), gen)
+
+	// Static allocations too, as long as it's the same prefix.
+	assert.NilError(t, a.AllocateStatic(p1, WithIdempotencyKey("req1")))
+	assert.Equal(t, a.Generation(), gen)
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/25"), WithIdempotencyKey("req1"))
+	assert.ErrorIs(t, err, ErrOverlap)
+
+	p2, err := a.Allocate(WithIdempotencyKey("req2"))
+	assert.NilError(t, err)
+	assert.Equal(t, p2, netip.MustParsePrefix("10.0.1.0/24"))
+	p3, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p3, netip.MustParsePrefix("10.0.2.0/24"))
+
+	// Keys are forgotten along with their subnet.
+	assert.NilError(t, a.Deallocate(p1))
+	p, err := a.Allocate(WithReverse(), WithIdempotencyKey("req1"))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.255.0/24"))
+
+	assert.NilError(t, a.Reset())
+	p, err = a.Allocate(WithIdempotencyKey("req2"))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+}
+
+func TestAllocateWithOwner(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+
+	p1, err := a.Allocate(WithOwner("container1"))
+	assert.NilError(t, err)
+	p2, err := a.Allocate()
+	assert.NilError(t, err)
+	p3 := netip.MustParsePrefix("192.168.0.0/24")
+	assert.NilError(t, a.AllocateStatic(p3, WithOwner("tenant1"), WithReverse()))
+
+	m, ok := a.Metadata(p1)
+	assert.Check(t, ok)
+	assert.Equal(t, m.Owner, "container1")
+	m, ok = a.Metadata(p2)
+	assert.Check(t, ok)
+	assert.Equal(t, m.Owner, "")
+	_, ok = a.Metadata(netip.MustParsePrefix("10.0.100.0/24"))
+	assert.Check(t, !ok)
+
+	// Owners are persisted.
+	b := mustNewAllocator(t, nil, WithStore(s))
+	m, ok = b.Metadata(p3)
+	assert.Check(t, ok)
+	assert.Equal(t, m.Owner, "tenant1")
+
+	// They go away with their allocation.
+	assert.NilError(t, a.Deallocate(p1))
+	assert.NilError(t, a.AllocateStatic(p1))
+	m, _ = a.Metadata(p1)
+	assert.Equal(t, m.Owner, "")
+}
+
+func TestWithPools(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "a", Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24},
+		{Name: "b", Prefix: netip.MustParsePrefix("10.1.0.0/24"), Size: 24},
+		{Name: "c", Prefix: netip.MustParsePrefix("10.2.0.0/24"), Size: 24},
+	})
+
+	p, err := a.Allocate(WithPools("c", "b"))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.1.0.0/24"))
+	p, err = a.Allocate(WithPools("b", "c"), WithHint(netip.MustParsePrefix("10.0.0.0/24")))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.2.0.0/24"))
+	_, err = a.Allocate(WithPools("b"))
+	assert.ErrorIs(t, err, ErrNoFreePool)
 }
@@ -0,0 +1,115 @@
+// Package allocatortest helps property-testing code built on the subnet
+// allocator. It generates random pools and reserved sets, and checks that
+// allocations honor the allocator's contract.
+//
+// It only deals with netip values, so that it can be used without depending
+// on the allocator itself.
+package allocatortest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// PoolSpec describes a pool: subnets of Size bits handed out from Prefix.
+type PoolSpec struct {
+	Prefix netip.Prefix
+	Size   int
+}
+
+// Subnets returns the number of subnets of the pool.
+func (p PoolSpec) Subnets() uint64 {
+	return uint64(1) << (p.Size - p.Prefix.Bits())
+}
+
+// RandomPools returns up to n pools carved out of supernet, sorted and not
+// overlapping with each other. Pools have at most 2^maxSubnetBits subnets,
+// such that tests can exhaust them.
+func RandomPools(r *rand.Rand, supernet netip.Prefix, n, maxSubnetBits int) []PoolSpec {
+	var pools []PoolSpec
+	for range n {
+		bits := supernet.Bits() + 1 + r.IntN(max(1, 24-supernet.Bits()))
+		p := RandomPrefix(r, supernet, bits)
+		if slices.ContainsFunc(pools, func(q PoolSpec) bool { return q.Prefix.Overlaps(p) }) {
+			continue
+		}
+		size := min(32, bits+r.IntN(maxSubnetBits+1))
+		pools = append(pools, PoolSpec{Prefix: p, Size: size})
+	}
+
+	slices.SortFunc(pools, func(a, b PoolSpec) int {
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	return pools
+}
+
+// RandomPrefix returns a random /bits prefix within supernet. bits can't be
+// lower than the length of supernet.
+func RandomPrefix(r *rand.Rand, supernet netip.Prefix, bits int) netip.Prefix {
+	a := supernet.Masked().Addr().As4()
+	v := uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])
+	if host := 32 - supernet.Bits(); host > 0 {
+		v |= r.Uint32() & (1<<host - 1)
+	}
+	addr := netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	return netip.PrefixFrom(addr, bits).Masked()
+}
+
+// RandomReserved returns n random prefixes overlapping with pools, of any
+// size. They may overlap with each other, like reserved sets found in the
+// wild.
+func RandomReserved(r *rand.Rand, pools []PoolSpec, n int) []netip.Prefix {
+	if len(pools) == 0 {
+		return nil
+	}
+
+	reserved := make([]netip.Prefix, 0, n)
+	for range n {
+		pool := pools[r.IntN(len(pools))]
+		bits := pool.Prefix.Bits() + r.IntN(33-pool.Prefix.Bits())
+		reserved = append(reserved, RandomPrefix(r, pool.Prefix, bits))
+	}
+	return reserved
+}
+
+// CheckAllocations verifies that allocated is sorted and that its prefixes
+// don't overlap with each other, or with any of reserved. If pools isn't nil,
+// every allocation must also be exactly a subnet of one of them.
+func CheckAllocations(allocated []netip.Prefix, pools []PoolSpec, reserved []netip.Prefix) error {
+	for i, p := range allocated {
+		if !p.IsValid() || p != p.Masked() {
+			return fmt.Errorf("allocated prefix %s is invalid", p)
+		}
+		if i > 0 && allocated[i-1].Addr().Compare(p.Addr()) >= 0 {
+			return fmt.Errorf("allocated prefixes %s and %s aren't sorted", allocated[i-1], p)
+		}
+		if i > 0 && allocated[i-1].Overlaps(p) {
+			return fmt.Errorf("allocated prefixes %s and %s overlap", allocated[i-1], p)
+		}
+	}
+
+	for _, p := range allocated {
+		for _, r := range reserved {
+			if r.Overlaps(p) {
+				return fmt.Errorf("allocated prefix %s overlaps with reserved prefix %s", p, r)
+			}
+		}
+		if pools != nil && !slices.ContainsFunc(pools, func(pool PoolSpec) bool {
+			return pool.Size == p.Bits() && pool.Prefix.Contains(p.Addr())
+		}) {
+			return fmt.Errorf("allocated prefix %s isn't a subnet of any pool", p)
+		}
+	}
+	return nil
+}
+
+// AssertAllocations fails the test if CheckAllocations returns an error.
+func AssertAllocations(t testing.TB, allocated []netip.Prefix, pools []PoolSpec, reserved []netip.Prefix) {
+	t.Helper()
+	if err := CheckAllocations(allocated, pools, reserved); err != nil {
+		t.Fatal(err)
+	}
+}
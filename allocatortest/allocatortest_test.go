@@ -0,0 +1,82 @@
+package allocatortest
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRandomPools(t *testing.T) {
+	supernet := netip.MustParsePrefix("10.0.0.0/8")
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for range 100 {
+		pools := RandomPools(r, supernet, 5, 6)
+		assert.Assert(t, len(pools) > 0)
+		for i, p := range pools {
+			assert.Check(t, supernet.Contains(p.Prefix.Addr()) && p.Prefix.Bits() > supernet.Bits(), "pool %s", p.Prefix)
+			assert.Check(t, p.Size >= p.Prefix.Bits() && p.Size-p.Prefix.Bits() <= 6, "pool %s, size %d", p.Prefix, p.Size)
+			if i > 0 {
+				assert.Check(t, !pools[i-1].Prefix.Overlaps(p.Prefix), "pools %s and %s", pools[i-1].Prefix, p.Prefix)
+			}
+		}
+
+		for _, reserved := range RandomReserved(r, pools, 5) {
+			assert.Check(t, supernet.Overlaps(reserved), "reserved %s", reserved)
+		}
+	}
+}
+
+func TestCheckAllocations(t *testing.T) {
+	pools := []PoolSpec{{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24}}
+	reserved := []netip.Prefix{netip.MustParsePrefix("192.168.10.0/23")}
+
+	testcases := []struct {
+		name      string
+		allocated []string
+		expErr    string
+	}{
+		{
+			name:      "valid",
+			allocated: []string{"192.168.0.0/24", "192.168.1.0/24", "192.168.12.0/24"},
+		},
+		{
+			name:      "unsorted",
+			allocated: []string{"192.168.1.0/24", "192.168.0.0/24"},
+			expErr:    "allocated prefixes 192.168.1.0/24 and 192.168.0.0/24 aren't sorted",
+		},
+		{
+			name:      "overlapping",
+			allocated: []string{"192.168.0.0/23", "192.168.1.0/24"},
+			expErr:    "allocated prefixes 192.168.0.0/23 and 192.168.1.0/24 overlap",
+		},
+		{
+			name:      "reserved",
+			allocated: []string{"192.168.11.0/24"},
+			expErr:    "allocated prefix 192.168.11.0/24 overlaps with reserved prefix 192.168.10.0/23",
+		},
+		{
+			name:      "wrong size",
+			allocated: []string{"192.168.0.0/25"},
+			expErr:    "allocated prefix 192.168.0.0/25 isn't a subnet of any pool",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var allocated []netip.Prefix
+			for _, s := range tc.allocated {
+				allocated = append(allocated, netip.MustParsePrefix(s))
+			}
+
+			err := CheckAllocations(allocated, pools, reserved)
+			if tc.expErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Error(t, err, tc.expErr)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// AuditAction is what an AuditEntry records.
+type AuditAction string
+
+const (
+	AuditAllocate       AuditAction = "allocate"
+	AuditAllocateStatic AuditAction = "allocate-static"
+	AuditDeallocate     AuditAction = "deallocate"
+)
+
+// AuditEntry records who asked the allocator for what, when, and how it went.
+type AuditEntry struct {
+	Time   time.Time   `json:"time"`
+	Actor  string      `json:"actor,omitempty"`
+	Action AuditAction `json:"action"`
+	// Prefix is the subnet that was allocated or released. It's invalid if
+	// Allocate failed.
+	Prefix netip.Prefix `json:"prefix"`
+	Owner  string       `json:"owner,omitempty"`
+	// Error is why the request failed, or empty if it succeeded. Denied
+	// tells whether it was denied by the admission policy.
+	Error  string `json:"error,omitempty"`
+	Denied bool   `json:"denied,omitempty"`
+}
+
+// AuditStore is implemented by stores able to keep an audit trail, see
+// WithAudit. Entries must only ever be appended, never rewritten by
+// SaveSnapshot.
+type AuditStore interface {
+	AppendAudit(entries []AuditEntry) error
+}
+
+// WithAudit makes the allocator keep an audit trail of every allocation and
+// release, whichever method made it, in its store. Requests that failed,
+// including denied ones, are recorded too. The store must implement
+// AuditStore.
+//
+// Unlike History, the audit trail is never pruned, and records who made
+// each request, see WithActor and ReleasedBy. Changes made on nobody's
+// behalf, e.g. by ReclaimExpired or Undo, have no actor. Entries are appended
+// to the store once the change is applied. Those the store fails to append
+// are kept, and appended along with the next ones, see FlushAudit.
+func WithAudit() Option {
+	return func(a *Allocator) {
+		a.audit = true
+	}
+}
+
+// WithActor records actor, e.g. a user or a service account, as the one who
+// asked for the allocation in the audit trail, see WithAudit. It's also
+// passed to the admission policy, see AdmissionRequest.
+func WithActor(actor string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.actor = actor
+	}
+}
+
+// ReleasedBy records actor as the one who asked for the deallocation in the
+// audit trail, see WithAudit.
+func ReleasedBy(actor string) DeallocateOption {
+	return func(o *deallocateOptions) {
+		o.actor = actor
+	}
+}
+
+// checkAudit returns an error if the audit trail is enabled, but the store
+// can't keep it.
+func (a *Allocator) checkAudit() error {
+	if !a.audit {
+		return nil
+	}
+	if _, ok := a.store.(AuditStore); !ok {
+		return errors.New("the audit trail needs a store implementing AuditStore")
+	}
+	return nil
+}
+
+// auditOp is the request in progress, which the changes it makes are
+// attributed to in the audit trail.
+type auditOp struct {
+	action AuditAction
+	actor  string
+}
+
+// beginAudit attributes the changes made until endAudit is called to actor,
+// as action. It returns the request in progress, if any, which endAudit
+// restores: hooks may make requests of their own.
+func (a *Allocator) beginAudit(action AuditAction, actor string) auditOp {
+	prev := a.op
+	a.op = auditOp{action: action, actor: actor}
+	return prev
+}
+
+// endAudit records the request in progress if it failed with err, restores
+// prev, and flushes the audit trail. Changes are recorded as they're applied,
+// see notify.
+func (a *Allocator) endAudit(prev auditOp, p netip.Prefix, owner string, err error) {
+	if a.audit && err != nil {
+		a.recordAudit(a.op.action, p, a.op.actor, owner, err)
+	}
+	a.op = prev
+	if a.audit {
+		a.flushAudit()
+	}
+}
+
+// auditAction returns the action c is recorded as in the audit trail.
+func (c change) auditAction() AuditAction {
+	if c.released {
+		return AuditDeallocate
+	}
+	if c.op.action == AuditAllocateStatic {
+		return AuditAllocateStatic
+	}
+	return AuditAllocate
+}
+
+// recordAudit adds an entry to the audit trail. It's appended to the store
+// by flushAudit.
+func (a *Allocator) recordAudit(action AuditAction, p netip.Prefix, actor, owner string, err error) {
+	if a.closed {
+		// The store might be gone already.
+		return
+	}
+	e := AuditEntry{
+		Time:   a.now(),
+		Actor:  actor,
+		Action: action,
+		Prefix: p,
+		Owner:  owner,
+	}
+	if err != nil {
+		e.Error = err.Error()
+		e.Denied = errors.Is(err, ErrDenied)
+	}
+	a.pendingAudit = append(a.pendingAudit, e)
+}
+
+// flushAudit is the same as FlushAudit, but failures are only logged, such
+// that they don't hide the outcome of the request.
+func (a *Allocator) flushAudit() {
+	if err := a.FlushAudit(); err != nil && a.logger != nil {
+		a.logger.Warn("audit trail not flushed", "error", err, "pending", len(a.pendingAudit))
+	}
+}
+
+// FlushAudit appends the entries of the audit trail the store failed to
+// append so far, see WithAudit.
+func (a *Allocator) FlushAudit() error {
+	if len(a.pendingAudit) == 0 {
+		return nil
+	}
+	if err := a.store.(AuditStore).AppendAudit(a.pendingAudit); err != nil {
+		return fmt.Errorf("appending to the audit trail: %w", err)
+	}
+	a.pendingAudit = nil
+	return nil
+}
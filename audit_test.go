@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// auditStore is a memStore keeping an audit trail. Appending fails while
+// failAudit is set.
+type auditStore struct {
+	memStore
+	audit     []AuditEntry
+	failAudit bool
+}
+
+func (s *auditStore) AppendAudit(entries []AuditEntry) error {
+	if s.failAudit {
+		return errStore
+	}
+	s.audit = append(s.audit, entries...)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &auditStore{}
+	deny := func(req AdmissionRequest) (string, error) {
+		if req.Owner == "mallory" {
+			return "", errors.New("not allowed")
+		}
+		return "", nil
+	}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}},
+		WithStore(s), WithAudit(), WithAdmissionPolicy(deny))
+	a.now = (&fakeClock{t: now}).now
+
+	p, err := a.Allocate(WithActor("alice"), WithOwner("ctr1"))
+	assert.NilError(t, err)
+	_, err = a.Allocate(WithActor("bob"), WithOwner("mallory"))
+	assert.ErrorIs(t, err, ErrDenied)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24"), WithActor("alice")))
+
+	// Entries the store fails to append are kept for the next flush.
+	s.failAudit = true
+	assert.NilError(t, a.Deallocate(p, ReleasedBy("bob")))
+	assert.Check(t, is.Len(s.audit, 3))
+	assert.ErrorIs(t, a.FlushAudit(), errStore)
+	s.failAudit = false
+
+	err = a.DeallocateAll([]netip.Prefix{netip.MustParsePrefix("192.168.0.0/24"), p})
+	assert.ErrorIs(t, err, ErrNotAllocated)
+	assert.NilError(t, a.FlushAudit())
+
+	denied := "allocation of 10.0.1.0/24 denied by the admission policy: not allowed"
+	notAllocated := "prefix 10.0.0.0/24 is not allocated"
+	assert.DeepEqual(t, s.audit, []AuditEntry{
+		{Time: now, Actor: "alice", Action: AuditAllocate, Prefix: netip.MustParsePrefix("10.0.0.0/24"), Owner: "ctr1"},
+		{Time: now, Actor: "bob", Action: AuditAllocate, Owner: "mallory", Error: denied, Denied: true},
+		{Time: now, Actor: "alice", Action: AuditAllocateStatic, Prefix: netip.MustParsePrefix("192.168.0.0/24")},
+		{Time: now, Actor: "bob", Action: AuditDeallocate, Prefix: netip.MustParsePrefix("10.0.0.0/24"), Owner: "ctr1"},
+		{Time: now, Action: AuditDeallocate, Prefix: netip.MustParsePrefix("192.168.0.0/24"), Error: notAllocated},
+		{Time: now, Action: AuditDeallocate, Prefix: netip.MustParsePrefix("10.0.0.0/24"), Error: notAllocated},
+	}, cmpPrefix)
+}
+
+func TestAuditNeedsAuditStore(t *testing.T) {
+	_, err := NewAllocator(nil, WithStore(&memStore{}), WithAudit())
+	assert.Error(t, err, "the audit trail needs a store implementing AuditStore")
+}
+
+func TestFileStoreAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewFileStore(path)
+	assert.NilError(t, err)
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s), WithAudit())
+
+	p, err := a.Allocate(WithActor("alice"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p, ReleasedBy("bob")))
+
+	f, err := os.Open(path + ".audit")
+	assert.NilError(t, err)
+	defer f.Close()
+	var actors []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e AuditEntry
+		assert.NilError(t, json.Unmarshal(sc.Bytes(), &e))
+		assert.Equal(t, e.Prefix, p)
+		actors = append(actors, string(e.Action)+" "+e.Actor)
+	}
+	assert.DeepEqual(t, actors, []string{"allocate alice", "deallocate bob"})
+}
+
+func TestAuditAllPaths(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{t: now}
+	s := &auditStore{}
+	pool := netip.MustParsePrefix("10.0.0.0/22")
+	a := mustNewAllocator(t, []Pool{{Prefix: pool, Size: 24}}, WithStore(s), WithAudit(), WithUndo(10))
+	a.now = clock.now
+
+	_, err := a.AllocateN(2, WithActor("alice"), WithOwner("ctr1"))
+	assert.NilError(t, err)
+	_, err = a.AllocateN(10, WithActor("alice"))
+	assert.ErrorIs(t, err, ErrNoFreePool)
+	_, err = a.AllocateIndex(pool, 3, WithActor("bob"))
+	assert.NilError(t, err)
+	_, err = a.AllocateNamed("net1", WithActor("carol"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.Release("net1", ReleasedBy("carol")))
+	_, err = a.DeallocateByOwner("ctr1", ReleasedBy("dave"))
+	assert.NilError(t, err)
+
+	tx := a.Begin()
+	_, err = tx.Allocate(WithActor("erin"))
+	assert.NilError(t, err)
+	assert.NilError(t, tx.Deallocate(netip.MustParsePrefix("10.0.3.0/24"), ReleasedBy("erin")))
+	assert.NilError(t, tx.Commit())
+
+	_, err = a.AllocateIfGeneration(a.Generation(), WithActor("frank"), WithTTL(time.Minute))
+	assert.NilError(t, err)
+	assert.Equal(t, a.Counters().AllocateLatency.Count, uint64(1))
+	assert.NilError(t, a.Undo())
+	_, err = a.AllocateIfGeneration(a.Generation(), WithTTL(time.Minute))
+	assert.NilError(t, err)
+	clock.t = now.Add(time.Hour)
+	_, err = a.ReclaimExpired()
+	assert.NilError(t, err)
+	_, err = a.GC(context.Background(), func(netip.Prefix, AllocationMeta) bool { return false }, ReleasedBy("gc"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24"), WithActor("bob")))
+	assert.NilError(t, a.Reset())
+
+	var got []string
+	for _, e := range s.audit {
+		got = append(got, fmt.Sprintf("%s %s actor=%s owner=%s error=%s", e.Action, e.Prefix, e.Actor, e.Owner, e.Error))
+	}
+	exhausted := "no free address pools: pool 10.0.0.0/22 has 2 allocations, 2 of 4 subnets free, 0 reserved"
+	assert.DeepEqual(t, got, []string{
+		"allocate 10.0.0.0/24 actor=alice owner=ctr1 error=",
+		"allocate 10.0.1.0/24 actor=alice owner=ctr1 error=",
+		"allocate invalid Prefix actor=alice owner= error=" + exhausted,
+		"allocate-static 10.0.3.0/24 actor=bob owner= error=",
+		"allocate 10.0.2.0/24 actor=carol owner= error=",
+		"deallocate 10.0.2.0/24 actor=carol owner= error=",
+		"deallocate 10.0.0.0/24 actor=dave owner=ctr1 error=",
+		"deallocate 10.0.1.0/24 actor=dave owner=ctr1 error=",
+		// Tx.Commit
+		"deallocate 10.0.3.0/24 actor=erin owner= error=",
+		"allocate 10.0.0.0/24 actor=erin owner= error=",
+		// AllocateIfGeneration, Undo, and a lease reclaimed by
+		// ReclaimExpired.
+		"allocate 10.0.1.0/24 actor=frank owner= error=",
+		"deallocate 10.0.1.0/24 actor= owner= error=",
+		"allocate 10.0.1.0/24 actor= owner= error=",
+		"deallocate 10.0.1.0/24 actor= owner= error=",
+		// GC, then Reset.
+		"deallocate 10.0.0.0/24 actor=gc owner= error=",
+		"allocate-static 192.168.0.0/24 actor=bob owner= error=",
+		"deallocate 192.168.0.0/24 actor= owner= error=",
+	})
+}
+
+func TestAuditTxFailure(t *testing.T) {
+	s := &auditStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}}, WithStore(s), WithAudit())
+
+	tx := a.Begin()
+	p, err := tx.Allocate(WithActor("alice"))
+	assert.NilError(t, err)
+	_, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.ErrorIs(t, tx.Commit(), ErrGenerationMismatch)
+	assert.ErrorIs(t, tx.Commit(), ErrGenerationMismatch)
+	tx.Rollback()
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+
+	assert.Assert(t, is.Len(s.audit, 3))
+	assert.Equal(t, s.audit[1].Prefix, p)
+	assert.Equal(t, s.audit[1].Actor, "alice")
+	assert.Check(t, is.Contains(s.audit[1].Error, "generation mismatch"))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// maxBitmapSubnets is the maximum number of subnets a pool can be split into
+// and still get a bitmap. That's 8KiB per pool at most.
+const maxBitmapSubnets = 1 << 16
+
+// poolBitmap tracks which subnets of a pool are in use. Bit n is set when the
+// n-th subnet of the pool overlaps with at least one allocated or reserved
+// prefix.
+type poolBitmap struct {
+	prefix netip.Prefix
+	size   int
+	n      int
+	words  []uint64
+	// cursor is the index of the first word that might not be full. Words
+	// before it are known to be full.
+	cursor int
+}
+
+// newPoolBitmap returns nil if p has too many subnets to get a bitmap.
+func newPoolBitmap(p Pool) *poolBitmap {
+	if p.Size < p.Prefix.Bits() || p.Size > 32 || 1<<(p.Size-p.Prefix.Bits()) > maxBitmapSubnets {
+		return nil
+	}
+
+	n := 1 << (p.Size - p.Prefix.Bits())
+	return &poolBitmap{
+		prefix: p.Prefix,
+		size:   p.Size,
+		n:      n,
+		words:  make([]uint64, (n+63)/64),
+	}
+}
+
+// mark sets the bits of all the subnets overlapping with p.
+func (bm *poolBitmap) mark(p netip.Prefix) {
+	first, last, ok := bm.span(p)
+	if !ok {
+		return
+	}
+
+	for n := first; n <= last; n++ {
+		bm.words[n/64] |= 1 << (n % 64)
+	}
+}
+
+// unmark clears the bits of the subnets overlapping with p, unless they're
+// still in use.
+func (bm *poolBitmap) unmark(p netip.Prefix, inUse func(netip.Prefix) bool) {
+	first, last, ok := bm.span(p)
+	if !ok {
+		return
+	}
+
+	for n := first; n <= last; n++ {
+		if !inUse(bm.subnet(n)) {
+			bm.words[n/64] &^= 1 << (n % 64)
+		}
+	}
+	bm.cursor = min(bm.cursor, first/64)
+}
+
+// firstFree returns the index of the first subnet not in use.
+func (bm *poolBitmap) firstFree() (int, bool) {
+	for bm.cursor < len(bm.words) && bm.words[bm.cursor] == ^uint64(0) {
+		bm.cursor++
+	}
+	return bm.nextFree(bm.cursor * 64)
+}
+
+// nextFree returns the index of the first subnet not in use, starting from
+// the n-th one.
+func (bm *poolBitmap) nextFree(n int) (int, bool) {
+	for w := n / 64; w < len(bm.words); w++ {
+		free := ^bm.words[w]
+		if w == n/64 {
+			free &^= 1<<(n%64) - 1
+		}
+		if free == 0 {
+			continue
+		}
+		if n := w*64 + bits.TrailingZeros64(free); n < bm.n {
+			return n, true
+		}
+		break
+	}
+	return 0, false
+}
+
+// prevFree returns the index of the last subnet not in use, starting from the
+// n-th one and going downward.
+func (bm *poolBitmap) prevFree(n int) (int, bool) {
+	if n >= bm.n {
+		n = bm.n - 1
+	}
+	if n < 0 {
+		return 0, false
+	}
+
+	for w := n / 64; w >= 0; w-- {
+		free := ^bm.words[w]
+		if w == n/64 {
+			free &= 1<<(n%64+1) - 1
+		}
+		if free != 0 {
+			return w*64 + 63 - bits.LeadingZeros64(free), true
+		}
+	}
+	return 0, false
+}
+
+// span returns the indexes of the first and last subnets overlapping with p.
+func (bm *poolBitmap) span(p netip.Prefix) (first, last int, ok bool) {
+	if !bm.prefix.Overlaps(p) {
+		return 0, 0, false
+	}
+	if p.Bits() <= bm.prefix.Bits() {
+		// p covers the whole pool.
+		return 0, bm.n - 1, true
+	}
+	return bm.index(p.Addr()), bm.index(lastAddr(p)), true
+}
+
+// index returns the index of the subnet containing addr. addr has to be
+// within the pool.
+func (bm *poolBitmap) index(addr netip.Addr) int {
+	return int(Distance(bm.prefix.Addr(), addr) >> (32 - bm.size))
+}
+
+// subnet returns the n-th subnet of the pool.
+func (bm *poolBitmap) subnet(n int) netip.Prefix {
+	return netip.PrefixFrom(Add(bm.prefix.Addr(), uint64(n), uint(32-bm.size)), bm.size)
+}
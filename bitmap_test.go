@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestPoolBitmap(t *testing.T) {
+	testcases := map[string]*struct {
+		pool     Pool
+		marked   []netip.Prefix
+		expFree  netip.Prefix
+		expFull  bool
+		expNoMap bool
+	}{
+		"Empty pool": {
+			pool:    Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			expFree: netip.MustParsePrefix("192.168.0.0/24"),
+		},
+		"Gap in the middle": {
+			pool: Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			marked: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.2.0/24"),
+			},
+			expFree: netip.MustParsePrefix("192.168.1.0/24"),
+		},
+		"Smaller allocation in a subnet": {
+			pool: Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			marked: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.3/30"),
+			},
+			expFree: netip.MustParsePrefix("192.168.1.0/24"),
+		},
+		"Bigger allocation spanning several subnets": {
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 16},
+			marked: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/14"),
+			},
+			expFree: netip.MustParsePrefix("10.4.0.0/16"),
+		},
+		"Free subnet past the first word": {
+			pool: Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			marked: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/18"),
+			},
+			expFree: netip.MustParsePrefix("192.168.64.0/24"),
+		},
+		"Allocation covering the pool": {
+			pool: Pool{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 24},
+			marked: []netip.Prefix{
+				netip.MustParsePrefix("172.0.0.0/8"),
+			},
+			expFull: true,
+		},
+		"Allocation outside of the pool": {
+			pool: Pool{Prefix: netip.MustParsePrefix("30.0.0.0/31"), Size: 31},
+			marked: []netip.Prefix{
+				netip.MustParsePrefix("40.0.0.0/31"),
+			},
+			expFree: netip.MustParsePrefix("30.0.0.0/31"),
+		},
+		"Too many subnets": {
+			pool:     Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+			expNoMap: true,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			bm := newPoolBitmap(tc.pool)
+			if tc.expNoMap {
+				assert.Assert(t, bm == nil)
+				return
+			}
+
+			for _, p := range tc.marked {
+				bm.mark(p)
+			}
+
+			n, ok := bm.firstFree()
+			assert.Equal(t, ok, !tc.expFull)
+			if ok {
+				assert.Equal(t, bm.subnet(n), tc.expFree)
+			}
+		})
+	}
+}
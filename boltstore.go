@@ -0,0 +1,180 @@
+//go:build bbolt
+
+// The bbolt store is only built with the bbolt build tag, such that programs
+// not using it don't link bbolt in. Build with:
+//
+//	go build -tags bbolt
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltPoolsBucket       = []byte("pools")
+	boltAllocationsBucket = []byte("allocations")
+	boltReservedBucket    = []byte("reserved")
+	boltTombstonesBucket  = []byte("tombstones")
+)
+
+// BoltStore is a Store backed by a bbolt database. Pools, allocations,
+// reservations and tombstones each live in their own bucket, keyed by packed
+// prefix, such that allocating or deallocating a prefix only writes a single
+// key. The metadata of allocations, if any, is the value of their key.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore returns a BoltStore keeping its buckets in db, and creates them
+// if needed. The caller owns db, and closes it once the store isn't used
+// anymore.
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltPoolsBucket, boltAllocationsBucket, boltReservedBucket, boltTombstonesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() (Snapshot, error) {
+	var state Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltPoolsBucket).ForEach(func(k, v []byte) error {
+			r := &snapshotReader{buf: v}
+			p := readPool(r)
+			if r.err != nil {
+				return fmt.Errorf("invalid pool record %x: %w", k, r.err)
+			}
+			state.Pools = append(state.Pools, p)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltAllocationsBucket).ForEach(func(k, v []byte) error {
+			p, err := unpackPrefix(k)
+			if err != nil {
+				return err
+			}
+			state.Allocated = append(state.Allocated, p)
+			if len(v) == 0 {
+				return nil
+			}
+
+			r := &snapshotReader{buf: v}
+			m := readMeta(r)
+			if r.err != nil {
+				return fmt.Errorf("invalid metadata record %x: %w", k, r.err)
+			}
+			if state.Meta == nil {
+				state.Meta = map[netip.Prefix]AllocationMeta{}
+			}
+			state.Meta[p] = m
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		state.Reserved, err = boltPrefixes(tx.Bucket(boltReservedBucket))
+		if err != nil {
+			return err
+		}
+		state.Tombstones, err = boltPrefixes(tx.Bucket(boltTombstonesBucket))
+		return err
+	})
+	return state, err
+}
+
+func (s *BoltStore) SaveAllocation(p netip.Prefix) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAllocationsBucket).Put(packPrefix(p), nil)
+	})
+}
+
+func (s *BoltStore) DeleteAllocation(p netip.Prefix) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAllocationsBucket).Delete(packPrefix(p))
+	})
+}
+
+func (s *BoltStore) SaveSnapshot(state Snapshot) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltPoolsBucket, boltAllocationsBucket, boltReservedBucket, boltTombstonesBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+
+		pools, err := tx.CreateBucket(boltPoolsBucket)
+		if err != nil {
+			return err
+		}
+		for _, p := range state.Pools {
+			rec, err := appendPool(nil, p)
+			if err != nil {
+				return err
+			}
+			if err := pools.Put(packPrefix(p.Prefix), rec); err != nil {
+				return err
+			}
+		}
+
+		allocations, err := tx.CreateBucket(boltAllocationsBucket)
+		if err != nil {
+			return err
+		}
+		for _, p := range state.Allocated {
+			var rec []byte
+			if m, ok := state.Meta[p]; ok {
+				rec = appendMeta(nil, m)
+			}
+			if err := allocations.Put(packPrefix(p), rec); err != nil {
+				return err
+			}
+		}
+
+		if err := putBoltPrefixes(tx, boltReservedBucket, state.Reserved); err != nil {
+			return err
+		}
+		return putBoltPrefixes(tx, boltTombstonesBucket, state.Tombstones)
+	})
+}
+
+func putBoltPrefixes(tx *bolt.Tx, name []byte, prefixes []netip.Prefix) error {
+	b, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		if err := b.Put(packPrefix(p), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltPrefixes(b *bolt.Bucket) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	err := b.ForEach(func(k, _ []byte) error {
+		p, err := unpackPrefix(k)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, p)
+		return nil
+	})
+	return prefixes, err
+}
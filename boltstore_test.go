@@ -0,0 +1,36 @@
+//go:build bbolt
+
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"gotest.tools/v3/assert"
+)
+
+func TestBoltStore(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "state.db"), 0o600, nil)
+	assert.NilError(t, err)
+	defer db.Close()
+
+	s, err := NewBoltStore(db)
+	assert.NilError(t, err)
+	a := mustNewAllocator(t, []Pool{
+		{Name: "default", Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24, Labels: map[string]string{"env": "prod"}},
+	}, WithStore(s))
+	_, err = a.AllocateN(3)
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("10.0.1.0/24")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")))
+	_, err = a.AllocateNamed("net1")
+	assert.NilError(t, err)
+
+	s, err = NewBoltStore(db)
+	assert.NilError(t, err)
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+}
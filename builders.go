@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// NewAllocatorFromStrings is the same as NewAllocator, but pools are written
+// as ParsePool expects, e.g. "10.0.0.0/8:24". The allocated prefixes are then
+// restored, see Restore.
+func NewAllocatorFromStrings(pools, allocated []string, opts ...Option) (*Allocator, error) {
+	ps := make([]Pool, 0, len(pools))
+	for _, s := range pools {
+		p, err := ParsePool(s)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+
+	prefixes, err := parsePrefixes(allocated)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := NewAllocator(ps, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Restore(prefixes); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Restore allocates all of the given prefixes, e.g. when reloading the state
+// of a previous run. Prefixes can be in any order, and don't have to be within
+// a pool. If any of them is invalid, or overlaps with another one or with an
+// existing allocation, an error is returned and nothing is allocated.
+func (a *Allocator) Restore(prefixes []netip.Prefix) error {
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	for _, p := range prefixes {
+		if !p.IsValid() || !p.Addr().Is4() || p != p.Masked() {
+			return fmt.Errorf("%w %s", ErrInvalidPrefix, p)
+		}
+		if allocated, ok := a.trie.overlapping(p); ok {
+			return &OverlapError{Prefix: p, Allocated: allocated}
+		}
+	}
+
+	// Once sorted, a prefix overlapping with others overlaps with the next
+	// one.
+	sorted := slices.SortedFunc(slices.Values(prefixes), comparePrefix)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].Overlaps(sorted[i]) {
+			return fmt.Errorf("prefixes %s and %s overlap", sorted[i-1], sorted[i])
+		}
+	}
+
+	return a.persist(func() error {
+		for _, p := range sorted {
+			a.insert(p)
+		}
+		return nil
+	})
+}
+
+// parsePrefixes parses a list of prefixes, such as "10.0.0.0/24".
+func parsePrefixes(ss []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		p, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPrefix, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
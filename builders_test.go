@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestNewAllocatorFromStrings(t *testing.T) {
+	a, err := NewAllocatorFromStrings(
+		[]string{"192.168.0.0/16:24", "10.0.0.0/8:16"},
+		[]string{"10.0.0.0/16", "192.168.0.0/24", "172.16.0.0/12"},
+	)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/16"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+	}, cmpPrefix)
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.1.0.0/16"))
+
+	_, err = NewAllocatorFromStrings([]string{"192.168.0.0/16"}, nil)
+	assert.Error(t, err, `invalid pool "192.168.0.0/16": expected prefix:size`)
+	_, err = NewAllocatorFromStrings([]string{"192.168.0.0/16:24"}, []string{"192.168.0.0"})
+	assert.ErrorIs(t, err, ErrInvalidPrefix)
+}
+
+func TestRestore(t *testing.T) {
+	testcases := []struct {
+		name     string
+		prefixes []netip.Prefix
+		expErr   string
+	}{
+		{
+			name: "unsorted",
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("192.168.2.0/24"),
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.168.1.0/24"),
+			},
+		},
+		{
+			name: "overlapping with each other",
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("192.168.2.0/24"),
+				netip.MustParsePrefix("192.168.2.128/25"),
+			},
+			expErr: "prefixes 192.168.2.0/24 and 192.168.2.128/25 overlap",
+		},
+		{
+			name: "overlapping with an allocation",
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("192.168.2.0/24"),
+				netip.MustParsePrefix("192.168.0.0/23"),
+			},
+			expErr: "prefix 192.168.0.0/23 overlaps with allocated prefix 192.168.0.0/24",
+		},
+		{
+			name: "unmasked",
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("192.168.2.1/24"),
+			},
+			expErr: "invalid prefix 192.168.2.1/24",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAllocatorFromStrings([]string{"192.168.0.0/16:24"}, []string{"192.168.0.0/24"})
+			assert.NilError(t, err)
+
+			err = a.Restore(tc.prefixes)
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+				assert.Equal(t, len(a.Allocated()), 1)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, len(a.Allocated()), 1+len(tc.prefixes))
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client drives an allocator served by Server from another process. Its
+// methods mirror the ones of Allocator, take the same options, and fail with
+// the same errors: errors.Is matches ErrNoFreePool, ErrOverlap, etc.
+//
+// Requests that couldn't reach the server, or that it couldn't serve for now,
+// are retried. Allocations are made with an idempotency key, see
+// WithIdempotencyKey, such that retrying them never allocates twice.
+type Client struct {
+	url string
+	// HTTPClient sends requests. Set its transport to present a client
+	// certificate to servers requiring mutual TLS, see TLSConfig.
+	HTTPClient *http.Client
+	// Token, if set, is sent as a bearer token, see WithTokens.
+	Token string
+	// Retries is the number of times a failed request is retried. It
+	// defaults to 3.
+	Retries int
+	// Backoff is how long the client waits before retrying, doubled on
+	// every retry. It defaults to 100 milliseconds.
+	Backoff time.Duration
+}
+
+// NewClient returns a Client sending requests to the server at url, e.g.
+// "https://ipam.example.com:8443".
+func NewClient(url string) *Client {
+	return &Client{
+		url:        strings.TrimSuffix(url, "/"),
+		HTTPClient: http.DefaultClient,
+		Retries:    3,
+		Backoff:    100 * time.Millisecond,
+	}
+}
+
+// Allocate allocates a subnet, see Allocator.Allocate. Options the API doesn't
+// carry, such as WithReverse, are refused. Unless opts pass one, a random
+// idempotency key is generated.
+func (c *Client) Allocate(ctx context.Context, opts ...AllocateOption) (netip.Prefix, error) {
+	req, err := newAllocateRequest(opts)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if req.IdempotencyKey == "" {
+		if req.IdempotencyKey, err = newIdempotencyKey(); err != nil {
+			return netip.Prefix{}, err
+		}
+	}
+
+	var resp allocationResponse
+	if _, err := c.do(ctx, http.MethodPost, "/allocations", req, &resp); err != nil {
+		return netip.Prefix{}, err
+	}
+	return resp.Prefix, nil
+}
+
+// AllocateStatic allocates p, see Allocator.AllocateStatic. Like Allocate, it
+// passes an idempotency key.
+func (c *Client) AllocateStatic(ctx context.Context, p netip.Prefix, opts ...AllocateOption) error {
+	req, err := newAllocateRequest(opts)
+	if err != nil {
+		return err
+	}
+	req.Prefix = p
+	if req.IdempotencyKey == "" {
+		if req.IdempotencyKey, err = newIdempotencyKey(); err != nil {
+			return err
+		}
+	}
+
+	_, err = c.do(ctx, http.MethodPost, "/allocations", req, nil)
+	return err
+}
+
+// Deallocate releases p, see Allocator.Deallocate. If a retry finds p already
+// released, the previous attempt is assumed to have released it.
+func (c *Client) Deallocate(ctx context.Context, p netip.Prefix) error {
+	retried, err := c.do(ctx, http.MethodDelete, "/allocations/"+p.String(), nil, nil)
+	if retried && errors.Is(err, ErrNotAllocated) {
+		return nil
+	}
+	return err
+}
+
+// ListAllocations returns the allocations matching the selector s, see
+// Allocator.ListAllocations.
+func (c *Client) ListAllocations(ctx context.Context, s string) ([]netip.Prefix, error) {
+	var resp []allocationState
+	if _, err := c.do(ctx, http.MethodGet, "/allocations?selector="+url.QueryEscape(s), nil, &resp); err != nil {
+		return nil, err
+	}
+	prefixes := make([]netip.Prefix, 0, len(resp))
+	for _, alloc := range resp {
+		prefixes = append(prefixes, alloc.Prefix)
+	}
+	return prefixes, nil
+}
+
+// newAllocateRequest returns the request asking for the allocation opts
+// describe.
+func newAllocateRequest(opts []AllocateOption) (allocateRequest, error) {
+	o := newAllocateOptions(opts)
+	switch {
+	case o.reverse:
+		return allocateRequest{}, errors.New("WithReverse isn't supported by Client")
+	case o.align != 0:
+		return allocateRequest{}, errors.New("WithAlignment isn't supported by Client")
+	case o.reserved != nil:
+		return allocateRequest{}, errors.New("WithReserved isn't supported by Client")
+	case o.actor != "":
+		return allocateRequest{}, errors.New("WithActor isn't supported by Client: the server identifies clients by their token or certificate")
+	case len(o.pools) > 1:
+		return allocateRequest{}, errors.New("Client only supports WithPools with a single pool")
+	}
+
+	req := allocateRequest{
+		Size:           o.size,
+		Hint:           o.hint,
+		Selector:       o.selector,
+		Owner:          o.owner,
+		Labels:         o.labels,
+		Pinned:         o.pinned,
+		IdempotencyKey: o.key,
+	}
+	if len(o.pools) == 1 {
+		req.Pool = o.pools[0]
+	}
+	if o.ttl != 0 {
+		req.TTL = o.ttl.String()
+	}
+	return req, nil
+}
+
+func newIdempotencyKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// do sends a request with in as its JSON body, if not nil, and decodes the
+// response into out, if not nil. It tells whether the request was retried.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) (retried bool, err error) {
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return false, err
+		}
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err = c.send(ctx, method, path, body, out)
+		if attempt >= c.Retries || !retryable(err) || ctx.Err() != nil {
+			return attempt > 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempt > 0, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, out any) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestSize))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return newClientError(resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// clientError is an error reported by the server. It matches the error of the
+// allocator it stands for, if any, see errorCodes.
+type clientError struct {
+	status int
+	msg    string
+	err    error
+}
+
+func newClientError(status int, body []byte) *clientError {
+	var resp errorResponse
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error == "" {
+		return &clientError{status: status, msg: fmt.Sprintf("server replied %d %s", status, http.StatusText(status))}
+	}
+
+	e := &clientError{status: status, msg: resp.Error}
+	for _, c := range errorCodes {
+		if c.code == resp.Code {
+			e.err = c.err
+			break
+		}
+	}
+	return e
+}
+
+func (e *clientError) Error() string {
+	return e.msg
+}
+
+func (e *clientError) Unwrap() error {
+	return e.err
+}
+
+// retryable tells whether a request that failed with err may succeed if sent
+// again: it couldn't reach the server, or the server couldn't serve it for now.
+func retryable(err error) bool {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return true
+	}
+	var ce *clientError
+	if errors.As(err, &ce) {
+		switch ce.status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestClient(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "a", Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24, Labels: map[string]string{"env": "prod"}},
+	})
+	srv := httptest.NewServer(NewServer(a, &sync.Mutex{}, WithTokens(map[string]ACL{
+		"ci": {Actor: "ci", Role: RoleAllocate},
+	})))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := NewClient(srv.URL)
+	_, err := c.Allocate(ctx)
+	assert.Check(t, is.Error(err, "missing or invalid token"))
+
+	c.Token = "ci"
+	p, err := c.Allocate(ctx, WithOwner("tenant1"), WithSelector("env=prod"), WithTTL(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+	m, _ := a.Metadata(p)
+	assert.Equal(t, m.Owner, "tenant1")
+	assert.Check(t, !m.Expires.IsZero())
+
+	// Errors of the allocator are mapped back.
+	err = c.Deallocate(ctx, netip.MustParsePrefix("10.0.1.0/24"))
+	assert.Check(t, is.ErrorIs(err, ErrNotAllocated))
+	assert.NilError(t, c.AllocateStatic(ctx, netip.MustParsePrefix("10.0.1.0/24")))
+	_, err = c.Allocate(ctx)
+	assert.Check(t, is.ErrorIs(err, ErrNoFreePool))
+	err = c.AllocateStatic(ctx, netip.MustParsePrefix("10.0.1.0/25"))
+	assert.Check(t, is.ErrorIs(err, ErrOverlap))
+
+	// Options the API doesn't carry are refused.
+	_, err = c.Allocate(ctx, WithReverse())
+	assert.Check(t, is.Error(err, "WithReverse isn't supported by Client"))
+
+	prefixes, err := c.ListAllocations(ctx, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prefixes, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.1.0/24"),
+	}, cmpPrefix)
+	assert.NilError(t, c.Deallocate(ctx, p))
+	assert.Equal(t, len(a.Allocated()), 1)
+}
+
+// lossyHandler serves requests, but replies with a 502 instead of the first
+// response of every request, as if it was lost on the way back.
+type lossyHandler struct {
+	h     http.Handler
+	mu    sync.Mutex
+	calls int
+}
+
+func (l *lossyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	l.calls++
+	lost := l.calls%2 == 1
+	l.mu.Unlock()
+
+	if !lost {
+		l.h.ServeHTTP(w, r)
+		return
+	}
+	l.h.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func TestClientRetries(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	lossy := &lossyHandler{h: NewServer(a, &sync.Mutex{})}
+	srv := httptest.NewServer(lossy)
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := NewClient(srv.URL)
+	c.Backoff = time.Millisecond
+
+	// Retries don't allocate twice.
+	p, err := c.Allocate(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+	assert.NilError(t, c.AllocateStatic(ctx, netip.MustParsePrefix("192.168.0.0/24")))
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+	}, cmpPrefix)
+
+	// The second attempt finds p released by the first one.
+	assert.NilError(t, c.Deallocate(ctx, p))
+	assert.Equal(t, len(a.Allocated()), 1)
+	lossy.mu.Lock()
+	assert.Equal(t, lossy.calls, 6)
+	lossy.mu.Unlock()
+
+	// Requests are retried a limited number of times.
+	c.Retries = 0
+	_, err = c.Allocate(ctx)
+	assert.Check(t, is.Error(err, "server replied 502 Bad Gateway"))
+}
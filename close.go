@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Close shuts the allocator down, such that the process embedding it can exit
+// without losing changes: host routes aren't refreshed in the background
+// anymore, see Start, background helpers like Reaper and PoolReloader stop,
+// watchers are closed, and the entries of the audit trail that weren't
+// appended yet are flushed, along with the store if it's a Flusher. ctx
+// bounds flushing the store.
+//
+// Changes are rejected with ErrClosed from then on, while queries keep
+// working on the last state. Closing the allocator again is a no-op.
+//
+// Like other methods, Close must be called while holding the lock shared
+// with background helpers, if any. It doesn't wait for them to stop, their
+// own Close methods do.
+func (a *Allocator) Close(ctx context.Context) error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if a.closing != nil {
+		close(a.closing)
+	}
+	a.Stop()
+	a.watchersMu.Lock()
+	for _, w := range a.watchers {
+		w.close()
+		w.stop()
+	}
+	a.watchers = nil
+	a.watchersMu.Unlock()
+
+	var errs []error
+	if err := a.FlushAudit(); err != nil {
+		errs = append(errs, err)
+	}
+	if f, ok := a.store.(Flusher); ok {
+		if err := f.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("flushing store: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Done returns a channel that's closed when the allocator is closed, see
+// Close. Background helpers using the allocator stop then.
+func (a *Allocator) Done() <-chan struct{} {
+	return a.closing
+}
+
+// checkWritable returns an error if the allocator can't be changed.
+func (a *Allocator) checkWritable() error {
+	if a.closed {
+		return ErrClosed
+	}
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
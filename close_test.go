@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// flushStore is an auditStore counting flushes. Flushing fails with err.
+type flushStore struct {
+	auditStore
+	flushes int
+	err     error
+}
+
+func (s *flushStore) Flush(ctx context.Context) error {
+	s.flushes++
+	return s.err
+}
+
+func TestClose(t *testing.T) {
+	s := &flushStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}},
+		WithStore(s), WithAudit())
+	p, err := a.Allocate(WithActor("alice"))
+	assert.NilError(t, err)
+	events := a.Watch(context.Background())
+
+	// Entries of the audit trail that weren't appended yet are flushed.
+	s.failAudit = true
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")))
+	assert.Check(t, is.Len(s.audit, 1))
+	s.failAudit = false
+
+	assert.NilError(t, a.Close(context.Background()))
+	assert.Check(t, is.Len(s.audit, 2))
+	assert.Check(t, is.Equal(s.flushes, 1))
+	select {
+	case <-a.Done():
+	default:
+		t.Fatal("Done isn't closed")
+	}
+	for range events {
+	}
+	_, ok := <-a.Watch(context.Background())
+	assert.Check(t, !ok)
+
+	// Changes are rejected, queries keep working.
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, a.AllocateStatic(netip.MustParsePrefix("192.168.1.0/24")), ErrClosed)
+	assert.ErrorIs(t, a.Deallocate(p), ErrClosed)
+	assert.ErrorIs(t, a.AddReserved(netip.MustParsePrefix("10.0.1.0/24")), ErrClosed)
+	assert.ErrorIs(t, a.Start(time.Minute), ErrClosed)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p, netip.MustParsePrefix("192.168.0.0/24")}, cmpPrefix)
+	assert.Check(t, is.Len(s.audit, 2))
+
+	assert.NilError(t, a.Close(context.Background()))
+	assert.Check(t, is.Equal(s.flushes, 1))
+
+	// Flush errors are reported, but the allocator is closed anyway.
+	s = &flushStore{err: errStore}
+	a = mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}}, WithStore(s))
+	assert.ErrorContains(t, a.Close(context.Background()), "flushing store")
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestCloseStopsHelpers(t *testing.T) {
+	var mu sync.Mutex
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	r := NewReaper(a, &mu, time.Hour, nil)
+	assert.NilError(t, r.Start(context.Background()))
+	pr := NewPoolReloader(a, &mu, func() ([]Pool, error) { return a.Pools(), nil }, nil)
+	assert.NilError(t, pr.Start(context.Background()))
+
+	mu.Lock()
+	assert.NilError(t, a.Close(context.Background()))
+	mu.Unlock()
+
+	for _, done := range []chan struct{}{r.done, pr.done} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("helper didn't stop")
+		}
+	}
+	assert.NilError(t, r.Close())
+	assert.NilError(t, pr.Close())
+}
+
+func TestServerClosed(t *testing.T) {
+	var mu sync.Mutex
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	assert.NilError(t, a.Close(context.Background()))
+	srv := NewServer(a, &mu)
+
+	for _, tc := range []struct {
+		method, target, body string
+		status               int
+	}{
+		{method: http.MethodPost, target: "/allocations", body: "{}", status: http.StatusServiceUnavailable},
+		{method: http.MethodGet, target: "/allocations", status: http.StatusOK},
+		{method: http.MethodGet, target: "/readyz", status: http.StatusServiceUnavailable},
+		{method: http.MethodGet, target: "/healthz", status: http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+		assert.Check(t, is.Equal(rec.Code, tc.status), "%s %s", tc.method, tc.target)
+	}
+}
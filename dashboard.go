@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardHTML is a single-page dashboard showing the pools and the
+// allocations, and allocating and releasing subnets through the API of
+// Server.
+//
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// dashboard serves the dashboard. It holds no data, so it's served without a
+// token: the page asks for one, and sends it along with its API requests.
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestDashboard(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	srv := NewServer(a, &sync.Mutex{})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	assert.Check(t, is.Contains(rec.Body.String(), "<title>Subnet allocator</title>"))
+
+	// The page is only served at the root.
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/index.html", nil))
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+
+	// Every endpoint the page uses exists.
+	for _, path := range []string{"/stats", "/allocations", "/pools"} {
+		rec = httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, rec.Code, http.StatusOK, path)
+		assert.Check(t, !strings.Contains(rec.Body.String(), "error"), path)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+)
+
+// WithDebug mounts debugging endpoints on the server, only available to
+// admins, see RoleAdmin:
+//
+//	GET  /debug/pprof/  runtime profiles, see net/http/pprof
+//	GET  /debug/state   the state of the allocator, see Dump
+//	POST /debug/check   checks the invariants of the allocator, see
+//	                    CheckInvariants, and ?in_pools=true whether every
+//	                    allocation is within a pool
+//
+// Profiles slow the process down while they're collected, and the state
+// lists every allocation, so they're off by default.
+func WithDebug() ServerOption {
+	return func(s *Server) {
+		s.mux.HandleFunc("GET /debug/pprof/", s.adminOnly(pprof.Index))
+		s.mux.HandleFunc("GET /debug/pprof/cmdline", s.adminOnly(pprof.Cmdline))
+		s.mux.HandleFunc("GET /debug/pprof/profile", s.adminOnly(pprof.Profile))
+		s.mux.HandleFunc("GET /debug/pprof/symbol", s.adminOnly(pprof.Symbol))
+		s.mux.HandleFunc("GET /debug/pprof/trace", s.adminOnly(pprof.Trace))
+		s.mux.HandleFunc("GET /debug/state", s.adminOnly(s.debugState))
+		s.mux.HandleFunc("POST /debug/check", s.adminOnly(s.debugCheck))
+	}
+}
+
+// adminOnly wraps h such that it only serves admins.
+func (s *Server) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestACL(r).Role != RoleAdmin {
+			writeError(w, http.StatusForbidden, errForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) debugState(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	s.mu.Lock()
+	err := s.a.Dump(&buf)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) debugCheck(w http.ResponseWriter, r *http.Request) {
+	var inPools bool
+	if v := r.URL.Query().Get("in_pools"); v != "" {
+		var err error
+		if inPools, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	err := s.a.CheckInvariants(inPools)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
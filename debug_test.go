@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestServerDebug(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")))
+	tokens := WithTokens(map[string]ACL{
+		"ci":   {Role: RoleAllocate},
+		"root": {Role: RoleAdmin},
+	})
+
+	testcases := []struct {
+		name      string
+		opts      []ServerOption
+		token     string
+		method    string
+		path      string
+		expStatus int
+		expBody   string
+	}{
+		{
+			name:      "disabled",
+			method:    http.MethodGet,
+			path:      "/debug/state",
+			expStatus: http.StatusNotFound,
+		},
+		{
+			name:      "pprof",
+			opts:      []ServerOption{WithDebug()},
+			method:    http.MethodGet,
+			path:      "/debug/pprof/",
+			expStatus: http.StatusOK,
+			expBody:   "goroutine",
+		},
+		{
+			name:      "pprof profile",
+			opts:      []ServerOption{WithDebug()},
+			method:    http.MethodGet,
+			path:      "/debug/pprof/heap?debug=1",
+			expStatus: http.StatusOK,
+			expBody:   "heap profile",
+		},
+		{
+			name:      "state",
+			opts:      []ServerOption{WithDebug()},
+			method:    http.MethodGet,
+			path:      "/debug/state",
+			expStatus: http.StatusOK,
+			expBody:   "192.168.0.0/24",
+		},
+		{
+			name:      "check",
+			opts:      []ServerOption{WithDebug()},
+			method:    http.MethodPost,
+			path:      "/debug/check",
+			expStatus: http.StatusNoContent,
+		},
+		{
+			name:      "check in pools",
+			opts:      []ServerOption{WithDebug()},
+			method:    http.MethodPost,
+			path:      "/debug/check?in_pools=true",
+			expStatus: http.StatusInternalServerError,
+			expBody:   "192.168.0.0/24",
+		},
+		{
+			name:      "check invalid in_pools",
+			opts:      []ServerOption{WithDebug()},
+			method:    http.MethodPost,
+			path:      "/debug/check?in_pools=maybe",
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "not an admin",
+			opts:      []ServerOption{WithDebug(), tokens},
+			token:     "ci",
+			method:    http.MethodGet,
+			path:      "/debug/pprof/",
+			expStatus: http.StatusForbidden,
+		},
+		{
+			name:      "admin",
+			opts:      []ServerOption{WithDebug(), tokens},
+			token:     "root",
+			method:    http.MethodGet,
+			path:      "/debug/state",
+			expStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			NewServer(a, &sync.Mutex{}, tc.opts...).ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Code, tc.expStatus)
+			assert.Check(t, is.Contains(rec.Body.String(), tc.expBody))
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// dockerPool is an entry of dockerd's default-address-pools.
+type dockerPool struct {
+	Base string `json:"base"`
+	Size int    `json:"size"`
+}
+
+// ParseDockerPools parses pools written the way dockerd's
+// default-address-pools are. data is either a list of {"base", "size"}
+// objects, or a whole daemon.json with a "default-address-pools" key.
+func ParseDockerPools(data []byte) ([]Pool, error) {
+	var entries []dockerPool
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var daemon struct {
+			DefaultAddressPools []dockerPool `json:"default-address-pools"`
+		}
+		if err := json.Unmarshal(data, &daemon); err != nil {
+			return nil, fmt.Errorf("invalid daemon config: %w", err)
+		}
+		entries = daemon.DefaultAddressPools
+	} else if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid default-address-pools: %w", err)
+	}
+
+	pools := make([]Pool, 0, len(entries))
+	for _, e := range entries {
+		base, err := netip.ParsePrefix(e.Base)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base %q: %w", e.Base, err)
+		}
+
+		p := Pool{Prefix: base.Masked(), Size: e.Size}
+		if err := validatePool(p); err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+
+	return pools, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseDockerPools(t *testing.T) {
+	testcases := map[string]*struct {
+		data     string
+		expPools []Pool
+		expErr   string
+	}{
+		"List of pools": {
+			data: `[{"base": "172.80.0.0/16", "size": 24}, {"base": "10.10.0.0/16", "size": 26}]`,
+			expPools: []Pool{
+				{Prefix: netip.MustParsePrefix("172.80.0.0/16"), Size: 24},
+				{Prefix: netip.MustParsePrefix("10.10.0.0/16"), Size: 26},
+			},
+		},
+		"Whole daemon.json": {
+			data: `{
+				"log-driver": "json-file",
+				"default-address-pools": [
+					{"base": "10.10.0.0/16", "size": 24}
+				]
+			}`,
+			expPools: []Pool{
+				{Prefix: netip.MustParsePrefix("10.10.0.0/16"), Size: 24},
+			},
+		},
+		"daemon.json without pools": {
+			data:     `{"log-driver": "json-file"}`,
+			expPools: []Pool{},
+		},
+		"Invalid base": {
+			data:   `[{"base": "10.10.0.0", "size": 24}]`,
+			expErr: `invalid base "10.10.0.0": netip.ParsePrefix("10.10.0.0"): no '/'`,
+		},
+		"Invalid size": {
+			data:   `[{"base": "10.10.0.0/16", "size": 8}]`,
+			expErr: "pool 10.10.0.0/16: invalid size /8",
+		},
+		"Invalid JSON": {
+			data:   `[{"base": }]`,
+			expErr: "invalid default-address-pools: invalid character '}' looking for beginning of value",
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			pools, err := ParseDockerPools([]byte(tc.data))
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+				return
+			}
+
+			assert.NilError(t, err)
+			assert.Equal(t, len(pools), len(tc.expPools))
+			for i, p := range pools {
+				assert.Equal(t, p.Prefix, tc.expPools[i].Prefix)
+				assert.Equal(t, p.Size, tc.expPools[i].Size)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Dump writes a listing of pools, allocations and reserved prefixes to w, as
+// aligned columns. It's meant for humans, the format may change.
+func (a *Allocator) Dump(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "POOL\tNAME\tSIZE\tFLAGS\tALLOCATED\tFREE")
+	for poolID, p := range a.pools {
+		ps := a.poolStats(poolID)
+		fmt.Fprintf(tw, "%s\t%s\t/%d\t%s\t%d\t%d\n", p.Prefix, orDash(p.Name), p.Size, orDash(poolFlags(p)), ps.Allocated, ps.Free)
+	}
+
+	fmt.Fprintln(tw, "\nALLOCATION\tPOOL")
+	a.allocated.each(func(allocated netip.Prefix) bool {
+		pool := "-"
+		if poolID, ok := a.poolIndex(allocated); ok {
+			pool = a.pools[poolID].Prefix.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", allocated, pool)
+		return true
+	})
+
+	fmt.Fprintln(tw, "\nRESERVED\tSOURCE")
+	for _, p := range a.permanent {
+		fmt.Fprintf(tw, "%s\tpermanent\n", p)
+	}
+	a.reservedSet.each(func(p netip.Prefix) bool {
+		fmt.Fprintf(tw, "%s\treserved\n", p)
+		return true
+	})
+	if routes := a.routes.Load(); routes != nil {
+		for _, p := range *routes {
+			fmt.Fprintf(tw, "%s\troute\n", p)
+		}
+	}
+	for _, provider := range a.providers {
+		for _, p := range provider() {
+			fmt.Fprintf(tw, "%s\tprovider\n", p)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// String returns the same listing as Dump.
+func (a *Allocator) String() string {
+	var b strings.Builder
+	a.Dump(&b)
+	return b.String()
+}
+
+func poolFlags(p Pool) string {
+	var flags []string
+	if p.Overflow {
+		flags = append(flags, "overflow")
+	}
+	if p.StaticReserve > 0 {
+		flags = append(flags, fmt.Sprintf("static=%d%%", p.StaticReserve))
+	}
+	for _, c := range p.SizeClasses {
+		flags = append(flags, fmt.Sprintf("class=/%d:%d", c.Size, c.Quota))
+	}
+	for _, k := range slices.Sorted(maps.Keys(p.Labels)) {
+		flags = append(flags, k+"="+p.Labels[k])
+	}
+	return strings.Join(flags, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDump(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "local", Prefix: netip.MustParsePrefix("192.168.0.0/22"), Size: 24, Labels: map[string]string{"zone": "eu", "tier": "1"}},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 16, Overflow: true, StaticReserve: 50},
+	}, WithReservedProvider(func() []netip.Prefix {
+		return []netip.Prefix{netip.MustParsePrefix("192.168.3.0/24")}
+	}))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("192.168.2.0/24")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("172.16.0.0/12")))
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+
+	assert.Equal(t, a.String(), `POOL            NAME   SIZE  FLAGS                ALLOCATED  FREE
+10.0.0.0/8      -      /16   overflow,static=50%  0          128
+192.168.0.0/22  local  /24   tier=1,zone=eu       1          1
+
+ALLOCATION      POOL
+172.16.0.0/12   -
+192.168.0.0/24  192.168.0.0/22
+
+RESERVED        SOURCE
+192.168.2.0/24  reserved
+192.168.3.0/24  provider
+`)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+var (
+	// ErrInvalidPrefix is returned for prefixes that aren't valid IPv4
+	// prefixes.
+	ErrInvalidPrefix = errors.New("invalid prefix")
+	// ErrNotAllocated is returned when releasing a prefix that isn't
+	// allocated.
+	ErrNotAllocated = errors.New("not allocated")
+	// ErrOverlap is matched by OverlapError.
+	ErrOverlap = errors.New("prefix overlaps with an allocated prefix")
+	// ErrStoreConflict is returned by stores shared by several allocators,
+	// when another allocator changed the persisted state. See Store.
+	ErrStoreConflict = errors.New("state was changed by another allocator")
+	// ErrGenerationMismatch is returned by conditional operations when the
+	// allocator changed since the expected generation. See Generation.
+	ErrGenerationMismatch = errors.New("generation mismatch")
+	// ErrTxDone is returned when using a Tx that was already committed or
+	// rolled back.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+	// ErrNothingToUndo is returned by Undo when there's no change left to
+	// revert.
+	ErrNothingToUndo = errors.New("nothing to undo")
+	// ErrDenied is returned when the admission policy denies an allocation,
+	// see WithAdmissionPolicy.
+	ErrDenied = errors.New("denied by the admission policy")
+	// ErrVetoed is returned when the validator vetoes an allocation, see
+	// WithValidator.
+	ErrVetoed = errors.New("vetoed by the validator")
+	// ErrTombstoned is returned when allocating a prefix overlapping with a
+	// tombstone, see WithTombstone.
+	ErrTombstoned = errors.New("prefix overlaps with a tombstone")
+	// ErrPinned is returned when releasing a pinned allocation without
+	// WithForce.
+	ErrPinned = errors.New("allocation is pinned")
+	// ErrQuotaExceeded is matched by QuotaExceededError.
+	ErrQuotaExceeded = errors.New("owner quota exceeded")
+	// ErrClosed is returned when changing an allocator after Close.
+	ErrClosed = errors.New("allocator is closed")
+	// ErrReadOnly is returned when changing a read-only allocator, see
+	// SetReadOnly.
+	ErrReadOnly = errors.New("allocator is read-only")
+)
+
+// OverlapError is returned when a prefix can't be allocated because it
+// overlaps with an allocated prefix. It matches ErrOverlap.
+type OverlapError struct {
+	Prefix netip.Prefix
+	// Allocated is the allocated prefix Prefix overlaps with. There might be
+	// others, see FindOverlapping.
+	Allocated netip.Prefix
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("prefix %s overlaps with allocated prefix %s", e.Prefix, e.Allocated)
+}
+
+func (e *OverlapError) Is(target error) bool {
+	return target == ErrOverlap
+}
+
+// QuotaExceededError is returned when an allocation would take an owner over
+// its quota, see WithOwnerQuota. It matches ErrQuotaExceeded.
+type QuotaExceededError struct {
+	Owner string
+	Quota OwnerQuota
+	// Allocations and Addresses are what the owner would hold if the
+	// allocation was made.
+	Allocations int
+	Addresses   uint64
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Quota.MaxAllocations != 0 && e.Allocations > e.Quota.MaxAllocations {
+		return fmt.Sprintf("%s: %q would hold %d allocations, at most %d are allowed",
+			ErrQuotaExceeded, e.Owner, e.Allocations, e.Quota.MaxAllocations)
+	}
+	return fmt.Sprintf("%s: %q would hold %d addresses, at most a /%d is allowed",
+		ErrQuotaExceeded, e.Owner, e.Addresses, e.Quota.MaxSpace)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
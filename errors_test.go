@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTypedErrors(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	})
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/23")))
+
+	err := a.AllocateStatic(netip.MustParsePrefix("192.168.1.0/24"))
+	assert.ErrorIs(t, err, ErrOverlap)
+	assert.Error(t, err, "prefix 192.168.1.0/24 overlaps with allocated prefix 192.168.0.0/23")
+	var overlap *OverlapError
+	assert.Assert(t, errors.As(err, &overlap))
+	assert.Equal(t, overlap.Allocated, netip.MustParsePrefix("192.168.0.0/23"))
+
+	err = a.AllocateStatic(netip.MustParsePrefix("2001:db8::/64"))
+	assert.ErrorIs(t, err, ErrInvalidPrefix)
+	assert.Error(t, err, "invalid prefix 2001:db8::/64")
+	assert.ErrorIs(t, a.AddReserved(netip.Prefix{}), ErrInvalidPrefix)
+
+	err = a.Deallocate(netip.MustParsePrefix("192.168.1.0/24"))
+	assert.ErrorIs(t, err, ErrNotAllocated)
+	assert.Error(t, err, "prefix 192.168.1.0/24 is not allocated")
+	assert.ErrorIs(t, a.DeallocateAll([]netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}), ErrNotAllocated)
+}
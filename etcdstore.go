@@ -0,0 +1,117 @@
+//go:build etcd
+
+// The etcd store is only built with the etcd build tag, such that programs
+// not using it don't link the etcd client in. Build with:
+//
+//	go build -tags etcd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdStore is a Store keeping the state in a single etcd key, in the binary
+// format written by MarshalBinary. Every write is a transaction comparing the
+// revision of the key with the one last seen by the store, such that several
+// allocators, on different hosts, can share the same pools: when another
+// allocator changed the state in the meantime, the write is refused with an
+// error matching ErrStoreConflict, and the allocator reloads the state.
+type EtcdStore struct {
+	kv  clientv3.KV
+	key string
+	// Timeout bounds every request to etcd. It defaults to 5 seconds.
+	Timeout time.Duration
+
+	state Snapshot
+	// rev is the modification revision of the key when state was last
+	// loaded or saved. It's 0 when the key doesn't exist.
+	rev int64
+}
+
+// NewEtcdStore returns an EtcdStore keeping the state in key. kv is usually
+// a *clientv3.Client.
+func NewEtcdStore(kv clientv3.KV, key string) *EtcdStore {
+	return &EtcdStore{kv: kv, key: key, Timeout: 5 * time.Second}
+}
+
+// CheckHealth verifies that etcd can be reached, without fetching the state.
+func (s *EtcdStore) CheckHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	_, err := s.kv.Get(ctx, s.key, clientv3.WithCountOnly())
+	return err
+}
+
+func (s *EtcdStore) Load() (Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	resp, err := s.kv.Get(ctx, s.key)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		s.state, s.rev = Snapshot{}, 0
+		return s.state, nil
+	}
+
+	state, err := unmarshalBinarySnapshot(resp.Kvs[0].Value)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("etcd key %s: %w", s.key, err)
+	}
+	s.state, s.rev = state, resp.Kvs[0].ModRevision
+	return s.state, nil
+}
+
+func (s *EtcdStore) SaveAllocation(p netip.Prefix) error {
+	state := s.state
+	i, _ := slices.BinarySearchFunc(state.Allocated, p, comparePrefix)
+	state.Allocated = slices.Insert(slices.Clone(state.Allocated), i, p)
+	return s.SaveSnapshot(state)
+}
+
+func (s *EtcdStore) DeleteAllocation(p netip.Prefix) error {
+	state := s.state
+	state.Allocated = slices.DeleteFunc(slices.Clone(state.Allocated), func(q netip.Prefix) bool {
+		return q == p
+	})
+	if _, ok := state.Meta[p]; ok {
+		state.Meta = maps.Clone(state.Meta)
+		delete(state.Meta, p)
+	}
+	return s.SaveSnapshot(state)
+}
+
+func (s *EtcdStore) SaveSnapshot(state Snapshot) error {
+	data, err := marshalBinarySnapshot(state)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	// A missing key has a modification revision of 0, so the first write
+	// only succeeds if nobody else created the key.
+	resp, err := s.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(s.key), "=", s.rev)).
+		Then(clientv3.OpPut(s.key, string(data))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("etcd key %s: %w", s.key, ErrStoreConflict)
+	}
+
+	s.state, s.rev = state, resp.Header.Revision
+	return nil
+}
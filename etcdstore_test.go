@@ -0,0 +1,67 @@
+//go:build etcd
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gotest.tools/v3/assert"
+)
+
+// newEtcdClient connects to the etcd cluster listed in ETCD_ENDPOINTS, and
+// returns a key that's deleted at the end of the test.
+func newEtcdClient(t *testing.T) (*clientv3.Client, string) {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS isn't set")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	assert.NilError(t, err)
+
+	key := "/subnet-allocator-test/" + t.Name()
+	t.Cleanup(func() {
+		cli.Delete(context.Background(), key)
+		cli.Close()
+	})
+	return cli, key
+}
+
+func TestEtcdStoreShared(t *testing.T) {
+	cli, key := newEtcdClient(t)
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+
+	a := mustNewAllocator(t, pools, WithStore(NewEtcdStore(cli, key)))
+	b := mustNewAllocator(t, pools, WithStore(NewEtcdStore(cli, key)))
+
+	// b hasn't seen a's allocations, but it never hands out the same
+	// subnet.
+	seen := map[netip.Prefix]bool{}
+	for i := 0; i < 4; i++ {
+		for _, alloc := range []*Allocator{a, b} {
+			p, err := alloc.Allocate()
+			assert.NilError(t, err)
+			assert.Check(t, !seen[p], "%s allocated twice", p)
+			seen[p] = true
+		}
+	}
+
+	// Other changes made by a stale allocator fail, but its state is
+	// reloaded, so trying again works.
+	err := a.AddReserved(netip.MustParsePrefix("10.0.128.0/17"))
+	assert.ErrorIs(t, err, ErrStoreConflict)
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")))
+
+	c := mustNewAllocator(t, nil, WithStore(NewEtcdStore(cli, key)))
+	assert.DeepEqual(t, c.Snapshot(), a.Snapshot(), cmpPrefix)
+	assert.Equal(t, len(c.Allocated()), 8)
+}
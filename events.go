@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// eventMessage is the JSON representation of an Event, as streamed by
+// GET /events and GET /events/ws.
+type eventMessage struct {
+	Kind       string            `json:"kind"`
+	Prefix     netip.Prefix      `json:"prefix"`
+	Pool       netip.Prefix      `json:"pool"`
+	Name       string            `json:"name,omitempty"`
+	Owner      string            `json:"owner,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Generation uint64            `json:"generation"`
+}
+
+func newEventMessage(ev Event) eventMessage {
+	return eventMessage{
+		Kind:       ev.Kind.String(),
+		Prefix:     ev.Allocation.Prefix,
+		Pool:       ev.Allocation.Pool.Prefix,
+		Name:       ev.Meta.Name,
+		Owner:      ev.Meta.Owner,
+		Labels:     ev.Meta.Labels,
+		Generation: ev.Generation,
+	}
+}
+
+// watch returns the changes made to the allocations until ctx is done, see
+// Watch.
+func (s *Server) watch(ctx context.Context) <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.a.Watch(ctx)
+}
+
+// events streams changes made to the allocations as server-sent events. Each
+// event is named after its kind, and its id is the generation of the
+// allocator. If the client falls behind, a "dropped" event is sent before the
+// stream ends, and the client should fetch the state again.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming isn't supported"))
+		return
+	}
+
+	acl := requestACL(r)
+	ch := s.watch(r.Context())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for ev := range ch {
+		if !acl.allows(ev.Allocation.Pool) {
+			continue
+		}
+		data, err := json.Marshal(newEventMessage(ev))
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Generation, ev.Kind, data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+	if r.Context().Err() == nil {
+		fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+		flusher.Flush()
+	}
+}
+
+// websocketGUID is appended to the key of WebSocket handshakes, see RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes and close codes.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+
+	wsCloseNormal   = 1000
+	wsCloseTryAgain = 1013
+)
+
+// eventsWebSocket streams changes made to the allocations over a WebSocket,
+// as one text message per event. If the client falls behind, the connection
+// is closed with status 1013 (try again later), and the client should fetch
+// the state again.
+func (s *Server) eventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("expected a WebSocket handshake"))
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	// The server outlives the request once hijacked, so the stream stops
+	// when the client closes the connection.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ws := &wsConn{conn: conn}
+	go func() {
+		defer cancel()
+		ws.readLoop(brw.Reader)
+	}()
+
+	acl := requestACL(r)
+	for ev := range s.watch(ctx) {
+		if !acl.allows(ev.Allocation.Pool) {
+			continue
+		}
+		data, err := json.Marshal(newEventMessage(ev))
+		if err != nil {
+			return
+		}
+		if err := ws.writeFrame(wsText, data); err != nil {
+			return
+		}
+	}
+	if ctx.Err() == nil {
+		ws.writeClose(wsCloseTryAgain, "watcher fell behind")
+	}
+}
+
+// headerContains tells whether the comma-separated values of the header key
+// contain token, ignoring case.
+func headerContains(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is the server side of a WebSocket, see RFC 6455.
+type wsConn struct {
+	// mu serializes writes, which are made both by the event loop and by
+	// the read loop answering pings.
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// writeFrame writes an unfragmented frame. Frames sent by servers aren't
+// masked.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+func (ws *wsConn) writeClose(code uint16, reason string) error {
+	return ws.writeFrame(wsClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// readLoop reads frames sent by the client, answering pings, until the client
+// closes the connection.
+func (ws *wsConn) readLoop(r *bufio.Reader) {
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			if ws.writeFrame(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			ws.writeClose(wsCloseNormal, "")
+			return
+		}
+	}
+}
+
+// maxClientFrame is the maximum size of frames read from clients, which have
+// no reason to send more than control frames.
+const maxClientFrame = 1 << 16
+
+// readFrame reads a frame, and unmasks its payload.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxClientFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
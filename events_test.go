@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func TestServerEvents(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "a", Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24},
+		{Name: "b", Prefix: netip.MustParsePrefix("10.1.0.0/23"), Size: 24},
+	})
+	mu := &sync.Mutex{}
+	ts := httptest.NewServer(NewServer(a, mu, WithTokens(map[string]ACL{
+		"reader": {Role: RoleReadOnly, Pools: []string{"b"}},
+	})))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/events", nil)
+	assert.NilError(t, err)
+	req.Header.Set("Authorization", "Bearer reader")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+	waitWatchers(t, a, mu, 1)
+
+	mu.Lock()
+	p, err := a.Allocate(WithPools("a"))
+	assert.NilError(t, err)
+	q, err := a.Allocate(WithPools("b"), WithOwner("ctr1"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p))
+	assert.NilError(t, a.Deallocate(q))
+	mu.Unlock()
+
+	// Events of pools the token doesn't give access to are skipped.
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, readEvent(t, r), `id: 2
+event: allocated
+data: {"kind":"allocated","prefix":"10.1.0.0/24","pool":"10.1.0.0/23","owner":"ctr1","generation":2}`)
+	assert.Equal(t, readEvent(t, r), `id: 4
+event: released
+data: {"kind":"released","prefix":"10.1.0.0/24","pool":"10.1.0.0/23","owner":"ctr1","generation":4}`)
+}
+
+// readEvent returns the next server-sent event read from r.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		assert.NilError(t, err)
+		if line == "\n" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// waitWatchers waits until a has n watchers, such that events aren't missed.
+func waitWatchers(t *testing.T, a *Allocator, mu sync.Locker, n int) {
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(a.watchers) == n {
+			return poll.Success()
+		}
+		return poll.Continue("%d watchers", len(a.watchers))
+	}, poll.WithTimeout(5*time.Second))
+}
+
+func TestServerEventsWebSocket(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	mu := &sync.Mutex{}
+	ts := httptest.NewServer(NewServer(a, mu))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /events/ws HTTP/1.1\r\nHost: allocator\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusSwitchingProtocols)
+	// The accept key for the sample nonce of RFC 6455.
+	assert.Equal(t, resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	waitWatchers(t, a, mu, 1)
+
+	mu.Lock()
+	_, err = a.Allocate()
+	mu.Unlock()
+	assert.NilError(t, err)
+
+	opcode, payload, err := readFrame(r)
+	assert.NilError(t, err)
+	assert.Equal(t, opcode, byte(wsText))
+	assert.Equal(t, string(payload), `{"kind":"allocated","prefix":"10.0.0.0/24","pool":"10.0.0.0/23","generation":1}`)
+
+	// Pings are answered, and closing is acknowledged.
+	writeMaskedFrame(t, conn, wsPing, []byte("hi"))
+	opcode, payload, err = readFrame(r)
+	assert.NilError(t, err)
+	assert.Equal(t, opcode, byte(wsPong))
+	assert.Equal(t, string(payload), "hi")
+
+	writeMaskedFrame(t, conn, wsClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	opcode, payload, err = readFrame(r)
+	assert.NilError(t, err)
+	assert.Equal(t, opcode, byte(wsClose))
+	assert.Equal(t, binary.BigEndian.Uint16(payload), uint16(wsCloseNormal))
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// writeMaskedFrame writes a frame the way clients do.
+func writeMaskedFrame(t *testing.T, w io.Writer, opcode byte, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	assert.NilError(t, err)
+}
+
+func TestServerEventsWebSocketHandshake(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	rec := httptest.NewRecorder()
+	NewServer(a, &sync.Mutex{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events/ws", nil))
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assert.Equal(t, strings.TrimSpace(rec.Body.String()), `{"error":"expected a WebSocket handshake"}`)
+}
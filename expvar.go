@@ -0,0 +1,86 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarPool is the utilization of a pool, as published by PublishExpvar.
+type expvarPool struct {
+	Pool      string `json:"pool"`
+	Name      string `json:"name,omitempty"`
+	Capacity  uint64 `json:"capacity"`
+	Allocated int    `json:"allocated"`
+	Free      uint64 `json:"free"`
+}
+
+// expvarHistogram is a LatencyHistogram, as published by PublishExpvar.
+// Durations are in seconds, like the Prometheus collector.
+type expvarHistogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+// expvarVar is the value published by PublishExpvar.
+type expvarVar struct {
+	Pools            []expvarPool    `json:"pools"`
+	Allocations      uint64          `json:"allocations"`
+	Deallocations    uint64          `json:"deallocations"`
+	Exhausted        uint64          `json:"exhausted"`
+	ScannedPools     uint64          `json:"scanned_pools"`
+	ScannedEntries   uint64          `json:"scanned_entries"`
+	AllocateDuration expvarHistogram `json:"allocate_duration_seconds"`
+}
+
+// PublishExpvar publishes the utilization of the pools of a, see Stats, and
+// its Counters as the expvar variable name. This exposes the same metrics as
+// the Prometheus collector, see NewCollector, to programs serving
+// /debug/vars.
+//
+// The allocator isn't safe for concurrent use, so the variable holds mu
+// while reading from it. mu must be the lock guarding every other use of the
+// allocator. Like expvar.Publish, PublishExpvar panics if name is already
+// in use.
+func PublishExpvar(name string, a *Allocator, mu sync.Locker) {
+	expvar.Publish(name, expvar.Func(func() any {
+		mu.Lock()
+		stats := a.Stats()
+		counters := a.Counters()
+		mu.Unlock()
+		return newExpvarVar(stats, counters)
+	}))
+}
+
+func newExpvarVar(stats Stats, counters Counters) expvarVar {
+	v := expvarVar{
+		Pools:          make([]expvarPool, 0, len(stats.Pools)),
+		Allocations:    counters.Allocations,
+		Deallocations:  counters.Deallocations,
+		Exhausted:      counters.Exhausted,
+		ScannedPools:   counters.ScannedPools,
+		ScannedEntries: counters.ScannedEntries,
+	}
+	for _, ps := range stats.Pools {
+		v.Pools = append(v.Pools, expvarPool{
+			Pool:      ps.Prefix.String(),
+			Name:      ps.Name,
+			Capacity:  ps.Capacity,
+			Allocated: ps.Allocated,
+			Free:      ps.Free,
+		})
+	}
+
+	h := counters.AllocateLatency
+	v.AllocateDuration = expvarHistogram{
+		Bounds: make([]float64, len(h.Bounds)),
+		Counts: h.Counts,
+		Count:  h.Count,
+		Sum:    h.Sum.Seconds(),
+	}
+	for i, bound := range h.Bounds {
+		v.AllocateDuration.Bounds[i] = bound.Seconds()
+	}
+	return v
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// expvarRuns is the number of times TestPublishExpvar ran, see -count.
+var expvarRuns int
+
+func TestPublishExpvar(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Name: "default", Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}})
+	// Variables can't be unpublished, so each run needs a name of its own.
+	expvarRuns++
+	name := fmt.Sprintf("subnet_allocator_test_%d", expvarRuns)
+	PublishExpvar(name, a, &sync.Mutex{})
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p))
+	_, err = a.Allocate()
+	assert.NilError(t, err)
+
+	v := expvar.Get(name)
+	assert.Assert(t, v != nil)
+	var got expvarVar
+	assert.NilError(t, json.Unmarshal([]byte(v.String()), &got))
+
+	assert.DeepEqual(t, got.Pools, []expvarPool{
+		{Pool: "10.0.0.0/22", Name: "default", Capacity: 4, Allocated: 1, Free: 3},
+	})
+	assert.Equal(t, got.Allocations, uint64(2))
+	assert.Equal(t, got.Deallocations, uint64(1))
+	assert.Equal(t, got.Exhausted, uint64(0))
+	assert.Equal(t, got.AllocateDuration.Count, uint64(2))
+	assert.Equal(t, len(got.AllocateDuration.Bounds), len(latencyBounds))
+	assert.Equal(t, got.AllocateDuration.Bounds[0], 10e-6)
+	assert.Equal(t, got.AllocateDuration.Counts[len(latencyBounds)-1], uint64(2))
+}
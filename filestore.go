@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+)
+
+// FileStore is a Store keeping the whole state in a single JSON file, as
+// encoded by MarshalJSON. Every change rewrites the file: the new state is
+// written to a temporary file, synced, and then renamed over the previous
+// one, such that a crash never leaves a half-written file behind.
+type FileStore struct {
+	path  string
+	state Snapshot
+}
+
+// NewFileStore returns a FileStore writing to path, and loads the state
+// persisted there, if any. The directory of path must exist.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.state, err = unmarshalSnapshot(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Load returns the state read by NewFileStore, or last saved.
+func (s *FileStore) Load() (Snapshot, error) {
+	return s.state, nil
+}
+
+func (s *FileStore) SaveAllocation(p netip.Prefix) error {
+	state := s.state
+	state.Allocated = append(slices.Clip(state.Allocated), p)
+	return s.SaveSnapshot(state)
+}
+
+func (s *FileStore) DeleteAllocation(p netip.Prefix) error {
+	state := s.state
+	state.Allocated = slices.DeleteFunc(slices.Clone(state.Allocated), func(q netip.Prefix) bool {
+		return q == p
+	})
+	if _, ok := state.Meta[p]; ok {
+		state.Meta = maps.Clone(state.Meta)
+		delete(state.Meta, p)
+	}
+	return s.SaveSnapshot(state)
+}
+
+func (s *FileStore) SaveSnapshot(state Snapshot) error {
+	data, err := marshalSnapshot(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+// CheckHealth verifies that the directory of the file still exists.
+func (s *FileStore) CheckHealth(ctx context.Context) error {
+	dir := filepath.Dir(s.path)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+	return nil
+}
+
+// AppendAudit appends entries to the audit trail, see WithAudit. They're
+// written as JSON lines to the file at the path of the store, suffixed with
+// ".audit", which is never rewritten.
+func (s *FileStore) AppendAudit(entries []AuditEntry) error {
+	var data []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	f, err := os.OpenFile(s.path+".audit", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAtomic replaces the file at path with data. Readers see either the
+// previous content or the new one, even if the process crashes midway.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Once renamed, removing the temporary file is a no-op.
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes sure a rename in dir is persisted.
+func syncDir(dir string) error {
+	// Directories can't be synced on Windows, where renames are persisted
+	// by the filesystem.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
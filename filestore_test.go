@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+
+	s, err := NewFileStore(path)
+	assert.NilError(t, err)
+	a := mustNewAllocator(t, pools, WithStore(s))
+	_, err = a.AllocateN(3)
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("10.0.1.0/24")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")))
+	_, err = a.AllocateNamed("net1")
+	assert.NilError(t, err)
+
+	// Only the state file is left in the directory.
+	entries, err := os.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+
+	// The state is loaded back on restart.
+	s, err = NewFileStore(path)
+	assert.NilError(t, err)
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+
+	p, err := b.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.3.0/24"))
+}
+
+func TestFileStoreReleasedMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+
+	s, err := NewFileStore(path)
+	assert.NilError(t, err)
+	a := mustNewAllocator(t, pools, WithStore(s))
+	p, err := a.Allocate(WithOwner("alice"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p))
+	q, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, q, p)
+
+	// The metadata of the released allocation doesn't come back on restart.
+	s, err = NewFileStore(path)
+	assert.NilError(t, err)
+	b := mustNewAllocator(t, nil, WithStore(s))
+	m, _ := b.Metadata(p)
+	assert.Equal(t, m.Owner, "")
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+}
+
+func TestFileStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	assert.NilError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err := NewFileStore(path)
+	assert.Check(t, is.ErrorContains(err, path+": unexpected end of JSON input"))
+
+	assert.NilError(t, os.WriteFile(path, []byte(`{"allocations": [{"prefix": "10.0.0.0/24"}, {"prefix": "10.0.0.0/16"}]}`), 0o600))
+	s, err := NewFileStore(path)
+	assert.NilError(t, err)
+	_, err = NewAllocator(nil, WithStore(s))
+	assert.Error(t, err, "prefixes 10.0.0.0/16 and 10.0.0.0/24 overlap")
+
+	// NewAllocator saves the initial state, which fails when the directory
+	// doesn't exist.
+	s, err = NewFileStore(filepath.Join(dir, "sub", "state.json"))
+	assert.NilError(t, err)
+	_, err = NewAllocator(nil, WithStore(s))
+	assert.Check(t, is.ErrorContains(err, "saving state: "))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"gotest.tools/v3/assert"
+)
+
+// fuzzPools are small pools, such that the fuzzer exhausts them quickly, and
+// with a bit of everything: static reserve, overflow, subnets of various
+// sizes.
+var fuzzPools = []Pool{
+	{Prefix: netip.MustParsePrefix("10.0.0.0/20"), Size: 24, StaticReserve: 25},
+	{Prefix: netip.MustParsePrefix("10.0.16.0/22"), Size: 26},
+	{Prefix: netip.MustParsePrefix("10.0.20.0/24"), Size: 28, Overflow: true},
+}
+
+// FuzzAllocator replays sequences of operations, decoded from the input,
+// against Allocator and refAllocator, and checks they agree.
+func FuzzAllocator(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 1, 0, 0, 0})
+	f.Add([]byte{3, 0, 1, 20, 0, 0, 0, 0, 4, 0, 0, 0})
+	f.Add([]byte{2, 22, 0, 0, 2, 22, 0, 0, 1, 0, 0, 0, 4, 1, 0, 0})
+	f.Add([]byte{5, 2, 0, 22, 0, 0, 0, 0, 3, 1, 8, 26})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		a := mustNewAllocator(t, fuzzPools, WithInvariantChecks(false))
+		ref := &refAllocator{pools: slices.Clone(fuzzPools)}
+
+		for ; len(ops) >= 4; ops = ops[4:] {
+			op, args := ops[0]%6, ops[1:4]
+			switch op {
+			case 0, 1, 2:
+				reverse := op == 1
+				align := 0
+				opts := []AllocateOption{}
+				if reverse {
+					opts = append(opts, WithReverse())
+				}
+				if op == 2 {
+					align = int(args[0] % 33)
+					opts = append(opts, WithAlignment(align))
+				}
+
+				got, err := a.Allocate(opts...)
+				want, ok := ref.allocate(reverse, align)
+				if !ok {
+					assert.ErrorIs(t, err, ErrNoFreePool, "reverse=%t align=%d", reverse, align)
+					continue
+				}
+				assert.NilError(t, err, "reverse=%t align=%d", reverse, align)
+				assert.Equal(t, got, want, "reverse=%t align=%d", reverse, align)
+			case 3:
+				p := fuzzPrefix(args)
+				err := a.AllocateStatic(p)
+				assert.Equal(t, err == nil, ref.allocateStatic(p), "AllocateStatic(%s): %v", p, err)
+			case 4:
+				// Mostly release allocated prefixes.
+				p := fuzzPrefix(args)
+				if len(ref.allocated) > 0 && args[0]%4 != 0 {
+					p = ref.allocated[int(args[1])%len(ref.allocated)]
+				}
+				err := a.Deallocate(p)
+				assert.Equal(t, err == nil, ref.deallocate(p), "Deallocate(%s): %v", p, err)
+			case 5:
+				p := fuzzPrefix(args)
+				err := a.AddReserved(p)
+				assert.Equal(t, err == nil, ref.addReserved(p), "AddReserved(%s): %v", p, err)
+			}
+		}
+
+		assert.DeepEqual(t, a.Allocated(), slices.SortedFunc(slices.Values(ref.allocated), comparePrefix), cmpPrefix, cmpopts.EquateEmpty())
+	})
+}
+
+// fuzzPrefix decodes a prefix around fuzzPools from 3 bytes.
+func fuzzPrefix(b []byte) netip.Prefix {
+	addr := netip.AddrFrom4([4]byte{10, 0, b[0] % 32, b[1]})
+	return netip.PrefixFrom(addr, 16+int(b[2])%17).Masked()
+}
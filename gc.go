@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+)
+
+// GC asks isAlive whether each allocation is still in use, e.g. whether the
+// container or the service owning it still exists, and releases those that
+// aren't, all at once. It returns the released prefixes, sorted.
+//
+// Pinned allocations are skipped, unless WithForce is used. If ctx is done
+// before every allocation was checked, GC returns the error of ctx, and
+// releases nothing.
+func (a *Allocator) GC(ctx context.Context, isAlive func(p netip.Prefix, m AllocationMeta) bool, opts ...DeallocateOption) ([]netip.Prefix, error) {
+	o := newDeallocateOptions(opts)
+	prev := a.beginAudit(AuditDeallocate, o.actor)
+	orphans, err := a.gc(ctx, isAlive, o)
+	a.endAudit(prev, netip.Prefix{}, "", err)
+	return orphans, err
+}
+
+func (a *Allocator) gc(ctx context.Context, isAlive func(p netip.Prefix, m AllocationMeta) bool, o deallocateOptions) ([]netip.Prefix, error) {
+	var orphans []netip.Prefix
+	for _, p := range a.allocated.slice() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if a.checkPinned(p, o) != nil {
+			continue
+		}
+		m, _ := a.Metadata(p)
+		if !isAlive(p, m) {
+			orphans = append(orphans, p)
+		}
+	}
+	if len(orphans) == 0 {
+		return nil, nil
+	}
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+	err := a.persist(func() error {
+		for _, p := range orphans {
+			a.releaseWith(p, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
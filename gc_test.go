@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGC(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+	for _, owner := range []string{"c1", "c2", "c3", "", "c2"} {
+		_, err := a.Allocate(WithOwner(owner))
+		assert.NilError(t, err)
+	}
+
+	alive := map[string]bool{"c1": true, "c3": true}
+	var checked int
+	isAlive := func(p netip.Prefix, m AllocationMeta) bool {
+		checked++
+		return m.Owner == "" || alive[m.Owner]
+	}
+
+	released, err := a.GC(context.Background(), isAlive)
+	assert.NilError(t, err)
+	assert.Equal(t, checked, 5)
+	assert.DeepEqual(t, released, []netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.4.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+		netip.MustParsePrefix("10.0.3.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+
+	// Nothing is released if the sweep is interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	released, err = a.GC(ctx, func(p netip.Prefix, m AllocationMeta) bool {
+		cancel()
+		return false
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, len(released), 0)
+	assert.Equal(t, len(a.Allocated()), 3)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Generation returns the generation of the allocator's state. It's
+// incremented on every change: allocations, deallocations, reservations, pool
+// changes, and reloads from the store. Callers caching a view of the allocator
+// can compare generations to tell whether it's still fresh, and pass it to
+// conditional operations, such as AllocateIfGeneration, to detect concurrent
+// changes.
+//
+// Generations aren't persisted, they're only meaningful to compare states of
+// the same allocator.
+func (a *Allocator) Generation() uint64 {
+	return a.generation
+}
+
+// checkGeneration returns an error matching ErrGenerationMismatch if the
+// allocator isn't at generation gen anymore.
+func (a *Allocator) checkGeneration(gen uint64) error {
+	if a.generation != gen {
+		return fmt.Errorf("%w: expected generation %d, got %d", ErrGenerationMismatch, gen, a.generation)
+	}
+	return nil
+}
+
+// AllocateIfGeneration is the same as Allocate, but it fails with an error
+// matching ErrGenerationMismatch, and allocates nothing, if the allocator
+// isn't at generation gen anymore. Unlike Allocate, it doesn't try again on
+// store conflicts, as reloading the state changes the generation.
+func (a *Allocator) AllocateIfGeneration(gen uint64, opts ...AllocateOption) (netip.Prefix, error) {
+	if err := a.checkGeneration(gen); err != nil {
+		return netip.Prefix{}, err
+	}
+	alloc, err := a.allocateWithRetries(opts, 0)
+	return alloc.Prefix, err
+}
+
+// AllocateStaticIfGeneration is the same as AllocateStatic, but it fails with
+// an error matching ErrGenerationMismatch if the allocator isn't at
+// generation gen anymore.
+func (a *Allocator) AllocateStaticIfGeneration(gen uint64, p netip.Prefix) error {
+	if err := a.checkGeneration(gen); err != nil {
+		return err
+	}
+	return a.AllocateStatic(p)
+}
+
+// DeallocateIfGeneration is the same as Deallocate, but it fails with an
+// error matching ErrGenerationMismatch if the allocator isn't at generation
+// gen anymore.
+func (a *Allocator) DeallocateIfGeneration(gen uint64, p netip.Prefix) error {
+	if err := a.checkGeneration(gen); err != nil {
+		return err
+	}
+	return a.Deallocate(p)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGeneration(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	p := netip.MustParsePrefix("10.0.10.0/24")
+
+	testcases := []struct {
+		name string
+		op   func() error
+	}{
+		{
+			name: "allocate",
+			op: func() error {
+				_, err := a.Allocate()
+				return err
+			},
+		},
+		{
+			name: "allocate static",
+			op:   func() error { return a.AllocateStatic(p) },
+		},
+		{
+			name: "deallocate",
+			op:   func() error { return a.Deallocate(p) },
+		},
+		{
+			name: "allocate n",
+			op: func() error {
+				_, err := a.AllocateN(2)
+				return err
+			},
+		},
+		{
+			name: "add reserved",
+			op:   func() error { return a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")) },
+		},
+		{
+			name: "add pool",
+			op:   func() error { return a.AddPool(Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24}) },
+		},
+		{
+			name: "reset",
+			op:   a.Reset,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := a.Generation()
+			assert.NilError(t, tc.op())
+			assert.Check(t, a.Generation() > before)
+		})
+	}
+
+	// Failed operations leave the generation untouched.
+	gen := a.Generation()
+	assert.ErrorIs(t, a.Deallocate(p), ErrNotAllocated)
+	assert.Equal(t, a.Generation(), gen)
+}
+
+func TestIfGeneration(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	gen := a.Generation()
+
+	p, err := a.AllocateIfGeneration(gen)
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+
+	// gen is stale now.
+	_, err = a.AllocateIfGeneration(gen)
+	assert.ErrorIs(t, err, ErrGenerationMismatch)
+	err = a.AllocateStaticIfGeneration(gen, netip.MustParsePrefix("10.0.10.0/24"))
+	assert.ErrorIs(t, err, ErrGenerationMismatch)
+	err = a.DeallocateIfGeneration(gen, p)
+	assert.ErrorIs(t, err, ErrGenerationMismatch)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p}, cmpPrefix)
+
+	gen = a.Generation()
+	assert.NilError(t, a.AllocateStaticIfGeneration(gen, netip.MustParsePrefix("10.0.10.0/24")))
+	assert.NilError(t, a.DeallocateIfGeneration(a.Generation(), p))
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{netip.MustParsePrefix("10.0.10.0/24")}, cmpPrefix)
+}
@@ -1,7 +1,11 @@
 module github.com/akerouanton/subnet-allocator
 
-go 1.21.6
+go 1.23
 
-require gotest.tools/v3 v3.5.1
-
-require github.com/google/go-cmp v0.5.9 // indirect
+require (
+	github.com/google/go-cmp v0.5.9
+	github.com/redis/go-redis/v9 v9.7.0
+	go.etcd.io/bbolt v1.5.0
+	go.etcd.io/etcd/client/v3 v3.5.17
+	gotest.tools/v3 v3.5.1
+)
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// gossipMagic starts every gossip message.
+var gossipMagic = []byte("SNAG")
+
+const gossipVersion = 1
+
+// maxGossipMessage is the maximum size of a gossip message, that is the
+// maximum payload of a UDP datagram. Dense allocations take 2 to 4 bytes
+// each, so that's room for 15,000 allocations at least.
+const maxGossipMessage = 65507
+
+// Gossip shares allocations between allocators on different hosts, without
+// consensus. Each host advertises its own allocations to its peers over UDP,
+// and peers treat them as reserved: register Gossip.Reserved with
+// WithReservedProvider. Two hosts can still hand out the same subnet if they
+// allocate it before hearing from each other, so each host should allocate
+// from its own partition, see PartitionPools.
+//
+// Gossip is a Store, such that the allocator tells it about its allocations:
+// register it with WithStore. Calls are forwarded to the next Store, if any.
+// Advertisements not refreshed for a while expire, such that the space
+// allocated by a host that went away can be reused.
+type Gossip struct {
+	conn  net.PacketConn
+	id    string
+	peers []net.Addr
+	next  Store
+	// TTL is how long advertisements received from a peer are kept once it
+	// stopped sending them. It defaults to 3 times the interval passed to
+	// Start.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	local prefixList
+	// remote holds the last advertisement of every peer, by peer ID.
+	remote map[string]gossipPeer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type gossipPeer struct {
+	seq      uint64
+	prefixes []netip.Prefix
+	seen     time.Time
+}
+
+// NewGossip returns a Gossip sending and receiving advertisements on conn,
+// which is usually a UDP socket. id identifies the host, and must be unique
+// among peers. next is the Store calls are forwarded to, it can be nil.
+func NewGossip(conn net.PacketConn, id string, peers []netip.AddrPort, next Store) *Gossip {
+	g := &Gossip{
+		conn:   conn,
+		id:     id,
+		next:   next,
+		remote: map[string]gossipPeer{},
+	}
+	for _, p := range peers {
+		g.peers = append(g.peers, net.UDPAddrFromAddrPort(p))
+	}
+	return g
+}
+
+// Reserved returns the allocations advertised by peers, normalized. It's a
+// ReservedProvider.
+func (g *Gossip) Reserved() []netip.Prefix {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var all []netip.Prefix
+	for id, peer := range g.remote {
+		if g.TTL > 0 && time.Since(peer.seen) > g.TTL {
+			delete(g.remote, id)
+			continue
+		}
+		all = append(all, peer.prefixes...)
+	}
+	return normalizeReserved(all)
+}
+
+func (g *Gossip) Load() (Snapshot, error) {
+	var s Snapshot
+	if g.next != nil {
+		var err error
+		if s, err = g.next.Load(); err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	g.mu.Lock()
+	g.local = newPrefixList(s.Allocated...)
+	g.mu.Unlock()
+	return s, nil
+}
+
+func (g *Gossip) SaveAllocation(p netip.Prefix) error {
+	if g.next != nil {
+		if err := g.next.SaveAllocation(p); err != nil {
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	g.local.insert(p)
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *Gossip) DeleteAllocation(p netip.Prefix) error {
+	if g.next != nil {
+		if err := g.next.DeleteAllocation(p); err != nil {
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	g.local.remove(p)
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *Gossip) SaveSnapshot(s Snapshot) error {
+	if g.next != nil {
+		if err := g.next.SaveSnapshot(s); err != nil {
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	g.local = newPrefixList(s.Allocated...)
+	g.mu.Unlock()
+	return nil
+}
+
+// Start advertises local allocations to peers every interval, and collects
+// their advertisements, in the background until Stop is called.
+func (g *Gossip) Start(interval time.Duration) error {
+	if g.stop != nil {
+		return errors.New("gossip is already running")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid gossip interval %s", interval)
+	}
+	if g.TTL == 0 {
+		g.TTL = 3 * interval
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	g.stop, g.done = stop, done
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, maxGossipMessage)
+		next := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if !time.Now().Before(next) {
+				// Sending errors are transient, e.g. a peer being down,
+				// the next round tries again.
+				g.advertise()
+				next = time.Now().Add(interval)
+			}
+
+			// Wake up for the next round at the latest, and regularly
+			// enough to notice Stop.
+			deadline := time.Now().Add(100 * time.Millisecond)
+			if next.Before(deadline) {
+				deadline = next
+			}
+			g.conn.SetReadDeadline(deadline)
+			n, _, err := g.conn.ReadFrom(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			if err != nil {
+				// The connection was closed.
+				return
+			}
+			g.receive(buf[:n])
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops gossiping, and waits for the background task to return.
+// Advertisements received so far are kept until they expire.
+func (g *Gossip) Stop() {
+	if g.stop == nil {
+		return
+	}
+
+	close(g.stop)
+	<-g.done
+	g.stop, g.done = nil, nil
+}
+
+// advertise sends local allocations to every peer.
+func (g *Gossip) advertise() error {
+	g.mu.Lock()
+	msg := marshalGossip(g.id, uint64(time.Now().UnixNano()), g.local.slice())
+	g.mu.Unlock()
+
+	if len(msg) > maxGossipMessage {
+		return fmt.Errorf("too many allocations to advertise: message is %d bytes long", len(msg))
+	}
+
+	var errs []error
+	for _, peer := range g.peers {
+		if _, err := g.conn.WriteTo(msg, peer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// receive records the advertisement msg. Invalid messages, messages sent by
+// the host itself, and messages older than the last one received from the
+// same peer are ignored.
+func (g *Gossip) receive(msg []byte) {
+	id, seq, prefixes, err := unmarshalGossip(msg)
+	if err != nil || id == g.id {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if peer, ok := g.remote[id]; ok && peer.seq >= seq {
+		return
+	}
+	g.remote[id] = gossipPeer{seq: seq, prefixes: prefixes, seen: time.Now()}
+}
+
+// marshalGossip encodes an advertisement: the ID of the sender, a sequence
+// number ordering its advertisements, and its allocations, packed like in
+// binary snapshots.
+func marshalGossip(id string, seq uint64, prefixes []netip.Prefix) []byte {
+	buf := append([]byte(nil), gossipMagic...)
+	buf = binary.AppendUvarint(buf, gossipVersion)
+	buf = appendBytes(buf, []byte(id))
+	buf = binary.AppendUvarint(buf, seq)
+	buf = binary.AppendUvarint(buf, uint64(len(prefixes)))
+	return appendPrefixes(buf, prefixes)
+}
+
+func unmarshalGossip(msg []byte) (id string, seq uint64, prefixes []netip.Prefix, err error) {
+	if !bytes.HasPrefix(msg, gossipMagic) {
+		return "", 0, nil, errors.New("not a gossip message")
+	}
+	r := &snapshotReader{buf: msg[len(gossipMagic):]}
+	if v := r.uvarint(); r.err == nil && v != gossipVersion {
+		return "", 0, nil, fmt.Errorf("unsupported gossip version %d", v)
+	}
+	id = string(r.bytes())
+	seq = r.uvarint()
+	prefixes = readPrefixes(r)
+	if r.err != nil {
+		return "", 0, nil, r.err
+	}
+	return id, seq, prefixes, nil
+}
+
+// PartitionPools splits every pool into n partitions of the same size, and
+// returns the i-th partition of each of them. Hosts sharing pools can each
+// use their own partition, such that they don't compete for the same subnets.
+// n must be a power of 2, and pools must be big enough to be split.
+func PartitionPools(pools []Pool, i, n int) ([]Pool, error) {
+	if n <= 0 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("invalid number of partitions %d: must be a power of 2", n)
+	}
+	if i < 0 || i >= n {
+		return nil, fmt.Errorf("invalid partition %d: must be within [0, %d)", i, n)
+	}
+
+	var bits int
+	for 1<<bits < n {
+		bits++
+	}
+
+	partitions := make([]Pool, 0, len(pools))
+	for _, p := range pools {
+		p = p.clone()
+		prefix := p.Prefix.Masked()
+		if prefix.Bits()+bits > p.Size {
+			return nil, fmt.Errorf("pool %s can't be split in %d partitions of /%d subnets", prefix, n, p.Size)
+		}
+		p.Prefix = netip.PrefixFrom(Add(prefix.Addr(), uint64(i), uint(32-prefix.Bits()-bits)), prefix.Bits()+bits)
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
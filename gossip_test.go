@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func TestGossipReceive(t *testing.T) {
+	g := NewGossip(nil, "host1", nil, nil)
+	p1 := netip.MustParsePrefix("10.0.0.0/24")
+	p2 := netip.MustParsePrefix("10.0.1.0/24")
+
+	g.receive(marshalGossip("host2", 2, []netip.Prefix{p1, p2}))
+	// Older advertisements, our own, and garbage are ignored.
+	g.receive(marshalGossip("host2", 1, nil))
+	g.receive(marshalGossip("host1", 3, []netip.Prefix{netip.MustParsePrefix("10.0.2.0/24")}))
+	g.receive([]byte("SNAG\x01garbage"))
+	assert.DeepEqual(t, g.Reserved(), []netip.Prefix{p1, p2}, cmpPrefix)
+
+	g.receive(marshalGossip("host2", 3, []netip.Prefix{p2}))
+	g.receive(marshalGossip("host3", 1, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}))
+	assert.DeepEqual(t, g.Reserved(), []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}, cmpPrefix)
+
+	// Advertisements expire.
+	g.TTL = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	assert.DeepEqual(t, g.Reserved(), []netip.Prefix{}, cmpPrefix, cmpopts.EquateEmpty())
+}
+
+func TestGossip(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NilError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	conn1, conn2 := listen(), listen()
+	addr1 := conn1.LocalAddr().(*net.UDPAddr).AddrPort()
+	addr2 := conn2.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	g1 := NewGossip(conn1, "host1", []netip.AddrPort{addr2}, nil)
+	g2 := NewGossip(conn2, "host2", []netip.AddrPort{addr1}, nil)
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithStore(g1), WithReservedProvider(g1.Reserved))
+	b := mustNewAllocator(t, pools, WithStore(g2), WithReservedProvider(g2.Reserved))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+
+	assert.NilError(t, g1.Start(10*time.Millisecond))
+	defer g1.Stop()
+	assert.NilError(t, g2.Start(10*time.Millisecond))
+	defer g2.Stop()
+
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if len(g2.Reserved()) == 0 {
+			return poll.Continue("waiting for host1 to advertise its allocations")
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(5*time.Millisecond))
+
+	p, err = b.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.1.0/24"))
+}
+
+func TestPartitionPools(t *testing.T) {
+	pools := []Pool{
+		{Name: "a", Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24},
+		{Name: "b", Prefix: netip.MustParsePrefix("192.168.0.0/20"), Size: 22},
+	}
+
+	got, err := PartitionPools(pools, 3, 4)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, []Pool{
+		{Name: "a", Prefix: netip.MustParsePrefix("10.0.192.0/18"), Size: 24},
+		{Name: "b", Prefix: netip.MustParsePrefix("192.168.12.0/22"), Size: 22},
+	}, cmpPrefix)
+
+	_, err = PartitionPools(pools, 0, 3)
+	assert.Error(t, err, "invalid number of partitions 3: must be a power of 2")
+	_, err = PartitionPools(pools, 4, 4)
+	assert.Error(t, err, "invalid partition 4: must be within [0, 4)")
+	_, err = PartitionPools(pools, 0, 8)
+	assert.Error(t, err, "pool 192.168.0.0/20 can't be split in 8 partitions of /22 subnets")
+}
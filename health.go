@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthTimeout bounds the readiness checks of the store.
+const healthTimeout = 5 * time.Second
+
+// statusResponse is the body of successful /healthz and /readyz responses.
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+// healthz reports that the server is alive. It waits for the allocator
+// lock, such that a deadlocked server fails liveness probes by timing out.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
+
+// readyz reports whether the server can serve requests: the allocator isn't
+// closed, the state was reloaded after the last conflict with another
+// allocator sharing the store, and the store can be reached, if it can tell,
+// see HealthChecker. It fails with a 503 otherwise.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	err, store := s.a.reloadErr, s.a.store
+	if s.a.closed {
+		err = ErrClosed
+	}
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	// The store is checked without holding the lock, such that a store
+	// that can't be reached doesn't hold back other requests.
+	if hc, ok := store.(HealthChecker); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		if err := hc.CheckHealth(ctx); err != nil {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("store can't be reached: %w", err))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// healthStore is a memStore telling whether it can be reached.
+type healthStore struct {
+	memStore
+	err error
+}
+
+func (s *healthStore) CheckHealth(ctx context.Context) error {
+	return s.err
+}
+
+// probe returns the status and body of a GET to path.
+func probe(t *testing.T, srv http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func TestServerProbes(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	s := &healthStore{}
+	a := mustNewAllocator(t, pools, WithStore(s))
+	// Probes don't need a token.
+	srv := NewServer(a, &sync.Mutex{}, WithTokens(map[string]ACL{"root": {Role: RoleAdmin}}))
+
+	code, body := probe(t, srv, "/healthz")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, `{"status":"ok"}`)
+	code, body = probe(t, srv, "/readyz")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, `{"status":"ok"}`)
+
+	s.err = errStore
+	code, body = probe(t, srv, "/readyz")
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, body, `{"error":"store can't be reached: store is down"}`)
+	code, _ = probe(t, srv, "/healthz")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestServerReadyAfterReload(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	s := &sharedStore{}
+	a := mustNewAllocator(t, pools, WithStore(&sharedView{shared: s}))
+	srv := NewServer(a, &sync.Mutex{})
+
+	// Another allocator wrote a state that can't be loaded.
+	valid := s.state
+	s.state.Allocated = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("10.0.0.0/24")}
+	s.rev++
+	err := a.AllocateStatic(netip.MustParsePrefix("10.0.1.0/24"))
+	assert.ErrorIs(t, err, ErrStoreConflict)
+
+	code, body := probe(t, srv, "/readyz")
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Assert(t, strings.HasPrefix(body, `{"error":"reloading state: `), body)
+
+	// Once the state is reloaded, the server is ready again.
+	s.state = valid
+	s.rev++
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.1.0/24"))
+	assert.ErrorIs(t, err, ErrStoreConflict)
+	code, _ = probe(t, srv, "/readyz")
+	assert.Equal(t, code, http.StatusOK)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// HistoryEntry records that Prefix was allocated to Owner at AllocatedAt, and
+// released at ReleasedAt. ReleasedAt is the zero time while Prefix is still
+// allocated.
+type HistoryEntry struct {
+	Prefix      netip.Prefix
+	Owner       string
+	AllocatedAt time.Time
+	ReleasedAt  time.Time
+}
+
+// WithHistory makes the allocator keep a history of the last n allocations,
+// see History. Older entries are dropped as new ones come in. The history
+// isn't persisted.
+func WithHistory(n int) Option {
+	return func(a *Allocator) {
+		a.historySize = n
+	}
+}
+
+// History returns the recorded allocations overlapping with p, oldest first,
+// e.g. to find out who held p at some point in time. It's always empty unless
+// WithHistory is used.
+func (a *Allocator) History(p netip.Prefix) []HistoryEntry {
+	p = p.Masked()
+	var entries []HistoryEntry
+	for _, e := range a.history {
+		if !e.Prefix.Overlaps(p) {
+			continue
+		}
+		if e.ReleasedAt.IsZero() {
+			// The owner is only recorded on release.
+			e.Owner = a.meta[e.Prefix].Owner
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// recordAllocation appends the allocation of p to the history.
+func (a *Allocator) recordAllocation(p netip.Prefix) {
+	if a.historySize <= 0 {
+		return
+	}
+	a.history = append(a.history, HistoryEntry{Prefix: p, AllocatedAt: a.now()})
+	if n := len(a.history) - a.historySize; n > 0 {
+		a.history = slices.Delete(a.history, 0, n)
+	}
+}
+
+// recordRelease records in the history that p is being released. It must be
+// called before the metadata of p is forgotten.
+func (a *Allocator) recordRelease(p netip.Prefix) {
+	for i := len(a.history) - 1; i >= 0; i-- {
+		if e := &a.history[i]; e.Prefix == p && e.ReleasedAt.IsZero() {
+			e.Owner = a.meta[p].Owner
+			e.ReleasedAt = a.now()
+			return
+		}
+	}
+}
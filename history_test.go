@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHistory(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{t: t0}
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s), WithHistory(3))
+	a.now = clock.now
+	at := func(d time.Duration) time.Time { return t0.Add(d) }
+
+	p1, err := a.Allocate(WithOwner("c1"))
+	assert.NilError(t, err)
+	clock.t = at(time.Hour)
+	assert.NilError(t, a.Deallocate(p1))
+	clock.t = at(2 * time.Hour)
+	p, err := a.Allocate(WithOwner("c2"))
+	assert.NilError(t, err)
+	assert.Equal(t, p, p1)
+
+	assert.DeepEqual(t, a.History(netip.MustParsePrefix("10.0.0.0/16")), []HistoryEntry{
+		{Prefix: p1, Owner: "c1", AllocatedAt: at(0), ReleasedAt: at(time.Hour)},
+		{Prefix: p1, Owner: "c2", AllocatedAt: at(2 * time.Hour)},
+	}, cmpPrefix)
+
+	// Failed changes aren't recorded.
+	s.fail = true
+	_, err = a.Allocate(WithOwner("c3"))
+	assert.ErrorIs(t, err, errStore)
+	assert.Equal(t, len(a.History(netip.MustParsePrefix("10.0.0.0/16"))), 2)
+	s.fail = false
+
+	// Only the last entries are kept, and History only returns those
+	// overlapping with the given prefix.
+	clock.t = at(3 * time.Hour)
+	p2, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.Reset())
+	_, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, a.History(p2), []HistoryEntry{
+		{Prefix: p2, AllocatedAt: at(3 * time.Hour), ReleasedAt: at(3 * time.Hour)},
+	}, cmpPrefix)
+	assert.DeepEqual(t, a.History(p1), []HistoryEntry{
+		{Prefix: p1, Owner: "c2", AllocatedAt: at(2 * time.Hour), ReleasedAt: at(3 * time.Hour)},
+		{Prefix: p1, AllocatedAt: at(3 * time.Hour)},
+	}, cmpPrefix)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// AllocationHook is called with an allocation, and the metadata attached to
+// it, when it's made or released. See OnAllocate and OnDeallocate.
+type AllocationHook func(alloc Allocation, m AllocationMeta)
+
+// OnAllocate registers h, such that it's called for every allocation made
+// through the allocator, e.g. to program routes or firewall rules. Hooks are
+// called once the change was applied and persisted, in the goroutine that
+// made it, so they shouldn't block. They can call the allocator back. When the
+// change is made through a helper sharing a lock with other users of the
+// allocator, e.g. Server, RPCServer, Reaper or PoolReloader, hooks are called
+// once the helper released it, so they can go through the same helpers.
+// Allocations made by other allocators sharing the same store aren't
+// reported.
+func (a *Allocator) OnAllocate(h AllocationHook) {
+	a.allocateHooks = append(a.allocateHooks, h)
+}
+
+// OnDeallocate is the same as OnAllocate, but h is called for every
+// allocation released, whatever the reason: Deallocate, expired leases,
+// Reset, etc.
+func (a *Allocator) OnDeallocate(h AllocationHook) {
+	a.deallocateHooks = append(a.deallocateHooks, h)
+}
+
+// change is an allocation made or released by the ongoing operation, which
+// hooks and watchers are told about once it succeeds.
+type change struct {
+	prefix   netip.Prefix
+	released bool
+	// meta is only recorded for released prefixes, as the metadata of
+	// new allocations is attached after they're inserted.
+	meta AllocationMeta
+	// op is the request that made the change, for the audit trail.
+	op auditOp
+}
+
+// recordChange records that p was allocated, or released along with meta. The
+// change itself is only kept if anybody is listening, or if it's audited.
+func (a *Allocator) recordChange(p netip.Prefix, released bool, meta AllocationMeta) {
+	if released {
+		a.counters.pendingDeallocations++
+	} else {
+		a.counters.pendingAllocations++
+	}
+	if len(a.allocateHooks) == 0 && len(a.deallocateHooks) == 0 && !a.watched() && !a.audit {
+		return
+	}
+	a.changes = append(a.changes, change{prefix: p, released: released, meta: meta, op: a.op})
+}
+
+// discardChanges forgets about the changes recorded by an operation that
+// failed.
+func (a *Allocator) discardChanges() {
+	a.changes = nil
+	a.counters.pendingAllocations, a.counters.pendingDeallocations = 0, 0
+}
+
+// notify counts the changes recorded since the last call, once they were
+// applied, records them in the audit trail, and tells hooks and watchers about
+// them.
+func (a *Allocator) notify() {
+	c := &a.counters
+	c.allocations += c.pendingAllocations
+	c.deallocations += c.pendingDeallocations
+	c.pendingAllocations, c.pendingDeallocations = 0, 0
+
+	changes := a.changes
+	if len(changes) == 0 {
+		return
+	}
+	// Hooks may change the allocator, recording new changes.
+	a.changes = nil
+	gen := a.generation
+	now := a.now()
+
+	if a.audit {
+		for _, c := range changes {
+			owner := c.meta.Owner
+			if !c.released {
+				owner = a.meta[c.prefix].Owner
+			}
+			a.recordAudit(c.auditAction(), c.prefix, c.op.actor, owner, nil)
+		}
+		a.flushAudit()
+	}
+
+	for _, c := range changes {
+		var pool Pool
+		if poolID, ok := a.poolIndex(c.prefix); ok {
+			pool = a.pools[poolID].clone()
+		}
+		alloc := Allocation{Prefix: c.prefix, Pool: pool}
+
+		hooks, kind := a.allocateHooks, EventAllocated
+		if c.released {
+			hooks, kind = a.deallocateHooks, EventReleased
+			if c.meta.expired(now) {
+				kind = EventExpired
+			}
+		} else {
+			c.meta, _ = a.Metadata(c.prefix)
+		}
+
+		ev := Event{Kind: kind, Allocation: alloc, Meta: c.meta, Generation: gen}
+		a.watchersMu.Lock()
+		a.watchers = slices.DeleteFunc(a.watchers, func(w *watcher) bool {
+			return !w.send(ev)
+		})
+		a.watchersMu.Unlock()
+		for _, h := range hooks {
+			if a.holdingHooks {
+				a.heldHooks = append(a.heldHooks, hookCall{h: h, alloc: alloc, meta: c.meta})
+				continue
+			}
+			h(alloc, c.meta)
+		}
+	}
+}
+
+// hookCall is a call to a hook held back until the lock shared by the users of
+// the allocator is released, see withLock.
+type hookCall struct {
+	h     AllocationHook
+	alloc Allocation
+	meta  AllocationMeta
+}
+
+// withLock runs fn with mu held. The hooks called by the changes fn makes are
+// only called once mu is released, so they don't run under a lock the
+// allocator doesn't know about, and can take it in turn.
+func withLock(a *Allocator, mu sync.Locker, fn func()) {
+	var calls []hookCall
+	func() {
+		mu.Lock()
+		defer mu.Unlock()
+		a.holdingHooks = true
+		defer func() {
+			calls, a.heldHooks = a.heldHooks, nil
+			a.holdingHooks = false
+		}()
+		fn()
+	}()
+	for _, c := range calls {
+		c.h(c.alloc, c.meta)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHooks(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := &memStore{}
+	pools := []Pool{{Name: "default", Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithStore(s))
+	a.now = clock.now
+
+	var events []string
+	a.OnAllocate(func(alloc Allocation, m AllocationMeta) {
+		events = append(events, fmt.Sprintf("allocate %s from %q owner=%q", alloc.Prefix, alloc.Pool.Name, m.Owner))
+	})
+	a.OnDeallocate(func(alloc Allocation, m AllocationMeta) {
+		events = append(events, fmt.Sprintf("deallocate %s from %q owner=%q", alloc.Prefix, alloc.Pool.Name, m.Owner))
+	})
+
+	p1, err := a.Allocate()
+	assert.NilError(t, err)
+	_, err = a.Allocate(WithOwner("c1"), WithTTL(time.Minute))
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")))
+	assert.NilError(t, a.Deallocate(p1))
+
+	// Failed changes aren't reported.
+	s.fail = true
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, errStore)
+	_, err = a.AllocateN(2)
+	assert.ErrorIs(t, err, errStore)
+	s.fail = false
+
+	clock.t = clock.t.Add(time.Hour)
+	_, err = a.ReclaimExpired()
+	assert.NilError(t, err)
+	assert.NilError(t, a.Reset())
+
+	assert.DeepEqual(t, events, []string{
+		`allocate 10.0.0.0/24 from "default" owner=""`,
+		`allocate 10.0.1.0/24 from "default" owner="c1"`,
+		`allocate 192.168.0.0/24 from "" owner=""`,
+		`deallocate 10.0.0.0/24 from "default" owner=""`,
+		`deallocate 10.0.1.0/24 from "default" owner="c1"`,
+		`deallocate 192.168.0.0/24 from "" owner=""`,
+	})
+}
+
+func TestHooksReentrant(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+
+	// A hook releasing what was just allocated.
+	var released []netip.Prefix
+	a.OnAllocate(func(alloc Allocation, _ AllocationMeta) {
+		assert.NilError(t, a.Deallocate(alloc.Prefix))
+	})
+	a.OnDeallocate(func(alloc Allocation, _ AllocationMeta) {
+		released = append(released, alloc.Prefix)
+	})
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, released, []netip.Prefix{p}, cmpPrefix)
+	assert.Equal(t, len(a.Allocated()), 0)
+}
+
+func TestHooksOutsideLock(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	var mu sync.Mutex
+	srv := NewServer(a, &mu)
+
+	// A hook releasing what was just allocated, through the server: it'd
+	// deadlock if it was called with the server's lock held.
+	var released []netip.Prefix
+	a.OnAllocate(func(alloc Allocation, _ AllocationMeta) {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/allocations/"+alloc.Prefix.String(), nil))
+		assert.Equal(t, rec.Code, http.StatusNoContent)
+	})
+	a.OnDeallocate(func(alloc Allocation, _ AllocationMeta) {
+		assert.Assert(t, mu.TryLock(), "hook called with the server's lock held")
+		mu.Unlock()
+		released = append(released, alloc.Prefix)
+	})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/allocations", strings.NewReader("{}")))
+	assert.Equal(t, rec.Code, http.StatusCreated)
+	assert.Equal(t, len(released), 1)
+	assert.Equal(t, len(a.Allocated()), 0)
+}
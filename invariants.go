@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// WithInvariantChecks makes the allocator check its invariants, see
+// CheckInvariants, after every allocation and deallocation, and panic if one
+// doesn't hold. It's slow, and meant for debugging and tests.
+func WithInvariantChecks(inPools bool) Option {
+	return func(a *Allocator) {
+		a.checks = true
+		a.checksInPools = inPools
+	}
+}
+
+// CheckInvariants verifies that allocated prefixes are valid, sorted and
+// don't overlap with each other, and that indexes and metadata agree with
+// them. If inPools
+// is true, it also verifies that every allocation is within a pool. It
+// returns an error describing the first broken invariant found.
+func (a *Allocator) CheckInvariants(inPools bool) error {
+	var prev netip.Prefix
+	var err error
+	n := 0
+	for i, chunk := range a.allocated.chunks {
+		if len(chunk) == 0 {
+			return fmt.Errorf("chunk %d is empty", i)
+		}
+	}
+	a.allocated.each(func(p netip.Prefix) bool {
+		n++
+		switch {
+		case !p.IsValid() || !p.Addr().Is4() || p != p.Masked():
+			err = fmt.Errorf("allocated prefix %s is invalid", p)
+		case prev.IsValid() && comparePrefix(prev, p) >= 0:
+			err = fmt.Errorf("allocated prefixes %s and %s aren't sorted", prev, p)
+		case prev.IsValid() && prev.Overlaps(p):
+			// Sorted prefixes overlapping with any later prefix overlap
+			// with the next one too.
+			err = fmt.Errorf("allocated prefixes %s and %s overlap", prev, p)
+		}
+		if _, ok := a.poolIndex(p); err == nil && inPools && !ok {
+			err = fmt.Errorf("allocated prefix %s isn't within a pool", p)
+		}
+		prev = p
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if n != a.allocated.len() {
+		return fmt.Errorf("%d prefixes are allocated, but the count is %d", n, a.allocated.len())
+	}
+	if err := a.checkMeta(); err != nil {
+		return err
+	}
+
+	if a.trie == nil {
+		return nil
+	}
+	return a.checkIndexes()
+}
+
+// checkIndexes verifies that the trie and the bitmaps agree with 'allocated'
+// and reserved prefixes.
+func (a *Allocator) checkIndexes() error {
+	if a.trie.root.count != a.allocated.len() {
+		return fmt.Errorf("trie has %d prefixes, but %d are allocated", a.trie.root.count, a.allocated.len())
+	}
+
+	var err error
+	a.allocated.each(func(p netip.Prefix) bool {
+		if got, ok := a.trie.overlapping(p); !ok || got != p {
+			err = fmt.Errorf("allocated prefix %s isn't in the trie", p)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for poolID, bm := range a.bitmaps {
+		if bm == nil {
+			continue
+		}
+		for n := 0; n < bm.n; n++ {
+			marked := bm.words[n/64]&(1<<(n%64)) != 0
+			switch used := a.inUse(bm.subnet(n)); {
+			case marked && !used:
+				return fmt.Errorf("bitmap of pool %s: subnet %s is marked as used, but it's free", a.pools[poolID].Prefix, bm.subnet(n))
+			case !marked && used:
+				return fmt.Errorf("bitmap of pool %s: subnet %s is used, but it isn't marked", a.pools[poolID].Prefix, bm.subnet(n))
+			}
+		}
+		for w := 0; w < bm.cursor; w++ {
+			if bm.words[w] != ^uint64(0) {
+				return fmt.Errorf("bitmap of pool %s: word %d is before the cursor, but isn't full", a.pools[poolID].Prefix, w)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkMeta verifies that metadata belongs to allocated prefixes, and that
+// its indexes agree with it.
+func (a *Allocator) checkMeta() error {
+	keys, names, owned := 0, 0, 0
+	for p, m := range a.meta {
+		if !a.allocated.contains(p) {
+			return fmt.Errorf("prefix %s has metadata, but isn't allocated", p)
+		}
+		if m.key != "" {
+			keys++
+			if a.keys[m.key] != p {
+				return fmt.Errorf("idempotency key %q of %s isn't indexed", m.key, p)
+			}
+		}
+		if m.Name != "" {
+			names++
+			if a.names[m.Name] != p {
+				return fmt.Errorf("name %q of %s isn't indexed", m.Name, p)
+			}
+		}
+		if m.Owner != "" {
+			owned++
+			if l := a.owners[m.Owner]; l == nil || !l.contains(p) {
+				return fmt.Errorf("owner %q of %s isn't indexed", m.Owner, p)
+			}
+		}
+	}
+	if keys != len(a.keys) || names != len(a.names) {
+		return fmt.Errorf("%d idempotency keys and %d names are indexed, but %d and %d are set", len(a.keys), len(a.names), keys, names)
+	}
+	for owner, l := range a.owners {
+		if l.len() == 0 {
+			return fmt.Errorf("owner %q is indexed, but owns nothing", owner)
+		}
+		owned -= l.len()
+	}
+	if owned != 0 {
+		return fmt.Errorf("owner index and metadata disagree by %d allocations", owned)
+	}
+	return nil
+}
+
+// mustCheckInvariants panics if invariant checks are enabled, and one of them
+// doesn't hold.
+func (a *Allocator) mustCheckInvariants() {
+	if !a.checks {
+		return
+	}
+	if err := a.CheckInvariants(a.checksInPools); err != nil {
+		panic("subnet allocator: " + err.Error())
+	}
+}
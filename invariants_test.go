@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	pools := []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	}
+
+	testcases := []struct {
+		name    string
+		corrupt func(a *Allocator)
+		inPools bool
+		expErr  string
+	}{
+		{
+			name:    "consistent",
+			corrupt: func(a *Allocator) {},
+			inPools: true,
+		},
+		{
+			name: "unsorted",
+			corrupt: func(a *Allocator) {
+				c := a.allocated.chunks[0]
+				c[0], c[1] = c[1], c[0]
+			},
+			expErr: "allocated prefixes 192.168.1.0/24 and 192.168.0.0/24 aren't sorted",
+		},
+		{
+			name: "overlapping",
+			corrupt: func(a *Allocator) {
+				a.allocated.insert(netip.MustParsePrefix("192.168.0.0/23"))
+			},
+			expErr: "allocated prefixes 192.168.0.0/23 and 192.168.0.0/24 overlap",
+		},
+		{
+			name: "unmasked",
+			corrupt: func(a *Allocator) {
+				a.allocated.insert(netip.MustParsePrefix("192.168.9.1/24"))
+			},
+			expErr: "allocated prefix 192.168.9.1/24 is invalid",
+		},
+		{
+			name: "outside of pools",
+			corrupt: func(a *Allocator) {
+				a.insert(netip.MustParsePrefix("10.0.0.0/8"))
+			},
+			inPools: true,
+			expErr:  "allocated prefix 10.0.0.0/8 isn't within a pool",
+		},
+		{
+			name: "missing from the trie",
+			corrupt: func(a *Allocator) {
+				a.trie.remove(netip.MustParsePrefix("192.168.1.0/24"))
+			},
+			expErr: "trie has 1 prefixes, but 2 are allocated",
+		},
+		{
+			name: "stale bitmap",
+			corrupt: func(a *Allocator) {
+				a.allocated.remove(netip.MustParsePrefix("192.168.1.0/24"))
+				a.trie.remove(netip.MustParsePrefix("192.168.1.0/24"))
+			},
+			expErr: "bitmap of pool 192.168.0.0/16: subnet 192.168.1.0/24 is marked as used, but it's free",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, pools)
+			_, err := a.AllocateN(2)
+			assert.NilError(t, err)
+
+			tc.corrupt(a)
+			err = a.CheckInvariants(tc.inPools)
+			if tc.expErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Error(t, err, tc.expErr)
+		})
+	}
+}
+
+func TestWithInvariantChecks(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	}, WithInvariantChecks(true))
+
+	_, err := a.AllocateN(3)
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("192.168.1.0/24")))
+
+	assert.Assert(t, func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/8"))
+		return false
+	}())
+}
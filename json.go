@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// stateVersion is the version of the format written by MarshalJSON.
+const stateVersion = 1
+
+// state is the JSON representation of an allocator.
+type state struct {
+	Version     int               `json:"version"`
+	Pools       []poolState       `json:"pools"`
+	Allocations []allocationState `json:"allocations"`
+	Reserved    []netip.Prefix    `json:"reserved,omitempty"`
+	Tombstones  []netip.Prefix    `json:"tombstones,omitempty"`
+}
+
+type poolState struct {
+	Name          string            `json:"name,omitempty"`
+	Prefix        netip.Prefix      `json:"prefix"`
+	Size          int               `json:"size"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Metadata      map[string]any    `json:"metadata,omitempty"`
+	Overflow      bool              `json:"overflow,omitempty"`
+	StaticReserve int               `json:"static_reserve,omitempty"`
+	SizeClasses   []sizeClassState  `json:"size_classes,omitempty"`
+}
+
+type sizeClassState struct {
+	Size  int `json:"size"`
+	Quota int `json:"quota,omitempty"`
+}
+
+// allocationState is an object rather than a bare prefix, such that
+// per-allocation data can be added without breaking the format.
+type allocationState struct {
+	Prefix netip.Prefix      `json:"prefix"`
+	Name   string            `json:"name,omitempty"`
+	Owner  string            `json:"owner,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Expires is a pointer, such that allocations that never expire omit
+	// it.
+	Expires *time.Time `json:"expires,omitempty"`
+	Pinned  bool       `json:"pinned,omitempty"`
+}
+
+// MarshalJSON encodes the pools, the allocated prefixes along with their
+// metadata, the prefixes reserved with AddReserved, and tombstones. Options,
+// permanent reservations and host routes are part of the configuration, not
+// the state, so they aren't encoded.
+func (a *Allocator) MarshalJSON() ([]byte, error) {
+	return marshalSnapshot(a.Snapshot())
+}
+
+// UnmarshalJSON replaces the pools, allocations and reservations of the
+// allocator with those encoded by MarshalJSON. Options the allocator was
+// created with are kept. The decoded state is validated like it would be by
+// NewAllocator, Restore and AddReserved; if it's invalid, an error is returned
+// and the allocator is left untouched.
+func (a *Allocator) UnmarshalJSON(data []byte) error {
+	s, err := unmarshalSnapshot(data)
+	if err != nil {
+		return err
+	}
+	return a.replaceState(s)
+}
+
+// marshalSnapshot encodes s to JSON.
+func marshalSnapshot(s Snapshot) ([]byte, error) {
+	st := state{
+		Version:     stateVersion,
+		Pools:       make([]poolState, 0, len(s.Pools)),
+		Allocations: make([]allocationState, 0, len(s.Allocated)),
+		Reserved:    s.Reserved,
+		Tombstones:  s.Tombstones,
+	}
+	for _, p := range s.Pools {
+		st.Pools = append(st.Pools, newPoolState(p))
+	}
+	for _, p := range s.Allocated {
+		st.Allocations = append(st.Allocations, newAllocationState(p, s.Meta[p]))
+	}
+
+	return json.Marshal(st)
+}
+
+// newPoolState returns the JSON representation of p.
+func newPoolState(p Pool) poolState {
+	ps := poolState{
+		Name:          p.Name,
+		Prefix:        p.Prefix,
+		Size:          p.Size,
+		Labels:        p.Labels,
+		Metadata:      p.Metadata,
+		Overflow:      p.Overflow,
+		StaticReserve: p.StaticReserve,
+	}
+	for _, c := range p.SizeClasses {
+		ps.SizeClasses = append(ps.SizeClasses, sizeClassState(c))
+	}
+	return ps
+}
+
+// pool returns the pool ps represents.
+func (ps poolState) pool() Pool {
+	p := Pool{
+		Name:          ps.Name,
+		Prefix:        ps.Prefix,
+		Size:          ps.Size,
+		Labels:        ps.Labels,
+		Metadata:      ps.Metadata,
+		Overflow:      ps.Overflow,
+		StaticReserve: ps.StaticReserve,
+	}
+	for _, c := range ps.SizeClasses {
+		p.SizeClasses = append(p.SizeClasses, SizeClass(c))
+	}
+	return p
+}
+
+// newAllocationState returns the JSON representation of the allocation of p.
+func newAllocationState(p netip.Prefix, m AllocationMeta) allocationState {
+	as := allocationState{Prefix: p, Name: m.Name, Owner: m.Owner, Labels: m.Labels, Pinned: m.Pinned}
+	if !m.Expires.IsZero() {
+		as.Expires = &m.Expires
+	}
+	return as
+}
+
+// unmarshalSnapshot decodes a snapshot encoded by marshalSnapshot. The
+// snapshot isn't validated.
+func unmarshalSnapshot(data []byte) (Snapshot, error) {
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return Snapshot{}, err
+	}
+	if st.Version > stateVersion {
+		return Snapshot{}, fmt.Errorf("unsupported state version %d", st.Version)
+	}
+
+	s := Snapshot{Reserved: st.Reserved, Tombstones: st.Tombstones}
+	for _, ps := range st.Pools {
+		s.Pools = append(s.Pools, ps.pool())
+	}
+	for _, as := range st.Allocations {
+		s.Allocated = append(s.Allocated, as.Prefix)
+		m := AllocationMeta{Name: as.Name, Owner: as.Owner, Labels: as.Labels, Pinned: as.Pinned}
+		if as.Expires != nil {
+			m.Expires = *as.Expires
+		}
+		if !m.isZero() {
+			if s.Meta == nil {
+				s.Meta = map[netip.Prefix]AllocationMeta{}
+			}
+			s.Meta[as.Prefix] = m
+		}
+	}
+
+	return s, nil
+}
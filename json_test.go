@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{
+			Name:          "default",
+			Prefix:        netip.MustParsePrefix("10.0.0.0/16"),
+			Size:          24,
+			Labels:        map[string]string{"env": "prod"},
+			Metadata:      map[string]any{"owner": "netops"},
+			StaticReserve: 50,
+			SizeClasses:   []SizeClass{{Size: 26, Quota: 4}},
+		},
+		{Prefix: netip.MustParsePrefix("192.168.0.0/24"), Size: 28, Overflow: true},
+	})
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("172.16.0.0/12")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.1.0/24")))
+	_, err = a.AllocateNamed("net1")
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.100.0/24"), WithOwner("tenant1"), WithLabels(map[string]string{"env": "prod"}), WithTTL(time.Hour)))
+
+	data, err := json.Marshal(a)
+	assert.NilError(t, err)
+
+	b := mustNewAllocator(t, nil)
+	assert.NilError(t, json.Unmarshal(data, b))
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+
+	// Reservations are still honored after a restore.
+	p, err := b.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.3.0/24"))
+}
+
+func TestUnmarshalJSONInvalid(t *testing.T) {
+	testcases := []struct {
+		name   string
+		data   string
+		expErr string
+	}{
+		{
+			name:   "unknown version",
+			data:   `{"version": 2}`,
+			expErr: "unsupported state version 2",
+		},
+		{
+			name:   "overlapping pools",
+			data:   `{"pools": [{"prefix": "10.0.0.0/8", "size": 24}, {"prefix": "10.1.0.0/16", "size": 24}]}`,
+			expErr: "pool 10.1.0.0/16 overlaps with pool 10.0.0.0/8",
+		},
+		{
+			name:   "overlapping allocations",
+			data:   `{"allocations": [{"prefix": "10.0.0.0/24"}, {"prefix": "10.0.0.0/16"}]}`,
+			expErr: "prefixes 10.0.0.0/16 and 10.0.0.0/24 overlap",
+		},
+		{
+			name:   "unmasked allocation",
+			data:   `{"allocations": [{"prefix": "10.0.0.1/24"}]}`,
+			expErr: "invalid prefix 10.0.0.1/24",
+		},
+		{
+			name:   "duplicate reservation",
+			data:   `{"reserved": ["10.0.0.0/24", "10.0.0.0/24"]}`,
+			expErr: "prefix 10.0.0.0/24 is already reserved",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24}})
+			_, err := a.Allocate()
+			assert.NilError(t, err)
+
+			err = json.Unmarshal([]byte(tc.data), a)
+			assert.Error(t, err, tc.expErr)
+
+			// The allocator is left untouched.
+			assert.Equal(t, len(a.Pools()), 1)
+			assert.DeepEqual(t, a.Allocated(), []netip.Prefix{netip.MustParsePrefix("192.168.0.0/24")}, cmpPrefix)
+		})
+	}
+}
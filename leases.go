@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ReclaimExpired releases the allocations whose lease expired, see WithTTL,
+// all at once. It returns the released prefixes, sorted. Pinned allocations
+// are skipped, see WithPinned.
+func (a *Allocator) ReclaimExpired() ([]netip.Prefix, error) {
+	now := a.now()
+	var expired []netip.Prefix
+	for p, m := range a.meta {
+		if m.expired(now) && !m.Pinned {
+			expired = append(expired, p)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	slices.SortFunc(expired, comparePrefix)
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+	err := a.persist(func() error {
+		for _, p := range expired {
+			a.release(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// Renew extends the lease on the allocated prefix p, such that it expires ttl
+// from now. Allocations that never expired can be turned into leases that
+// way. A zero or negative TTL makes the allocation never expire. An expired
+// lease can be renewed as long as it wasn't reclaimed.
+func (a *Allocator) Renew(p netip.Prefix, ttl time.Duration) error {
+	if !a.allocated.contains(p) {
+		return fmt.Errorf("prefix %s is %w", p, ErrNotAllocated)
+	}
+
+	m := a.meta[p]
+	m.Expires = time.Time{}
+	if ttl > 0 {
+		m.Expires = a.now().Add(ttl)
+	}
+	return a.persist(func() error {
+		if m.AllocationMeta.isZero() && m.key == "" {
+			a.forget(p)
+		} else {
+			a.setMeta(p, m)
+		}
+		return nil
+	})
+}
+
+// TimeToExpiry returns how long is left before the lease on the allocated
+// prefix p expires, or 0 if it already expired. ok is false if p isn't
+// allocated, or never expires.
+func (a *Allocator) TimeToExpiry(p netip.Prefix) (d time.Duration, ok bool) {
+	m, ok := a.meta[p]
+	if !ok || m.Expires.IsZero() {
+		return 0, false
+	}
+	return max(m.Expires.Sub(a.now()), 0), true
+}
+
+// Reaper reclaims expired leases in the background, see ReclaimExpired.
+//
+// The allocator isn't safe for concurrent use, so the reaper holds mu while
+// it uses it. Everything else using the allocator while the reaper runs must
+// hold mu too.
+type Reaper struct {
+	a         *Allocator
+	mu        sync.Locker
+	interval  time.Duration
+	onReclaim func(netip.Prefix)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReaper returns a Reaper reclaiming the expired leases of a every
+// interval, once started. onReclaim, if not nil, is called with every
+// reclaimed prefix, without holding mu.
+func NewReaper(a *Allocator, mu sync.Locker, interval time.Duration, onReclaim func(netip.Prefix)) *Reaper {
+	return &Reaper{a: a, mu: mu, interval: interval, onReclaim: onReclaim}
+}
+
+// Start reclaims expired leases in the background until ctx is done, Close
+// is called, or the allocator is closed. Errors, e.g. from the store, are ignored: leases that couldn't be
+// reclaimed are tried again on the next round.
+func (r *Reaper) Start(ctx context.Context) error {
+	if r.done != nil {
+		return errors.New("reaper is already running")
+	}
+	if r.interval <= 0 {
+		return fmt.Errorf("invalid reaper interval %s", r.interval)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.a.Done():
+				return
+			case <-ticker.C:
+			}
+			r.reap()
+		}
+	}()
+
+	return nil
+}
+
+// reap runs a single round.
+func (r *Reaper) reap() {
+	var (
+		reclaimed []netip.Prefix
+		err       error
+	)
+	withLock(r.a, r.mu, func() {
+		reclaimed, err = r.a.ReclaimExpired()
+	})
+	if err != nil || r.onReclaim == nil {
+		return
+	}
+	for _, p := range reclaimed {
+		r.onReclaim(p)
+	}
+}
+
+// Close stops the reaper, and waits for the round in progress, if any.
+func (r *Reaper) Close() error {
+	if r.done == nil {
+		return nil
+	}
+
+	r.cancel()
+	<-r.done
+	r.cancel, r.done = nil, nil
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// fakeClock is a clock tests move forward by hand.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestReclaimExpired(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+	a.now = clock.now
+
+	p1, err := a.Allocate(WithTTL(time.Minute))
+	assert.NilError(t, err)
+	p2, err := a.Allocate(WithTTL(time.Hour), WithOwner("ci"))
+	assert.NilError(t, err)
+	p3, err := a.Allocate()
+	assert.NilError(t, err)
+	p4 := netip.MustParsePrefix("192.168.0.0/24")
+	assert.NilError(t, a.AllocateStatic(p4, WithTTL(time.Minute)))
+
+	m, _ := a.Metadata(p1)
+	assert.Equal(t, m.Expires, clock.t.Add(time.Minute))
+	m, _ = a.Metadata(p3)
+	assert.Check(t, m.Expires.IsZero())
+
+	// Nothing expired yet.
+	released, err := a.ReclaimExpired()
+	assert.NilError(t, err)
+	assert.Equal(t, len(released), 0)
+
+	// Leases expire once their TTL elapsed, but stay allocated until
+	// they're reclaimed.
+	clock.t = clock.t.Add(time.Minute)
+	assert.Check(t, a.IsAllocated(p1))
+	released, err = a.ReclaimExpired()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, released, []netip.Prefix{p1, p4}, cmpPrefix)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p2, p3}, cmpPrefix)
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+
+	// Expiry times are persisted.
+	b := mustNewAllocator(t, nil, WithStore(s))
+	b.now = clock.now
+	clock.t = clock.t.Add(time.Hour)
+	released, err = b.ReclaimExpired()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, released, []netip.Prefix{p2}, cmpPrefix)
+	assert.Equal(t, len(b.LookupByOwner("ci")), 0)
+	assert.NilError(t, b.CheckInvariants(true))
+}
+
+func TestRenew(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+	a.now = clock.now
+
+	p1, err := a.Allocate(WithTTL(time.Minute), WithOwner("ci"))
+	assert.NilError(t, err)
+	p2, err := a.Allocate()
+	assert.NilError(t, err)
+
+	d, ok := a.TimeToExpiry(p1)
+	assert.Check(t, ok)
+	assert.Equal(t, d, time.Minute)
+	_, ok = a.TimeToExpiry(p2)
+	assert.Check(t, !ok)
+
+	// Expired leases can be renewed until they're reclaimed.
+	clock.t = clock.t.Add(2 * time.Minute)
+	d, ok = a.TimeToExpiry(p1)
+	assert.Check(t, ok)
+	assert.Equal(t, d, time.Duration(0))
+	assert.NilError(t, a.Renew(p1, time.Hour))
+	d, _ = a.TimeToExpiry(p1)
+	assert.Equal(t, d, time.Hour)
+
+	// Other metadata is kept.
+	m, _ := a.Metadata(p1)
+	assert.Equal(t, m.Owner, "ci")
+
+	// Allocations can be turned into leases and back.
+	assert.NilError(t, a.Renew(p2, time.Minute))
+	assert.NilError(t, a.Renew(p1, 0))
+	_, ok = a.TimeToExpiry(p1)
+	assert.Check(t, !ok)
+
+	clock.t = clock.t.Add(time.Minute)
+	released, err := a.ReclaimExpired()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, released, []netip.Prefix{p2}, cmpPrefix)
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+
+	assert.ErrorIs(t, a.Renew(p2, time.Minute), ErrNotAllocated)
+	assert.NilError(t, a.CheckInvariants(true))
+}
+
+func TestReaper(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	a.now = clock.now
+	p1, err := a.Allocate(WithTTL(time.Minute))
+	assert.NilError(t, err)
+	p2, err := a.Allocate()
+	assert.NilError(t, err)
+
+	var mu sync.Mutex
+	reclaimed := make(chan netip.Prefix, 1)
+	r := NewReaper(a, &mu, time.Millisecond, func(p netip.Prefix) { reclaimed <- p })
+	assert.NilError(t, r.Start(context.Background()))
+	defer r.Close()
+	assert.Error(t, r.Start(context.Background()), "reaper is already running")
+
+	mu.Lock()
+	clock.t = clock.t.Add(time.Minute)
+	mu.Unlock()
+
+	select {
+	case p := <-reclaimed:
+		assert.Equal(t, p, p1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired lease wasn't reclaimed")
+	}
+	assert.NilError(t, r.Close())
+	assert.NilError(t, r.Close())
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p2}, cmpPrefix)
+
+	// The reaper stops once its context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	r = NewReaper(a, &mu, time.Millisecond, nil)
+	assert.NilError(t, r.Start(ctx))
+	cancel()
+	assert.NilError(t, r.Close())
+
+	r = NewReaper(a, &mu, 0, nil)
+	assert.Error(t, r.Start(context.Background()), "invalid reaper interval 0s")
+}
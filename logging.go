@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// levelTrace is the level of the most verbose logs, such as those explaining
+// why each pool was skipped.
+const levelTrace = slog.LevelDebug - 4
+
+// WithLogger makes the allocator log to l how it picks subnets: pools being
+// skipped or exhausted, hints that can't be honored, and the chosen
+// candidates. Logs are emitted at the debug level, and below it for the most
+// verbose ones.
+func WithLogger(l *slog.Logger) Option {
+	return func(a *Allocator) {
+		a.logger = l
+	}
+}
+
+// trace logs msg at levelTrace. Callers check that a.logger is set first,
+// such that args aren't built for nothing.
+func (a *Allocator) trace(msg string, args ...any) {
+	a.logger.Log(context.Background(), levelTrace, msg, args...)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: levelTrace,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24, Labels: map[string]string{"zone": "a"}},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/23"), Size: 24},
+	}, WithLogger(logger))
+
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+	_, err = a.Allocate(WithHint(netip.MustParsePrefix("10.0.0.0/25")))
+	assert.NilError(t, err)
+	_, err = a.Allocate(WithSelector("zone=a"))
+	assert.ErrorIs(t, err, ErrNoFreePool)
+
+	assert.DeepEqual(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), []string{
+		`level=DEBUG msg="picked subnet" subnet=10.0.0.0/24 pool=10.0.0.0/24 scanned_pools=1 scanned_entries=0`,
+		`level=DEBUG msg="hint can't be allocated" hint=10.0.0.0/25`,
+		`level=DEBUG-4 msg="pool is full, moving to the next one" pool=10.0.0.0/24 size=24`,
+		`level=DEBUG msg="picked subnet" subnet=10.1.0.0/24 pool=10.1.0.0/23 scanned_pools=2 scanned_entries=0`,
+		`level=DEBUG-4 msg="pool is full, moving to the next one" pool=10.0.0.0/24 size=24`,
+		`level=DEBUG-4 msg="skipping pool not matching the request" pool=10.1.0.0/23`,
+		`level=DEBUG msg="no free subnet" error="no free address pools: pool 10.0.0.0/24 has 1 allocations, 0 of 1 subnets free, 0 reserved"`,
+	})
+}
@@ -3,173 +3,1192 @@ package main
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
 	"net/netip"
 	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNoFreePool = errors.New("no free address pools")
 
 type Allocator struct {
 	pools     []Pool
-	allocated []netip.Prefix
+	allocated prefixList
+	// trie and bitmaps index 'allocated'. They're lazily built on first use.
+	trie *prefixTrie
+	// bitmaps has one entry per pool, nil when the pool has too many subnets
+	// to get a bitmap.
+	bitmaps []*poolBitmap
+	// permanent lists prefixes that are never handed out by Allocate, and
+	// reserved indexes them. Reserved prefixes can still be allocated
+	// statically.
+	permanent []netip.Prefix
+	reserved  *prefixTrie
+	// reservedSet holds the prefixes reserved with AddReserved. They're
+	// indexed by 'reserved' too.
+	reservedSet prefixList
+	// tombstones holds released prefixes that can't be allocated again
+	// until they're purged, see WithTombstone.
+	tombstones prefixList
+	providers  []ReservedProvider
+	// routes are the host routes found by ReserveHostRoutes. They can be
+	// refreshed in the background, see Start.
+	routes atomic.Pointer[[]netip.Prefix]
+	// stop and done are set while the background refresh is running.
+	stop chan struct{}
+	done chan struct{}
+	// closed is set by Close, after which changes are rejected. closing is
+	// closed along, see Done.
+	closed  bool
+	closing chan struct{}
+	// readOnly is set while changes are rejected, see SetReadOnly.
+	readOnly bool
+
+	mergePools bool
+	// checks enables invariant checks after every change, see
+	// WithInvariantChecks.
+	checks        bool
+	checksInPools bool
+	// store, if set, persists every change. See WithStore.
+	store Store
+	// hostSeed is the hash of the host ID, 0 if there's none. See
+	// WithHostID.
+	hostSeed uint64
+	// generation is incremented on every change, see Generation.
+	generation uint64
+	// meta holds what's known about allocations besides their prefix.
+	// Allocations without any metadata have no entry. keys, names and
+	// owners index it by idempotency key, by name and by owner.
+	meta   map[netip.Prefix]allocMeta
+	keys   map[string]netip.Prefix
+	names  map[string]netip.Prefix
+	owners map[string]*prefixList
+	// ownerQuotas limits what each owner can hold, see WithOwnerQuota.
+	ownerQuotas map[string]OwnerQuota
+	// quarantine is how long released subnets are kept away from
+	// Allocate, see WithQuarantine, and reuse tells which free subnet it
+	// picks first, see WithReusePolicy. freed holds when free subnets were
+	// released, for those either needs.
+	quarantine time.Duration
+	reuse      ReusePolicy
+	freed      map[netip.Prefix]time.Time
+	// freedPruneAt is the size freed has to reach before it's pruned, see
+	// markFreed.
+	freedPruneAt int
+	// history records the last historySize allocations, see WithHistory.
+	history     []HistoryEntry
+	historySize int
+	// undo holds the last undoSize changes Undo can revert, the most recent
+	// last.
+	undo     []undoEntry
+	undoSize int
+	// changes are the allocations made and released by the ongoing
+	// operation, which hooks and watchers are told about once it succeeds.
+	// See OnAllocate, OnDeallocate and Watch.
+	changes         []change
+	allocateHooks   []AllocationHook
+	deallocateHooks []AllocationHook
+	// holdingHooks tells whether hook calls are held back in heldHooks until
+	// the caller releases its lock, see withLock.
+	holdingHooks bool
+	heldHooks    []hookCall
+	// watchers are the channels returned by Watch. They're removed once the
+	// context passed to Watch is done, from another goroutine, hence
+	// watchersMu.
+	watchersMu sync.Mutex
+	watchers   []*watcher
+	// admission and validator, if set, gate allocations, see
+	// WithAdmissionPolicy and WithValidator.
+	admission AdmissionPolicy
+	validator Validator
+	// logger, if set, explains allocation decisions, see WithLogger.
+	logger *slog.Logger
+	// audit tells whether requests are recorded in the audit trail, and
+	// pendingAudit holds the entries not appended to the store yet. op is
+	// the request in progress. See WithAudit.
+	audit        bool
+	pendingAudit []AuditEntry
+	op           auditOp
+	// reloadErr is why the state couldn't be reloaded from the store after
+	// a conflict, until it's reloaded successfully.
+	reloadErr error
+	// counters count what the allocator did, see Counters.
+	counters counters
+	// scan is what pick walked through since the ongoing allocation
+	// started, and lastScan what the last successful one did, see LastScan.
+	scan, lastScan ScanCost
+	// now tells the time leases expire against. It's time.Now, unless
+	// tests replace it.
+	now func() time.Time
 }
 
 type Pool struct {
+	Name   string
 	Prefix netip.Prefix
 	Size   int
+	Labels map[string]string
+	// Metadata is arbitrary data attached to the pool. The allocator doesn't
+	// use it, but carries it along.
+	Metadata map[string]any
+	// Overflow pools are only used once all other pools are exhausted.
+	Overflow bool
+	// StaticReserve is the percentage of the pool, taken from its end, that
+	// Allocate never hands out. It's left for AllocateStatic.
+	StaticReserve int
+	// SizeClasses lists subnet sizes the pool hands out, besides Size, and
+	// how many of them. Subnets of other sizes can only be allocated
+	// statically.
+	SizeClasses []SizeClass
+}
+
+// SizeClass is a subnet size, along with the maximum number of subnets of that
+// size a pool hands out. A zero Quota means there's no limit.
+type SizeClass struct {
+	Size  int
+	Quota int
+}
+
+// Allocation is an allocated prefix, along with the pool it comes from. Pool
+// is the zero value for prefixes allocated outside of any pool.
+type Allocation struct {
+	Prefix netip.Prefix
+	Pool   Pool
 }
 
-func NewAllocator(pools []Pool) *Allocator {
-	for i, p := range pools {
-		pools[i].Prefix = p.Prefix.Masked()
+// Option configures an Allocator when it's created.
+type Option func(*Allocator)
+
+// WithMergedPools makes NewAllocator merge overlapping pools instead of
+// rejecting them. When a pool contains another one, the bigger pool wins and
+// the smaller one is dropped.
+func WithMergedPools() Option {
+	return func(a *Allocator) {
+		a.mergePools = true
 	}
+}
 
-	slices.SortFunc(pools, func(a, b Pool) int {
-		addr := a.Prefix.Addr().Compare(b.Prefix.Addr())
-		if addr < 0 || addr > 0 {
-			return addr
+// WithHostID makes Allocate start looking for free subnets at an offset
+// derived from a hash of id, instead of the start of pools, and wrap around.
+// Hosts drawing from the same pools without sharing their state, each with its
+// own ID, e.g. its hostname or machine ID, then rarely pick the same subnets.
+// The offset is the same across restarts, as long as the ID and the pools
+// don't change.
+func WithHostID(id string) Option {
+	return func(a *Allocator) {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		a.hostSeed = h.Sum64()
+	}
+}
+
+// NewAllocator returns an allocator handing out subnets from pools. Pools
+// must be valid, and can't overlap with each other unless WithMergedPools is
+// used.
+func NewAllocator(pools []Pool, opts ...Option) (*Allocator, error) {
+	a := &Allocator{now: time.Now, closing: make(chan struct{})}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	pools = normalizePools(pools)
+	if a.mergePools {
+		pools = mergePools(pools)
+	}
+	if err := validatePools(pools); err != nil {
+		return nil, err
+	}
+	a.pools = pools
+	for owner, q := range a.ownerQuotas {
+		if err := validateOwnerQuota(owner, q); err != nil {
+			return nil, err
 		}
+	}
+
+	if err := a.checkAudit(); err != nil {
+		return nil, err
+	}
 
-		if a.Prefix.Bits() < b.Prefix.Bits() {
-			return -1
-		} else if a.Prefix.Bits() > b.Prefix.Bits() {
-			return 1
+	if a.store != nil {
+		if err := a.load(); err != nil {
+			return nil, err
 		}
-		return 0
-	})
+	}
+
+	return a, nil
+}
+
+// clone returns a copy of p that doesn't share its maps.
+func (p Pool) clone() Pool {
+	p.Labels = maps.Clone(p.Labels)
+	p.Metadata = maps.Clone(p.Metadata)
+	p.SizeClasses = slices.Clone(p.SizeClasses)
+	return p
+}
+
+// Pools returns the pools of the allocator, sorted by prefix.
+func (a *Allocator) Pools() []Pool {
+	pools := make([]Pool, len(a.pools))
+	for i, p := range a.pools {
+		pools[i] = p.clone()
+	}
+	return pools
+}
 
-	return &Allocator{
-		pools:     pools,
-		allocated: []netip.Prefix{},
+// Pool returns the pool named name.
+func (a *Allocator) Pool(name string) (Pool, bool) {
+	for _, p := range a.pools {
+		if p.Name == name {
+			return p.clone(), true
+		}
 	}
+	return Pool{}, false
 }
 
-func (a *Allocator) Allocate() (netip.Prefix, error) {
-	var i, poolID int
-	var partialOverlap bool
+type AllocateOption func(*allocateOptions)
+
+type allocateOptions struct {
+	hint     netip.Prefix
+	reverse  bool
+	align    int
+	selector string
+	size     int
+	reserved []netip.Prefix
+	key      string
+	owner    string
+	labels   map[string]string
+	ttl      time.Duration
+	pinned   bool
+	actor    string
+	// pools restricts allocations to the pools of these names, see
+	// WithPools.
+	pools []string
+	// pool restricts allocations to the pool of that name. It's set when
+	// the admission policy redirects an allocation.
+	pool string
+}
 
-	nextPrefixAfter := func(prev, p netip.Prefix, targetSz int) netip.Prefix {
-		// TOOD: is there a simpler way? This code looks silly.
-		next := nextPrefix(netip.PrefixFrom(prev.Addr(), targetSz).Masked())
+// WithHint makes Allocate try to allocate p first, if it's within a pool
+// handing out subnets of that size. If p isn't available, Allocate picks the
+// next free subnet as usual.
+func WithHint(p netip.Prefix) AllocateOption {
+	return func(o *allocateOptions) {
+		o.hint = p
+	}
+}
 
-		if p.Overlaps(next) {
-			return next
+// WithReverse makes Allocate pick the highest free subnet instead of the
+// lowest one, starting from the last pool.
+func WithReverse() AllocateOption {
+	return func(o *allocateOptions) {
+		o.reverse = true
+	}
+}
+
+// WithAlignment makes Allocate pick a subnet starting on a /bits boundary, such
+// that it can later be grown up to a /bits. It has no effect if bits is
+// greater than the size of subnets.
+func WithAlignment(bits int) AllocateOption {
+	return func(o *allocateOptions) {
+		o.align = bits
+	}
+}
+
+// WithSelector restricts Allocate to pools whose labels match s, a
+// comma-separated list of key=value or key!=value requirements.
+func WithSelector(s string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.selector = s
+	}
+}
+
+// WithPools restricts Allocate to the pools of the given names.
+func WithPools(names ...string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.pools = names
+	}
+}
+
+// WithSize makes Allocate pick a subnet of the given size, from a pool that
+// has a SizeClass for it. By default, subnets are of the Size of their pool.
+func WithSize(bits int) AllocateOption {
+	return func(o *allocateOptions) {
+		o.size = bits
+	}
+}
+
+// WithReserved makes Allocate avoid the given prefixes, on top of the
+// reserved set of the allocator. They don't need to be sorted, and may
+// overlap with each other.
+func WithReserved(prefixes ...netip.Prefix) AllocateOption {
+	return func(o *allocateOptions) {
+		o.reserved = prefixes
+	}
+}
+
+// WithIdempotencyKey makes Allocate return the subnet it previously allocated
+// with the same key, as long as it's still allocated, instead of allocating a
+// new one. Clients retrying a request that timed out can pass the ID of the
+// request, such that the subnet allocated by the first attempt doesn't leak.
+// AllocateStatic likewise succeeds if the prefix was allocated with the same
+// key. Keys are forgotten when their subnet is deallocated, and aren't
+// persisted.
+func WithIdempotencyKey(key string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.key = key
+	}
+}
+
+// WithOwner records owner, e.g. a container ID, a tenant or a service, as the
+// owner of the allocated subnet. It's persisted along with the allocation, see
+// Metadata.
+func WithOwner(owner string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.owner = owner
+	}
+}
+
+// WithLabels attaches labels to the allocated subnet. They're persisted along
+// with the allocation, and allocations can be listed by label, see
+// ListAllocations.
+func WithLabels(labels map[string]string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.labels = maps.Clone(labels)
+	}
+}
+
+// WithTTL makes the allocation a lease expiring after ttl. Expired leases
+// stay allocated until they're reclaimed, see ReclaimExpired. A zero or
+// negative TTL means the allocation never expires.
+func WithTTL(ttl time.Duration) AllocateOption {
+	return func(o *allocateOptions) {
+		o.ttl = ttl
+	}
+}
+
+// newMeta returns the metadata to attach to subnets allocated with o.
+func (a *Allocator) newMeta(o allocateOptions) allocMeta {
+	m := allocMeta{
+		AllocationMeta: AllocationMeta{Owner: o.owner, Labels: o.labels},
+		key:            o.key,
+	}
+	if o.ttl > 0 {
+		m.Expires = a.now().Add(o.ttl)
+	}
+	m.Pinned = o.pinned
+	return m
+}
+
+func newAllocateOptions(opts []AllocateOption) allocateOptions {
+	if len(opts) == 0 {
+		// Don't let 'o' escape to the heap when there's nothing to apply.
+		return allocateOptions{}
+	}
+
+	var o allocateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (a *Allocator) Allocate(opts ...AllocateOption) (netip.Prefix, error) {
+	alloc, err := a.AllocateWithPool(opts...)
+	return alloc.Prefix, err
+}
+
+// maxConflictRetries is the number of times Allocate tries again when the
+// store reports a conflict with another allocator.
+const maxConflictRetries = 3
+
+// AllocateWithPool is the same as Allocate, but it also reports which pool
+// the prefix was allocated from.
+func (a *Allocator) AllocateWithPool(opts ...AllocateOption) (Allocation, error) {
+	return a.allocateWithRetries(opts, maxConflictRetries)
+}
+
+// allocateWithRetries is the same as AllocateWithPool, but it tries again at
+// most retries times on store conflicts.
+func (a *Allocator) allocateWithRetries(opts []AllocateOption, retries int) (Allocation, error) {
+	defer a.observeAllocate(time.Now())
+	var o allocateOptions
+	if a.audit {
+		o = newAllocateOptions(opts)
+	}
+	prev := a.beginAudit(AuditAllocate, o.actor)
+	for attempt := 0; ; attempt++ {
+		alloc, err := a.allocateWithPool(opts)
+		// The state was reloaded on conflict, so the next attempt doesn't
+		// pick the same subnet.
+		if attempt < retries && errors.Is(err, ErrStoreConflict) {
+			continue
+		}
+		a.endAudit(prev, alloc.Prefix, o.owner, err)
+		return alloc, err
+	}
+}
+
+func (a *Allocator) allocateWithPool(opts []AllocateOption) (Allocation, error) {
+	o := newAllocateOptions(opts)
+	if p, ok := a.keys[o.key]; ok && o.key != "" {
+		var pool Pool
+		if poolID, ok := a.poolIndex(p); ok {
+			pool = a.pools[poolID].clone()
+		}
+		return Allocation{Prefix: p, Pool: pool}, nil
+	}
+
+	a.scan = ScanCost{}
+	next, poolID, err := a.pickAdmitted(o)
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	if err := a.add(next, a.newMeta(o)); err != nil {
+		return Allocation{}, err
+	}
+	a.observeScan()
+	return Allocation{Prefix: next, Pool: a.pools[poolID].clone()}, nil
+}
+
+// pick returns the subnet Allocate would hand out, and the index of its pool,
+// without allocating it.
+func (a *Allocator) pick(o allocateOptions) (netip.Prefix, int, error) {
+	var sel selector
+	if o.selector != "" {
+		var err error
+		if sel, err = parseSelector(o.selector); err != nil {
+			return netip.Prefix{}, 0, fmt.Errorf("invalid selector: %w", err)
 		}
+	}
 
-		return netip.Prefix{}
+	if a.trie == nil {
+		a.buildIndexes()
 	}
+	o.reserved = a.provideReserved(o.reserved)
 
-	for i < len(a.allocated) {
-		allocated := a.allocated[i]
+	if o.hint.IsValid() && o.hint.Addr().Is4() {
+		hint := o.hint.Masked()
+		poolID, ok := a.poolIndex(hint)
+		if ok && a.poolAllowed(poolID, o, sel) && a.quotaLeft(poolID, hint.Bits()) != 0 &&
+			Distance(a.pools[poolID].Prefix.Addr(), lastAddr(hint)) < dynamicSize(a.pools[poolID]) &&
+			!a.isReserved(hint) && !overlapsAny(o.reserved, hint) {
+			allocated, overlaps := a.trie.overlapping(hint)
+			if !overlaps {
+				if a.logger != nil {
+					a.logger.Debug("picked the hinted subnet", "subnet", hint, "pool", a.pools[poolID].Prefix)
+				}
+				return hint, poolID, nil
+			}
+			if a.logger != nil {
+				a.logger.Debug("hint overlaps with an allocation", "hint", hint, "allocated", allocated)
+			}
+		} else if a.logger != nil {
+			a.logger.Debug("hint can't be allocated", "hint", hint)
+		}
+	}
 
-		if poolID >= len(a.pools) {
-			return netip.Prefix{}, ErrNoFreePool
+	var next netip.Prefix
+	var nextPool int
+	a.eachPool(o.reverse, func(poolID int) bool {
+		a.scan.Pools++
+		size := a.pools[poolID].Size
+		if o.size != 0 {
+			size = o.size
+		}
+		if !a.poolAllowed(poolID, o, sel) {
+			if a.logger != nil {
+				a.trace("skipping pool not matching the request", "pool", a.pools[poolID].Prefix)
+			}
+			return true
+		}
+		if a.quotaLeft(poolID, size) == 0 {
+			if a.logger != nil {
+				a.trace("skipping pool out of quota", "pool", a.pools[poolID].Prefix, "size", size)
+			}
+			return true
 		}
 
-		p := a.pools[poolID]
+		var lru netip.Prefix
+		var lruFreed time.Time
+		a.eachFree(poolID, o, func(p netip.Prefix) bool {
+			if a.reuse == ReuseLeastRecentlyUsed {
+				// Keep looking for a subnet that was never used.
+				if t, ok := a.freed[p]; ok {
+					if !lru.IsValid() || t.Before(lruFreed) {
+						lru, lruFreed = p, t
+					}
+					return true
+				}
+			}
+			next, nextPool = p, poolID
+			return false
+		})
+		if !next.IsValid() && lru.IsValid() {
+			next, nextPool = lru, poolID
+		}
+		if !next.IsValid() && a.logger != nil {
+			a.trace("pool is full, moving to the next one", "pool", a.pools[poolID].Prefix, "size", size)
+		}
+		return !next.IsValid()
+	})
 
-		if allocated.Overlaps(p.Prefix) {
-			i++
+	if !next.IsValid() {
+		err := a.exhausted(o.size, sel)
+		if a.logger != nil {
+			a.logger.Debug("no free subnet", "error", err)
+		}
+		return netip.Prefix{}, 0, err
+	}
+	if a.logger != nil {
+		a.logger.Debug("picked subnet", "subnet", next, "pool", a.pools[nextPool].Prefix,
+			"scanned_pools", a.scan.Pools, "scanned_entries", a.scan.Entries)
+	}
+	return next, nextPool, nil
+}
 
-			if allocated.Bits() <= p.Prefix.Bits() {
-				// The current 'allocated' prefix is bigger than the pool, thus
-				// the pool is fully overlapped.
-				partialOverlap = false
-				poolID++
-				continue
+// poolAllowed tells whether o allows allocating from the poolID-th pool.
+func (a *Allocator) poolAllowed(poolID int, o allocateOptions, sel selector) bool {
+	if o.pool != "" && a.pools[poolID].Name != o.pool {
+		return false
+	}
+	if o.pools != nil && !slices.Contains(o.pools, a.pools[poolID].Name) {
+		return false
+	}
+	return sel.matches(a.pools[poolID].Labels)
+}
+
+// AllocateN allocates n subnets in a single pass over the pools. Either all
+// of them are allocated, or none is and an error matching ErrNoFreePool is
+// returned. Options choosing where subnets come from apply like with Suggest,
+// and options attaching metadata, such as WithOwner, apply to every subnet.
+// WithIdempotencyKey doesn't apply.
+func (a *Allocator) AllocateN(n int, opts ...AllocateOption) ([]netip.Prefix, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	o := newAllocateOptions(opts)
+	prev := a.beginAudit(AuditAllocate, o.actor)
+	prefixes, err := a.allocateN(n, o)
+	a.endAudit(prev, netip.Prefix{}, o.owner, err)
+	return prefixes, err
+}
+
+func (a *Allocator) allocateN(n int, o allocateOptions) ([]netip.Prefix, error) {
+	sel, err := parseSelector(o.selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	prefixes, err := a.suggestAdmitted(n, o, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	m := a.newMeta(o)
+	m.key = ""
+	var addresses int64
+	for _, p := range prefixes {
+		addresses += int64(1) << (32 - p.Bits())
+	}
+	if err := a.checkOwnerQuota(m.Owner, n, addresses); err != nil {
+		return nil, err
+	}
+
+	err = a.persist(func() error {
+		for _, p := range prefixes {
+			a.insert(p)
+			if !m.AllocationMeta.isZero() {
+				a.setMeta(p, m)
 			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.pushUndo(undoEntry{allocated: prefixes})
+
+	return prefixes, nil
+}
+
+// Suggest returns up to n free subnets, in the order Allocate would hand them
+// out, without allocating them. Options choosing where subnets come from,
+// such as WithReserved, WithPools or WithSize, apply like with Allocate,
+// except WithHint. Nothing is suggested if the selector is invalid.
+func (a *Allocator) Suggest(n int, opts ...AllocateOption) []netip.Prefix {
+	o := newAllocateOptions(opts)
+	sel, err := parseSelector(o.selector)
+	if err != nil {
+		return nil
+	}
+	return a.suggest(n, o, sel)
+}
+
+func (a *Allocator) suggest(n int, o allocateOptions, sel selector) []netip.Prefix {
+	if n <= 0 {
+		return nil
+	}
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	// Free subnets yielded by eachFree don't overlap with each other, so we
+	// can collect all of them before inserting anything.
+	o.reserved = a.provideReserved(o.reserved)
+	prefixes := make([]netip.Prefix, 0, n)
+	a.eachPool(o.reverse, func(poolID int) bool {
+		if !a.poolAllowed(poolID, o, sel) {
+			return true
+		}
+		size := a.pools[poolID].Size
+		if o.size != 0 {
+			size = o.size
+		}
+		left := a.quotaLeft(poolID, size)
+		if left == 0 {
+			return true
+		}
+		a.eachFree(poolID, o, func(p netip.Prefix) bool {
+			prefixes = append(prefixes, p)
+			left--
+			return len(prefixes) < n && left != 0
+		})
+		return len(prefixes) < n
+	})
 
-			if lastAddr(allocated) == lastAddr(p.Prefix) {
-				// The last address of the current 'allocated' prefix is the
-				// same as the last address of the pool, it's fully overlapped.
-				// We can go to the next one.
-				partialOverlap = false
-				poolID++
+	return prefixes
+}
+
+// eachPool calls fn with the index of every pool, in the order they should be
+// used, until fn returns false. Primary pools come first, then overflow
+// pools. Each tier is sorted by prefix, or in reverse order.
+func (a *Allocator) eachPool(reverse bool, fn func(poolID int) bool) {
+	for _, overflow := range [2]bool{false, true} {
+		for i := range a.pools {
+			poolID := i
+			if reverse {
+				poolID = len(a.pools) - 1 - i
+			}
+			if a.pools[poolID].Overflow != overflow {
 				continue
 			}
+			if !fn(poolID) {
+				return
+			}
+		}
+	}
+}
+
+// eachFree calls fn with every free subnet of the poolID-th pool, in order,
+// until fn returns false. Only the reverse, align, size and reserved options
+// are taken into account.
+func (a *Allocator) eachFree(poolID int, o allocateOptions, fn func(netip.Prefix) bool) {
+	p := a.pools[poolID]
+	bm := a.bitmaps[poolID]
+	if o.size != 0 && o.size != p.Size {
+		// Bitmaps only know about subnets of the pool size.
+		p.Size = o.size
+		bm = nil
+	}
+	if p.Size < p.Prefix.Bits() || p.Size > 32 {
+		return
+	}
+
+	align := p.Size
+	if o.align > 0 && o.align < p.Size {
+		// Pools are aligned on their own size, no need to look further.
+		align = max(o.align, p.Prefix.Bits())
+	}
+
+	// Subnets past 'limit' are kept for static allocations.
+	limit := dynamicSize(p)
+	if limit == 0 {
+		return
+	}
+	isDynamic := func(q netip.Prefix) bool {
+		return Distance(p.Prefix.Addr(), lastAddr(q)) < limit
+	}
+
+	// The walk starts at the start-th /align block of the pool, and wraps
+	// around. That's the first block, unless a host ID is set.
+	start := a.scanOffset(limit, align)
+	startAddr := Add(p.Prefix.Addr(), start, uint(32-align))
+
+	// Pools with a bitmap are only a few word scans away from their free
+	// subnets. Bitmaps don't know about alignment though.
+	if bm != nil && align == p.Size {
+		if o.reverse {
+			last := int(limit>>(32-p.Size)) - 1
+			// Walk down from the start, then from the end down to the
+			// start.
+			hi := last
+			if start > 0 {
+				hi = int(start) - 1
+			}
+			for n, ok := bm.prevFree(hi); ok; n, ok = bm.prevFree(n - 1) {
+				if q := bm.subnet(n); !a.skipReserved(o.reserved, q) && !fn(q) {
+					return
+				}
+			}
+			if start > 0 {
+				for n, ok := bm.prevFree(last); ok && n >= int(start); n, ok = bm.prevFree(n - 1) {
+					if q := bm.subnet(n); !a.skipReserved(o.reserved, q) && !fn(q) {
+						return
+					}
+				}
+			}
+			return
+		}
 
-			// This pool is partially overlapped. If the next iteration yields
-			// an 'allocated' prefix that don't overlap with the current pool,
-			// then might have found the right spot.
-			partialOverlap = true
-			continue
+		n, ok := bm.firstFree()
+		if start > 0 {
+			n, ok = bm.nextFree(int(start))
+		}
+		for ; ok && isDynamic(bm.subnet(n)); n, ok = bm.nextFree(n + 1) {
+			if q := bm.subnet(n); !a.skipReserved(o.reserved, q) && !fn(q) {
+				return
+			}
 		}
+		if start > 0 {
+			for n, ok := bm.firstFree(); ok && n < int(start); n, ok = bm.nextFree(n + 1) {
+				if q := bm.subnet(n); !a.skipReserved(o.reserved, q) && !fn(q) {
+					return
+				}
+			}
+		}
+		return
+	}
 
-		// Okay, so previous 'allocated' overlapped and current doesn't. Now
-		// the question is: is there enough space left between previous
-		// 'allocated' and the end of p?
-		if partialOverlap {
-			partialOverlap = false
+	if o.reverse {
+		last := netip.PrefixFrom(Add(p.Prefix.Addr(), limit-1, 0), align).Masked().Addr()
+		from := last
+		if start > 0 {
+			from = blockBefore(startAddr, align)
+		}
+		for prev, ok := a.prevFree(p, align, o.reserved, from); ok; prev, ok = a.prevFree(p, align, o.reserved, blockBefore(prev.Addr(), align)) {
+			if isDynamic(prev) && !fn(prev) {
+				return
+			}
+		}
+		if start > 0 {
+			for prev, ok := a.prevFree(p, align, o.reserved, last); ok && !prev.Addr().Less(startAddr); prev, ok = a.prevFree(p, align, o.reserved, blockBefore(prev.Addr(), align)) {
+				if isDynamic(prev) && !fn(prev) {
+					return
+				}
+			}
+		}
+		return
+	}
 
-			// No need to check if 'i > 0' -- the lowest 'i' where 'partialOverlap'
-			// could be set is 1.
-			prevAlloc := a.allocated[i-1]
-			if next := nextPrefixAfter(prevAlloc, p.Prefix, p.Size); next != (netip.Prefix{}) {
-				a.allocated = slices.Insert(a.allocated, i, next)
-				return next, nil
+	for next, ok := a.nextFree(p, align, o.reserved, startAddr); ok && isDynamic(next); next, ok = a.nextFree(p, align, o.reserved, blockAfter(next.Addr(), align)) {
+		if !fn(next) {
+			return
+		}
+	}
+	if start > 0 {
+		for next, ok := a.nextFree(p, align, o.reserved, p.Prefix.Addr()); ok && next.Addr().Less(startAddr); next, ok = a.nextFree(p, align, o.reserved, blockAfter(next.Addr(), align)) {
+			if !fn(next) {
+				return
 			}
+		}
+	}
+}
 
-			// No luck -- nextPrefixAfter yielded an invalid prefix. There's
-			// not enough space left to use this pool.
-			poolID++
+// scanOffset returns the index of the /align block eachFree starts from, in
+// a pool whose first 'limit' addresses are handed out dynamically. It's
+// derived from the host ID, see WithHostID.
+func (a *Allocator) scanOffset(limit uint64, align int) uint64 {
+	blocks := limit >> (32 - align)
+	if a.hostSeed == 0 || blocks == 0 {
+		return 0
+	}
+	return a.hostSeed % blocks
+}
 
-			// We don't increment 'i' here, because we need to re-test the
-			// current 'allocated' against the next pool available.
-			continue
+// nextFree walks the subnets of p starting on a /align boundary, from the one
+// at addr and jumping over allocated and reserved prefixes, until it finds
+// one that doesn't overlap with anything. 'extra' prefixes are avoided too.
+func (a *Allocator) nextFree(p Pool, align int, extra []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for addr.IsValid() && p.Prefix.Contains(addr) {
+		next := netip.PrefixFrom(addr, p.Size)
+		allocated, ok := a.overlapping(next)
+		if !ok {
+			allocated, ok = firstOverlapping(extra, next)
 		}
+		if !ok {
+			return next, true
+		}
+		a.scan.Entries++
+
+		// 'allocated' is either bigger than 'next', and we need to jump
+		// right after it. Or it's smaller, and we only need to skip 'next'.
+		if allocated.Bits() > next.Bits() {
+			allocated = next
+		}
+		addr = blockAfter(allocated.Addr(), min(allocated.Bits(), align))
+	}
+
+	return netip.Prefix{}, false
+}
+
+// prevFree is the same as nextFree, but it walks the subnets of p downward.
+func (a *Allocator) prevFree(p Pool, align int, extra []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for addr.IsValid() && p.Prefix.Contains(addr) {
+		prev := netip.PrefixFrom(addr, p.Size)
+		allocated, ok := a.overlapping(prev)
+		if !ok {
+			allocated, ok = firstOverlapping(extra, prev)
+		}
+		if !ok {
+			return prev, true
+		}
+		a.scan.Entries++
 
-		// If the pool doesn't overlap and has a binary value lower than the
-		// current 'allocated', we found the right spot.
-		if p.Prefix.Addr().Less(allocated.Addr()) {
-			copy(a.allocated[i+1:], a.allocated[i:])
-			a.allocated[i] = netip.PrefixFrom(p.Prefix.Addr(), p.Size)
-			return a.allocated[i], nil
+		if allocated.Bits() > prev.Bits() {
+			allocated = prev
 		}
+		addr = blockBefore(allocated.Addr(), align)
+	}
+
+	return netip.Prefix{}, false
+}
+
+// AllocateStatic allocates p, which may or may not be part of a pool, if it
+// doesn't overlap with any existing allocation. Only options attaching
+// metadata to the allocation, such as WithOwner, apply.
+func (a *Allocator) AllocateStatic(p netip.Prefix, opts ...AllocateOption) error {
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	o := newAllocateOptions(opts)
+	if q, ok := a.keys[o.key]; ok && o.key != "" && q == p.Masked() {
+		return nil
+	}
+	prev := a.beginAudit(AuditAllocateStatic, o.actor)
+	err := a.allocateStatic(p, a.newMeta(o), o.actor)
+	a.endAudit(prev, p, o.owner, err)
+	return err
+}
+
+// AllocateIndex allocates the i-th subnet of the pool whose prefix is 'pool',
+// if it's free. Like with AllocateStatic, only options attaching metadata to
+// the allocation apply.
+func (a *Allocator) AllocateIndex(pool netip.Prefix, i uint64, opts ...AllocateOption) (netip.Prefix, error) {
+	o := newAllocateOptions(opts)
+	prev := a.beginAudit(AuditAllocateStatic, o.actor)
+	p, err := a.allocateIndex(pool, i, o)
+	a.endAudit(prev, p, o.owner, err)
+	return p, err
+}
+
+func (a *Allocator) allocateIndex(pool netip.Prefix, i uint64, o allocateOptions) (netip.Prefix, error) {
+	poolID := slices.IndexFunc(a.pools, func(p Pool) bool {
+		return p.Prefix == pool.Masked()
+	})
+	if poolID == -1 {
+		return netip.Prefix{}, fmt.Errorf("no pool %s", pool)
+	}
+
+	p := a.pools[poolID]
+	if p.Size < p.Prefix.Bits() || i >= uint64(1)<<(p.Size-p.Prefix.Bits()) {
+		return netip.Prefix{}, fmt.Errorf("pool %s has no subnet at index %d", p.Prefix, i)
+	}
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	next := netip.PrefixFrom(Add(p.Prefix.Addr(), i, uint(32-p.Size)), p.Size)
+	if err := a.allocateStatic(next, a.newMeta(o), o.actor); err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return next, nil
+}
 
-		i++
+func (a *Allocator) allocateStatic(p netip.Prefix, m allocMeta, actor string) error {
+	if !p.IsValid() || !p.Addr().Is4() {
+		return fmt.Errorf("%w %s", ErrInvalidPrefix, p)
 	}
 
-	if poolID >= len(a.pools) {
-		return netip.Prefix{}, ErrNoFreePool
+	p = p.Masked()
+	if allocated, ok := a.trie.overlapping(p); ok {
+		return &OverlapError{Prefix: p, Allocated: allocated}
+	}
+	if err := a.checkTombstones(p); err != nil {
+		return err
+	}
+	if err := a.admitStatic(p, m.Owner, actor, m.Labels); err != nil {
+		return err
+	}
+	if err := a.validateStatic(p); err != nil {
+		return err
 	}
 
-	// We reached the end of 'allocated', but not the end of pools. Let's
-	// try two more times (once on the current 'p', and once on the next pool
-	// if any).
-	if partialOverlap {
-		p := a.pools[poolID]
+	return a.add(p, m)
+}
 
-		prevAlloc := a.allocated[i-1]
-		if next := nextPrefixAfter(prevAlloc, p.Prefix, p.Size); next != (netip.Prefix{}) {
-			a.allocated = slices.Insert(a.allocated, i, next)
-			return next, nil
+func (a *Allocator) Deallocate(p netip.Prefix, opts ...DeallocateOption) error {
+	if !a.audit {
+		return a.deallocate(p, opts)
+	}
+	owner := a.meta[p].Owner
+	prev := a.beginAudit(AuditDeallocate, newDeallocateOptions(opts).actor)
+	err := a.deallocate(p, opts)
+	a.endAudit(prev, p, owner, err)
+	return err
+}
+
+func (a *Allocator) deallocate(p netip.Prefix, opts []DeallocateOption) error {
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	if !a.allocated.contains(p) {
+		return fmt.Errorf("prefix %s is %w", p, ErrNotAllocated)
+	}
+	o := newDeallocateOptions(opts)
+	if err := a.checkPinned(p, o); err != nil {
+		return err
+	}
+	if o.tombstone {
+		// Tombstones are only persisted by snapshots.
+		return a.deallocateAll([]netip.Prefix{p}, opts)
+	}
+	if err := a.deleteAllocation(p); err != nil {
+		return err
+	}
+	e := undoEntry{released: map[netip.Prefix]allocMeta{p: a.meta[p]}}
+	a.release(p)
+	a.generation++
+	a.pushUndo(e)
+	a.notify()
+
+	return nil
+}
+
+// DeallocateAll releases all of the given prefixes. If any of them isn't
+// allocated, or is pinned, an error is returned and nothing is released.
+func (a *Allocator) DeallocateAll(prefixes []netip.Prefix, opts ...DeallocateOption) error {
+	if !a.audit {
+		return a.deallocateAll(prefixes, opts)
+	}
+	owners := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		owners[i] = a.meta[p].Owner
+	}
+	actor := newDeallocateOptions(opts).actor
+	prev := a.beginAudit(AuditDeallocate, actor)
+	err := a.deallocateAll(prefixes, opts)
+	if err != nil {
+		// Nothing was released, the request failed for every prefix.
+		for i, p := range prefixes {
+			a.recordAudit(AuditDeallocate, p, actor, owners[i], err)
+		}
+	}
+	a.op = prev
+	a.flushAudit()
+	return err
+}
+
+func (a *Allocator) deallocateAll(prefixes []netip.Prefix, opts []DeallocateOption) error {
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	o := newDeallocateOptions(opts)
+	seen := make(map[netip.Prefix]struct{}, len(prefixes))
+	for _, p := range prefixes {
+		if _, ok := seen[p]; ok {
+			return fmt.Errorf("prefix %s is listed more than once", p)
+		}
+		seen[p] = struct{}{}
+
+		if !a.allocated.contains(p) {
+			return fmt.Errorf("prefix %s is %w", p, ErrNotAllocated)
+		}
+		if err := a.checkPinned(p, o); err != nil {
+			return err
+		}
+	}
+
+	e := undoEntry{released: make(map[netip.Prefix]allocMeta, len(prefixes))}
+	for _, p := range prefixes {
+		e.released[p] = a.meta[p]
+	}
+	err := a.persist(func() error {
+		for _, p := range prefixes {
+			a.releaseWith(p, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.pushUndo(e)
+	return nil
+}
+
+// Reset releases all allocations at once, pinned ones included, see
+// WithPinned. It only fails if the new state can't be persisted, see
+// WithStore.
+func (a *Allocator) Reset() error {
+	return a.persist(func() error {
+		for _, p := range a.allocated.slice() {
+			a.markFreed(p)
+			a.recordRelease(p)
+			a.recordChange(p, true, a.meta[p].AllocationMeta)
+		}
+		a.allocated = prefixList{}
+		a.meta = nil
+		a.reindexMeta()
+		a.invalidateIndexes()
+		return nil
+	})
+}
+
+// insert adds p to 'allocated', keeping it sorted, and updates indexes.
+func (a *Allocator) insert(p netip.Prefix) {
+	a.allocated.insert(p)
+	delete(a.freed, p)
+	a.recordAllocation(p)
+	a.recordChange(p, false, AllocationMeta{})
+
+	a.trie.insert(p)
+	for _, bm := range a.bitmaps {
+		if bm != nil {
+			bm.mark(p)
+		}
+	}
+	a.mustCheckInvariants()
+}
+
+// add allocates p, attaching m to it, and writes it through the store.
+func (a *Allocator) add(p netip.Prefix, m allocMeta) error {
+	if err := a.checkOwnerQuota(m.Owner, 1, int64(1)<<(32-p.Bits())); err != nil {
+		return err
+	}
+
+	if !m.AllocationMeta.isZero() {
+		// Metadata is only persisted by snapshots.
+		err := a.persist(func() error {
+			a.insert(p)
+			a.setMeta(p, m)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if a.undoSize > 0 {
+			a.pushUndo(undoEntry{allocated: []netip.Prefix{p}})
+		}
+		return nil
+	}
+
+	if err := a.saveAllocation(p); err != nil {
+		return err
+	}
+	a.insert(p)
+	if m.key != "" {
+		a.setMeta(p, m)
+	}
+	a.generation++
+	a.notify()
+	if a.undoSize > 0 {
+		// Don't allocate the entry when there's no undo stack.
+		a.pushUndo(undoEntry{allocated: []netip.Prefix{p}})
+	}
+	return nil
+}
+
+// poolIndex returns the index of the pool containing p.
+func (a *Allocator) poolIndex(p netip.Prefix) (int, bool) {
+	for poolID, pool := range a.pools {
+		if pool.Prefix.Bits() <= p.Bits() && pool.Prefix.Contains(p.Addr()) {
+			return poolID, true
+		}
+	}
+	return 0, false
+}
+
+// unindex removes p from indexes once it was removed from 'allocated'.
+func (a *Allocator) unindex(p netip.Prefix) {
+	a.trie.remove(p)
+	for _, bm := range a.bitmaps {
+		if bm != nil {
+			bm.unmark(p, a.inUse)
 		}
+	}
+	a.mustCheckInvariants()
+}
 
-		// No luck -- next yielded an invalid prefix. There's not enough
-		// space left to use this pool.
-		poolID++
+// buildIndexes builds the tries and the bitmaps from 'allocated',
+// 'permanent' and 'reservedSet'.
+func (a *Allocator) buildIndexes() {
+	a.bitmaps = make([]*poolBitmap, len(a.pools))
+	for i, p := range a.pools {
+		a.bitmaps[i] = newPoolBitmap(p)
 	}
 
-	// One last chance. Here we don't increment poolID since the last iteration
-	// on 'a.allocated' found either:
-	//
-	// - A full overlap, and incremented 'poolID'.
-	// - A partial overlap, and the previous 'if' incremented 'poolID'.
-	// - The current 'poolID' comes after the last 'allocated'.
-	//
-	// Hence, we're sure 'poolID' has never been subnetted yet.
-	if poolID < len(a.pools) {
-		p := a.pools[poolID]
+	a.reserved = &prefixTrie{}
+	for _, p := range a.permanent {
+		a.indexReserved(p)
+	}
+	a.reservedSet.each(func(p netip.Prefix) bool {
+		a.indexReserved(p)
+		return true
+	})
+
+	a.trie = &prefixTrie{}
+	a.allocated.each(func(allocated netip.Prefix) bool {
+		a.trie.insert(allocated)
+		for _, bm := range a.bitmaps {
+			if bm != nil {
+				bm.mark(allocated)
+			}
+		}
+		return true
+	})
+}
+
+// comparePrefix orders prefixes by address, and then by prefix length.
+func comparePrefix(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
 
-		a.allocated = append(a.allocated, netip.PrefixFrom(p.Prefix.Addr(), p.Size))
-		return a.allocated[i], nil
+	if a.Bits() < b.Bits() {
+		return -1
+	} else if a.Bits() > b.Bits() {
+		return 1
 	}
+	return 0
+}
+
+// blockAfter returns the first address of the /bits block following the one
+// containing addr. It's invalid if there's no such block.
+func blockAfter(addr netip.Addr, bits int) netip.Addr {
+	return nextPrefix(netip.PrefixFrom(addr, bits).Masked()).Addr()
+}
 
-	return netip.Prefix{}, ErrNoFreePool
+// blockBefore returns the first address of the /bits block preceding the one
+// containing addr. It's invalid if there's no such block.
+func blockBefore(addr netip.Addr, bits int) netip.Addr {
+	return netip.PrefixFrom(netip.PrefixFrom(addr, bits).Masked().Addr().Prev(), bits).Masked().Addr()
 }
 
 func lastAddr(p netip.Prefix) netip.Addr {
-	return Add(p.Addr(), 1, uint(32-p.Bits())).Prev()
+	a := p.Addr().As4()
+	addr := binary.BigEndian.Uint32(a[:]) | uint32(uint64(1)<<(32-p.Bits())-1)
+	binary.BigEndian.PutUint32(a[:], addr)
+	return netip.AddrFrom4(a)
 }
 
 func nextPrefix(p netip.Prefix) netip.Prefix {
@@ -184,3 +1203,9 @@ func Add(ip netip.Addr, x uint64, shift uint) netip.Addr {
 	binary.BigEndian.PutUint32(a[:], addr)
 	return netip.AddrFrom4(a)
 }
+
+// Distance returns b - a.
+func Distance(a, b netip.Addr) uint64 {
+	a4, b4 := a.As4(), b.As4()
+	return uint64(binary.BigEndian.Uint32(b4[:]) - binary.BigEndian.Uint32(a4[:]))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// AllocationMeta is what's attached to an allocation besides its prefix. It's
+// persisted along with the allocation, see Snapshot.
+type AllocationMeta struct {
+	// Name binds the allocation to a name, see AllocateNamed.
+	Name string
+	// Owner is who the allocation was made for, see WithOwner.
+	Owner string
+	// Labels are arbitrary key/value pairs, see WithLabels.
+	Labels map[string]string
+	// Expires is when the lease on the allocation expires, see WithTTL. It's
+	// the zero Time if the allocation never expires.
+	Expires time.Time
+	// Pinned allocations can only be released by force, see WithPinned.
+	Pinned bool
+}
+
+func (m AllocationMeta) isZero() bool {
+	return m.Name == "" && m.Owner == "" && len(m.Labels) == 0 && m.Expires.IsZero() && !m.Pinned
+}
+
+// expired tells whether the lease on the allocation expired at now.
+func (m AllocationMeta) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// allocMeta is what the allocator knows about an allocation besides its
+// prefix: its persisted metadata, and the idempotency key it was made with,
+// which isn't persisted. See WithIdempotencyKey.
+type allocMeta struct {
+	AllocationMeta
+	key string
+}
+
+// setMeta records m as the metadata of the allocated prefix p, and indexes
+// it.
+func (a *Allocator) setMeta(p netip.Prefix, m allocMeta) {
+	a.forget(p)
+	if a.meta == nil {
+		a.meta = map[netip.Prefix]allocMeta{}
+	}
+	a.meta[p] = m
+	a.indexMeta(p, m)
+}
+
+// forget drops the metadata of p, if any.
+func (a *Allocator) forget(p netip.Prefix) {
+	m, ok := a.meta[p]
+	if !ok {
+		return
+	}
+	if m.key != "" {
+		delete(a.keys, m.key)
+	}
+	if m.Name != "" {
+		delete(a.names, m.Name)
+	}
+	if owned := a.owners[m.Owner]; m.Owner != "" && owned != nil {
+		owned.remove(p)
+		if owned.len() == 0 {
+			delete(a.owners, m.Owner)
+		}
+	}
+	delete(a.meta, p)
+}
+
+func (a *Allocator) indexMeta(p netip.Prefix, m allocMeta) {
+	if m.key != "" {
+		if a.keys == nil {
+			a.keys = map[string]netip.Prefix{}
+		}
+		a.keys[m.key] = p
+	}
+	if m.Name != "" {
+		if a.names == nil {
+			a.names = map[string]netip.Prefix{}
+		}
+		a.names[m.Name] = p
+	}
+	if m.Owner != "" {
+		if a.owners == nil {
+			a.owners = map[string]*prefixList{}
+		}
+		owned := a.owners[m.Owner]
+		if owned == nil {
+			owned = &prefixList{}
+			a.owners[m.Owner] = owned
+		}
+		owned.insert(p)
+	}
+}
+
+// reindexMeta rebuilds the indexes of 'meta', once it was replaced.
+func (a *Allocator) reindexMeta() {
+	a.keys, a.names, a.owners = nil, nil, nil
+	for p, m := range a.meta {
+		a.indexMeta(p, m)
+	}
+}
+
+// persistedMeta returns the metadata to persist in snapshots, or nil if there
+// is none.
+func (a *Allocator) persistedMeta() map[netip.Prefix]AllocationMeta {
+	var meta map[netip.Prefix]AllocationMeta
+	for p, m := range a.meta {
+		if m.AllocationMeta.isZero() {
+			continue
+		}
+		if meta == nil {
+			meta = map[netip.Prefix]AllocationMeta{}
+		}
+		meta[p] = m.AllocationMeta
+	}
+	return meta
+}
+
+// restoreMeta records the metadata of a snapshot. Metadata of prefixes that
+// aren't allocated is ignored.
+func (a *Allocator) restoreMeta(meta map[netip.Prefix]AllocationMeta) error {
+	for p, m := range meta {
+		if m.isZero() || !a.allocated.contains(p) {
+			continue
+		}
+		if other, ok := a.names[m.Name]; ok && m.Name != "" {
+			return fmt.Errorf("name %q is bound to both %s and %s", m.Name, other, p)
+		}
+		a.setMeta(p, allocMeta{AllocationMeta: m})
+	}
+	return nil
+}
+
+// release removes p from 'allocated', along with its metadata, and updates
+// indexes.
+func (a *Allocator) release(p netip.Prefix) {
+	a.markFreed(p)
+	a.recordRelease(p)
+	a.recordChange(p, true, a.meta[p].AllocationMeta)
+	a.forget(p)
+	a.allocated.remove(p)
+	a.unindex(p)
+}
@@ -0,0 +1,97 @@
+package main
+
+import "time"
+
+// Counters count what the allocator did since it was created, see Counters.
+type Counters struct {
+	// Allocations and Deallocations count subnets allocated and released,
+	// whatever the method.
+	Allocations   uint64
+	Deallocations uint64
+	// Exhausted counts the errors matching ErrNoFreePool.
+	Exhausted uint64
+	// ScannedPools and ScannedEntries are the sums of the ScanCost of
+	// successful Allocate calls, see LastScan.
+	ScannedPools   uint64
+	ScannedEntries uint64
+	// AllocateLatency is the distribution of the time taken by Allocate and
+	// AllocateWithPool.
+	AllocateLatency LatencyHistogram
+}
+
+// LatencyHistogram is a distribution of durations.
+type LatencyHistogram struct {
+	// Bounds are the upper bounds of the buckets, sorted.
+	Bounds []time.Duration
+	// Counts[i] is the number of calls that took Bounds[i] or less, such
+	// that counts are cumulative.
+	Counts []uint64
+	// Count and Sum are the number of calls, and their total duration.
+	Count uint64
+	Sum   time.Duration
+}
+
+// latencyBounds are the bounds of the buckets of latency histograms.
+var latencyBounds = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// counters is where the allocator keeps its Counters. Changes made by the
+// ongoing operation are pending until it succeeds.
+type counters struct {
+	allocations, deallocations               uint64
+	pendingAllocations, pendingDeallocations uint64
+	exhausted                                uint64
+	scannedPools, scannedEntries             uint64
+	latency                                  [len(latencyBounds)]uint64
+	latencyCount                             uint64
+	latencySum                               time.Duration
+}
+
+// Counters returns what the allocator did since it was created.
+func (a *Allocator) Counters() Counters {
+	c := a.counters
+	h := LatencyHistogram{
+		Bounds: latencyBounds[:],
+		Counts: make([]uint64, len(latencyBounds)),
+		Count:  c.latencyCount,
+		Sum:    c.latencySum,
+	}
+	var total uint64
+	for i, n := range c.latency {
+		total += n
+		h.Counts[i] = total
+	}
+	return Counters{
+		Allocations:     c.allocations,
+		Deallocations:   c.deallocations,
+		Exhausted:       c.exhausted,
+		ScannedPools:    c.scannedPools,
+		ScannedEntries:  c.scannedEntries,
+		AllocateLatency: h,
+	}
+}
+
+// observeAllocate records that an allocation started at start just returned.
+func (a *Allocator) observeAllocate(start time.Time) {
+	d := time.Since(start)
+	c := &a.counters
+	c.latencyCount++
+	c.latencySum += d
+	for i, bound := range latencyBounds {
+		if d <= bound {
+			c.latency[i]++
+			break
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCounters(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}}, WithStore(s))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	_, err = a.AllocateN(2)
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p))
+
+	// Failed changes aren't counted.
+	s.fail = true
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, errStore)
+	assert.ErrorIs(t, a.Reset(), errStore)
+	s.fail = false
+
+	_, err = a.AllocateN(3)
+	assert.ErrorIs(t, err, ErrNoFreePool)
+	assert.NilError(t, a.Reset())
+
+	c := a.Counters()
+	assert.Equal(t, c.Allocations, uint64(3))
+	assert.Equal(t, c.Deallocations, uint64(3))
+	assert.Equal(t, c.Exhausted, uint64(1))
+
+	h := c.AllocateLatency
+	assert.Equal(t, h.Count, uint64(2))
+	assert.Equal(t, len(h.Counts), len(h.Bounds))
+	assert.Equal(t, h.Counts[len(h.Counts)-1], uint64(2))
+	assert.Check(t, h.Sum > 0)
+}
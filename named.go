@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// AllocateNamed allocates a subnet like Allocate does, and binds it to name.
+// If name is already bound, the subnet it's bound to is returned instead, such
+// that callers can request the subnet of a network again, e.g. after a
+// restart, without leaking a new one. Bindings are persisted along with
+// allocations, see WithStore.
+//
+// The binding lasts until the subnet is deallocated, either by Release or by
+// any other means.
+func (a *Allocator) AllocateNamed(name string, opts ...AllocateOption) (netip.Prefix, error) {
+	if name == "" {
+		return netip.Prefix{}, errors.New("empty allocation name")
+	}
+
+	o := newAllocateOptions(opts)
+	prev := a.beginAudit(AuditAllocate, o.actor)
+	for attempt := 0; ; attempt++ {
+		p, err := a.allocateNamed(name, opts)
+		if attempt < maxConflictRetries && errors.Is(err, ErrStoreConflict) {
+			continue
+		}
+		a.endAudit(prev, p, o.owner, err)
+		return p, err
+	}
+}
+
+func (a *Allocator) allocateNamed(name string, opts []AllocateOption) (netip.Prefix, error) {
+	if p, ok := a.names[name]; ok {
+		return p, nil
+	}
+
+	o := newAllocateOptions(opts)
+	next, _, err := a.pickAdmitted(o)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	m := a.newMeta(o)
+	m.Name, m.key = name, ""
+	if err := a.add(next, m); err != nil {
+		return netip.Prefix{}, err
+	}
+	return next, nil
+}
+
+// Release deallocates the subnet bound to name. Like with Deallocate, a
+// pinned subnet is only released with WithForce.
+func (a *Allocator) Release(name string, opts ...DeallocateOption) error {
+	p := a.names[name]
+	owner := a.meta[p].Owner
+	prev := a.beginAudit(AuditDeallocate, newDeallocateOptions(opts).actor)
+	err := a.releaseName(name, opts)
+	a.endAudit(prev, p, owner, err)
+	return err
+}
+
+func (a *Allocator) releaseName(name string, opts []DeallocateOption) error {
+	p, ok := a.names[name]
+	if !ok {
+		return fmt.Errorf("name %q is %w", name, ErrNotAllocated)
+	}
+	if err := a.checkPinned(p, newDeallocateOptions(opts)); err != nil {
+		return err
+	}
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+	return a.persist(func() error {
+		a.release(p)
+		return nil
+	})
+}
+
+// Lookup returns the subnet bound to name, if any.
+func (a *Allocator) Lookup(name string) (netip.Prefix, bool) {
+	p, ok := a.names[name]
+	return p, ok
+}
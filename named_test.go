@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAllocateNamed(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+
+	p1, err := a.AllocateNamed("net1")
+	assert.NilError(t, err)
+	assert.Equal(t, p1, netip.MustParsePrefix("10.0.0.0/24"))
+	p2, err := a.AllocateNamed("net2", WithReverse())
+	assert.NilError(t, err)
+	assert.Equal(t, p2, netip.MustParsePrefix("10.0.255.0/24"))
+
+	// Asking again returns the same subnet.
+	p, err := a.AllocateNamed("net1")
+	assert.NilError(t, err)
+	assert.Equal(t, p, p1)
+
+	p, ok := a.Lookup("net2")
+	assert.Check(t, ok)
+	assert.Equal(t, p, p2)
+	_, ok = a.Lookup("net3")
+	assert.Check(t, !ok)
+
+	_, err = a.AllocateNamed("")
+	assert.Error(t, err, "empty allocation name")
+
+	// Bindings are persisted.
+	b := mustNewAllocator(t, nil, WithStore(s))
+	p, ok = b.Lookup("net1")
+	assert.Check(t, ok)
+	assert.Equal(t, p, p1)
+
+	// Bindings go away with their subnet.
+	assert.NilError(t, a.Release("net1"))
+	assert.NilError(t, a.Deallocate(p2))
+	_, ok = a.Lookup("net1")
+	assert.Check(t, !ok)
+	_, ok = a.Lookup("net2")
+	assert.Check(t, !ok)
+	assert.ErrorIs(t, a.Release("net1"), ErrNotAllocated)
+	assert.Equal(t, len(a.Allocated()), 0)
+	assert.NilError(t, a.CheckInvariants(true))
+
+	c := mustNewAllocator(t, nil, WithStore(s))
+	_, ok = c.Lookup("net1")
+	assert.Check(t, !ok)
+}
+
+func TestRestoreMetaDuplicateName(t *testing.T) {
+	a := mustNewAllocator(t, nil)
+	err := a.replaceState(Snapshot{
+		Pools: []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}},
+		Allocated: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/24"),
+			netip.MustParsePrefix("10.0.1.0/24"),
+		},
+		Meta: map[netip.Prefix]AllocationMeta{
+			netip.MustParsePrefix("10.0.0.0/24"): {Name: "net1"},
+			netip.MustParsePrefix("10.0.1.0/24"): {Name: "net1"},
+		},
+	})
+	assert.ErrorContains(t, err, `name "net1" is bound to both`)
+	assert.Equal(t, len(a.Allocated()), 0)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// OwnerQuota limits what a single owner can hold. Zero fields mean no limit.
+type OwnerQuota struct {
+	// MaxAllocations is the maximum number of allocations.
+	MaxAllocations int
+	// MaxSpace is the maximum address space, as a prefix length: with 19,
+	// the allocations of the owner can't add up to more than a /19.
+	MaxSpace int
+}
+
+// WithOwnerQuota limits what owner can hold, see WithOwner. Allocations that
+// would take it over q fail with a QuotaExceededError. The quota set for the
+// empty owner applies to every owner without its own quota. Allocations
+// without an owner aren't limited.
+func WithOwnerQuota(owner string, q OwnerQuota) Option {
+	return func(a *Allocator) {
+		if a.ownerQuotas == nil {
+			a.ownerQuotas = map[string]OwnerQuota{}
+		}
+		a.ownerQuotas[owner] = q
+	}
+}
+
+func validateOwnerQuota(owner string, q OwnerQuota) error {
+	if q.MaxAllocations < 0 {
+		return fmt.Errorf("quota of %q: invalid maximum number of allocations %d", owner, q.MaxAllocations)
+	}
+	if q.MaxSpace < 0 || q.MaxSpace > 32 {
+		return fmt.Errorf("quota of %q: invalid maximum space /%d", owner, q.MaxSpace)
+	}
+	return nil
+}
+
+// checkOwnerQuota returns a QuotaExceededError if owner can't hold n more
+// allocations, adding up to 'addresses' more addresses, on top of what it
+// already holds. n and addresses can be negative when allocations are
+// released at the same time.
+func (a *Allocator) checkOwnerQuota(owner string, n int, addresses int64) error {
+	if owner == "" {
+		return nil
+	}
+	q, ok := a.ownerQuotas[owner]
+	if !ok {
+		if q, ok = a.ownerQuotas[""]; !ok {
+			return nil
+		}
+	}
+
+	if owned := a.owners[owner]; owned != nil {
+		n += owned.len()
+		owned.each(func(p netip.Prefix) bool {
+			addresses += int64(1) << (32 - p.Bits())
+			return true
+		})
+	}
+	if (q.MaxAllocations != 0 && n > q.MaxAllocations) ||
+		(q.MaxSpace != 0 && addresses > int64(1)<<(32-q.MaxSpace)) {
+		return &QuotaExceededError{Owner: owner, Quota: q, Allocations: n, Addresses: uint64(max(addresses, 0))}
+	}
+	return nil
+}
+
+// LookupByOwner returns the prefixes allocated for owner, sorted. See
+// WithOwner.
+func (a *Allocator) LookupByOwner(owner string) []netip.Prefix {
+	if owned := a.owners[owner]; owned != nil && owner != "" {
+		return owned.slice()
+	}
+	return nil
+}
+
+// DeallocateByOwner releases all the allocations owned by owner at once, e.g.
+// when tearing down a tenant or cleaning up after a crashed service. See
+// WithOwner. It returns the released prefixes, sorted. If any of them is
+// pinned, an error is returned and nothing is released.
+func (a *Allocator) DeallocateByOwner(owner string, opts ...DeallocateOption) ([]netip.Prefix, error) {
+	if owner == "" {
+		return nil, nil
+	}
+
+	prev := a.beginAudit(AuditDeallocate, newDeallocateOptions(opts).actor)
+	released, err := a.deallocateByOwner(owner, opts)
+	a.endAudit(prev, netip.Prefix{}, owner, err)
+	return released, err
+}
+
+func (a *Allocator) deallocateByOwner(owner string, opts []DeallocateOption) ([]netip.Prefix, error) {
+	owned := a.LookupByOwner(owner)
+	if len(owned) == 0 {
+		return nil, nil
+	}
+	o := newDeallocateOptions(opts)
+	for _, p := range owned {
+		if err := a.checkPinned(p, o); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+	err := a.persist(func() error {
+		for _, p := range owned {
+			a.releaseWith(p, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return owned, nil
+}
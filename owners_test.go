@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDeallocateByOwner(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+
+	for _, owner := range []string{"tenant1", "tenant2", "tenant1", "", "tenant1"} {
+		_, err := a.Allocate(WithOwner(owner))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24"), WithOwner("tenant1")))
+
+	released, err := a.DeallocateByOwner("tenant1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, released, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+		netip.MustParsePrefix("10.0.4.0/24"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.3.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+	assert.NilError(t, a.CheckInvariants(false))
+
+	// Unknown owners have nothing to release, and allocations without an
+	// owner can't be released that way.
+	released, err = a.DeallocateByOwner("tenant3")
+	assert.NilError(t, err)
+	assert.Equal(t, len(released), 0)
+	released, err = a.DeallocateByOwner("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(released), 0)
+	assert.Equal(t, len(a.Allocated()), 2)
+
+	// Nothing is released when the store fails.
+	s.fail = true
+	_, err = a.DeallocateByOwner("tenant2")
+	assert.ErrorIs(t, err, errStore)
+	assert.Equal(t, len(a.Allocated()), 2)
+}
+
+func TestLookupByOwner(t *testing.T) {
+	s := &memStore{}
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithStore(s), WithInvariantChecks(false))
+	pfx := netip.MustParsePrefix
+
+	p1, err := a.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+	_, err = a.AllocateNamed("net1", WithOwner("tenant2"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(pfx("10.0.10.0/24"), WithOwner("tenant1")))
+
+	tx := a.Begin()
+	_, err = tx.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+	assert.NilError(t, tx.Commit())
+
+	assert.DeepEqual(t, a.LookupByOwner("tenant1"), []netip.Prefix{
+		pfx("10.0.0.0/24"), pfx("10.0.2.0/24"), pfx("10.0.10.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, a.LookupByOwner("tenant2"), []netip.Prefix{pfx("10.0.1.0/24")}, cmpPrefix)
+	assert.Equal(t, len(a.LookupByOwner("tenant3")), 0)
+	assert.Equal(t, len(a.LookupByOwner("")), 0)
+
+	// The index is kept up to date by every mutation.
+	assert.NilError(t, a.Deallocate(p1))
+	assert.NilError(t, a.Release("net1"))
+	assert.DeepEqual(t, a.LookupByOwner("tenant1"), []netip.Prefix{pfx("10.0.2.0/24"), pfx("10.0.10.0/24")}, cmpPrefix)
+	assert.Equal(t, len(a.LookupByOwner("tenant2")), 0)
+
+	s.fail = true
+	assert.ErrorIs(t, a.DeallocateAll([]netip.Prefix{pfx("10.0.2.0/24")}), errStore)
+	assert.DeepEqual(t, a.LookupByOwner("tenant1"), []netip.Prefix{pfx("10.0.2.0/24"), pfx("10.0.10.0/24")}, cmpPrefix)
+	s.fail = false
+
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.DeepEqual(t, b.LookupByOwner("tenant1"), a.LookupByOwner("tenant1"), cmpPrefix)
+
+	assert.NilError(t, a.Reset())
+	assert.Equal(t, len(a.LookupByOwner("tenant1")), 0)
+}
+
+func TestOwnerQuota(t *testing.T) {
+	pools := []Pool{{
+		Prefix:      netip.MustParsePrefix("10.0.0.0/16"),
+		Size:        24,
+		SizeClasses: []SizeClass{{Size: 20}},
+	}}
+	a := mustNewAllocator(t, pools,
+		WithOwnerQuota("tenant1", OwnerQuota{MaxAllocations: 2}),
+		WithOwnerQuota("", OwnerQuota{MaxSpace: 20}))
+
+	// tenant1 can hold 2 allocations, whatever their size.
+	_, err := a.Allocate(WithOwner("tenant1"), WithSize(20))
+	assert.NilError(t, err)
+	p, err := a.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+	_, err = a.Allocate(WithOwner("tenant1"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Error(t, err, `owner quota exceeded: "tenant1" would hold 3 allocations, at most 2 are allowed`)
+	err = a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24"), WithOwner("tenant1"))
+	var qerr *QuotaExceededError
+	assert.Assert(t, errors.As(err, &qerr))
+	assert.DeepEqual(t, *qerr, QuotaExceededError{
+		Owner:       "tenant1",
+		Quota:       OwnerQuota{MaxAllocations: 2},
+		Allocations: 3,
+		Addresses:   4096 + 256 + 256,
+	})
+
+	// Releasing an allocation makes room for another one.
+	assert.NilError(t, a.Deallocate(p))
+	_, err = a.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+
+	// Other owners can hold up to a /20.
+	for i := 0; i < 16; i++ {
+		_, err = a.Allocate(WithOwner("tenant2"))
+		assert.NilError(t, err)
+	}
+	_, err = a.Allocate(WithOwner("tenant2"))
+	assert.Error(t, err, `owner quota exceeded: "tenant2" would hold 4352 addresses, at most a /20 is allowed`)
+	_, err = a.Allocate(WithOwner("tenant3"), WithSize(20))
+	assert.NilError(t, err)
+
+	// Allocations without an owner aren't limited.
+	_, err = a.AllocateN(20)
+	assert.NilError(t, err)
+	assert.NilError(t, a.CheckInvariants(true))
+}
+
+func TestOwnerQuotaTx(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}},
+		WithOwnerQuota("tenant1", OwnerQuota{MaxAllocations: 1}))
+	p, err := a.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+
+	tx := a.Begin()
+	_, err = tx.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+	assert.ErrorIs(t, tx.Commit(), ErrQuotaExceeded)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p}, cmpPrefix)
+
+	// Swapping an allocation for another one is fine.
+	tx = a.Begin()
+	assert.NilError(t, tx.Deallocate(p))
+	q, err := tx.Allocate(WithOwner("tenant1"))
+	assert.NilError(t, err)
+	assert.NilError(t, tx.Commit())
+	assert.DeepEqual(t, a.LookupByOwner("tenant1"), []netip.Prefix{q}, cmpPrefix)
+}
+
+func TestOwnerQuotaInvalid(t *testing.T) {
+	_, err := NewAllocator(nil, WithOwnerQuota("tenant1", OwnerQuota{MaxAllocations: -1}))
+	assert.Error(t, err, `quota of "tenant1": invalid maximum number of allocations -1`)
+	_, err = NewAllocator(nil, WithOwnerQuota("tenant1", OwnerQuota{MaxSpace: 33}))
+	assert.Error(t, err, `quota of "tenant1": invalid maximum space /33`)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// WithPinned pins the allocation, such that Deallocate, DeallocateAll,
+// DeallocateByOwner, GC, Release and Tx.Deallocate refuse to release it unless
+// WithForce is used, and ReclaimExpired skips it. Only Reset releases it
+// regardless. It protects infrastructure subnets from automation mistakes.
+func WithPinned() AllocateOption {
+	return func(o *allocateOptions) {
+		o.pinned = true
+	}
+}
+
+// DeallocateOption configures how prefixes are released.
+type DeallocateOption func(*deallocateOptions)
+
+type deallocateOptions struct {
+	force     bool
+	tombstone bool
+	actor     string
+}
+
+// WithForce releases pinned allocations too, see WithPinned.
+func WithForce() DeallocateOption {
+	return func(o *deallocateOptions) {
+		o.force = true
+	}
+}
+
+func newDeallocateOptions(opts []DeallocateOption) deallocateOptions {
+	var o deallocateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// checkPinned returns an error matching ErrPinned if p is pinned, and o
+// doesn't force its release.
+func (a *Allocator) checkPinned(p netip.Prefix, o deallocateOptions) error {
+	if a.meta[p].Pinned && !o.force {
+		return fmt.Errorf("prefix %s: %w", p, ErrPinned)
+	}
+	return nil
+}
+
+// SetPinned pins or unpins the allocated prefix p, see WithPinned.
+func (a *Allocator) SetPinned(p netip.Prefix, pinned bool) error {
+	if !a.allocated.contains(p) {
+		return fmt.Errorf("prefix %s is %w", p, ErrNotAllocated)
+	}
+
+	m := a.meta[p]
+	if m.Pinned == pinned {
+		return nil
+	}
+	m.Pinned = pinned
+	return a.persist(func() error {
+		if m.AllocationMeta.isZero() && m.key == "" {
+			a.forget(p)
+		} else {
+			a.setMeta(p, m)
+		}
+		return nil
+	})
+}
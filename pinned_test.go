@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestPinned(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+
+	p1, err := a.Allocate(WithOwner("infra"), WithPinned())
+	assert.NilError(t, err)
+	p2, err := a.Allocate(WithOwner("infra"))
+	assert.NilError(t, err)
+	m, _ := a.Metadata(p1)
+	assert.Check(t, m.Pinned)
+
+	assert.ErrorIs(t, a.Deallocate(p1), ErrPinned)
+	assert.ErrorIs(t, a.DeallocateAll([]netip.Prefix{p2, p1}), ErrPinned)
+	_, err = a.DeallocateByOwner("infra")
+	assert.Error(t, err, "prefix 10.0.0.0/24: allocation is pinned")
+
+	// GC skips pinned allocations.
+	released, err := a.GC(context.Background(), func(netip.Prefix, AllocationMeta) bool { return false })
+	assert.NilError(t, err)
+	assert.DeepEqual(t, released, []netip.Prefix{p2}, cmpPrefix)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p1}, cmpPrefix)
+
+	// Pins persist.
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.ErrorIs(t, b.Deallocate(p1), ErrPinned)
+
+	assert.NilError(t, a.Deallocate(p1, WithForce()))
+	assert.Equal(t, len(a.Allocated()), 0)
+}
+
+func TestPinnedReleasePaths(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{t: now}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	a.now = clock.now
+
+	p1, err := a.AllocateNamed("net1", WithPinned(), WithTTL(time.Minute))
+	assert.NilError(t, err)
+
+	tx := a.Begin()
+	assert.ErrorIs(t, tx.Deallocate(p1), ErrPinned)
+	assert.NilError(t, tx.Commit())
+	assert.ErrorIs(t, a.Release("net1"), ErrPinned)
+
+	// Expired pinned leases aren't reclaimed.
+	clock.t = now.Add(time.Hour)
+	released, err := a.ReclaimExpired()
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(released, 0))
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p1}, cmpPrefix)
+
+	tx = a.Begin()
+	assert.NilError(t, tx.Deallocate(p1, WithForce()))
+	tx.Rollback()
+	assert.NilError(t, a.Release("net1", WithForce()))
+	assert.Check(t, is.Len(a.Allocated(), 0))
+
+	p2, err := a.Allocate(WithPinned())
+	assert.NilError(t, err)
+	tx = a.Begin()
+	assert.NilError(t, tx.Deallocate(p2, WithForce()))
+	assert.NilError(t, tx.Commit())
+	assert.Check(t, is.Len(a.Allocated(), 0))
+
+	// Reset overrides pinning.
+	_, err = a.Allocate(WithPinned())
+	assert.NilError(t, err)
+	assert.NilError(t, a.Reset())
+	assert.Check(t, is.Len(a.Allocated(), 0))
+}
+
+func TestSetPinned(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+
+	assert.NilError(t, a.SetPinned(p, true))
+	assert.ErrorIs(t, a.Deallocate(p), ErrPinned)
+	assert.NilError(t, a.SetPinned(p, false))
+	_, ok := a.meta[p]
+	assert.Check(t, !ok)
+	assert.NilError(t, a.Deallocate(p))
+
+	assert.ErrorIs(t, a.SetPinned(p, true), ErrNotAllocated)
+}
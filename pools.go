@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RemovePolicy tells RemovePool what to do with allocations living in the
+// removed pool.
+type RemovePolicy int
+
+const (
+	// KeepAllocations leaves allocations in place. They keep blocking
+	// overlapping allocations until they're deallocated.
+	KeepAllocations RemovePolicy = iota
+	// ReleaseAllocations deallocates everything within the pool.
+	ReleaseAllocations
+	// RefuseIfAllocated makes RemovePool fail if the pool isn't empty.
+	RefuseIfAllocated
+)
+
+// AddPool adds p to the pools of a live allocator. p can't overlap with
+// existing pools, nor reuse the name of one of them.
+func (a *Allocator) AddPool(p Pool) error {
+	p = p.clone()
+	p.Prefix = p.Prefix.Masked()
+
+	if err := validatePool(p); err != nil {
+		return err
+	}
+
+	for _, existing := range a.pools {
+		if existing.Prefix.Overlaps(p.Prefix) {
+			return fmt.Errorf("pool %s overlaps with pool %s", p.Prefix, existing.Prefix)
+		}
+		if p.Name != "" && existing.Name == p.Name {
+			return fmt.Errorf("pool %s: name %q is already used by pool %s", p.Prefix, p.Name, existing.Prefix)
+		}
+	}
+
+	i, _ := slices.BinarySearchFunc(a.pools, p, func(a, b Pool) int {
+		return comparePrefix(a.Prefix, b.Prefix)
+	})
+	return a.persist(func() error {
+		a.pools = slices.Insert(a.pools, i, p)
+		a.invalidateIndexes()
+		return nil
+	})
+}
+
+// RemovePool removes the pool whose prefix is 'pool'. Allocations living in
+// that pool are handled according to policy.
+func (a *Allocator) RemovePool(pool netip.Prefix, policy RemovePolicy) error {
+	poolID := slices.IndexFunc(a.pools, func(p Pool) bool {
+		return p.Prefix == pool.Masked()
+	})
+	if poolID == -1 {
+		return fmt.Errorf("no pool %s", pool)
+	}
+
+	p := a.pools[poolID]
+	within := a.allocationsWithin(p.Prefix)
+
+	var release []netip.Prefix
+	switch policy {
+	case KeepAllocations:
+	case ReleaseAllocations:
+		for _, q := range within {
+			if err := a.checkPinned(q, deallocateOptions{}); err != nil {
+				return err
+			}
+		}
+		release = within
+	case RefuseIfAllocated:
+		if len(within) > 0 {
+			return fmt.Errorf("pool %s still has %d allocations", p.Prefix, len(within))
+		}
+	default:
+		return fmt.Errorf("unknown remove policy %d", policy)
+	}
+
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+	// Allocations are released along with the pool, such that both are
+	// rolled back if the store fails.
+	return a.persist(func() error {
+		for _, q := range release {
+			a.release(q)
+		}
+		a.pools = slices.Delete(a.pools, poolID, poolID+1)
+		a.invalidateIndexes()
+		return nil
+	})
+}
+
+// ExtendPool widens the pool named name to newPrefix, which has to contain
+// the current prefix of the pool. Allocations are left untouched.
+func (a *Allocator) ExtendPool(name string, newPrefix netip.Prefix) error {
+	poolID := slices.IndexFunc(a.pools, func(p Pool) bool {
+		return p.Name == name
+	})
+	if name == "" || poolID == -1 {
+		return fmt.Errorf("no pool named %q", name)
+	}
+
+	p := a.pools[poolID]
+	newPrefix = newPrefix.Masked()
+	if newPrefix.Bits() > p.Prefix.Bits() || !newPrefix.Contains(p.Prefix.Addr()) {
+		return fmt.Errorf("pool %q: %s doesn't contain %s", name, newPrefix, p.Prefix)
+	}
+
+	p.Prefix = newPrefix
+	if err := validatePool(p); err != nil {
+		return err
+	}
+	for i, other := range a.pools {
+		if i != poolID && other.Prefix.Overlaps(newPrefix) {
+			return fmt.Errorf("pool %s overlaps with pool %s", newPrefix, other.Prefix)
+		}
+	}
+
+	// Any pool between the new and the old start of p would overlap with
+	// newPrefix, so pools are still sorted.
+	return a.persist(func() error {
+		a.pools[poolID] = p
+		a.invalidateIndexes()
+		return nil
+	})
+}
+
+// ReplacePools swaps all the pools of the allocator at once. Allocations that
+// were in a pool but aren't covered by any of the new pools are orphaned: they
+// stay allocated, but aren't part of any pool anymore. Orphans are returned,
+// and unless allowOrphans is true, pools aren't replaced if there are any.
+func (a *Allocator) ReplacePools(pools []Pool, allowOrphans bool) ([]netip.Prefix, error) {
+	pools = normalizePools(pools)
+	if err := validatePools(pools); err != nil {
+		return nil, err
+	}
+
+	var orphans []netip.Prefix
+	for _, old := range a.pools {
+		for _, allocated := range a.allocationsWithin(old.Prefix) {
+			covered := slices.ContainsFunc(pools, func(p Pool) bool {
+				return p.Prefix.Bits() <= allocated.Bits() && p.Prefix.Contains(allocated.Addr())
+			})
+			if !covered {
+				orphans = append(orphans, allocated)
+			}
+		}
+	}
+
+	if len(orphans) > 0 && !allowOrphans {
+		return orphans, fmt.Errorf("replacing pools would orphan %d allocations", len(orphans))
+	}
+
+	err := a.persist(func() error {
+		a.pools = pools
+		a.invalidateIndexes()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+// ParsePool parses a pool written as prefix:size, such as "10.0.0.0/8:24".
+func ParsePool(s string) (Pool, error) {
+	prefix, size, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return Pool{}, fmt.Errorf("invalid pool %q: expected prefix:size", s)
+	}
+
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return Pool{}, fmt.Errorf("invalid pool %q: %w", s, err)
+	}
+
+	sz, err := strconv.Atoi(strings.TrimPrefix(size, "/"))
+	if err != nil {
+		return Pool{}, fmt.Errorf("invalid pool %q: invalid size %q", s, size)
+	}
+
+	pool := Pool{Prefix: p.Masked(), Size: sz}
+	if err := validatePool(pool); err != nil {
+		return Pool{}, err
+	}
+
+	return pool, nil
+}
+
+// ParsePools parses a comma-separated list of pools, each of them written as
+// ParsePool expects.
+func ParsePools(s string) ([]Pool, error) {
+	var pools []Pool
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		p, err := ParsePool(field)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// SplitPools splits supernet into pools of length poolBits, each of them
+// handing out subnets of the given size. For instance, 10.0.0.0/8 split into
+// /12 pools with size 24 yields 16 pools: 10.0.0.0/12, 10.16.0.0/12, etc.
+func SplitPools(supernet netip.Prefix, poolBits, size int) ([]Pool, error) {
+	supernet = supernet.Masked()
+	if !supernet.IsValid() || !supernet.Addr().Is4() {
+		return nil, fmt.Errorf("invalid supernet %s", supernet)
+	}
+	if poolBits < supernet.Bits() || poolBits > 32 {
+		return nil, fmt.Errorf("can't split %s into /%d pools", supernet, poolBits)
+	}
+	// Don't let a typo produce millions of pools.
+	if poolBits-supernet.Bits() > 16 {
+		return nil, fmt.Errorf("splitting %s into /%d pools yields too many pools", supernet, poolBits)
+	}
+
+	n := 1 << (poolBits - supernet.Bits())
+	pools := make([]Pool, 0, n)
+	for i := 0; i < n; i++ {
+		p := Pool{
+			Prefix: netip.PrefixFrom(Add(supernet.Addr(), uint64(i), uint(32-poolBits)), poolBits),
+			Size:   size,
+		}
+		if err := validatePool(p); err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+
+	return pools, nil
+}
+
+// normalizePools returns a sorted copy of pools, with their prefixes masked.
+// The copy doesn't share any map or slice with pools.
+func normalizePools(pools []Pool) []Pool {
+	pools = slices.Clone(pools)
+	for i, p := range pools {
+		pools[i] = p.clone()
+		pools[i].Prefix = p.Prefix.Masked()
+	}
+
+	slices.SortFunc(pools, func(a, b Pool) int {
+		return comparePrefix(a.Prefix, b.Prefix)
+	})
+
+	return pools
+}
+
+// mergePools drops pools contained in another one. pools must be sorted.
+func mergePools(pools []Pool) []Pool {
+	var merged []Pool
+	for _, p := range pools {
+		// Since pools are sorted, the last merged pool comes first and
+		// contains p if they overlap.
+		if len(merged) > 0 && merged[len(merged)-1].Prefix.Overlaps(p.Prefix) {
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// CGNATPrefix is the shared address space reserved for carrier-grade NAT by
+// RFC 6598.
+var CGNATPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// CGNATPools splits CGNATPrefix into pools of length poolBits, each of them
+// handing out subnets of the given size.
+func CGNATPools(poolBits, size int) ([]Pool, error) {
+	return SplitPools(CGNATPrefix, poolBits, size)
+}
+
+// validatePools checks that pools, sorted by prefix, are valid and don't
+// overlap with each other.
+func validatePools(pools []Pool) error {
+	names := map[string]netip.Prefix{}
+	for i, p := range pools {
+		if err := validatePool(p); err != nil {
+			return err
+		}
+		if i > 0 && pools[i-1].Prefix.Overlaps(p.Prefix) {
+			return fmt.Errorf("pool %s overlaps with pool %s", p.Prefix, pools[i-1].Prefix)
+		}
+		if other, ok := names[p.Name]; ok && p.Name != "" {
+			return fmt.Errorf("pool %s: name %q is already used by pool %s", p.Prefix, p.Name, other)
+		}
+		names[p.Name] = p.Prefix
+	}
+	return nil
+}
+
+func validatePool(p Pool) error {
+	if !p.Prefix.IsValid() || !p.Prefix.Addr().Is4() {
+		return fmt.Errorf("pool %s: invalid prefix", p.Prefix)
+	}
+	if p.Size < p.Prefix.Bits() || p.Size > 32 {
+		return fmt.Errorf("pool %s: invalid size /%d", p.Prefix, p.Size)
+	}
+	if p.StaticReserve < 0 || p.StaticReserve > 100 {
+		return fmt.Errorf("pool %s: invalid static reserve %d%%", p.Prefix, p.StaticReserve)
+	}
+	for _, c := range p.SizeClasses {
+		if c.Size < p.Prefix.Bits() || c.Size > 32 {
+			return fmt.Errorf("pool %s: invalid size class /%d", p.Prefix, c.Size)
+		}
+		if c.Quota < 0 {
+			return fmt.Errorf("pool %s: invalid quota %d for size class /%d", p.Prefix, c.Quota, c.Size)
+		}
+	}
+	return nil
+}
+
+// quotaLeft returns how many more subnets of the given size can be allocated
+// from the poolID-th pool, or -1 if there's no limit. It returns 0 if the pool
+// doesn't hand out subnets of that size at all.
+func (a *Allocator) quotaLeft(poolID, size int) int {
+	p := a.pools[poolID]
+
+	permitted, quota := size == p.Size, 0
+	for _, c := range p.SizeClasses {
+		if c.Size == size {
+			permitted, quota = true, c.Quota
+		}
+	}
+	if !permitted {
+		return 0
+	}
+	if quota == 0 {
+		return -1
+	}
+
+	used := 0
+	for _, allocated := range a.allocationsWithin(p.Prefix) {
+		if allocated.Bits() == size {
+			used++
+		}
+	}
+	return max(quota-used, 0)
+}
+
+// dynamicSize returns the number of addresses, from the start of p, that
+// Allocate can hand out.
+func dynamicSize(p Pool) uint64 {
+	total := uint64(1) << (32 - p.Prefix.Bits())
+	return total * uint64(100-p.StaticReserve) / 100
+}
+
+// allocationsWithin returns the allocated prefixes contained in p.
+func (a *Allocator) allocationsWithin(p netip.Prefix) []netip.Prefix {
+	var within []netip.Prefix
+	a.allocated.eachFrom(netip.PrefixFrom(p.Addr(), 0), func(allocated netip.Prefix) bool {
+		if !p.Contains(allocated.Addr()) {
+			return false
+		}
+		if allocated.Bits() >= p.Bits() {
+			within = append(within, allocated)
+		}
+		return true
+	})
+	return within
+}
+
+// invalidateIndexes drops indexes, such that they get rebuilt on next use.
+// That's needed when pools change, since bitmaps are tied to them.
+func (a *Allocator) invalidateIndexes() {
+	a.trie = nil
+	a.reserved = nil
+	a.bitmaps = nil
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAddPool(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "bridge", Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 24},
+	})
+
+	// Fill the first pool, and make sure bitmaps are built.
+	_, err := a.AllocateN(2)
+	assert.NilError(t, err)
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrNoFreePool)
+
+	assert.Error(t, a.AddPool(Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24}),
+		"pool 192.168.0.0/16 overlaps with pool 192.168.0.0/23")
+	assert.Error(t, a.AddPool(Pool{Name: "bridge", Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24}),
+		`pool 10.0.0.0/8: name "bridge" is already used by pool 192.168.0.0/23`)
+	assert.Error(t, a.AddPool(Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 4}),
+		"pool 10.0.0.0/8: invalid size /4")
+	assert.Error(t, a.AddPool(Pool{Prefix: netip.MustParsePrefix("fd00::/8"), Size: 64}),
+		"pool fd00::/8: invalid prefix")
+
+	assert.NilError(t, a.AddPool(Pool{Name: "overlay", Prefix: netip.MustParsePrefix("10.1.2.3/8"), Size: 24}))
+
+	pools := a.Pools()
+	assert.Equal(t, len(pools), 2)
+	assert.Equal(t, pools[0].Prefix, netip.MustParsePrefix("10.0.0.0/8"))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+}
+
+func TestRemovePool(t *testing.T) {
+	newAllocator := func() *Allocator {
+		return &Allocator{
+			pools: []Pool{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+				{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			},
+			allocated: newPrefixList(
+				netip.MustParsePrefix("10.0.0.0/24"),
+				netip.MustParsePrefix("10.0.1.0/24"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			),
+		}
+	}
+
+	testcases := map[string]*struct {
+		policy       RemovePolicy
+		expAllocated []netip.Prefix
+		expErr       string
+	}{
+		"Keep allocations": {
+			policy: KeepAllocations,
+			expAllocated: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/24"),
+				netip.MustParsePrefix("10.0.1.0/24"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			},
+		},
+		"Release allocations": {
+			policy: ReleaseAllocations,
+			expAllocated: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/24"),
+			},
+		},
+		"Refuse if allocated": {
+			policy: RefuseIfAllocated,
+			expErr: "pool 10.0.0.0/8 still has 2 allocations",
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			a := newAllocator()
+
+			err := a.RemovePool(netip.MustParsePrefix("10.0.0.0/8"), tc.policy)
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+				assert.Equal(t, len(a.pools), 2)
+				return
+			}
+
+			assert.NilError(t, err)
+			assert.Equal(t, len(a.pools), 1)
+			assert.DeepEqual(t, a.allocated.slice(), tc.expAllocated, cmpPrefix)
+
+			p, err := a.Allocate()
+			assert.NilError(t, err)
+			assert.Equal(t, p, netip.MustParsePrefix("192.168.1.0/24"))
+		})
+	}
+
+	assert.Error(t, newAllocator().RemovePool(netip.MustParsePrefix("172.16.0.0/12"), KeepAllocations),
+		"no pool 172.16.0.0/12")
+}
+
+func TestRemovePoolRollback(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	}, WithStore(s))
+	prefixes, err := a.AllocateN(2)
+	assert.NilError(t, err)
+
+	// Allocations and the pool are rolled back together.
+	s.fail = true
+	assert.ErrorIs(t, a.RemovePool(netip.MustParsePrefix("10.0.0.0/8"), ReleaseAllocations), errStore)
+	s.fail = false
+	assert.Equal(t, len(a.Pools()), 2)
+	assert.DeepEqual(t, a.Allocated(), prefixes, cmpPrefix)
+
+	assert.NilError(t, a.SetPinned(prefixes[0], true))
+	assert.ErrorIs(t, a.RemovePool(netip.MustParsePrefix("10.0.0.0/8"), ReleaseAllocations), ErrPinned)
+	assert.NilError(t, a.SetPinned(prefixes[0], false))
+
+	assert.NilError(t, a.RemovePool(netip.MustParsePrefix("10.0.0.0/8"), ReleaseAllocations))
+	assert.Equal(t, len(a.Pools()), 1)
+	assert.Equal(t, len(a.Allocated()), 0)
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.Equal(t, len(b.Pools()), 1)
+	assert.Equal(t, len(b.Allocated()), 0)
+}
+
+func TestReplacePools(t *testing.T) {
+	newAllocator := func() *Allocator {
+		return &Allocator{
+			pools: []Pool{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+				{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			},
+			allocated: newPrefixList(
+				netip.MustParsePrefix("10.0.0.0/24"),
+				netip.MustParsePrefix("10.1.0.0/24"),
+				// Static allocation, outside of any pool.
+				netip.MustParsePrefix("172.16.0.0/24"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			),
+		}
+	}
+
+	testcases := map[string]*struct {
+		pools        []Pool
+		allowOrphans bool
+		expOrphans   []netip.Prefix
+		expErr       string
+		expReplaced  bool
+	}{
+		"All allocations covered": {
+			pools: []Pool{
+				{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+				{Prefix: netip.MustParsePrefix("10.0.0.0/15"), Size: 24},
+			},
+			expReplaced: true,
+		},
+		"Orphans refused": {
+			pools: []Pool{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24},
+			},
+			expOrphans: []netip.Prefix{
+				netip.MustParsePrefix("10.1.0.0/24"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			},
+			expErr: "replacing pools would orphan 2 allocations",
+		},
+		"Orphans allowed": {
+			pools: []Pool{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24},
+			},
+			allowOrphans: true,
+			expOrphans: []netip.Prefix{
+				netip.MustParsePrefix("10.1.0.0/24"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+			},
+			expReplaced: true,
+		},
+		"Overlapping pools": {
+			pools: []Pool{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24},
+			},
+			expErr: "pool 10.0.0.0/16 overlaps with pool 10.0.0.0/8",
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			a := newAllocator()
+
+			orphans, err := a.ReplacePools(tc.pools, tc.allowOrphans)
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+			} else {
+				assert.NilError(t, err)
+			}
+			assert.DeepEqual(t, orphans, tc.expOrphans, cmpPrefix)
+
+			if tc.expReplaced {
+				assert.Equal(t, len(a.pools), len(tc.pools))
+			} else {
+				assert.Equal(t, a.pools[0].Prefix, netip.MustParsePrefix("10.0.0.0/8"))
+			}
+			// Allocations are never released.
+			assert.Equal(t, a.allocated.len(), 4)
+		})
+	}
+}
+
+func TestSplitPools(t *testing.T) {
+	pools, err := SplitPools(netip.MustParsePrefix("10.0.0.0/8"), 12, 24)
+	assert.NilError(t, err)
+	assert.Equal(t, len(pools), 16)
+	assert.Equal(t, pools[0].Prefix, netip.MustParsePrefix("10.0.0.0/12"))
+	assert.Equal(t, pools[1].Prefix, netip.MustParsePrefix("10.16.0.0/12"))
+	assert.Equal(t, pools[15].Prefix, netip.MustParsePrefix("10.240.0.0/12"))
+	for _, p := range pools {
+		assert.Equal(t, p.Size, 24)
+	}
+
+	pools, err = SplitPools(netip.MustParsePrefix("172.17.0.0/16"), 16, 16)
+	assert.NilError(t, err)
+	assert.Equal(t, len(pools), 1)
+	assert.Equal(t, pools[0].Prefix, netip.MustParsePrefix("172.17.0.0/16"))
+
+	_, err = SplitPools(netip.MustParsePrefix("10.0.0.0/8"), 4, 24)
+	assert.Error(t, err, "can't split 10.0.0.0/8 into /4 pools")
+
+	_, err = SplitPools(netip.MustParsePrefix("10.0.0.0/8"), 30, 32)
+	assert.Error(t, err, "splitting 10.0.0.0/8 into /30 pools yields too many pools")
+
+	_, err = SplitPools(netip.MustParsePrefix("10.0.0.0/8"), 12, 8)
+	assert.Error(t, err, "pool 10.0.0.0/12: invalid size /8")
+}
+
+func TestSizeClasses(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{
+			Prefix: netip.MustParsePrefix("10.0.0.0/16"),
+			Size:   24,
+			SizeClasses: []SizeClass{
+				{Size: 24, Quota: 2},
+				{Size: 20, Quota: 1},
+				{Size: 28},
+			},
+		},
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	})
+
+	// Quotas are enforced by AllocateN too.
+	prefixes, err := a.AllocateN(3)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prefixes, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+	}, cmpPrefix)
+
+	p, err := a.Allocate(WithSize(20))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.16.0/20"))
+
+	_, err = a.Allocate(WithSize(20))
+	assert.ErrorIs(t, err, ErrNoFreePool)
+
+	p, err = a.Allocate(WithSize(28))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.2.0/28"))
+
+	// The /24 quota of the first pool is exhausted.
+	p, err = a.Allocate(WithHint(netip.MustParsePrefix("10.0.3.0/24")))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.1.0/24"))
+
+	// Freeing a subnet gives some quota back.
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("10.0.1.0/24")))
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.1.0/24"))
+
+	err = a.AddPool(Pool{
+		Prefix:      netip.MustParsePrefix("172.16.0.0/12"),
+		Size:        24,
+		SizeClasses: []SizeClass{{Size: 8}},
+	})
+	assert.Error(t, err, "pool 172.16.0.0/12: invalid size class /8")
+}
+
+func TestStaticReserve(t *testing.T) {
+	for _, size := range []int{24, 28} {
+		t.Run(fmt.Sprintf("Size /%d", size), func(t *testing.T) {
+			// Subnets of size /28 don't get a bitmap.
+			a := mustNewAllocator(t, []Pool{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: size, StaticReserve: 25},
+			})
+
+			p, err := a.Allocate(WithReverse())
+			assert.NilError(t, err)
+			assert.Equal(t, lastAddr(p), netip.MustParsePrefix("10.191.255.255/32").Addr())
+
+			// Hints within the reserve are ignored.
+			p, err = a.Allocate(WithHint(netip.PrefixFrom(netip.MustParseAddr("10.192.0.0"), size)))
+			assert.NilError(t, err)
+			assert.Equal(t, p, netip.PrefixFrom(netip.MustParseAddr("10.0.0.0"), size))
+
+			assert.NilError(t, a.AllocateStatic(netip.PrefixFrom(netip.MustParseAddr("10.192.0.0"), size)))
+		})
+	}
+
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/22"), Size: 24, StaticReserve: 50},
+	})
+	prefixes := a.Suggest(4)
+	assert.DeepEqual(t, prefixes, []netip.Prefix{
+		netip.MustParsePrefix("192.168.0.0/24"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}, cmpPrefix)
+
+	a = mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/22"), Size: 24, StaticReserve: 100},
+	})
+	_, err := a.Allocate()
+	assert.ErrorIs(t, err, ErrNoFreePool)
+
+	err = a.AddPool(Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24, StaticReserve: 101})
+	assert.Error(t, err, "pool 10.0.0.0/8: invalid static reserve 101%")
+}
+
+func TestExtendPool(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "low", Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24},
+		{Name: "bridge", Prefix: netip.MustParsePrefix("192.168.1.0/24"), Size: 24},
+		{Name: "high", Prefix: netip.MustParsePrefix("192.169.0.0/16"), Size: 24},
+	})
+
+	p, err := a.Allocate(WithHint(netip.MustParsePrefix("192.168.1.0/24")))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.1.0/24"))
+
+	assert.Error(t, a.ExtendPool("bridge", netip.MustParsePrefix("192.168.0.0/15")),
+		"pool 192.168.0.0/15 overlaps with pool 192.169.0.0/16")
+	assert.Error(t, a.ExtendPool("bridge", netip.MustParsePrefix("192.168.1.0/25")),
+		`pool "bridge": 192.168.1.0/25 doesn't contain 192.168.1.0/24`)
+	assert.Error(t, a.ExtendPool("unknown", netip.MustParsePrefix("192.168.0.0/16")),
+		`no pool named "unknown"`)
+
+	assert.NilError(t, a.ExtendPool("bridge", netip.MustParsePrefix("192.168.0.0/16")))
+	assert.NilError(t, a.ExtendPool("low", netip.MustParsePrefix("8.0.0.0/6")))
+
+	pools := a.Pools()
+	assert.Equal(t, pools[0].Name, "low")
+	assert.Equal(t, pools[0].Prefix, netip.MustParsePrefix("8.0.0.0/6"))
+	assert.Equal(t, pools[1].Name, "bridge")
+	assert.Equal(t, pools[1].Prefix, netip.MustParsePrefix("192.168.0.0/16"))
+
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("8.0.0.0/24"))
+}
+
+func TestNewAllocatorOverlappingPools(t *testing.T) {
+	pools := []Pool{
+		{Name: "small", Prefix: netip.MustParsePrefix("10.1.0.0/16"), Size: 24},
+		{Name: "big", Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+		{Name: "other", Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		{Name: "tiny", Prefix: netip.MustParsePrefix("10.2.3.0/24"), Size: 24},
+	}
+
+	_, err := NewAllocator(pools)
+	assert.Error(t, err, "pool 10.1.0.0/16 overlaps with pool 10.0.0.0/8")
+
+	a, err := NewAllocator(pools, WithMergedPools())
+	assert.NilError(t, err)
+
+	got := a.Pools()
+	assert.Equal(t, len(got), 2)
+	assert.Equal(t, got[0].Name, "big")
+	assert.Equal(t, got[1].Name, "other")
+
+	_, err = NewAllocator([]Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 33}})
+	assert.Error(t, err, "pool 10.0.0.0/8: invalid size /33")
+}
+
+func TestParsePool(t *testing.T) {
+	testcases := map[string]*struct {
+		spec      string
+		expPrefix netip.Prefix
+		expSize   int
+		expErr    string
+	}{
+		"Valid": {
+			spec:      "10.0.0.0/8:24",
+			expPrefix: netip.MustParsePrefix("10.0.0.0/8"),
+			expSize:   24,
+		},
+		"Size with a slash and unmasked prefix": {
+			spec:      " 172.17.1.0/16:/20 ",
+			expPrefix: netip.MustParsePrefix("172.17.0.0/16"),
+			expSize:   20,
+		},
+		"Missing size": {
+			spec:   "10.0.0.0/8",
+			expErr: `invalid pool "10.0.0.0/8": expected prefix:size`,
+		},
+		"Invalid prefix": {
+			spec:   "10.0.0.0:24",
+			expErr: `invalid pool "10.0.0.0:24": netip.ParsePrefix("10.0.0.0"): no '/'`,
+		},
+		"Invalid size": {
+			spec:   "10.0.0.0/8:abc",
+			expErr: `invalid pool "10.0.0.0/8:abc": invalid size "abc"`,
+		},
+		"Size out of range": {
+			spec:   "10.0.0.0/8:4",
+			expErr: "pool 10.0.0.0/8: invalid size /4",
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			p, err := ParsePool(tc.spec)
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+				return
+			}
+
+			assert.NilError(t, err)
+			assert.Equal(t, p.Prefix, tc.expPrefix)
+			assert.Equal(t, p.Size, tc.expSize)
+		})
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	pools, err := ParsePools("10.0.0.0/8:24, 192.168.0.0/16:24,")
+	assert.NilError(t, err)
+	assert.Equal(t, len(pools), 2)
+	assert.Equal(t, pools[1].Prefix, netip.MustParsePrefix("192.168.0.0/16"))
+
+	_, err = ParsePools("10.0.0.0/8:24,192.168.0.0/16")
+	assert.Error(t, err, `invalid pool "192.168.0.0/16": expected prefix:size`)
+}
+
+func TestCGNATPools(t *testing.T) {
+	pools, err := CGNATPools(12, 24)
+	assert.NilError(t, err)
+	assert.Equal(t, len(pools), 4)
+	assert.Equal(t, pools[0].Prefix, netip.MustParsePrefix("100.64.0.0/12"))
+	assert.Equal(t, pools[3].Prefix, netip.MustParsePrefix("100.112.0.0/12"))
+
+	a := mustNewAllocator(t, pools)
+	p, err := a.Allocate(WithReverse())
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("100.127.255.0/24"))
+
+	_, err = CGNATPools(8, 24)
+	assert.Error(t, err, "can't split 100.64.0.0/10 into /8 pools")
+}
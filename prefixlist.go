@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// maxChunkLen is the maximum number of prefixes stored in a chunk. Inserting
+// or removing a prefix moves at most that many prefixes around, plus the
+// chunk headers.
+const maxChunkLen = 512
+
+// prefixList is a sorted list of prefixes stored as a list of small sorted
+// chunks, such that inserting in the middle doesn't need to copy the whole
+// tail of the list.
+type prefixList struct {
+	chunks [][]netip.Prefix
+	n      int
+}
+
+func newPrefixList(prefixes ...netip.Prefix) prefixList {
+	prefixes = slices.Clone(prefixes)
+	slices.SortFunc(prefixes, comparePrefix)
+	prefixes = slices.Compact(prefixes)
+
+	l := prefixList{n: len(prefixes)}
+	for len(prefixes) > 0 {
+		// Leave room in each chunk, so that the first inserts don't split
+		// everything.
+		n := min(len(prefixes), maxChunkLen/2)
+		l.chunks = append(l.chunks, slices.Clip(prefixes[:n]))
+		prefixes = prefixes[n:]
+	}
+
+	return l
+}
+
+func (l *prefixList) len() int {
+	return l.n
+}
+
+// insert adds p to the list, unless it's already there.
+func (l *prefixList) insert(p netip.Prefix) bool {
+	if len(l.chunks) == 0 {
+		l.chunks = append(l.chunks, []netip.Prefix{p})
+		l.n++
+		return true
+	}
+
+	c := l.chunkFor(p)
+	i, found := slices.BinarySearchFunc(l.chunks[c], p, comparePrefix)
+	if found {
+		return false
+	}
+
+	l.chunks[c] = slices.Insert(l.chunks[c], i, p)
+	l.n++
+
+	if chunk := l.chunks[c]; len(chunk) > maxChunkLen {
+		half := len(chunk) / 2
+		tail := slices.Clone(chunk[half:])
+		l.chunks[c] = slices.Clip(chunk[:half])
+		l.chunks = slices.Insert(l.chunks, c+1, tail)
+	}
+
+	return true
+}
+
+// remove deletes p from the list. It returns false if p wasn't there.
+func (l *prefixList) remove(p netip.Prefix) bool {
+	if len(l.chunks) == 0 {
+		return false
+	}
+
+	c := l.chunkFor(p)
+	i, found := slices.BinarySearchFunc(l.chunks[c], p, comparePrefix)
+	if !found {
+		return false
+	}
+
+	l.chunks[c] = slices.Delete(l.chunks[c], i, i+1)
+	l.n--
+
+	if len(l.chunks[c]) == 0 {
+		l.chunks = slices.Delete(l.chunks, c, c+1)
+	}
+
+	return true
+}
+
+func (l *prefixList) contains(p netip.Prefix) bool {
+	if len(l.chunks) == 0 {
+		return false
+	}
+	_, found := slices.BinarySearchFunc(l.chunks[l.chunkFor(p)], p, comparePrefix)
+	return found
+}
+
+// each calls fn for every prefix, in order, until fn returns false.
+func (l *prefixList) each(fn func(p netip.Prefix) bool) {
+	for _, c := range l.chunks {
+		for _, p := range c {
+			if !fn(p) {
+				return
+			}
+		}
+	}
+}
+
+// eachFrom is the same as each, but it starts from the first prefix that
+// isn't lower than p.
+func (l *prefixList) eachFrom(p netip.Prefix, fn func(p netip.Prefix) bool) {
+	if len(l.chunks) == 0 {
+		return
+	}
+
+	c := l.chunkFor(p)
+	i, _ := slices.BinarySearchFunc(l.chunks[c], p, comparePrefix)
+	for ; c < len(l.chunks); c, i = c+1, 0 {
+		for _, p := range l.chunks[c][i:] {
+			if !fn(p) {
+				return
+			}
+		}
+	}
+}
+
+// slice returns a copy of the list as a flat slice.
+func (l *prefixList) slice() []netip.Prefix {
+	s := make([]netip.Prefix, 0, l.n)
+	for _, c := range l.chunks {
+		s = append(s, c...)
+	}
+	return s
+}
+
+// chunkFor returns the index of the chunk where p lives, or should be
+// inserted: the first chunk whose last prefix isn't lower than p.
+func (l *prefixList) chunkFor(p netip.Prefix) int {
+	c, _ := slices.BinarySearchFunc(l.chunks, p, func(chunk []netip.Prefix, p netip.Prefix) int {
+		return comparePrefix(chunk[len(chunk)-1], p)
+	})
+	if c == len(l.chunks) {
+		// p comes after everything, append it to the last chunk.
+		c--
+	}
+	return c
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestPrefixList(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	var l prefixList
+	var expected []netip.Prefix
+	for i := 0; i < 5*maxChunkLen; i++ {
+		p := netip.PrefixFrom(Add(netip.MustParseAddr("10.0.0.0"), uint64(rnd.Intn(1<<16)), 8), 24)
+		if l.insert(p) {
+			expected = append(expected, p)
+		}
+	}
+	slices.SortFunc(expected, comparePrefix)
+
+	assert.Equal(t, l.len(), len(expected))
+	assert.DeepEqual(t, l.slice(), expected, cmpPrefix)
+	for _, c := range l.chunks {
+		assert.Assert(t, len(c) <= maxChunkLen)
+	}
+
+	for i, p := range expected {
+		if i%3 == 0 {
+			assert.Assert(t, l.remove(p))
+		}
+	}
+	expected = slices.DeleteFunc(expected, func(p netip.Prefix) bool {
+		return !slices.Contains(l.slice(), p)
+	})
+
+	assert.Equal(t, l.len(), len(expected))
+	assert.Assert(t, !l.remove(netip.MustParsePrefix("192.168.0.0/24")))
+}
+
+func TestNewPrefixList(t *testing.T) {
+	l := newPrefixList(
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	)
+
+	assert.Equal(t, l.len(), 3)
+	assert.DeepEqual(t, l.slice(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}, cmpPrefix)
+}
+
+func BenchmarkPrefixListInsertFront(b *testing.B) {
+	var l prefixList
+	for i := 0; i < 1<<18; i++ {
+		l.insert(netip.PrefixFrom(Add(netip.MustParseAddr("10.0.0.0"), uint64(i), 8), 30))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := netip.PrefixFrom(Add(netip.MustParseAddr("0.0.0.0"), uint64(i), 8), 32)
+		l.insert(p)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build prometheus
+
+// The Prometheus collector is only built with the prometheus build tag, such
+// that the allocator doesn't depend on the Prometheus client unless needed.
+// Build with:
+//
+//	go get github.com/prometheus/client_golang
+//	go build -tags prometheus
+
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	poolLabels = []string{"pool", "name"}
+
+	poolCapacityDesc = prometheus.NewDesc("subnet_allocator_pool_capacity",
+		"Number of subnets of the pool size the pool holds.", poolLabels, nil)
+	poolAllocatedDesc = prometheus.NewDesc("subnet_allocator_pool_allocated",
+		"Number of allocations within the pool.", poolLabels, nil)
+	poolFreeDesc = prometheus.NewDesc("subnet_allocator_pool_free",
+		"Number of subnets of the pool size that can still be allocated.", poolLabels, nil)
+	allocationsDesc = prometheus.NewDesc("subnet_allocator_allocations_total",
+		"Number of subnets allocated.", nil, nil)
+	deallocationsDesc = prometheus.NewDesc("subnet_allocator_deallocations_total",
+		"Number of subnets released.", nil, nil)
+	exhaustedDesc = prometheus.NewDesc("subnet_allocator_exhausted_total",
+		"Number of allocations that failed because no pool had a free subnet.", nil, nil)
+	scannedPoolsDesc = prometheus.NewDesc("subnet_allocator_scanned_pools_total",
+		"Number of pools considered by successful allocations.", nil, nil)
+	scannedEntriesDesc = prometheus.NewDesc("subnet_allocator_scanned_entries_total",
+		"Number of allocated and reserved prefixes jumped over by successful allocations.", nil, nil)
+	allocateDurationDesc = prometheus.NewDesc("subnet_allocator_allocate_duration_seconds",
+		"Time taken by Allocate.", nil, nil)
+)
+
+// Collector is a prometheus.Collector exposing the utilization of the pools
+// of an allocator, see Stats, and its Counters.
+//
+// The allocator isn't safe for concurrent use, so the collector holds mu
+// while reading from it. mu must be the lock guarding every other use of the
+// allocator.
+type Collector struct {
+	a  *Allocator
+	mu sync.Locker
+}
+
+// NewCollector returns a Collector for a, guarded by mu. Register it with a
+// prometheus.Registerer to expose it.
+func NewCollector(a *Allocator, mu sync.Locker) *Collector {
+	return &Collector{a: a, mu: mu}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		poolCapacityDesc, poolAllocatedDesc, poolFreeDesc,
+		allocationsDesc, deallocationsDesc, exhaustedDesc,
+		scannedPoolsDesc, scannedEntriesDesc, allocateDurationDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	stats := c.a.Stats()
+	counters := c.a.Counters()
+	c.mu.Unlock()
+
+	for _, ps := range stats.Pools {
+		labels := []string{ps.Prefix.String(), ps.Name}
+		ch <- prometheus.MustNewConstMetric(poolCapacityDesc, prometheus.GaugeValue, float64(ps.Capacity), labels...)
+		ch <- prometheus.MustNewConstMetric(poolAllocatedDesc, prometheus.GaugeValue, float64(ps.Allocated), labels...)
+		ch <- prometheus.MustNewConstMetric(poolFreeDesc, prometheus.GaugeValue, float64(ps.Free), labels...)
+	}
+
+	ch <- prometheus.MustNewConstMetric(allocationsDesc, prometheus.CounterValue, float64(counters.Allocations))
+	ch <- prometheus.MustNewConstMetric(deallocationsDesc, prometheus.CounterValue, float64(counters.Deallocations))
+	ch <- prometheus.MustNewConstMetric(exhaustedDesc, prometheus.CounterValue, float64(counters.Exhausted))
+	ch <- prometheus.MustNewConstMetric(scannedPoolsDesc, prometheus.CounterValue, float64(counters.ScannedPools))
+	ch <- prometheus.MustNewConstMetric(scannedEntriesDesc, prometheus.CounterValue, float64(counters.ScannedEntries))
+
+	h := counters.AllocateLatency
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	for i, bound := range h.Bounds {
+		buckets[bound.Seconds()] = h.Counts[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(allocateDurationDesc, h.Count, h.Sum.Seconds(), buckets)
+}
@@ -0,0 +1,48 @@
+//go:build prometheus
+
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gotest.tools/v3/assert"
+)
+
+func TestCollector(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Name: "default", Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}})
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NilError(t, reg.Register(NewCollector(a, &sync.Mutex{})))
+	families, err := reg.Gather()
+	assert.NilError(t, err)
+
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch {
+			case m.GetGauge() != nil:
+				values[f.GetName()] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[f.GetName()] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				values[f.GetName()] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	assert.DeepEqual(t, values, map[string]float64{
+		"subnet_allocator_pool_capacity":             4,
+		"subnet_allocator_pool_allocated":            1,
+		"subnet_allocator_pool_free":                 3,
+		"subnet_allocator_allocations_total":         1,
+		"subnet_allocator_deallocations_total":       0,
+		"subnet_allocator_exhausted_total":           0,
+		"subnet_allocator_scanned_pools_total":       1,
+		"subnet_allocator_scanned_entries_total":     0,
+		"subnet_allocator_allocate_duration_seconds": 1,
+	})
+}
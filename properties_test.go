@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/akerouanton/subnet-allocator/allocatortest"
+	"gotest.tools/v3/assert"
+)
+
+// TestAllocatorProperties exhausts random pools, and checks that allocations
+// honor the contract of the allocator.
+func TestAllocatorProperties(t *testing.T) {
+	for seed := range uint64(50) {
+		r := rand.New(rand.NewPCG(seed, 0))
+		specs := allocatortest.RandomPools(r, netip.MustParsePrefix("10.0.0.0/8"), 4, 8)
+		reserved := allocatortest.RandomReserved(r, specs, 3)
+
+		var pools []Pool
+		for _, s := range specs {
+			pools = append(pools, Pool{Prefix: s.Prefix, Size: s.Size})
+		}
+		a := mustNewAllocator(t, pools)
+		for _, p := range reserved {
+			a.AddReserved(p)
+		}
+
+		var free uint64
+		for _, p := range pools {
+			free += a.CountFree(p.Prefix)
+		}
+
+		var n uint64
+		for {
+			_, err := a.Allocate()
+			if errors.Is(err, ErrNoFreePool) {
+				break
+			}
+			assert.NilError(t, err, "seed %d", seed)
+			n++
+		}
+
+		assert.Equal(t, n, free, "seed %d", seed)
+		allocatortest.AssertAllocations(t, a.Allocated(), specs, reserved)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// MarshalProto encodes the same state as MarshalJSON as a Snapshot message,
+// see allocator.proto.
+func (a *Allocator) MarshalProto() ([]byte, error) {
+	var buf []byte
+	buf = appendProtoVarint(buf, 1, stateVersion)
+	for _, p := range a.pools {
+		msg, err := appendProtoPool(nil, p)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendProtoBytes(buf, 2, msg)
+	}
+	for p := range a.Allocations() {
+		msg := appendProtoBytes(nil, 1, []byte(p.String()))
+		m := a.meta[p]
+		if m.Name != "" {
+			msg = appendProtoBytes(msg, 2, []byte(m.Name))
+		}
+		if m.Owner != "" {
+			msg = appendProtoBytes(msg, 3, []byte(m.Owner))
+		}
+		msg = appendProtoLabels(msg, 4, m.Labels)
+		if !m.Expires.IsZero() {
+			msg = appendProtoVarint(msg, 5, uint64(m.Expires.UnixNano()))
+		}
+		if m.Pinned {
+			msg = appendProtoVarint(msg, 6, 1)
+		}
+		buf = appendProtoBytes(buf, 3, msg)
+	}
+	a.reservedSet.each(func(p netip.Prefix) bool {
+		buf = appendProtoBytes(buf, 4, []byte(p.String()))
+		return true
+	})
+	a.tombstones.each(func(p netip.Prefix) bool {
+		buf = appendProtoBytes(buf, 5, []byte(p.String()))
+		return true
+	})
+	return buf, nil
+}
+
+// UnmarshalProto decodes a Snapshot message. Unknown fields are skipped. Like
+// UnmarshalJSON, it validates the decoded state, and leaves the allocator
+// untouched on error.
+func (a *Allocator) UnmarshalProto(data []byte) error {
+	var version uint64
+	var pools []Pool
+	var allocated, reserved, tombstones []netip.Prefix
+	var meta map[netip.Prefix]AllocationMeta
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			version = f.varint
+		case 2:
+			p, err := readProtoPool(f.bytes)
+			if err != nil {
+				return err
+			}
+			pools = append(pools, p)
+		case 3:
+			var p netip.Prefix
+			var m AllocationMeta
+			err := readProtoFields(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					var err error
+					if p, err = netip.ParsePrefix(string(f.bytes)); err != nil {
+						return fmt.Errorf("%w: %w", ErrInvalidPrefix, err)
+					}
+				case 2:
+					m.Name = string(f.bytes)
+				case 3:
+					m.Owner = string(f.bytes)
+				case 4:
+					return readProtoLabel(f.bytes, &m.Labels)
+				case 5:
+					if f.varint != 0 {
+						m.Expires = time.Unix(0, int64(f.varint))
+					}
+				case 6:
+					m.Pinned = f.varint != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			allocated = append(allocated, p)
+			if !m.isZero() {
+				if meta == nil {
+					meta = map[netip.Prefix]AllocationMeta{}
+				}
+				meta[p] = m
+			}
+		case 4:
+			p, err := netip.ParsePrefix(string(f.bytes))
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidPrefix, err)
+			}
+			reserved = append(reserved, p)
+		case 5:
+			p, err := netip.ParsePrefix(string(f.bytes))
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidPrefix, err)
+			}
+			tombstones = append(tombstones, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if version > stateVersion {
+		return fmt.Errorf("unsupported state version %d", version)
+	}
+
+	return a.replaceState(Snapshot{Pools: pools, Allocated: allocated, Reserved: reserved, Tombstones: tombstones, Meta: meta})
+}
+
+func appendProtoPool(buf []byte, p Pool) ([]byte, error) {
+	if p.Name != "" {
+		buf = appendProtoBytes(buf, 1, []byte(p.Name))
+	}
+	buf = appendProtoBytes(buf, 2, []byte(p.Prefix.String()))
+	buf = appendProtoVarint(buf, 3, uint64(p.Size))
+
+	buf = appendProtoLabels(buf, 4, p.Labels)
+	if len(p.Metadata) > 0 {
+		metadata, err := json.Marshal(p.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", p.Prefix, err)
+		}
+		buf = appendProtoBytes(buf, 5, metadata)
+	}
+	if p.Overflow {
+		buf = appendProtoVarint(buf, 6, 1)
+	}
+	if p.StaticReserve != 0 {
+		buf = appendProtoVarint(buf, 7, uint64(p.StaticReserve))
+	}
+	for _, c := range p.SizeClasses {
+		var msg []byte
+		msg = appendProtoVarint(msg, 1, uint64(c.Size))
+		if c.Quota != 0 {
+			msg = appendProtoVarint(msg, 2, uint64(c.Quota))
+		}
+		buf = appendProtoBytes(buf, 8, msg)
+	}
+	return buf, nil
+}
+
+func readProtoPool(data []byte) (Pool, error) {
+	var p Pool
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			p.Name = string(f.bytes)
+		case 2:
+			prefix, err := netip.ParsePrefix(string(f.bytes))
+			if err != nil {
+				return fmt.Errorf("invalid pool prefix: %w", err)
+			}
+			p.Prefix = prefix
+		case 3:
+			p.Size = int(f.varint)
+		case 4:
+			return readProtoLabel(f.bytes, &p.Labels)
+		case 5:
+			if err := json.Unmarshal(f.bytes, &p.Metadata); err != nil {
+				return fmt.Errorf("invalid pool metadata: %w", err)
+			}
+		case 6:
+			p.Overflow = f.varint != 0
+		case 7:
+			p.StaticReserve = int(f.varint)
+		case 8:
+			var c SizeClass
+			err := readProtoFields(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					c.Size = int(f.varint)
+				case 2:
+					c.Quota = int(f.varint)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			p.SizeClasses = append(p.SizeClasses, c)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// appendProtoLabels encodes labels as a map<string, string> field. Entries
+// are sorted, such that the encoding is deterministic.
+func appendProtoLabels(buf []byte, num int, labels map[string]string) []byte {
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		var entry []byte
+		entry = appendProtoBytes(entry, 1, []byte(k))
+		entry = appendProtoBytes(entry, 2, []byte(labels[k]))
+		buf = appendProtoBytes(buf, num, entry)
+	}
+	return buf
+}
+
+// readProtoLabel decodes a map entry, and adds it to labels.
+func readProtoLabel(data []byte, labels *map[string]string) error {
+	var k, v string
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			k = string(f.bytes)
+		case 2:
+			v = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *labels == nil {
+		*labels = map[string]string{}
+	}
+	(*labels)[k] = v
+	return nil
+}
+
+func appendProtoVarint(buf []byte, num int, v uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendProtoBytes(buf []byte, num int, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num)<<3|wireBytes)
+	return appendBytes(buf, b)
+}
+
+// protoField is a decoded field. Depending on its wire type, its value is
+// either in varint or in bytes.
+type protoField struct {
+	num    uint64
+	varint uint64
+	bytes  []byte
+}
+
+// readProtoFields calls fn for every varint and length-delimited field of the
+// message encoded in data. Fixed-size fields aren't used by the schema, so
+// they're skipped.
+func readProtoFields(data []byte, fn func(f protoField) error) error {
+	r := &snapshotReader{buf: data}
+	for len(r.buf) > 0 && r.err == nil {
+		key := r.uvarint()
+		f := protoField{num: key >> 3}
+		switch key & 7 {
+		case wireVarint:
+			f.varint = r.uvarint()
+		case wireBytes:
+			f.bytes = r.bytes()
+		case wireFixed64:
+			r.fixed(8)
+			continue
+		case wireFixed32:
+			r.fixed(4)
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if r.err != nil {
+			break
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return r.err
+}
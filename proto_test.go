@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestProtoRoundTrip(t *testing.T) {
+	a := newSnapshotAllocator(t)
+
+	data, err := a.MarshalProto()
+	assert.NilError(t, err)
+
+	b := mustNewAllocator(t, nil)
+	assert.NilError(t, b.UnmarshalProto(data))
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+}
+
+func TestProtoWireFormat(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24}})
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+
+	// Snapshot{version: 1, pools: [{prefix: "10.0.0.0/8", size: 24}], allocations: [{prefix: "10.0.0.0/24"}]}
+	const want = "\x08\x01" +
+		"\x12\x0e\x12\x0a10.0.0.0/8\x18\x18" +
+		"\x1a\x0d\x0a\x0b10.0.0.0/24"
+
+	data, err := a.MarshalProto()
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), want)
+
+	// Unknown fields are skipped: a varint, a fixed64, a fixed32, and a
+	// string.
+	unknown := want + "\x78\x07" + "\x31\x00\x00\x00\x00\x00\x00\x00\x00" + "\x3d\x00\x00\x00\x00" + "\x42\x03foo"
+	b := mustNewAllocator(t, nil)
+	assert.NilError(t, b.UnmarshalProto([]byte(unknown)))
+	assert.DeepEqual(t, b.Allocated(), a.Allocated(), cmpPrefix)
+}
+
+func TestUnmarshalProtoInvalid(t *testing.T) {
+	testcases := []struct {
+		name   string
+		data   string
+		expErr string
+	}{
+		{
+			name:   "unknown version",
+			data:   "\x08\x02",
+			expErr: "unsupported state version 2",
+		},
+		{
+			name:   "truncated",
+			data:   "\x1a\x0d\x0a\x0b10.0",
+			expErr: "truncated snapshot",
+		},
+		{
+			name:   "invalid allocation",
+			data:   "\x1a\x05\x0a\x0310.",
+			expErr: `invalid prefix: netip.ParsePrefix("10."): no '/'`,
+		},
+		{
+			name:   "overlapping allocations",
+			data:   "\x1a\x0d\x0a\x0b10.0.0.0/24" + "\x1a\x0c\x0a\x0a10.0.0.0/8",
+			expErr: "prefixes 10.0.0.0/8 and 10.0.0.0/24 overlap",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, nil)
+			err := a.UnmarshalProto([]byte(tc.data))
+			assert.Error(t, err, tc.expErr)
+		})
+	}
+}
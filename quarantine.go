@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+)
+
+// WithQuarantine makes Allocate avoid subnets released less than d ago, to
+// give stale routes, conntrack entries and DNS records time to go away before
+// a subnet is handed out again. Quarantined subnets can still be allocated
+// statically. The quarantine isn't persisted: it starts over when the state
+// is reloaded.
+func WithQuarantine(d time.Duration) Option {
+	return func(a *Allocator) {
+		a.quarantine = d
+	}
+}
+
+// ReusePolicy tells which free subnet Allocate hands out first.
+type ReusePolicy int
+
+const (
+	// ReuseLowestAddress hands out the free subnet with the lowest address
+	// first, or the highest one with WithReverse. That's the default.
+	ReuseLowestAddress ReusePolicy = iota
+	// ReuseLeastRecentlyUsed hands out subnets that were never allocated
+	// first, in address order, and then the subnet released the longest
+	// time ago, such that state left behind by previous users of a subnet
+	// has as much time as possible to go away.
+	ReuseLeastRecentlyUsed
+)
+
+// WithReusePolicy sets the policy Allocate follows to pick among the free
+// subnets of a pool. Pools are still used in the same order, and hints are
+// still honored first. Only subnets released since the allocator was created
+// count as used.
+func WithReusePolicy(p ReusePolicy) Option {
+	return func(a *Allocator) {
+		a.reuse = p
+	}
+}
+
+// markFreed records that p was just released.
+func (a *Allocator) markFreed(p netip.Prefix) {
+	if a.quarantine <= 0 && a.reuse != ReuseLeastRecentlyUsed {
+		return
+	}
+	if a.freed == nil {
+		a.freed = map[netip.Prefix]time.Time{}
+	}
+	if len(a.freed) >= a.freedPruneAt {
+		a.pruneFreed()
+		a.freedPruneAt = max(2*len(a.freed), minFreedPrune)
+	}
+	a.freed[p] = a.now()
+}
+
+// minFreedPrune is the least number of released subnets recorded before
+// they're pruned.
+const minFreedPrune = 1024
+
+// pruneFreed forgets about the released subnets no pool holds anymore, and
+// about those out of quarantine which were allocated again, in whole or in
+// part, or which the reuse policy doesn't need.
+func (a *Allocator) pruneFreed() {
+	now := a.now()
+	for p, t := range a.freed {
+		if _, ok := a.poolIndex(p); !ok {
+			delete(a.freed, p)
+			continue
+		}
+		if now.Sub(t) < a.quarantine {
+			continue
+		}
+		if a.reuse != ReuseLeastRecentlyUsed {
+			delete(a.freed, p)
+			continue
+		}
+		// Subnets being released are still allocated, exactly. Those
+		// allocated again exactly were already forgotten, see insert.
+		if a.trie == nil {
+			continue
+		}
+		if q, ok := a.trie.overlapping(p); ok && q != p {
+			delete(a.freed, p)
+		}
+	}
+}
+
+// quarantined returns the prefixes still in quarantine. Unless the reuse
+// policy needs them, it forgets about those whose quarantine is over.
+func (a *Allocator) quarantined() []netip.Prefix {
+	if len(a.freed) == 0 || a.quarantine <= 0 {
+		return nil
+	}
+
+	now := a.now()
+	var prefixes []netip.Prefix
+	for p, t := range a.freed {
+		if now.Sub(t) >= a.quarantine {
+			if a.reuse != ReuseLeastRecentlyUsed {
+				delete(a.freed, p)
+			}
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithQuarantine(time.Minute))
+	a.now = clock.now
+
+	p1, err := a.Allocate()
+	assert.NilError(t, err)
+	p2, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p1))
+
+	// p1 is skipped while in quarantine.
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.2.0/24"))
+	assert.DeepEqual(t, a.Suggest(2), []netip.Prefix{netip.MustParsePrefix("10.0.3.0/24")}, cmpPrefix)
+
+	// But it can still be allocated statically.
+	assert.NilError(t, a.AllocateStatic(p1))
+	assert.NilError(t, a.DeallocateAll([]netip.Prefix{p1, p2}))
+
+	clock.t = clock.t.Add(30 * time.Second)
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.3.0/24"))
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrNoFreePool)
+
+	// Once the quarantine is over, subnets are handed out again.
+	clock.t = clock.t.Add(30 * time.Second)
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, p1)
+	assert.Equal(t, len(a.freed), 0)
+}
+
+func TestReusePolicy(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}}
+
+	testcases := []struct {
+		name   string
+		policy ReusePolicy
+		want   []string
+	}{
+		{
+			name:   "lowest address",
+			policy: ReuseLowestAddress,
+			want:   []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			name:   "least recently used",
+			policy: ReuseLeastRecentlyUsed,
+			want:   []string{"10.0.3.0/24", "10.0.2.0/24", "10.0.0.0/24"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, pools, WithReusePolicy(tc.policy))
+			a.now = clock.now
+
+			prefixes, err := a.AllocateN(3)
+			assert.NilError(t, err)
+			for _, i := range []int{2, 0, 1} {
+				clock.t = clock.t.Add(time.Second)
+				assert.NilError(t, a.Deallocate(prefixes[i]))
+			}
+
+			var got []string
+			for range tc.want {
+				p, err := a.Allocate()
+				assert.NilError(t, err)
+				got = append(got, p.String())
+			}
+			assert.DeepEqual(t, got, tc.want)
+		})
+	}
+}
+
+func TestFreedPruned(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithReusePolicy(ReuseLeastRecentlyUsed))
+
+	// Subnets released, then allocated again as part of a larger one, aren't
+	// kept around.
+	for i := range 4 * minFreedPrune {
+		p := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i / 256), byte(i), 0}), 24)
+		assert.NilError(t, a.AllocateStatic(p))
+		assert.NilError(t, a.Deallocate(p))
+		if i%256 == 255 {
+			assert.NilError(t, a.AllocateStatic(netip.PrefixFrom(p.Addr(), 16).Masked()))
+		}
+	}
+	assert.Check(t, len(a.freed) <= minFreedPrune, "%d subnets recorded", len(a.freed))
+}
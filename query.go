@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"net/netip"
+	"slices"
+)
+
+// Allocations returns an iterator over allocated prefixes, sorted. The
+// allocator must not be modified while iterating.
+func (a *Allocator) Allocations() iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		a.allocated.each(yield)
+	}
+}
+
+// Allocated returns a snapshot of allocated prefixes, sorted.
+func (a *Allocator) Allocated() []netip.Prefix {
+	return a.allocated.slice()
+}
+
+// IsAllocated tells whether p is allocated, as is. Prefixes overlapping with
+// an allocation, but not equal to it, aren't allocated.
+func (a *Allocator) IsAllocated(p netip.Prefix) bool {
+	return a.allocated.contains(p)
+}
+
+// Metadata returns the metadata attached to p, e.g. its owner, if p is
+// allocated.
+func (a *Allocator) Metadata(p netip.Prefix) (AllocationMeta, bool) {
+	if !a.allocated.contains(p) {
+		return AllocationMeta{}, false
+	}
+	m := a.meta[p].AllocationMeta
+	m.Labels = maps.Clone(m.Labels)
+	return m, true
+}
+
+// ListAllocations returns the allocated prefixes whose labels match s, sorted.
+// s is a comma-separated list of key=value or key!=value requirements, like
+// for WithSelector. An empty selector matches all allocations.
+func (a *Allocator) ListAllocations(s string) ([]netip.Prefix, error) {
+	sel, err := parseSelector(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+
+	var matching []netip.Prefix
+	a.allocated.each(func(p netip.Prefix) bool {
+		if sel.matches(a.meta[p].Labels) {
+			matching = append(matching, p)
+		}
+		return true
+	})
+	return matching, nil
+}
+
+// ContainsAddr tells whether addr is within an allocated prefix.
+func (a *Allocator) ContainsAddr(addr netip.Addr) bool {
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	_, ok := a.trie.containing(addr)
+	return ok
+}
+
+// FindOverlapping returns the allocated prefixes overlapping with p, sorted.
+// That's either the allocation containing p, or all the allocations within p.
+func (a *Allocator) FindOverlapping(p netip.Prefix) []netip.Prefix {
+	if !p.IsValid() || !p.Addr().Is4() {
+		return nil
+	}
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	// Allocations never overlap with each other, so if one of them contains
+	// p, it's the only one overlapping with p.
+	p = p.Masked()
+	if allocated, ok := a.trie.containing(p.Addr()); ok && allocated.Bits() < p.Bits() {
+		return []netip.Prefix{allocated}
+	}
+	return a.allocationsWithin(p)
+}
+
+// AllocationsWithin returns the allocated prefixes contained in p, sorted.
+// Unlike FindOverlapping, an allocation containing p isn't returned.
+func (a *Allocator) AllocationsWithin(p netip.Prefix) []netip.Prefix {
+	if !p.IsValid() || !p.Addr().Is4() {
+		return nil
+	}
+	return a.allocationsWithin(p.Masked())
+}
+
+// PoolFor returns the pool the allocated prefix p lives in. It returns false
+// if p isn't allocated, or if it was allocated outside of any pool.
+func (a *Allocator) PoolFor(p netip.Prefix) (Pool, bool) {
+	if !a.allocated.contains(p) {
+		return Pool{}, false
+	}
+
+	poolID, ok := a.poolIndex(p)
+	if !ok {
+		return Pool{}, false
+	}
+	return a.pools[poolID].clone(), true
+}
+
+// FreeSubnets returns an iterator over the free subnets of the pool whose
+// prefix is 'pool', in the order Allocate hands them out. These are the
+// subnets Allocate could hand out from that pool, so reserved prefixes and
+// the static reserve of the pool are skipped. The allocator must not be
+// modified while iterating.
+func (a *Allocator) FreeSubnets(pool netip.Prefix) iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		poolID := slices.IndexFunc(a.pools, func(p Pool) bool {
+			return p.Prefix == pool.Masked()
+		})
+		if poolID == -1 {
+			return
+		}
+		if a.trie == nil {
+			a.buildIndexes()
+		}
+
+		a.eachFree(poolID, allocateOptions{reserved: a.provideReserved(nil)}, yield)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAllocations(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	})
+	assert.Equal(t, len(a.Allocated()), 0)
+
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.10.0/24")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/8")))
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/24"),
+		netip.MustParsePrefix("192.168.10.0/24"),
+	}
+	assert.DeepEqual(t, slices.Collect(a.Allocations()), want, cmpPrefix)
+	assert.DeepEqual(t, a.Allocated(), want, cmpPrefix)
+
+	// Breaking out of the loop stops the iteration.
+	var first []netip.Prefix
+	for p := range a.Allocations() {
+		first = append(first, p)
+		break
+	}
+	assert.DeepEqual(t, first, want[:1], cmpPrefix)
+
+	// Snapshots aren't affected by later changes.
+	snapshot := a.Allocated()
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("10.0.0.0/8")))
+	assert.DeepEqual(t, snapshot, want, cmpPrefix)
+}
+
+func TestIsAllocated(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.0.0/24"),
+			netip.MustParsePrefix("192.168.2.0/25"),
+		),
+	}
+
+	testcases := []struct {
+		p    netip.Prefix
+		want bool
+	}{
+		{p: netip.MustParsePrefix("192.168.0.0/24"), want: true},
+		{p: netip.MustParsePrefix("192.168.2.0/25"), want: true},
+		{p: netip.MustParsePrefix("192.168.2.0/24")},
+		{p: netip.MustParsePrefix("192.168.0.0/25")},
+		{p: netip.MustParsePrefix("192.168.1.0/24")},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, a.IsAllocated(tc.p), tc.want, "prefix %s", tc.p)
+	}
+}
+
+func TestContainsAddr(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.0.0/24"),
+			netip.MustParsePrefix("192.168.2.0/25"),
+		),
+	}
+
+	testcases := []struct {
+		addr netip.Addr
+		want bool
+	}{
+		{addr: netip.MustParseAddr("192.168.0.0"), want: true},
+		{addr: netip.MustParseAddr("192.168.0.255"), want: true},
+		{addr: netip.MustParseAddr("192.168.2.127"), want: true},
+		{addr: netip.MustParseAddr("192.168.2.128")},
+		{addr: netip.MustParseAddr("192.168.1.1")},
+		{addr: netip.MustParseAddr("::1")},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, a.ContainsAddr(tc.addr), tc.want, "address %s", tc.addr)
+	}
+}
+
+func TestFindOverlapping(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("192.168.0.0/24"),
+			netip.MustParsePrefix("192.168.1.0/25"),
+			netip.MustParsePrefix("192.168.1.128/25"),
+			netip.MustParsePrefix("192.168.4.0/22"),
+		),
+	}
+
+	testcases := []struct {
+		p    netip.Prefix
+		want []netip.Prefix
+	}{
+		{
+			p:    netip.MustParsePrefix("10.1.2.0/24"),
+			want: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		{
+			p:    netip.MustParsePrefix("192.168.0.0/24"),
+			want: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/24")},
+		},
+		{
+			p: netip.MustParsePrefix("192.168.0.0/23"),
+			want: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.1.0/25"),
+				netip.MustParsePrefix("192.168.1.128/25"),
+			},
+		},
+		{
+			p:    netip.MustParsePrefix("192.168.5.1/24"),
+			want: []netip.Prefix{netip.MustParsePrefix("192.168.4.0/22")},
+		},
+		{
+			p: netip.MustParsePrefix("192.168.2.0/24"),
+		},
+		{
+			p: netip.MustParsePrefix("0.0.0.0/0"),
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.1.0/25"),
+				netip.MustParsePrefix("192.168.1.128/25"),
+				netip.MustParsePrefix("192.168.4.0/22"),
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.p.String(), func(t *testing.T) {
+			assert.DeepEqual(t, a.FindOverlapping(tc.p), tc.want, cmpPrefix)
+		})
+	}
+}
+
+func TestAllocationsWithin(t *testing.T) {
+	a := &Allocator{
+		allocated: newPrefixList(
+			netip.MustParsePrefix("10.0.0.0/16"),
+			netip.MustParsePrefix("10.1.0.0/24"),
+			netip.MustParsePrefix("172.16.0.0/12"),
+			netip.MustParsePrefix("192.168.0.0/24"),
+		),
+	}
+
+	assert.DeepEqual(t, a.AllocationsWithin(netip.MustParsePrefix("10.0.0.0/8")), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/16"),
+		netip.MustParsePrefix("10.1.0.0/24"),
+	}, cmpPrefix)
+	assert.DeepEqual(t, a.AllocationsWithin(netip.MustParsePrefix("10.1.2.3/15")), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/16"),
+		netip.MustParsePrefix("10.1.0.0/24"),
+	}, cmpPrefix)
+	assert.Check(t, len(a.AllocationsWithin(netip.MustParsePrefix("172.16.0.0/16"))) == 0)
+	assert.Check(t, len(a.AllocationsWithin(netip.MustParsePrefix("::/0"))) == 0)
+}
+
+func TestPoolFor(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Name: "private", Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		{Name: "docker", Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 16},
+	})
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/8")))
+
+	pool, ok := a.PoolFor(p)
+	assert.Check(t, ok)
+	assert.Equal(t, pool.Name, "docker")
+
+	_, ok = a.PoolFor(netip.MustParsePrefix("10.0.0.0/8"))
+	assert.Check(t, !ok)
+	_, ok = a.PoolFor(netip.MustParsePrefix("192.168.0.0/24"))
+	assert.Check(t, !ok)
+}
+
+func TestFreeSubnets(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Prefix: netip.MustParsePrefix("192.168.0.0/21"), Size: 24},
+			{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.0.0/24"),
+			netip.MustParsePrefix("192.168.2.0/25"),
+			netip.MustParsePrefix("192.168.4.0/23"),
+			netip.MustParsePrefix("10.0.1.0/24"),
+		),
+	}
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("192.168.7.0/24")))
+
+	assert.DeepEqual(t, slices.Collect(a.FreeSubnets(netip.MustParsePrefix("192.168.0.0/21"))), []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("192.168.3.0/24"),
+		netip.MustParsePrefix("192.168.6.0/24"),
+	}, cmpPrefix)
+
+	var first []netip.Prefix
+	for p := range a.FreeSubnets(netip.MustParsePrefix("10.0.0.0/8")) {
+		first = append(first, p)
+		if len(first) == 2 {
+			break
+		}
+	}
+	assert.DeepEqual(t, first, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+	}, cmpPrefix)
+
+	assert.Check(t, len(slices.Collect(a.FreeSubnets(netip.MustParsePrefix("172.16.0.0/12")))) == 0)
+}
+
+func TestListAllocations(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	labels := []map[string]string{
+		{"env": "prod", "team": "net"},
+		{"env": "ci"},
+		nil,
+		{"env": "prod", "team": "storage"},
+	}
+	for _, l := range labels {
+		_, err := a.Allocate(WithLabels(l))
+		assert.NilError(t, err)
+	}
+
+	testcases := []struct {
+		selector string
+		want     []netip.Prefix
+		err      string
+	}{
+		{
+			selector: "",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/24"),
+				netip.MustParsePrefix("10.0.1.0/24"),
+				netip.MustParsePrefix("10.0.2.0/24"),
+				netip.MustParsePrefix("10.0.3.0/24"),
+			},
+		},
+		{
+			selector: "env=prod",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/24"),
+				netip.MustParsePrefix("10.0.3.0/24"),
+			},
+		},
+		{
+			selector: "env=prod, team!=net",
+			want:     []netip.Prefix{netip.MustParsePrefix("10.0.3.0/24")},
+		},
+		{
+			selector: "env!=prod",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.1.0/24"),
+				netip.MustParsePrefix("10.0.2.0/24"),
+			},
+		},
+		{
+			selector: "env=staging",
+		},
+		{
+			selector: "env",
+			err:      `invalid selector: invalid requirement "env": expected key=value or key!=value`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.selector, func(t *testing.T) {
+			got, err := a.ListAllocations(tc.selector)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tc.want, cmpPrefix)
+		})
+	}
+
+	// Labels are copied, both ways.
+	l := map[string]string{"env": "dev"}
+	p, err := a.Allocate(WithLabels(l))
+	assert.NilError(t, err)
+	l["env"] = "prod"
+	m, _ := a.Metadata(p)
+	assert.Equal(t, m.Labels["env"], "dev")
+	m.Labels["env"] = "prod"
+	m, _ = a.Metadata(p)
+	assert.Equal(t, m.Labels["env"], "dev")
+}
@@ -0,0 +1,38 @@
+package main
+
+import "errors"
+
+// WithReadOnly makes the allocator start read-only, see SetReadOnly. The pools
+// given to NewAllocator then aren't written to the store.
+func WithReadOnly() Option {
+	return func(a *Allocator) {
+		a.readOnly = true
+	}
+}
+
+// SetReadOnly switches the allocator to read-only mode, or back. While it's
+// read-only, changes are rejected with ErrReadOnly, but queries keep working.
+// It's meant for maintenance windows, and for warm standby allocators sharing
+// a store with the active one, which pick up its changes with Refresh.
+func (a *Allocator) SetReadOnly(readOnly bool) {
+	a.readOnly = readOnly
+}
+
+// ReadOnly tells whether the allocator is read-only, see SetReadOnly.
+func (a *Allocator) ReadOnly() bool {
+	return a.readOnly
+}
+
+// Refresh reloads the state persisted in the store, to pick up the changes
+// made by other allocators sharing it. The generation is incremented, but
+// hooks and watchers aren't told about these changes. On error, the state is
+// left untouched.
+func (a *Allocator) Refresh() error {
+	if a.store == nil {
+		return errors.New("there's no store to refresh from")
+	}
+	if a.closed {
+		return ErrClosed
+	}
+	return a.reload()
+}
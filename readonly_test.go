@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestReadOnly(t *testing.T) {
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}}
+	s := &sharedStore{}
+	active := mustNewAllocator(t, pools, WithStore(&sharedView{shared: s}))
+	standby := mustNewAllocator(t, pools, WithStore(&sharedView{shared: s}), WithReadOnly())
+	assert.Check(t, standby.ReadOnly())
+
+	p, err := active.Allocate()
+	assert.NilError(t, err)
+
+	// Changes are rejected, queries keep working.
+	_, err = standby.Allocate()
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.Check(t, is.Equal(errorStatus(err), http.StatusServiceUnavailable))
+	assert.ErrorIs(t, standby.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")), ErrReadOnly)
+	assert.ErrorIs(t, standby.AddReserved(netip.MustParsePrefix("10.0.1.0/24")), ErrReadOnly)
+	assert.Check(t, is.Len(standby.Allocated(), 0))
+
+	// The standby picks up the changes of the active allocator.
+	gen := standby.Generation()
+	assert.NilError(t, standby.Refresh())
+	assert.DeepEqual(t, standby.Allocated(), []netip.Prefix{p}, cmpPrefix)
+	assert.Check(t, standby.Generation() > gen)
+	assert.ErrorIs(t, standby.Deallocate(p), ErrReadOnly)
+
+	// Once switched back, the standby takes over.
+	standby.SetReadOnly(false)
+	assert.Check(t, !standby.ReadOnly())
+	assert.NilError(t, standby.Deallocate(p))
+	assert.Check(t, is.Len(standby.Allocated(), 0))
+
+	a := mustNewAllocator(t, pools)
+	assert.Error(t, a.Refresh(), "there's no store to refresh from")
+}
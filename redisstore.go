@@ -0,0 +1,219 @@
+//go:build redis
+
+// The Redis store is only built with the redis build tag, such that programs
+// not using it don't link the Redis client in. Build with:
+//
+//	go build -tags redis
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys used by a RedisStore named name are:
+//   - {name}:rev, a counter incremented on every write,
+//   - {name}:allocated, the set of allocated prefixes,
+//   - {name}:config, the pools, the reserved prefixes, the tombstones and the
+//     metadata of allocations, in the binary format written by MarshalBinary.
+//
+// The braces make them hash to the same slot on a Redis Cluster, as scripts
+// can only access keys living in the same slot.
+//
+// Every script touching them gets the keys in that order.
+
+// redisLoad reads the whole state at once.
+var redisLoad = redis.NewScript(`
+return {redis.call('GET', KEYS[1]) or '0', redis.call('GET', KEYS[3]) or '', redis.call('SMEMBERS', KEYS[2])}
+`)
+
+// redisRev reads the revision, which is enough to tell that Redis can be
+// reached.
+var redisRev = redis.NewScript(`
+return redis.call('GET', KEYS[1]) or '0'
+`)
+
+// redisSaveAllocation adds ARGV[2] to the allocated set if the revision is
+// still ARGV[1]. It returns the new revision, or -1 on conflict.
+var redisSaveAllocation = redis.NewScript(`
+if (redis.call('GET', KEYS[1]) or '0') ~= ARGV[1] then
+	return -1
+end
+redis.call('SADD', KEYS[2], ARGV[2])
+return redis.call('INCR', KEYS[1])
+`)
+
+// redisDeleteAllocation is the same as redisSaveAllocation, but removes
+// ARGV[2] from the allocated set. If ARGV[3] is set, it replaces the config,
+// to drop the metadata of the allocation.
+var redisDeleteAllocation = redis.NewScript(`
+if (redis.call('GET', KEYS[1]) or '0') ~= ARGV[1] then
+	return -1
+end
+redis.call('SREM', KEYS[2], ARGV[2])
+if ARGV[3] then
+	redis.call('SET', KEYS[3], ARGV[3])
+end
+return redis.call('INCR', KEYS[1])
+`)
+
+// redisSaveSnapshot replaces the config with ARGV[2], and the allocated set
+// with the remaining arguments, if the revision is still ARGV[1].
+var redisSaveSnapshot = redis.NewScript(`
+if (redis.call('GET', KEYS[1]) or '0') ~= ARGV[1] then
+	return -1
+end
+redis.call('SET', KEYS[3], ARGV[2])
+redis.call('DEL', KEYS[2])
+for i = 3, #ARGV do
+	redis.call('SADD', KEYS[2], ARGV[i])
+end
+return redis.call('INCR', KEYS[1])
+`)
+
+// RedisStore is a Store keeping the state in Redis. Allocations are stored
+// one by one, such that allocating a prefix doesn't rewrite the whole state.
+// Writes are Lua scripts checking that nobody else changed the state since
+// the store last loaded or wrote it, and applying the change atomically. That
+// way, several allocators, on different hosts, can share the same pools: when
+// another allocator changed the state in the meantime, the write is refused
+// with an error matching ErrStoreConflict, and the allocator reloads the state.
+type RedisStore struct {
+	client redis.Scripter
+	keys   []string
+	// Timeout bounds every request to Redis. It defaults to 5 seconds.
+	Timeout time.Duration
+
+	// rev is the revision of the state when it was last loaded or saved.
+	rev int64
+	// config is what the config key held at that revision.
+	config Snapshot
+}
+
+// NewRedisStore returns a RedisStore keeping the state in keys prefixed by
+// name. client is usually a *redis.Client or a *redis.ClusterClient.
+func NewRedisStore(client redis.Scripter, name string) *RedisStore {
+	return &RedisStore{
+		client: client,
+		keys: []string{
+			"{" + name + "}:rev",
+			"{" + name + "}:allocated",
+			"{" + name + "}:config",
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+// CheckHealth verifies that Redis can be reached, without fetching the state.
+func (s *RedisStore) CheckHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	return redisRev.Run(ctx, s.client, s.keys).Err()
+}
+
+func (s *RedisStore) Load() (Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	res, err := redisLoad.Run(ctx, s.client, s.keys).Slice()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(res) != 3 {
+		return Snapshot{}, fmt.Errorf("unexpected reply to the load script: %v", res)
+	}
+	revStr, _ := res[0].(string)
+	config, _ := res[1].(string)
+	members, _ := res[2].([]any)
+
+	rev, err := strconv.ParseInt(revStr, 10, 64)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("invalid revision %q", revStr)
+	}
+
+	var state Snapshot
+	if config != "" {
+		if state, err = unmarshalBinarySnapshot([]byte(config)); err != nil {
+			return Snapshot{}, fmt.Errorf("redis key %s: %w", s.keys[2], err)
+		}
+	}
+	for _, m := range members {
+		str, _ := m.(string)
+		p, err := netip.ParsePrefix(str)
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("redis key %s: %w: %w", s.keys[1], ErrInvalidPrefix, err)
+		}
+		state.Allocated = append(state.Allocated, p)
+	}
+
+	s.rev = rev
+	s.config = Snapshot{Pools: state.Pools, Reserved: state.Reserved, Tombstones: state.Tombstones, Meta: state.Meta}
+	return state, nil
+}
+
+func (s *RedisStore) SaveAllocation(p netip.Prefix) error {
+	return s.run(redisSaveAllocation, p.String())
+}
+
+func (s *RedisStore) DeleteAllocation(p netip.Prefix) error {
+	if _, ok := s.config.Meta[p]; !ok {
+		return s.run(redisDeleteAllocation, p.String())
+	}
+
+	config := s.config
+	config.Meta = maps.Clone(config.Meta)
+	delete(config.Meta, p)
+	data, err := marshalBinarySnapshot(config)
+	if err != nil {
+		return err
+	}
+	if err := s.run(redisDeleteAllocation, p.String(), data); err != nil {
+		return err
+	}
+	s.config = config
+	return nil
+}
+
+func (s *RedisStore) SaveSnapshot(state Snapshot) error {
+	// Allocations are kept in their own key, but their metadata is part of
+	// the config.
+	config := Snapshot{Pools: state.Pools, Reserved: state.Reserved, Tombstones: state.Tombstones, Meta: state.Meta}
+	data, err := marshalBinarySnapshot(config)
+	if err != nil {
+		return err
+	}
+
+	args := make([]any, 0, len(state.Allocated)+1)
+	args = append(args, data)
+	for _, p := range state.Allocated {
+		args = append(args, p.String())
+	}
+	if err := s.run(redisSaveSnapshot, args...); err != nil {
+		return err
+	}
+	s.config = config
+	return nil
+}
+
+// run runs a write script, passing it the revision last seen before args.
+func (s *RedisStore) run(script *redis.Script, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	rev, err := script.Run(ctx, s.client, s.keys, append([]any{s.rev}, args...)...).Int64()
+	if err != nil {
+		return err
+	}
+	if rev == -1 {
+		return fmt.Errorf("redis key %s: %w", s.keys[0], ErrStoreConflict)
+	}
+	s.rev = rev
+	return nil
+}
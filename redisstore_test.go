@@ -0,0 +1,80 @@
+//go:build redis
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"gotest.tools/v3/assert"
+)
+
+// newRedisClient connects to the Redis server at REDIS_ADDR, and returns a
+// store name whose keys are deleted at the end of the test.
+func newRedisClient(t *testing.T) (*redis.Client, string) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR isn't set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	name := "subnet-allocator-test:" + t.Name()
+	t.Cleanup(func() {
+		client.Del(context.Background(), "{"+name+"}:rev", "{"+name+"}:allocated", "{"+name+"}:config")
+		client.Close()
+	})
+	return client, name
+}
+
+func TestRedisStoreShared(t *testing.T) {
+	client, name := newRedisClient(t)
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+
+	a := mustNewAllocator(t, pools, WithStore(NewRedisStore(client, name)))
+	b := mustNewAllocator(t, pools, WithStore(NewRedisStore(client, name)))
+
+	// b hasn't seen a's allocations, but it never hands out the same
+	// subnet.
+	seen := map[netip.Prefix]bool{}
+	for i := 0; i < 4; i++ {
+		for _, alloc := range []*Allocator{a, b} {
+			p, err := alloc.Allocate()
+			assert.NilError(t, err)
+			assert.Check(t, !seen[p], "%s allocated twice", p)
+			seen[p] = true
+		}
+	}
+	assert.NilError(t, b.Deallocate(netip.MustParsePrefix("10.0.0.0/24")))
+
+	// Other changes made by a stale allocator fail, but its state is
+	// reloaded, so trying again works.
+	err := a.AddReserved(netip.MustParsePrefix("10.0.128.0/17"))
+	assert.ErrorIs(t, err, ErrStoreConflict)
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")))
+
+	c := mustNewAllocator(t, nil, WithStore(NewRedisStore(client, name)))
+	assert.DeepEqual(t, c.Snapshot(), a.Snapshot(), cmpPrefix)
+	assert.Equal(t, len(c.Allocated()), 7)
+}
+
+func TestRedisStoreReleasedMeta(t *testing.T) {
+	client, name := newRedisClient(t)
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+
+	a := mustNewAllocator(t, pools, WithStore(NewRedisStore(client, name)))
+	p, err := a.Allocate(WithOwner("alice"))
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p))
+	q, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, q, p)
+
+	// The metadata of the released allocation doesn't come back on restart.
+	b := mustNewAllocator(t, nil, WithStore(NewRedisStore(client, name)))
+	m, _ := b.Metadata(p)
+	assert.Equal(t, m.Owner, "")
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+}
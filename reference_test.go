@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// refAllocator is a naive reference implementation of Allocator. It keeps
+// allocations in an unsorted slice, and looks for free subnets by enumerating
+// every candidate and comparing it with every allocation. It's slow, but
+// simple enough to be obviously right, and the fuzzer compares Allocator
+// against it.
+type refAllocator struct {
+	pools     []Pool
+	allocated []netip.Prefix
+	reserved  []netip.Prefix
+}
+
+func (r *refAllocator) used(p netip.Prefix) bool {
+	for _, q := range r.allocated {
+		if q.Overlaps(p) {
+			return true
+		}
+	}
+	for _, q := range r.reserved {
+		if q.Overlaps(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate mimics Allocate with the WithReverse and WithAlignment options.
+func (r *refAllocator) allocate(reverse bool, align int) (netip.Prefix, bool) {
+	pools := slices.Clone(r.pools)
+	slices.SortFunc(pools, func(a, b Pool) int { return comparePrefix(a.Prefix, b.Prefix) })
+	if reverse {
+		slices.Reverse(pools)
+	}
+
+	for _, overflow := range []bool{false, true} {
+		for _, p := range pools {
+			if p.Overflow != overflow {
+				continue
+			}
+
+			step := p.Size
+			if align > 0 && align < p.Size {
+				step = max(align, p.Prefix.Bits())
+			}
+			n := uint64(1) << (step - p.Prefix.Bits())
+			for k := range n {
+				if reverse {
+					k = n - 1 - k
+				}
+				offset := k << (32 - step)
+				if offset+uint64(1)<<(32-p.Size) > dynamicSize(p) {
+					continue
+				}
+
+				candidate := netip.PrefixFrom(Add(p.Prefix.Addr(), offset, 0), p.Size)
+				if !r.used(candidate) {
+					r.allocated = append(r.allocated, candidate)
+					return candidate, true
+				}
+			}
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+func (r *refAllocator) allocateStatic(p netip.Prefix) bool {
+	for _, q := range r.allocated {
+		if q.Overlaps(p) {
+			return false
+		}
+	}
+	r.allocated = append(r.allocated, p.Masked())
+	return true
+}
+
+func (r *refAllocator) deallocate(p netip.Prefix) bool {
+	i := slices.Index(r.allocated, p)
+	if i == -1 {
+		return false
+	}
+	r.allocated = slices.Delete(r.allocated, i, i+1)
+	return true
+}
+
+func (r *refAllocator) addReserved(p netip.Prefix) bool {
+	if slices.Contains(r.reserved, p.Masked()) {
+		return false
+	}
+	r.reserved = append(r.reserved, p.Masked())
+	return true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ReadPoolsFile reads the pools listed under the "pools" key of the JSON file
+// at path, in the format written by MarshalJSON. Other keys are ignored, such
+// that pools can be part of a bigger configuration file.
+func ReadPoolsFile(path string) ([]Pool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Pools []poolState `json:"pools"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	pools := make([]Pool, 0, len(config.Pools))
+	for _, ps := range config.Pools {
+		pools = append(pools, ps.pool())
+	}
+	return pools, nil
+}
+
+// PoolReloader replaces the pools of an allocator with freshly loaded ones
+// whenever the process gets SIGHUP, see ReplacePools, such that pools can be
+// added without restarting and losing the state that isn't persisted.
+//
+// The allocator isn't safe for concurrent use, so the reloader holds mu while
+// it uses it. Everything else using the allocator while the reloader runs
+// must hold mu too.
+type PoolReloader struct {
+	a        *Allocator
+	mu       sync.Locker
+	load     func() ([]Pool, error)
+	onReload func(orphans []netip.Prefix, err error)
+	// AllowOrphans makes reloads go through even if allocations end up
+	// outside of the new pools. Otherwise, such reloads fail and the pools
+	// are left untouched.
+	AllowOrphans bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPoolReloader returns a PoolReloader replacing the pools of a with those
+// returned by load, e.g. a closure calling ReadPoolsFile. onReload, if not
+// nil, is called after every reload with the orphaned allocations, or the
+// error that made it fail, without holding mu.
+func NewPoolReloader(a *Allocator, mu sync.Locker, load func() ([]Pool, error), onReload func(orphans []netip.Prefix, err error)) *PoolReloader {
+	return &PoolReloader{a: a, mu: mu, load: load, onReload: onReload}
+}
+
+// Start reloads the pools on SIGHUP in the background, until ctx is done,
+// Close is called, or the allocator is closed.
+func (r *PoolReloader) Start(ctx context.Context) error {
+	if r.done != nil {
+		return errors.New("pool reloader is already running")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		defer close(done)
+		defer signal.Stop(sig)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.a.Done():
+				return
+			case <-sig:
+			}
+			orphans, err := r.Reload()
+			if r.onReload != nil {
+				r.onReload(orphans, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reload replaces the pools right away, and returns the orphaned
+// allocations, see ReplacePools.
+func (r *PoolReloader) Reload() ([]netip.Prefix, error) {
+	pools, err := r.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading pools: %w", err)
+	}
+
+	var orphans []netip.Prefix
+	withLock(r.a, r.mu, func() {
+		orphans, err = r.a.ReplacePools(pools, r.AllowOrphans)
+	})
+	return orphans, err
+}
+
+// Close stops the reloader, and waits for the reload in progress, if any.
+func (r *PoolReloader) Close() error {
+	if r.done == nil {
+		return nil
+	}
+
+	r.cancel()
+	<-r.done
+	r.cancel, r.done = nil, nil
+	return nil
+}
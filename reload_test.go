@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestReadPoolsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NilError(t, os.WriteFile(path, []byte(`{
+		"listen": "127.0.0.1:8080",
+		"pools": [
+			{"name": "default", "prefix": "10.0.0.0/16", "size": 24, "labels": {"zone": "eu"}},
+			{"prefix": "10.1.0.0/16", "size": 24, "size_classes": [{"size": 26}]}
+		]
+	}`), 0o600))
+
+	pools, err := ReadPoolsFile(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pools, []Pool{
+		{Name: "default", Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24, Labels: map[string]string{"zone": "eu"}},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Size: 24, SizeClasses: []SizeClass{{Size: 26}}},
+	}, cmpPrefix)
+
+	assert.NilError(t, os.WriteFile(path, []byte(`{"pools": {}}`), 0o600))
+	_, err = ReadPoolsFile(path)
+	assert.ErrorContains(t, err, path+": json: cannot unmarshal object")
+}
+
+func TestPoolReloader(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24}})
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+
+	pools := []Pool{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Size: 24},
+	}
+	r := NewPoolReloader(a, &sync.Mutex{}, func() ([]Pool, error) { return pools, nil }, nil)
+
+	orphans, err := r.Reload()
+	assert.NilError(t, err)
+	assert.Equal(t, len(orphans), 0)
+	assert.DeepEqual(t, a.Pools(), pools, cmpPrefix)
+	// The allocation made before the reload is still there.
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.1.0.0/24"))
+
+	// Reloads that would orphan allocations are refused, unless allowed.
+	pools = pools[1:]
+	_, err = r.Reload()
+	assert.Error(t, err, "replacing pools would orphan 1 allocations")
+	assert.Equal(t, len(a.Pools()), 2)
+	r.AllowOrphans = true
+	orphans, err = r.Reload()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, orphans, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, cmpPrefix)
+}
+
+func TestPoolReloaderSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGHUP can't be sent on Windows")
+	}
+
+	mu := &sync.Mutex{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24}})
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Size: 24}}
+	reloaded := make(chan error, 1)
+	r := NewPoolReloader(a, mu, func() ([]Pool, error) { return pools, nil }, func(_ []netip.Prefix, err error) {
+		reloaded <- err
+	})
+	assert.NilError(t, r.Start(context.Background()))
+	defer r.Close()
+	assert.ErrorContains(t, r.Start(context.Background()), "already running")
+
+	proc, err := os.FindProcess(os.Getpid())
+	assert.NilError(t, err)
+	assert.NilError(t, proc.Signal(syscall.SIGHUP))
+	select {
+	case err := <-reloaded:
+		assert.NilError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pools weren't reloaded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.DeepEqual(t, a.Pools(), pools, cmpPrefix)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// specialPurposePrefixes lists the IPv4 special-purpose ranges (RFC 6890 and
+// its updates) that can't be used as regular subnets. Private ranges and the
+// shared address space are special-purpose too, but that's where pools
+// usually live, so they're not listed.
+var specialPurposePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This host on this network"
+	netip.MustParsePrefix("127.0.0.0/8"),     // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // Link-local
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation (TEST-NET-1)
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation (TEST-NET-2)
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation (TEST-NET-3)
+	netip.MustParsePrefix("224.0.0.0/4"),     // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, and limited broadcast
+}
+
+// WithSpecialPurposeExclusions makes the allocator permanently reserve the
+// IPv4 special-purpose ranges (loopback, link-local, multicast, benchmarking,
+// documentation, etc.), such that a pool overlapping with them never hands
+// them out.
+func WithSpecialPurposeExclusions() Option {
+	return func(a *Allocator) {
+		a.permanent = append(a.permanent, specialPurposePrefixes...)
+	}
+}
+
+// ReservedProvider returns prefixes that Allocate should avoid, e.g. the
+// subnets currently routed by the host. It's called on every allocation, so
+// it should be cheap or cache its results.
+type ReservedProvider func() []netip.Prefix
+
+// WithReservedProvider registers p, such that the prefixes it returns are
+// treated as reserved at allocation time. Several providers can be
+// registered.
+func WithReservedProvider(p ReservedProvider) Option {
+	return func(a *Allocator) {
+		a.providers = append(a.providers, p)
+	}
+}
+
+// provideReserved returns extra, along with host routes, quarantined prefixes,
+// tombstones and the prefixes returned by providers, normalized by
+// normalizeReserved.
+func (a *Allocator) provideReserved(extra []netip.Prefix) []netip.Prefix {
+	routes := a.routes.Load()
+	quarantined := a.quarantined()
+	if len(a.providers) == 0 && len(extra) == 0 && len(quarantined) == 0 && a.tombstones.len() == 0 {
+		// Host routes are normalized already.
+		if routes == nil {
+			return nil
+		}
+		return *routes
+	}
+
+	// Don't modify the caller's slice.
+	all := slices.Clone(extra)
+	if routes != nil {
+		all = append(all, *routes...)
+	}
+	all = append(all, quarantined...)
+	all = append(all, a.tombstones.slice()...)
+	for _, p := range a.providers {
+		all = append(all, p()...)
+	}
+	return normalizeReserved(all)
+}
+
+// normalizeReserved masks and sorts prefixes in place, and drops invalid and
+// non-IPv4 ones, duplicates, and those contained in another one. The result
+// is a sorted list of disjoint prefixes, as expected by firstOverlapping.
+func normalizeReserved(prefixes []netip.Prefix) []netip.Prefix {
+	prefixes = slices.DeleteFunc(prefixes, func(p netip.Prefix) bool {
+		return !p.IsValid() || !p.Addr().Is4()
+	})
+	for i, p := range prefixes {
+		prefixes[i] = p.Masked()
+	}
+	slices.SortFunc(prefixes, comparePrefix)
+
+	// A prefix sorts before the prefixes it contains, so these are always
+	// right after it.
+	kept := prefixes[:0]
+	for _, p := range prefixes {
+		if n := len(kept); n > 0 && kept[n-1].Overlaps(p) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// overlapping returns an allocated or reserved prefix overlapping with p.
+func (a *Allocator) overlapping(p netip.Prefix) (netip.Prefix, bool) {
+	if allocated, ok := a.trie.overlapping(p); ok {
+		return allocated, true
+	}
+	return a.reserved.overlapping(p)
+}
+
+// inUse tells whether p overlaps with an allocated or reserved prefix.
+func (a *Allocator) inUse(p netip.Prefix) bool {
+	_, ok := a.overlapping(p)
+	return ok
+}
+
+// isReserved tells whether p overlaps with a reserved prefix.
+func (a *Allocator) isReserved(p netip.Prefix) bool {
+	_, ok := a.reserved.overlapping(p)
+	return ok
+}
+
+// AddReserved reserves p, such that Allocate never hands out a subnet
+// overlapping with it. Prefixes already allocated aren't affected, and
+// reserved prefixes can still be allocated statically.
+func (a *Allocator) AddReserved(p netip.Prefix) error {
+	if !p.IsValid() || !p.Addr().Is4() {
+		return fmt.Errorf("%w %s", ErrInvalidPrefix, p)
+	}
+
+	p = p.Masked()
+	if a.reservedSet.contains(p) {
+		return fmt.Errorf("prefix %s is already reserved", p)
+	}
+
+	return a.persist(func() error {
+		a.reservedSet.insert(p)
+		if a.trie != nil {
+			a.indexReserved(p)
+		}
+		return nil
+	})
+}
+
+// RemoveReserved releases a prefix reserved with AddReserved.
+func (a *Allocator) RemoveReserved(p netip.Prefix) error {
+	p = p.Masked()
+	if !a.reservedSet.contains(p) {
+		return fmt.Errorf("prefix %s is not reserved", p)
+	}
+
+	return a.persist(func() error {
+		a.reservedSet.remove(p)
+		if a.trie == nil || slices.Contains(a.permanent, p) {
+			return nil
+		}
+
+		a.reserved.remove(p)
+		for _, bm := range a.bitmaps {
+			if bm != nil {
+				bm.unmark(p, a.inUse)
+			}
+		}
+		return nil
+	})
+}
+
+// ListReserved returns the prefixes reserved with AddReserved, sorted.
+func (a *Allocator) ListReserved() []netip.Prefix {
+	return a.reservedSet.slice()
+}
+
+// indexReserved adds p to the reserved trie and the bitmaps.
+func (a *Allocator) indexReserved(p netip.Prefix) {
+	a.reserved.insert(p)
+	for _, bm := range a.bitmaps {
+		if bm != nil {
+			bm.mark(p)
+		}
+	}
+}
+
+// firstOverlapping returns the prefix of prefixes overlapping with p, if
+// any. prefixes has to be normalized by normalizeReserved.
+func firstOverlapping(prefixes []netip.Prefix, p netip.Prefix) (netip.Prefix, bool) {
+	// i is the index of the first prefix starting after p's address. The one
+	// before might contain p, or p might contain the i-th one.
+	i, _ := slices.BinarySearchFunc(prefixes, p.Addr(), func(q netip.Prefix, addr netip.Addr) int {
+		if q.Addr().Compare(addr) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	if i > 0 && prefixes[i-1].Overlaps(p) {
+		return prefixes[i-1], true
+	}
+	if i < len(prefixes) && prefixes[i].Overlaps(p) {
+		return prefixes[i], true
+	}
+	return netip.Prefix{}, false
+}
+
+// overlapsAny tells whether p overlaps with any of prefixes.
+func overlapsAny(prefixes []netip.Prefix, p netip.Prefix) bool {
+	_, ok := firstOverlapping(prefixes, p)
+	return ok
+}
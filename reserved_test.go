@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"gotest.tools/v3/assert"
+)
+
+func TestSpecialPurposeExclusions(t *testing.T) {
+	testcases := []struct {
+		name string
+		pool Pool
+		want []netip.Prefix
+	}{
+		{
+			name: "pool overlapping with link-local",
+			pool: Pool{Prefix: netip.MustParsePrefix("169.252.0.0/14"), Size: 16},
+			want: []netip.Prefix{
+				netip.MustParsePrefix("169.252.0.0/16"),
+				netip.MustParsePrefix("169.253.0.0/16"),
+				netip.MustParsePrefix("169.255.0.0/16"),
+			},
+		},
+		{
+			name: "pool overlapping with benchmarking",
+			pool: Pool{Prefix: netip.MustParsePrefix("198.16.0.0/12"), Size: 15},
+			want: []netip.Prefix{
+				netip.MustParsePrefix("198.16.0.0/15"),
+				netip.MustParsePrefix("198.20.0.0/15"),
+				netip.MustParsePrefix("198.22.0.0/15"),
+			},
+		},
+		{
+			name: "pool without bitmap",
+			pool: Pool{Prefix: netip.MustParsePrefix("0.0.0.0/1"), Size: 24},
+			want: []netip.Prefix{
+				netip.MustParsePrefix("1.0.0.0/24"),
+				netip.MustParsePrefix("1.0.1.0/24"),
+				netip.MustParsePrefix("1.0.2.0/24"),
+			},
+		},
+		{
+			name: "pool within multicast",
+			pool: Pool{Prefix: netip.MustParsePrefix("239.0.0.0/24"), Size: 28},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, []Pool{tc.pool}, WithSpecialPurposeExclusions())
+
+			got := a.Suggest(3)
+			assert.DeepEqual(t, got, tc.want, cmpPrefix, cmpopts.EquateEmpty())
+		})
+	}
+}
+
+func TestSpecialPurposeExclusionsStatic(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("169.254.0.0/16"), Size: 24},
+	}, WithSpecialPurposeExclusions())
+
+	// Hints don't bypass reservations.
+	_, err := a.Allocate(WithHint(netip.MustParsePrefix("169.254.1.0/24")))
+	assert.ErrorIs(t, err, ErrNoFreePool)
+
+	// Static allocations do, and releasing them doesn't free the subnet.
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("169.254.1.0/24")))
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("169.254.1.0/24")))
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrNoFreePool)
+}
+
+func TestReservedSet(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+	})
+
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.0.0/23")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.2.1/24")))
+	assert.Error(t, a.AddReserved(netip.MustParsePrefix("10.0.2.0/24")), "prefix 10.0.2.0/24 is already reserved")
+	assert.Error(t, a.AddReserved(netip.MustParsePrefix("2001:db8::/64")), "invalid prefix 2001:db8::/64")
+	assert.DeepEqual(t, a.ListReserved(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/23"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+	}, cmpPrefix)
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.3.0/24"))
+
+	// Prefixes passed to a single call are avoided too.
+	p, err = a.Allocate(WithReserved(
+		netip.MustParsePrefix("10.0.6.0/24"),
+		netip.MustParsePrefix("10.0.4.0/22"),
+		netip.MustParsePrefix("10.0.4.0/22"),
+	))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.8.0/24"))
+
+	assert.NilError(t, a.RemoveReserved(netip.MustParsePrefix("10.0.0.0/23")))
+	assert.Error(t, a.RemoveReserved(netip.MustParsePrefix("10.0.0.0/23")), "prefix 10.0.0.0/23 is not reserved")
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+}
+
+func TestWithReserved(t *testing.T) {
+	testcases := []struct {
+		name     string
+		pool     Pool
+		reserved []netip.Prefix
+		opts     []AllocateOption
+		want     netip.Prefix
+	}{
+		{
+			name:     "bitmap",
+			pool:     Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			reserved: []netip.Prefix{netip.MustParsePrefix("192.168.0.128/25"), netip.MustParsePrefix("192.168.1.0/24")},
+			want:     netip.MustParsePrefix("192.168.2.0/24"),
+		},
+		{
+			name:     "bitmap, reverse",
+			pool:     Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			reserved: []netip.Prefix{netip.MustParsePrefix("192.168.254.0/23")},
+			opts:     []AllocateOption{WithReverse()},
+			want:     netip.MustParsePrefix("192.168.253.0/24"),
+		},
+		{
+			name:     "trie",
+			pool:     Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+			reserved: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/20")},
+			want:     netip.MustParsePrefix("10.0.16.0/28"),
+		},
+		{
+			name:     "trie, reverse",
+			pool:     Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 28},
+			reserved: []netip.Prefix{netip.MustParsePrefix("10.255.255.255/32")},
+			opts:     []AllocateOption{WithReverse()},
+			want:     netip.MustParsePrefix("10.255.255.224/28"),
+		},
+		{
+			name:     "hint",
+			pool:     Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			reserved: []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+			opts:     []AllocateOption{WithHint(netip.MustParsePrefix("192.168.10.0/24"))},
+			want:     netip.MustParsePrefix("192.168.0.0/24"),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, []Pool{tc.pool})
+
+			p, err := a.Allocate(append(tc.opts, WithReserved(tc.reserved...))...)
+			assert.NilError(t, err)
+			assert.Equal(t, p, tc.want)
+		})
+	}
+}
+
+func TestReservedProvider(t *testing.T) {
+	routes := []netip.Prefix{netip.MustParsePrefix("192.168.0.0/24")}
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+	}, WithReservedProvider(func() []netip.Prefix {
+		return routes
+	}))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.1.0/24"))
+
+	// The provider is called again on the next allocation.
+	routes = append(routes, netip.MustParsePrefix("192.168.2.0/23"))
+	p, err = a.Allocate(WithReserved(netip.MustParsePrefix("192.168.4.0/24")))
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.5.0/24"))
+
+	assert.DeepEqual(t, a.Suggest(1), []netip.Prefix{netip.MustParsePrefix("192.168.4.0/24")}, cmpPrefix)
+}
+
+func TestNormalizeReserved(t *testing.T) {
+	got := normalizeReserved([]netip.Prefix{
+		netip.MustParsePrefix("10.0.2.0/24"),
+		netip.MustParsePrefix("10.0.0.1/24"),
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.0.2.128/25"),
+		netip.MustParsePrefix("2001:db8::/64"),
+		{},
+		netip.MustParsePrefix("10.0.0.0/23"),
+		netip.MustParsePrefix("10.0.3.0/24"),
+	})
+	assert.DeepEqual(t, got, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/23"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+		netip.MustParsePrefix("10.0.3.0/24"),
+	}, cmpPrefix)
+}
+
+func TestFirstOverlapping(t *testing.T) {
+	reserved := normalizeReserved([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/16"),
+		netip.MustParsePrefix("10.2.0.0/24"),
+		netip.MustParsePrefix("10.2.1.0/24"),
+	})
+
+	testcases := []struct {
+		p    netip.Prefix
+		want netip.Prefix
+	}{
+		{p: netip.MustParsePrefix("10.0.0.0/24"), want: netip.MustParsePrefix("10.0.0.0/16")},
+		{p: netip.MustParsePrefix("10.0.255.0/24"), want: netip.MustParsePrefix("10.0.0.0/16")},
+		{p: netip.MustParsePrefix("10.0.0.0/8"), want: netip.MustParsePrefix("10.0.0.0/16")},
+		{p: netip.MustParsePrefix("10.1.0.0/16")},
+		{p: netip.MustParsePrefix("10.2.0.0/16"), want: netip.MustParsePrefix("10.2.0.0/24")},
+		{p: netip.MustParsePrefix("10.2.1.128/25"), want: netip.MustParsePrefix("10.2.1.0/24")},
+		{p: netip.MustParsePrefix("10.2.2.0/24")},
+		{p: netip.MustParsePrefix("9.0.0.0/8")},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.p.String(), func(t *testing.T) {
+			got, ok := firstOverlapping(reserved, tc.p)
+			assert.Equal(t, ok, tc.want.IsValid())
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// ReserveHostRoutes makes Allocate avoid the subnets routed by the host, such
+// that it never hands out a subnet already used by one of its networks. It
+// takes a snapshot of the routing table, previous snapshots are dropped.
+func (a *Allocator) ReserveHostRoutes() error {
+	routes, err := hostRoutes()
+	if err != nil {
+		return err
+	}
+
+	a.setHostRoutes(routes)
+	return nil
+}
+
+// setHostRoutes replaces the host routes Allocate avoids. Only IPv4 routes
+// are kept, and the default route is ignored since it'd cover everything.
+func (a *Allocator) setHostRoutes(routes []netip.Prefix) {
+	var kept []netip.Prefix
+	for _, r := range routes {
+		if r.IsValid() && r.Addr().Is4() && r.Bits() > 0 {
+			kept = append(kept, r.Masked())
+		}
+	}
+	kept = normalizeReserved(kept)
+	a.routes.Store(&kept)
+}
+
+// Start reserves host routes, like ReserveHostRoutes, and keeps refreshing
+// them in the background every interval until Stop is called. Where the
+// platform reports route changes, e.g. with netlink on Linux, routes are
+// refreshed as soon as they change too, and interval can be zero to rely on
+// that only. Refresh errors are ignored, the last snapshot is kept instead.
+//
+// The background task only touches host routes, so the allocator still has to
+// be used from a single goroutine.
+func (a *Allocator) Start(interval time.Duration) error {
+	if a.closed {
+		return ErrClosed
+	}
+	if a.stop != nil {
+		return errors.New("host routes are already refreshed in the background")
+	}
+	if err := a.ReserveHostRoutes(); err != nil {
+		return err
+	}
+
+	// Fall back to polling when route changes can't be watched.
+	events, closeEvents, err := watchRoutes()
+	if err != nil {
+		events, closeEvents = nil, func() {}
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	a.stop, a.done = stop, done
+	go func() {
+		defer close(done)
+		defer closeEvents()
+
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick:
+			case <-events:
+			}
+			if routes, err := hostRoutes(); err == nil {
+				a.setHostRoutes(routes)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops refreshing host routes in the background, and waits for the
+// refresh in progress, if any. Host routes found so far are kept.
+func (a *Allocator) Stop() {
+	if a.stop == nil {
+		return
+	}
+
+	close(a.stop)
+	<-a.done
+	a.stop, a.done = nil, nil
+}
@@ -0,0 +1,85 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// hostRoutes returns the on-link and static routes of the host, as reported
+// by the route(4) sysctl.
+//
+// The routing API of the syscall package is deprecated in favor of
+// golang.org/x/net/route, but it's enough for a dump, and it spares us a
+// dependency.
+func hostRoutes() ([]netip.Prefix, error) {
+	rib, err := syscall.RouteRIB(syscall.NET_RT_DUMP, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump routes: %w", err)
+	}
+
+	msgs, err := syscall.ParseRoutingMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %w", err)
+	}
+
+	var routes []netip.Prefix
+	for _, m := range msgs {
+		rm, ok := m.(*syscall.RouteMessage)
+		if !ok {
+			continue
+		}
+		sas, err := syscall.ParseRoutingSockaddr(rm)
+		if err != nil {
+			continue
+		}
+		if r, ok := parseRoute(rm.Header.Flags, sas); ok {
+			routes = append(routes, r)
+		}
+	}
+
+	return routes, nil
+}
+
+// parseRoute returns the destination of a route, given its flags and its
+// addresses indexed by RTAX_*, if it's an on-link or static route.
+func parseRoute(flags int32, sas []syscall.Sockaddr) (netip.Prefix, bool) {
+	if flags&syscall.RTF_UP == 0 || flags&(syscall.RTF_GATEWAY|syscall.RTF_STATIC) == syscall.RTF_GATEWAY {
+		return netip.Prefix{}, false
+	}
+	// Skip the entries of neighbors, and the routes of local, broadcast and
+	// multicast addresses.
+	if flags&(syscall.RTF_LLINFO|syscall.RTF_LOCAL|syscall.RTF_BROADCAST|syscall.RTF_MULTICAST) != 0 {
+		return netip.Prefix{}, false
+	}
+	if len(sas) <= syscall.RTAX_NETMASK {
+		return netip.Prefix{}, false
+	}
+
+	var dst netip.Addr
+	switch sa := sas[syscall.RTAX_DST].(type) {
+	case *syscall.SockaddrInet4:
+		dst = netip.AddrFrom4(sa.Addr)
+	case *syscall.SockaddrInet6:
+		dst = netip.AddrFrom16(sa.Addr)
+	default:
+		return netip.Prefix{}, false
+	}
+
+	// Host routes don't have a netmask.
+	bits := dst.BitLen()
+	switch sa := sas[syscall.RTAX_NETMASK].(type) {
+	case *syscall.SockaddrInet4:
+		bits, _ = net.IPMask(sa.Addr[:]).Size()
+	case *syscall.SockaddrInet6:
+		bits, _ = net.IPMask(sa.Addr[:]).Size()
+	}
+	if bits == 0 || dst.IsMulticast() {
+		return netip.Prefix{}, false
+	}
+
+	return netip.PrefixFrom(dst, bits), true
+}
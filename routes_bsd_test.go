@@ -0,0 +1,76 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"net/netip"
+	"syscall"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseRoute(t *testing.T) {
+	inet4 := func(s string) *syscall.SockaddrInet4 {
+		return &syscall.SockaddrInet4{Addr: netip.MustParseAddr(s).As4()}
+	}
+	sockaddrs := func(dst, gateway, netmask syscall.Sockaddr) []syscall.Sockaddr {
+		sas := make([]syscall.Sockaddr, syscall.RTAX_MAX)
+		sas[syscall.RTAX_DST] = dst
+		sas[syscall.RTAX_GATEWAY] = gateway
+		sas[syscall.RTAX_NETMASK] = netmask
+		return sas
+	}
+
+	testcases := []struct {
+		name  string
+		flags int32
+		sas   []syscall.Sockaddr
+		want  netip.Prefix
+		ok    bool
+	}{
+		{
+			name:  "on-link",
+			flags: syscall.RTF_UP,
+			sas:   sockaddrs(inet4("192.168.1.0"), &syscall.SockaddrDatalink{}, inet4("255.255.255.0")),
+			want:  netip.MustParsePrefix("192.168.1.0/24"),
+			ok:    true,
+		},
+		{
+			name:  "through a gateway",
+			flags: syscall.RTF_UP | syscall.RTF_GATEWAY,
+			sas:   sockaddrs(inet4("10.0.0.0"), inet4("192.168.1.1"), inet4("255.0.0.0")),
+		},
+		{
+			name:  "static",
+			flags: syscall.RTF_UP | syscall.RTF_GATEWAY | syscall.RTF_STATIC,
+			sas:   sockaddrs(inet4("10.0.0.0"), inet4("192.168.1.1"), inet4("255.0.0.0")),
+			want:  netip.MustParsePrefix("10.0.0.0/8"),
+			ok:    true,
+		},
+		{
+			name:  "static host route",
+			flags: syscall.RTF_UP | syscall.RTF_GATEWAY | syscall.RTF_STATIC | syscall.RTF_HOST,
+			sas:   sockaddrs(inet4("10.1.2.3"), inet4("192.168.1.1"), nil),
+			want:  netip.MustParsePrefix("10.1.2.3/32"),
+			ok:    true,
+		},
+		{
+			name:  "neighbor",
+			flags: syscall.RTF_UP | syscall.RTF_HOST | syscall.RTF_LLINFO,
+			sas:   sockaddrs(inet4("192.168.1.1"), &syscall.SockaddrDatalink{}, nil),
+		},
+		{
+			name: "down",
+			sas:  sockaddrs(inet4("192.168.1.0"), &syscall.SockaddrDatalink{}, inet4("255.255.255.0")),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseRoute(tc.flags, tc.sas)
+			assert.Equal(t, ok, tc.ok)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
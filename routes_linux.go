@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"syscall"
+)
+
+// hostRoutes returns the on-link and static routes of the main routing table,
+// as reported by netlink. It falls back to /proc when netlink isn't available,
+// e.g. in some sandboxes.
+func hostRoutes() ([]netip.Prefix, error) {
+	routes, err := netlinkRoutes()
+	if err != nil {
+		if routes, procErr := procRoutes(); procErr == nil {
+			return routes, nil
+		}
+		return nil, err
+	}
+	return routes, nil
+}
+
+func netlinkRoutes() ([]netip.Prefix, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump routes: %w", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %w", err)
+	}
+
+	var routes []netip.Prefix
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE {
+			continue
+		}
+		if r, ok := parseRouteMessage(&m); ok {
+			routes = append(routes, r)
+		}
+	}
+
+	return routes, nil
+}
+
+// parseRouteMessage returns the destination of the route described by m, if
+// it's an on-link or static unicast route of the main table.
+func parseRouteMessage(m *syscall.NetlinkMessage) (netip.Prefix, bool) {
+	if len(m.Data) < syscall.SizeofRtMsg {
+		return netip.Prefix{}, false
+	}
+
+	// The message starts with a struct rtmsg, made of single bytes up to
+	// its flags.
+	rtm := syscall.RtMsg{
+		Dst_len:  m.Data[1],
+		Table:    m.Data[4],
+		Protocol: m.Data[5],
+		Type:     m.Data[7],
+	}
+	if rtm.Table != syscall.RT_TABLE_MAIN || rtm.Type != syscall.RTN_UNICAST || rtm.Dst_len == 0 {
+		return netip.Prefix{}, false
+	}
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	var dst netip.Addr
+	static := rtm.Protocol == syscall.RTPROT_STATIC || rtm.Protocol == syscall.RTPROT_BOOT
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.RTA_DST:
+			dst, _ = netip.AddrFromSlice(attr.Value)
+		case syscall.RTA_GATEWAY, syscall.RTA_MULTIPATH:
+			// Routes through a gateway aren't on-link. IPv6 on-link
+			// routes don't have a link scope, so that's the only way
+			// to tell.
+			if !static {
+				return netip.Prefix{}, false
+			}
+		}
+	}
+	if !dst.IsValid() {
+		return netip.Prefix{}, false
+	}
+
+	return netip.PrefixFrom(dst, int(rtm.Dst_len)), true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHostRoutesNetlink(t *testing.T) {
+	routes, err := hostRoutes()
+	assert.NilError(t, err)
+	for _, r := range routes {
+		assert.Check(t, r.IsValid() && r.Bits() > 0, "unexpected route %s", r)
+	}
+}
+
+func TestParseProcRoutes(t *testing.T) {
+	const routes = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	010200C0	0003	0	0	0	00000000	0	0	0
+eth0	000200C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	000010AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+eth0	0000000A	010200C0	0003	0	0	0	000000FF	0	0	0
+docker0	000011AC	00000000	0000	0	0	0	0000FFFF	0	0	0
+`
+	got, err := parseProcRoutes(strings.NewReader(routes))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("172.16.0.0/16"),
+	}, cmpPrefix)
+
+	_, err = parseProcRoutes(strings.NewReader("Iface\teth0\n" + "eth0	000200C0	00000000	0001	0	0	0	00FF00FF	0	0	0\n"))
+	assert.Error(t, err, `invalid route mask "00FF00FF"`)
+}
+
+func TestParseProcRoutes6(t *testing.T) {
+	const routes = `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000002 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001       lo
+fd000000000000000000000000000002 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001     eth0
+ff000000000000000000000000000000 08 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000004 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+`
+	got, err := parseProcRoutes6(strings.NewReader(routes))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, []netip.Prefix{
+		netip.MustParsePrefix("fd00::/64"),
+		netip.MustParsePrefix("fe80::/64"),
+	}, cmpPrefix)
+}
+
+func TestProcRoutesMatchNetlink(t *testing.T) {
+	want, err := netlinkRoutes()
+	if err != nil {
+		t.Skip("netlink isn't available:", err)
+	}
+	got, err := procRoutes()
+	assert.NilError(t, err)
+
+	// /proc can't tell static routes from other ones, so it only reports
+	// on-link routes.
+	for _, r := range got {
+		assert.Check(t, slices.Contains(want, r), "route %s isn't reported by netlink", r)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !windows && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func hostRoutes() ([]netip.Prefix, error) {
+	return nil, errors.New("host route discovery is not supported on this platform")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Route flags, as found in /proc/net/route and /proc/net/ipv6_route.
+const (
+	rtfUp      = 0x1
+	rtfGateway = 0x2
+	rtfReject  = 0x200
+	rtfLocal   = 0x80000000
+)
+
+// procRoutes returns the on-link routes listed in /proc. It's used when
+// netlink isn't available. Unlike netlink, /proc doesn't tell how routes were
+// installed, so static routes through a gateway aren't reported.
+func procRoutes() ([]netip.Prefix, error) {
+	routes, err := readProcRoutes("/proc/net/route", parseProcRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	routes6, err := readProcRoutes("/proc/net/ipv6_route", parseProcRoutes6)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// That file is missing when IPv6 is disabled.
+		return nil, err
+	}
+
+	return append(routes, routes6...), nil
+}
+
+func readProcRoutes(path string, parse func(io.Reader) ([]netip.Prefix, error)) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	routes, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return routes, nil
+}
+
+// parseProcRoutes parses the format of /proc/net/route: a header line, then
+// one route per line with the destination, flags and mask as hex numbers in
+// host byte order.
+func parseProcRoutes(r io.Reader) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	s := bufio.NewScanner(r)
+	for first := true; s.Scan(); first = false {
+		fields := strings.Fields(s.Text())
+		if first || len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("invalid route %q", s.Text())
+		}
+
+		dst, err := parseProcAddr4(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route flags %q", fields[3])
+		}
+		mask, err := parseProcAddr4(fields[7])
+		if err != nil {
+			return nil, err
+		}
+
+		bits, size := net.IPMask(mask.AsSlice()).Size()
+		if size == 0 {
+			return nil, fmt.Errorf("invalid route mask %q", fields[7])
+		}
+		if !onLink(flags) || bits == 0 {
+			continue
+		}
+		routes = append(routes, netip.PrefixFrom(dst, bits))
+	}
+
+	return routes, s.Err()
+}
+
+// parseProcRoutes6 parses the format of /proc/net/ipv6_route: one route per
+// line, starting with the destination and its prefix length, and with flags
+// in the 9th column.
+func parseProcRoutes6(r io.Reader) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("invalid route %q", s.Text())
+		}
+
+		b, err := hex.DecodeString(fields[0])
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid route destination %q", fields[0])
+		}
+		bits, err := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil || bits > 128 {
+			return nil, fmt.Errorf("invalid route prefix length %q", fields[1])
+		}
+		flags, err := strconv.ParseUint(fields[8], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route flags %q", fields[8])
+		}
+
+		dst := netip.AddrFrom16([16]byte(b))
+		if !onLink(flags) || bits == 0 || dst.IsMulticast() || fields[9] == "lo" {
+			continue
+		}
+		routes = append(routes, netip.PrefixFrom(dst, int(bits)))
+	}
+
+	return routes, s.Err()
+}
+
+// onLink tells whether flags describe a usable route that doesn't go through
+// a gateway, and isn't a local address.
+func onLink(flags uint64) bool {
+	return flags&rtfUp != 0 && flags&(rtfGateway|rtfReject|rtfLocal) == 0
+}
+
+// parseProcAddr4 parses an IPv4 address written as a hex number in host byte
+// order.
+func parseProcAddr4(s string) (netip.Addr, error) {
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], uint32(v))
+	return netip.AddrFrom4(b), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHostRoutes(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 16},
+	})
+
+	a.setHostRoutes([]netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("172.16.0.0/16"),
+		netip.MustParsePrefix("172.17.0.1/16"),
+		netip.MustParsePrefix("fd00::/64"),
+	})
+	assert.DeepEqual(t, *a.routes.Load(), []netip.Prefix{
+		netip.MustParsePrefix("172.16.0.0/16"),
+		netip.MustParsePrefix("172.17.0.0/16"),
+	}, cmpPrefix)
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("172.18.0.0/16"))
+
+	// A new snapshot replaces the previous one.
+	a.setHostRoutes([]netip.Prefix{netip.MustParsePrefix("172.19.0.0/16")})
+	p, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("172.16.0.0/16"))
+}
+
+func TestStartStop(t *testing.T) {
+	if _, err := hostRoutes(); err != nil {
+		t.Skip("host routes can't be discovered:", err)
+	}
+
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("172.16.0.0/12"), Size: 16},
+	})
+
+	assert.NilError(t, a.Start(time.Millisecond))
+	assert.Error(t, a.Start(time.Millisecond), "host routes are already refreshed in the background")
+	assert.Check(t, a.routes.Load() != nil)
+
+	// Allocations can go on while routes are refreshed.
+	for i := 0; i < 10; i++ {
+		_, err := a.Allocate()
+		assert.NilError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+
+	a.Stop()
+	a.Stop()
+	assert.NilError(t, a.Start(0))
+	a.Stop()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Netlink multicast groups of route changes, missing from the syscall
+// package.
+const (
+	rtmgrpIPv4Route = 0x40
+	rtmgrpIPv6Route = 0x400
+)
+
+// watchRoutes returns a channel receiving a value whenever the kernel reports
+// a route change, and a function to stop watching. Changes happening in a
+// row may be reported only once.
+func watchRoutes() (<-chan struct{}, func(), error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("failed to subscribe to route changes: %w", err)
+	}
+
+	// Going through an os.File hooks the socket into the runtime poller, such
+	// that closing the file unblocks the pending Read.
+	f := os.NewFile(uintptr(fd), "netlink")
+	events := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, os.Getpagesize())
+		for {
+			// The content doesn't matter, routes are dumped again
+			// anyway. ENOBUFS means some changes were dropped, which
+			// is a change too.
+			if _, err := f.Read(buf); err != nil && !errors.Is(err, syscall.ENOBUFS) {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return events, func() { f.Close() }, nil
+}
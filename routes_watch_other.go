@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchRoutes() (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("watching route changes is not supported on this platform")
+}
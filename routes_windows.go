@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	iphlpapi               = syscall.NewLazyDLL("iphlpapi.dll")
+	procGetIpForwardTable2 = iphlpapi.NewProc("GetIpForwardTable2")
+	procFreeMibTable       = iphlpapi.NewProc("FreeMibTable")
+)
+
+const (
+	// sizeofIPForwardRow2 is the size of a MIB_IPFORWARD_ROW2.
+	sizeofIPForwardRow2 = 104
+	// mibIPProtoNetMgmt is the protocol of static routes.
+	mibIPProtoNetMgmt = 3
+)
+
+// hostRoutes returns the on-link and static routes of the host, as reported
+// by GetIpForwardTable2.
+func hostRoutes() ([]netip.Prefix, error) {
+	var table unsafe.Pointer
+	ret, _, _ := procGetIpForwardTable2.Call(uintptr(syscall.AF_UNSPEC), uintptr(unsafe.Pointer(&table)))
+	if ret != 0 {
+		return nil, fmt.Errorf("failed to dump routes: %w", syscall.Errno(ret))
+	}
+	defer procFreeMibTable.Call(uintptr(table))
+
+	// MIB_IPFORWARD_TABLE2 is a ULONG, followed by the rows aligned on 8
+	// bytes.
+	n := *(*uint32)(table)
+	rows := unsafe.Slice((*byte)(unsafe.Add(table, 8)), int(n)*sizeofIPForwardRow2)
+
+	var routes []netip.Prefix
+	for i := 0; i < int(n); i++ {
+		if r, ok := parseForwardRow(rows[i*sizeofIPForwardRow2 : (i+1)*sizeofIPForwardRow2]); ok {
+			routes = append(routes, r)
+		}
+	}
+
+	return routes, nil
+}
+
+// parseForwardRow returns the destination of the route described by row, a
+// MIB_IPFORWARD_ROW2, if it's an on-link or static route.
+func parseForwardRow(row []byte) (netip.Prefix, bool) {
+	// DestinationPrefix is at offset 12: a SOCKADDR_INET, followed by the
+	// prefix length. NextHop is another SOCKADDR_INET, at offset 44.
+	dst, ok := parseSockaddrInet(row[12:40])
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits := int(row[40])
+	nextHop, _ := parseSockaddrInet(row[44:72])
+	protocol := binary.LittleEndian.Uint32(row[88:92])
+	loopback := row[92] != 0
+
+	if bits == 0 || loopback || dst.IsMulticast() {
+		return netip.Prefix{}, false
+	}
+	if nextHop.IsValid() && !nextHop.IsUnspecified() && protocol != mibIPProtoNetMgmt {
+		return netip.Prefix{}, false
+	}
+
+	return netip.PrefixFrom(dst, bits), true
+}
+
+// parseSockaddrInet parses the address of a SOCKADDR_INET.
+func parseSockaddrInet(b []byte) (netip.Addr, bool) {
+	switch binary.LittleEndian.Uint16(b[0:2]) {
+	case syscall.AF_INET:
+		return netip.AddrFrom4([4]byte(b[4:8])), true
+	case syscall.AF_INET6:
+		return netip.AddrFrom16([16]byte(b[8:24])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"syscall"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseForwardRow(t *testing.T) {
+	row := func(dst netip.Prefix, nextHop netip.Addr, protocol uint32) []byte {
+		b := make([]byte, sizeofIPForwardRow2)
+		binary.LittleEndian.PutUint16(b[12:], syscall.AF_INET)
+		copy(b[16:], dst.Addr().AsSlice())
+		b[40] = byte(dst.Bits())
+		binary.LittleEndian.PutUint16(b[44:], syscall.AF_INET)
+		copy(b[48:], nextHop.AsSlice())
+		binary.LittleEndian.PutUint32(b[88:], protocol)
+		return b
+	}
+
+	testcases := []struct {
+		name string
+		row  []byte
+		want netip.Prefix
+		ok   bool
+	}{
+		{
+			name: "on-link",
+			row:  row(netip.MustParsePrefix("192.168.1.0/24"), netip.IPv4Unspecified(), 2),
+			want: netip.MustParsePrefix("192.168.1.0/24"),
+			ok:   true,
+		},
+		{
+			name: "through a gateway",
+			row:  row(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParseAddr("192.168.1.1"), 2),
+		},
+		{
+			name: "static",
+			row:  row(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParseAddr("192.168.1.1"), mibIPProtoNetMgmt),
+			want: netip.MustParsePrefix("10.0.0.0/8"),
+			ok:   true,
+		},
+		{
+			name: "default",
+			row:  row(netip.MustParsePrefix("0.0.0.0/0"), netip.IPv4Unspecified(), mibIPProtoNetMgmt),
+		},
+		{
+			name: "multicast",
+			row:  row(netip.MustParsePrefix("224.0.0.0/4"), netip.IPv4Unspecified(), 2),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseForwardRow(tc.row)
+			assert.Equal(t, ok, tc.ok)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
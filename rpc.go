@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// rpcRequest is a request of the RPC protocol, see RPCServer.
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// rpcResponse is a response of the RPC protocol. Exactly one of Result and
+// Error is set.
+type rpcResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Result any             `json:"result,omitempty"`
+	Error  *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Message string `json:"message"`
+}
+
+// releaseParams are the params of the release method.
+type releaseParams struct {
+	Prefix netip.Prefix `json:"prefix"`
+}
+
+// listParams are the params of the list method.
+type listParams struct {
+	Selector string `json:"selector"`
+}
+
+// RPCServer serves a JSON-RPC protocol meant for callers on the same host,
+// typically over a unix socket. Requests and responses are JSON objects sent
+// one after the other on the connection:
+//
+//	{"id": 1, "method": "allocate", "params": {"owner": "ctr1"}}
+//	{"id": 1, "result": {"prefix": "10.0.0.0/24", "pool": "10.0.0.0/16"}}
+//
+// Methods are:
+//
+//	allocate  allocates a subnet, with the same params as POST /allocations
+//	          of Server
+//	release   releases {"prefix"}
+//	list      lists the allocations matching {"selector"}, see
+//	          ListAllocations
+//
+// Failed requests get a response with an {"error": {"message"}} object
+// instead of a result. Like Server, the RPC server holds mu while using the
+// allocator.
+type RPCServer struct {
+	a  *Allocator
+	mu sync.Locker
+}
+
+// NewRPCServer returns an RPCServer driving a, guarded by mu.
+func NewRPCServer(a *Allocator, mu sync.Locker) *RPCServer {
+	return &RPCServer{a: a, mu: mu}
+}
+
+// Serve accepts connections on l, and serves each of them in its own
+// goroutine. It returns when l is closed.
+func (s *RPCServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests read from conn until it's closed, or a request
+// can't be decoded. conn is closed when it returns.
+func (s *RPCServer) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				enc.Encode(rpcResponse{Error: &rpcError{Message: fmt.Sprintf("invalid request: %v", err)}})
+			}
+			return
+		}
+
+		resp := rpcResponse{ID: req.ID}
+		result, err := s.call(req.Method, req.Params)
+		if err != nil {
+			resp.Error = &rpcError{Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// call runs the method of a request with its params.
+func (s *RPCServer) call(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "allocate":
+		var req allocateRequest
+		if err := decodeParams(params, &req); err != nil {
+			return nil, err
+		}
+		opts, err := req.options()
+		if err != nil {
+			return nil, err
+		}
+		var resp allocationResponse
+		withLock(s.a, s.mu, func() {
+			resp, err = allocateFor(s.a, req, opts)
+		})
+		return resp, err
+	case "release":
+		var p releaseParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		var err error
+		withLock(s.a, s.mu, func() {
+			err = s.a.Deallocate(p.Prefix)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	case "list":
+		var p listParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		prefixes, err := s.a.ListAllocations(p.Selector)
+		if err != nil {
+			return nil, err
+		}
+		allocations := make([]allocationState, 0, len(prefixes))
+		for _, q := range prefixes {
+			m, _ := s.a.Metadata(q)
+			allocations = append(allocations, newAllocationState(q, m))
+		}
+		return allocations, nil
+	default:
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+}
+
+// decodeParams decodes the params of a request into v. Missing params are
+// the same as an empty object, and unknown fields are rejected.
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRPCServer(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "allocator.sock"))
+	assert.NilError(t, err)
+	done := make(chan error)
+	go func() { done <- NewRPCServer(a, &sync.Mutex{}).Serve(l) }()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	testcases := []struct {
+		req, exp string
+	}{
+		{
+			req: `{"id": 1, "method": "allocate", "params": {"owner": "ctr1", "labels": {"env": "prod"}}}`,
+			exp: `{"id":1,"result":{"prefix":"10.0.0.0/24","pool":"10.0.0.0/23"}}`,
+		},
+		{
+			req: `{"id": 2, "method": "allocate", "params": {"prefix": "10.0.1.0/24"}}`,
+			exp: `{"id":2,"result":{"prefix":"10.0.1.0/24","pool":"10.0.0.0/23"}}`,
+		},
+		{
+			req: `{"id": 3, "method": "allocate"}`,
+			exp: `{"id":3,"error":{"message":"no free address pools: pool 10.0.0.0/23 has 2 allocations, 0 of 2 subnets free, 0 reserved"}}`,
+		},
+		{
+			req: `{"id": 4, "method": "list", "params": {"selector": "env=prod"}}`,
+			exp: `{"id":4,"result":[{"prefix":"10.0.0.0/24","owner":"ctr1","labels":{"env":"prod"}}]}`,
+		},
+		{
+			req: `{"id": "a", "method": "release", "params": {"prefix": "10.0.1.0/24"}}`,
+			exp: `{"id":"a","result":{}}`,
+		},
+		{
+			req: `{"id": 5, "method": "release", "params": {"prefix": "10.0.1.0/24"}}`,
+			exp: `{"id":5,"error":{"message":"prefix 10.0.1.0/24 is not allocated"}}`,
+		},
+		{
+			req: `{"id": 6, "method": "release", "params": {"subnet": "10.0.1.0/24"}}`,
+			exp: `{"id":6,"error":{"message":"invalid params: json: unknown field \"subnet\""}}`,
+		},
+		{
+			req: `{"id": 7, "method": "list"}`,
+			exp: `{"id":7,"result":[{"prefix":"10.0.0.0/24","owner":"ctr1","labels":{"env":"prod"}}]}`,
+		},
+		{
+			req: `{"id": 8, "method": "renew"}`,
+			exp: `{"id":8,"error":{"message":"unknown method \"renew\""}}`,
+		},
+	}
+	for _, tc := range testcases {
+		_, err := conn.Write([]byte(tc.req + "\n"))
+		assert.NilError(t, err)
+		line, err := r.ReadString('\n')
+		assert.NilError(t, err)
+		assert.Equal(t, strings.TrimSpace(line), tc.exp)
+	}
+
+	assert.NilError(t, l.Close())
+	assert.NilError(t, <-done)
+}
+
+func TestRPCServerInvalidRequest(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	client, server := net.Pipe()
+	go NewRPCServer(a, &sync.Mutex{}).ServeConn(server)
+
+	go client.Write([]byte(`{"id": ]`))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	assert.NilError(t, err)
+	assert.Equal(t, strings.TrimSpace(line), `{"id":null,"error":{"message":"invalid request: invalid character ']' looking for beginning of value"}}`)
+}
@@ -0,0 +1,39 @@
+package main
+
+import "net/netip"
+
+// ScanCost is how much an allocation had to walk through before finding a
+// free subnet. It tells whether pools are ordered such that allocations are
+// served by the first ones, and whether allocated and reserved prefixes
+// cluster where allocations start looking, see WithHostID.
+type ScanCost struct {
+	// Pools is the number of pools considered, including the one the
+	// subnet was picked from.
+	Pools int
+	// Entries is the number of allocated and reserved prefixes jumped over.
+	Entries int
+}
+
+// LastScan returns what the last successful Allocate walked through. Pools
+// allocating subnets of their own size keep a bitmap of their free subnets,
+// so their allocations are never walked through and don't count.
+func (a *Allocator) LastScan() ScanCost {
+	return a.lastScan
+}
+
+// observeScan records what the allocation that just succeeded walked through.
+func (a *Allocator) observeScan() {
+	a.lastScan = a.scan
+	a.counters.scannedPools += uint64(a.scan.Pools)
+	a.counters.scannedEntries += uint64(a.scan.Entries)
+}
+
+// skipReserved tells whether q overlaps with one of the reserved prefixes,
+// and counts it as scanned if so.
+func (a *Allocator) skipReserved(reserved []netip.Prefix, q netip.Prefix) bool {
+	if !overlapsAny(reserved, q) {
+		return false
+	}
+	a.scan.Entries++
+	return true
+}
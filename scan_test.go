@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLastScan(t *testing.T) {
+	pools := []Pool{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24, SizeClasses: []SizeClass{{Size: 26}}},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Size: 24},
+		{Prefix: netip.MustParsePrefix("10.2.0.0/24"), Size: 24},
+	}
+
+	testcases := []struct {
+		name      string
+		allocated []netip.Prefix
+		opts      []AllocateOption
+		exp       ScanCost
+	}{
+		{
+			name: "first pool",
+			exp:  ScanCost{Pools: 1},
+		},
+		{
+			name:      "full pools",
+			allocated: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.1.0.0/24")},
+			exp:       ScanCost{Pools: 3},
+		},
+		{
+			name: "reserved subnets",
+			opts: []AllocateOption{WithReserved(netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.1.0.0/24"))},
+			exp:  ScanCost{Pools: 3, Entries: 2},
+		},
+		{
+			name: "smaller subnets",
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/26"),
+				netip.MustParsePrefix("10.0.0.64/27"),
+				netip.MustParsePrefix("10.0.0.128/26"),
+			},
+			opts: []AllocateOption{WithSize(26)},
+			exp:  ScanCost{Pools: 1, Entries: 3},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := mustNewAllocator(t, pools)
+			for _, p := range tc.allocated {
+				assert.NilError(t, a.AllocateStatic(p))
+			}
+
+			_, err := a.Allocate(tc.opts...)
+			assert.NilError(t, err)
+			assert.Equal(t, a.LastScan(), tc.exp)
+
+			c := a.Counters()
+			assert.Equal(t, c.ScannedPools, uint64(tc.exp.Pools))
+			assert.Equal(t, c.ScannedEntries, uint64(tc.exp.Entries))
+		})
+	}
+}
+
+func TestLastScanFailure(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Size: 24}})
+	_, err := a.Allocate()
+	assert.NilError(t, err)
+
+	// Failed allocations don't count.
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrNoFreePool)
+	assert.Equal(t, a.LastScan(), ScanCost{Pools: 1})
+	assert.Equal(t, a.Counters().ScannedPools, uint64(1))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selector is a list of requirements on labels, all of which must be met.
+type selector []requirement
+
+type requirement struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// parseSelector parses a comma-separated list of requirements, such as
+// "zone=eu, class!=overlay".
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		var r requirement
+		key, value, ok := strings.Cut(field, "!=")
+		if ok {
+			r.negate = true
+		} else if key, value, ok = strings.Cut(field, "="); !ok {
+			return nil, fmt.Errorf("invalid requirement %q: expected key=value or key!=value", field)
+		}
+
+		r.key, r.value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if r.key == "" {
+			return nil, fmt.Errorf("invalid requirement %q: empty key", field)
+		}
+
+		sel = append(sel, r)
+	}
+
+	return sel, nil
+}
+
+func (sel selector) matches(labels map[string]string) bool {
+	for _, r := range sel {
+		if (labels[r.key] == r.value) == r.negate {
+			return false
+		}
+	}
+	return true
+}
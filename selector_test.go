@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSelector(t *testing.T) {
+	testcases := map[string]*struct {
+		selector string
+		labels   map[string]string
+		expMatch bool
+		expErr   string
+	}{
+		"Empty selector": {
+			selector: "",
+			expMatch: true,
+		},
+		"All requirements met": {
+			selector: "zone=eu, class=overlay",
+			labels:   map[string]string{"zone": "eu", "class": "overlay", "extra": "x"},
+			expMatch: true,
+		},
+		"One requirement not met": {
+			selector: "zone=eu, class=overlay",
+			labels:   map[string]string{"zone": "eu", "class": "bridge"},
+		},
+		"Missing label": {
+			selector: "zone=eu",
+		},
+		"Inequality": {
+			selector: "zone!=eu",
+			labels:   map[string]string{"zone": "us"},
+			expMatch: true,
+		},
+		"Inequality with missing label": {
+			selector: "zone!=eu",
+			expMatch: true,
+		},
+		"Inequality not met": {
+			selector: "zone!=eu",
+			labels:   map[string]string{"zone": "eu"},
+		},
+		"Missing operator": {
+			selector: "zone=eu, overlay",
+			expErr:   `invalid requirement "overlay": expected key=value or key!=value`,
+		},
+		"Empty key": {
+			selector: "=eu",
+			expErr:   `invalid requirement "=eu": empty key`,
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			sel, err := parseSelector(tc.selector)
+			if tc.expErr != "" {
+				assert.Error(t, err, tc.expErr)
+				return
+			}
+
+			assert.NilError(t, err)
+			assert.Equal(t, sel.matches(tc.labels), tc.expMatch)
+		})
+	}
+}
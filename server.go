@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxRequestSize is the maximum size of the body of API requests.
+const maxRequestSize = 1 << 20
+
+// allocateRequest is the body of POST /allocations. Prefix is set for static
+// allocations, see AllocateStatic.
+type allocateRequest struct {
+	Prefix         netip.Prefix      `json:"prefix"`
+	Pool           string            `json:"pool"`
+	Size           int               `json:"size"`
+	Hint           netip.Prefix      `json:"hint"`
+	Selector       string            `json:"selector"`
+	Owner          string            `json:"owner"`
+	Labels         map[string]string `json:"labels"`
+	TTL            string            `json:"ttl"`
+	Pinned         bool              `json:"pinned"`
+	IdempotencyKey string            `json:"idempotency_key"`
+}
+
+// allocationResponse is the body of successful POST /allocations responses.
+// Pool is empty for static allocations outside of the pools.
+type allocationResponse struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Pool   netip.Prefix `json:"pool"`
+}
+
+// statsResponse is the body of GET /stats responses.
+type statsResponse struct {
+	Capacity  uint64              `json:"capacity"`
+	Allocated int                 `json:"allocated"`
+	Reserved  uint64              `json:"reserved"`
+	Free      uint64              `json:"free"`
+	Pools     []poolStatsResponse `json:"pools"`
+}
+
+type poolStatsResponse struct {
+	Name          string       `json:"name,omitempty"`
+	Prefix        netip.Prefix `json:"prefix"`
+	Capacity      uint64       `json:"capacity"`
+	Allocated     int          `json:"allocated"`
+	Reserved      uint64       `json:"reserved"`
+	Free          uint64       `json:"free"`
+	Fragmentation float64      `json:"fragmentation"`
+}
+
+// errorResponse is the body of failed requests. Code identifies errors
+// clients can match, see errorCodes.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// errorCodes are the codes of the errors of the allocator reported by Server,
+// such that Client can map them back.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrInvalidPrefix, "invalid_prefix"},
+	{ErrNotAllocated, "not_allocated"},
+	{ErrNoFreePool, "no_free_pool"},
+	{ErrOverlap, "overlap"},
+	{ErrTombstoned, "tombstoned"},
+	{ErrPinned, "pinned"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrDenied, "denied"},
+	{ErrVetoed, "vetoed"},
+	{ErrStoreConflict, "store_conflict"},
+	{ErrClosed, "closed"},
+	{ErrReadOnly, "read_only"},
+}
+
+// Server serves a JSON API over HTTP to drive an allocator:
+//
+//	GET    /                      serves a dashboard
+//	GET    /allocations           lists the allocations matching ?selector,
+//	                              see ListAllocations
+//	POST   /allocations           allocates a subnet, see allocateRequest
+//	DELETE /allocations/{prefix}  releases an allocation
+//	GET    /pools                 lists the pools
+//	GET    /stats                 returns the utilization of the pools
+//	GET    /events                streams changes as server-sent events
+//	GET    /events/ws             streams changes over a WebSocket
+//	GET    /healthz               liveness probe
+//	GET    /readyz                readiness probe, see HealthChecker
+//
+// The allocator isn't safe for concurrent use, so the server holds mu while
+// using it. mu must be the lock guarding every other use of the allocator.
+//
+// Serve it over mutual TLS, see TLSConfig, to expose it beyond localhost.
+// Clients are then identified by their certificate. Access can be restricted
+// further with tokens, see WithTokens. Debugging endpoints are mounted with
+// WithDebug.
+//
+// Go programs can drive it through Client.
+type Server struct {
+	a   *Allocator
+	mu  sync.Locker
+	mux *http.ServeMux
+	// tokens maps the SHA-256 of tokens to their ACL, see WithTokens.
+	tokens map[[sha256.Size]byte]ACL
+}
+
+// NewServer returns a Server driving a, guarded by mu.
+func NewServer(a *Allocator, mu sync.Locker, opts ...ServerOption) *Server {
+	s := &Server{a: a, mu: mu, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /{$}", s.dashboard)
+	s.mux.HandleFunc("GET /allocations", s.list)
+	s.mux.HandleFunc("POST /allocations", s.allocate)
+	s.mux.HandleFunc("DELETE /allocations/{prefix...}", s.deallocate)
+	s.mux.HandleFunc("GET /pools", s.pools)
+	s.mux.HandleFunc("GET /stats", s.stats)
+	s.mux.HandleFunc("GET /events", s.events)
+	s.mux.HandleFunc("GET /events/ws", s.eventsWebSocket)
+	s.mux.HandleFunc("GET /healthz", s.healthz)
+	s.mux.HandleFunc("GET /readyz", s.readyz)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !unauthenticated(r) {
+		var ok bool
+		if r, ok = s.authenticate(w, r); !ok {
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// unauthenticated tells whether r is served without a token: the dashboard,
+// which holds no data, and probes.
+func unauthenticated(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	switch r.URL.Path {
+	case "/", "/healthz", "/readyz":
+		return true
+	}
+	return false
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	acl := requestACL(r)
+	s.mu.Lock()
+	prefixes, err := s.a.ListAllocations(r.URL.Query().Get("selector"))
+	if err != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	resp := make([]allocationState, 0, len(prefixes))
+	for _, p := range prefixes {
+		if !s.allowed(acl, p, "") {
+			continue
+		}
+		m, _ := s.a.Metadata(p)
+		resp = append(resp, newAllocationState(p, m))
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) allocate(w http.ResponseWriter, r *http.Request) {
+	acl := requestACL(r)
+	if acl.Role < RoleAllocate {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+
+	var req allocateRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if actor := requestActor(r); actor != "" {
+		opts = append(opts, WithActor(actor))
+	}
+	if req.Pool == "" && acl.Role != RoleAdmin && acl.Pools != nil {
+		opts = append(opts, WithPools(acl.Pools...))
+	}
+
+	var (
+		resp    allocationResponse
+		allowed bool
+	)
+	withLock(s.a, s.mu, func() {
+		if allowed = s.allowed(acl, req.Prefix, req.Pool); allowed {
+			resp, err = allocateFor(s.a, req, opts)
+		}
+	})
+	if !allowed {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// allocateFor makes the allocation req asks for, with opts built by
+// req.options.
+func allocateFor(a *Allocator, req allocateRequest, opts []AllocateOption) (allocationResponse, error) {
+	if req.Prefix.IsValid() {
+		if err := a.AllocateStatic(req.Prefix, opts...); err != nil {
+			return allocationResponse{}, err
+		}
+		resp := allocationResponse{Prefix: req.Prefix.Masked()}
+		if pool, ok := a.PoolFor(resp.Prefix); ok {
+			resp.Pool = pool.Prefix
+		}
+		return resp, nil
+	}
+
+	alloc, err := a.AllocateWithPool(opts...)
+	if err != nil {
+		return allocationResponse{}, err
+	}
+	return allocationResponse{Prefix: alloc.Prefix, Pool: alloc.Pool.Prefix}, nil
+}
+
+// options returns the options of the allocation req asks for.
+func (req allocateRequest) options() ([]AllocateOption, error) {
+	var opts []AllocateOption
+	if req.Pool != "" {
+		opts = append(opts, WithPools(req.Pool))
+	}
+	if req.Size != 0 {
+		opts = append(opts, WithSize(req.Size))
+	}
+	if req.Hint.IsValid() {
+		opts = append(opts, WithHint(req.Hint))
+	}
+	if req.Selector != "" {
+		opts = append(opts, WithSelector(req.Selector))
+	}
+	if req.Owner != "" {
+		opts = append(opts, WithOwner(req.Owner))
+	}
+	if req.Labels != nil {
+		opts = append(opts, WithLabels(req.Labels))
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl: %w", err)
+		}
+		opts = append(opts, WithTTL(ttl))
+	}
+	if req.Pinned {
+		opts = append(opts, WithPinned())
+	}
+	if req.IdempotencyKey != "" {
+		opts = append(opts, WithIdempotencyKey(req.IdempotencyKey))
+	}
+	return opts, nil
+}
+
+func (s *Server) deallocate(w http.ResponseWriter, r *http.Request) {
+	p, err := netip.ParsePrefix(r.PathValue("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %w", ErrInvalidPrefix, err))
+		return
+	}
+
+	acl := requestACL(r)
+	if acl.Role < RoleAllocate {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	var opts []DeallocateOption
+	if actor := requestActor(r); actor != "" {
+		opts = append(opts, ReleasedBy(actor))
+	}
+
+	var allowed bool
+	withLock(s.a, s.mu, func() {
+		if allowed = s.allowed(acl, p, ""); allowed {
+			err = s.a.Deallocate(p, opts...)
+		}
+	})
+	if !allowed {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) pools(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	pools := s.a.Pools()
+	s.mu.Unlock()
+
+	acl := requestACL(r)
+	resp := make([]poolState, 0, len(pools))
+	for _, p := range pools {
+		if acl.allows(p) {
+			resp = append(resp, newPoolState(p))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	stats := s.a.Stats()
+	s.mu.Unlock()
+
+	// Totals only account for the pools the token gives access to.
+	acl := requestACL(r)
+	resp := statsResponse{Pools: make([]poolStatsResponse, 0, len(stats.Pools))}
+	for _, ps := range stats.Pools {
+		if !acl.allows(Pool{Name: ps.Name}) {
+			continue
+		}
+		resp.Capacity += ps.Capacity
+		resp.Allocated += ps.Allocated
+		resp.Reserved += ps.Reserved
+		resp.Free += ps.Free
+		resp.Pools = append(resp.Pools, poolStatsResponse{
+			Name:          ps.Name,
+			Prefix:        ps.Prefix,
+			Capacity:      ps.Capacity,
+			Allocated:     ps.Allocated,
+			Reserved:      ps.Reserved,
+			Free:          ps.Free,
+			Fragmentation: ps.Fragmentation,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// allowed tells whether acl allows allocating or releasing p, if valid, or
+// allocating from the pool of that name, if not empty.
+func (s *Server) allowed(acl ACL, p netip.Prefix, pool string) bool {
+	if acl.Role == RoleAdmin {
+		return true
+	}
+	if pool != "" && !acl.allows(Pool{Name: pool}) {
+		return false
+	}
+	if p.IsValid() {
+		// Only admins can touch prefixes outside of the pools.
+		poolID, ok := s.a.poolIndex(p)
+		return ok && acl.allows(s.a.pools[poolID])
+	}
+	return true
+}
+
+// errorStatus returns the HTTP status matching an error returned by the
+// allocator.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidPrefix):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotAllocated):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDenied), errors.Is(err, ErrVetoed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrClosed), errors.Is(err, ErrReadOnly):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrNoFreePool), errors.Is(err, ErrOverlap), errors.Is(err, ErrTombstoned),
+		errors.Is(err, ErrPinned), errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrStoreConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	resp := errorResponse{Error: err.Error()}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			resp.Code = c.code
+			break
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestServer(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Name: "default", Prefix: netip.MustParsePrefix("10.0.0.0/23"), Size: 24}})
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24"), WithPinned()))
+	srv := NewServer(a, &sync.Mutex{})
+
+	testcases := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		expStatus int
+		expBody   string
+		expPrefix string
+	}{
+		{
+			name:      "allocate",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"owner": "ctr1", "ttl": "1h"}`,
+			expStatus: http.StatusCreated,
+			expBody:   `{"prefix":"10.0.0.0/24","pool":"10.0.0.0/23"}`,
+			expPrefix: "10.0.0.0/24",
+		},
+		{
+			name:      "allocate static",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"prefix": "10.0.1.0/24"}`,
+			expStatus: http.StatusCreated,
+			expBody:   `{"prefix":"10.0.1.0/24","pool":"10.0.0.0/23"}`,
+			expPrefix: "10.0.1.0/24",
+		},
+		{
+			name:      "no free pool",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{}`,
+			expStatus: http.StatusConflict,
+			expBody:   `{"error":"no free address pools: pool 10.0.0.0/23 has 2 allocations, 0 of 2 subnets free, 0 reserved","code":"no_free_pool"}`,
+		},
+		{
+			name:      "unknown field",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"sise": 24}`,
+			expStatus: http.StatusBadRequest,
+			expBody:   `{"error":"invalid request: json: unknown field \"sise\""}`,
+		},
+		{
+			name:      "invalid ttl",
+			method:    http.MethodPost,
+			path:      "/allocations",
+			body:      `{"ttl": "1 hour"}`,
+			expStatus: http.StatusBadRequest,
+			expBody:   `{"error":"invalid ttl: time: unknown unit \" hour\" in duration \"1 hour\""}`,
+		},
+		{
+			name:      "deallocate",
+			method:    http.MethodDelete,
+			path:      "/allocations/10.0.0.0/24",
+			expStatus: http.StatusNoContent,
+		},
+		{
+			name:      "deallocate unallocated",
+			method:    http.MethodDelete,
+			path:      "/allocations/10.0.0.0/24",
+			expStatus: http.StatusNotFound,
+			expBody:   `{"error":"prefix 10.0.0.0/24 is not allocated","code":"not_allocated"}`,
+		},
+		{
+			name:      "deallocate pinned",
+			method:    http.MethodDelete,
+			path:      "/allocations/192.168.0.0/24",
+			expStatus: http.StatusConflict,
+			expBody:   `{"error":"prefix 192.168.0.0/24: allocation is pinned","code":"pinned"}`,
+		},
+		{
+			name:      "deallocate invalid prefix",
+			method:    http.MethodDelete,
+			path:      "/allocations/10.0.0.0",
+			expStatus: http.StatusBadRequest,
+			expBody:   `{"error":"invalid prefix: netip.ParsePrefix(\"10.0.0.0\"): no '/'","code":"invalid_prefix"}`,
+		},
+		{
+			name:      "pools",
+			method:    http.MethodGet,
+			path:      "/pools",
+			expStatus: http.StatusOK,
+			expBody:   `[{"name":"default","prefix":"10.0.0.0/23","size":24}]`,
+		},
+		{
+			name:      "stats",
+			method:    http.MethodGet,
+			path:      "/stats",
+			expStatus: http.StatusOK,
+			expBody:   `{"capacity":2,"allocated":1,"reserved":0,"free":1,"pools":[{"name":"default","prefix":"10.0.0.0/23","capacity":2,"allocated":1,"reserved":0,"free":1,"fragmentation":0}]}`,
+		},
+		{
+			name:      "list",
+			method:    http.MethodGet,
+			path:      "/allocations",
+			expStatus: http.StatusOK,
+			expBody:   `[{"prefix":"10.0.1.0/24"},{"prefix":"192.168.0.0/24","pinned":true}]`,
+		},
+		{
+			name:      "list with an invalid selector",
+			method:    http.MethodGet,
+			path:      "/allocations?selector=env",
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "method not allowed",
+			method:    http.MethodPut,
+			path:      "/pools",
+			expStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+
+			assert.Equal(t, rec.Code, tc.expStatus)
+			if tc.expBody != "" {
+				assert.Equal(t, rec.Header().Get("Content-Type"), "application/json")
+				assert.Equal(t, strings.TrimSpace(rec.Body.String()), tc.expBody)
+			}
+			if tc.expPrefix != "" {
+				assert.Check(t, is.Equal(a.IsAllocated(netip.MustParsePrefix(tc.expPrefix)), true))
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// snapshotMagic starts every binary snapshot.
+var snapshotMagic = []byte("SNAL")
+
+// snapshotVersion is the version of the format written by MarshalBinary.
+// Decoders accept newer versions, as long as sections they know about keep
+// their layout.
+const snapshotVersion = 1
+
+// Sections of a binary snapshot. Each section is written as its tag, the
+// length of its payload and its payload, all lengths and counts being
+// uvarints. Decoders skip sections they don't know about.
+const (
+	// sectionPools holds a count, followed by length-prefixed pool records.
+	// Decoders ignore trailing bytes in a record, such that fields can be
+	// appended to it.
+	sectionPools = 1
+	// sectionAllocations and sectionReserved hold packed prefixes, see
+	// appendPrefixes.
+	sectionAllocations = 2
+	sectionReserved    = 3
+	// sectionMeta holds a count, followed by the metadata of allocations:
+	// each entry is a packed prefix, see packPrefix, and a length-prefixed
+	// record. Like pool records, decoders ignore trailing bytes in a
+	// record.
+	sectionMeta = 4
+	// sectionTombstones holds packed prefixes, like sectionReserved. It's
+	// omitted when there are no tombstones.
+	sectionTombstones = 5
+)
+
+var errTruncatedSnapshot = errors.New("truncated snapshot")
+
+// MarshalBinary encodes the same state as MarshalJSON in a compact binary
+// format, for embedders snapshotting large allocators frequently.
+func (a *Allocator) MarshalBinary() ([]byte, error) {
+	return marshalBinarySnapshot(a.Snapshot())
+}
+
+// UnmarshalBinary decodes a snapshot written by MarshalBinary. Like
+// UnmarshalJSON, it validates the decoded state, and leaves the allocator
+// untouched on error.
+func (a *Allocator) UnmarshalBinary(data []byte) error {
+	s, err := unmarshalBinarySnapshot(data)
+	if err != nil {
+		return err
+	}
+	return a.replaceState(s)
+}
+
+// marshalBinarySnapshot encodes s. Allocated, Reserved and Tombstones must be
+// sorted.
+func marshalBinarySnapshot(s Snapshot) ([]byte, error) {
+	buf := append([]byte(nil), snapshotMagic...)
+	buf = binary.AppendUvarint(buf, snapshotVersion)
+
+	var pools []byte
+	pools = binary.AppendUvarint(pools, uint64(len(s.Pools)))
+	for _, p := range s.Pools {
+		rec, err := appendPool(nil, p)
+		if err != nil {
+			return nil, err
+		}
+		pools = appendBytes(pools, rec)
+	}
+	buf = appendSection(buf, sectionPools, pools)
+
+	var allocated []byte
+	allocated = binary.AppendUvarint(allocated, uint64(len(s.Allocated)))
+	allocated = appendPrefixes(allocated, s.Allocated)
+	buf = appendSection(buf, sectionAllocations, allocated)
+
+	var reserved []byte
+	reserved = binary.AppendUvarint(reserved, uint64(len(s.Reserved)))
+	reserved = appendPrefixes(reserved, s.Reserved)
+	buf = appendSection(buf, sectionReserved, reserved)
+
+	if len(s.Meta) > 0 {
+		var meta []byte
+		meta = binary.AppendUvarint(meta, uint64(len(s.Meta)))
+		for _, p := range slices.SortedFunc(maps.Keys(s.Meta), comparePrefix) {
+			meta = append(meta, packPrefix(p)...)
+			meta = appendBytes(meta, appendMeta(nil, s.Meta[p]))
+		}
+		buf = appendSection(buf, sectionMeta, meta)
+	}
+
+	if len(s.Tombstones) > 0 {
+		var tombstones []byte
+		tombstones = binary.AppendUvarint(tombstones, uint64(len(s.Tombstones)))
+		tombstones = appendPrefixes(tombstones, s.Tombstones)
+		buf = appendSection(buf, sectionTombstones, tombstones)
+	}
+
+	return buf, nil
+}
+
+// unmarshalBinarySnapshot decodes a snapshot encoded by
+// marshalBinarySnapshot. The snapshot isn't validated.
+func unmarshalBinarySnapshot(data []byte) (Snapshot, error) {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return Snapshot{}, errors.New("not a subnet allocator snapshot")
+	}
+	r := &snapshotReader{buf: data[len(snapshotMagic):]}
+	if r.uvarint() == 0 {
+		return Snapshot{}, errors.New("unsupported snapshot version 0")
+	}
+
+	var s Snapshot
+	for len(r.buf) > 0 && r.err == nil {
+		tag := r.uvarint()
+		section := &snapshotReader{buf: r.bytes()}
+		if r.err != nil {
+			break
+		}
+
+		switch tag {
+		case sectionPools:
+			n := section.uvarint()
+			for i := uint64(0); i < n && section.err == nil; i++ {
+				rec := &snapshotReader{buf: section.bytes()}
+				p := readPool(rec)
+				if rec.err != nil {
+					return Snapshot{}, fmt.Errorf("invalid pool record: %w", rec.err)
+				}
+				s.Pools = append(s.Pools, p)
+			}
+		case sectionAllocations:
+			s.Allocated = readPrefixes(section)
+		case sectionReserved:
+			s.Reserved = readPrefixes(section)
+		case sectionTombstones:
+			s.Tombstones = readPrefixes(section)
+		case sectionMeta:
+			n := section.uvarint()
+			for i := uint64(0); i < n && section.err == nil; i++ {
+				k := section.fixed(5)
+				rec := &snapshotReader{buf: section.bytes()}
+				if section.err != nil {
+					break
+				}
+				p, err := unpackPrefix(k)
+				if err != nil {
+					return Snapshot{}, err
+				}
+				m := readMeta(rec)
+				if rec.err != nil {
+					return Snapshot{}, fmt.Errorf("invalid metadata record: %w", rec.err)
+				}
+				if s.Meta == nil {
+					s.Meta = map[netip.Prefix]AllocationMeta{}
+				}
+				s.Meta[p] = m
+			}
+		}
+		if section.err != nil {
+			return Snapshot{}, section.err
+		}
+	}
+	if r.err != nil {
+		return Snapshot{}, r.err
+	}
+
+	return s, nil
+}
+
+func appendSection(buf []byte, tag uint64, payload []byte) []byte {
+	buf = binary.AppendUvarint(buf, tag)
+	return appendBytes(buf, payload)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// appendPool encodes p. Metadata can hold anything, so it's encoded as JSON.
+func appendPool(buf []byte, p Pool) ([]byte, error) {
+	addr := p.Prefix.Addr().As4()
+	buf = append(buf, addr[:]...)
+	buf = append(buf, byte(p.Prefix.Bits()), byte(p.Size), byte(p.StaticReserve))
+	var flags byte
+	if p.Overflow {
+		flags |= 1
+	}
+	buf = append(buf, flags)
+	buf = appendBytes(buf, []byte(p.Name))
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.Labels)))
+	for _, k := range slices.Sorted(maps.Keys(p.Labels)) {
+		buf = appendBytes(buf, []byte(k))
+		buf = appendBytes(buf, []byte(p.Labels[k]))
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.SizeClasses)))
+	for _, c := range p.SizeClasses {
+		buf = append(buf, byte(c.Size))
+		buf = binary.AppendUvarint(buf, uint64(c.Quota))
+	}
+
+	var metadata []byte
+	if len(p.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(p.Metadata); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", p.Prefix, err)
+		}
+	}
+	return appendBytes(buf, metadata), nil
+}
+
+func readPool(r *snapshotReader) Pool {
+	var p Pool
+	addr := r.fixed(4)
+	hdr := r.fixed(4)
+	if r.err != nil {
+		return p
+	}
+	p.Prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(addr)), int(hdr[0]))
+	p.Size, p.StaticReserve = int(hdr[1]), int(hdr[2])
+	p.Overflow = hdr[3]&1 != 0
+	p.Name = string(r.bytes())
+
+	for i, n := uint64(0), r.uvarint(); i < n && r.err == nil; i++ {
+		if p.Labels == nil {
+			p.Labels = map[string]string{}
+		}
+		k := string(r.bytes())
+		p.Labels[k] = string(r.bytes())
+	}
+
+	for i, n := uint64(0), r.uvarint(); i < n && r.err == nil; i++ {
+		size := r.fixed(1)
+		quota := r.uvarint()
+		if r.err == nil {
+			p.SizeClasses = append(p.SizeClasses, SizeClass{Size: int(size[0]), Quota: int(quota)})
+		}
+	}
+
+	if metadata := r.bytes(); len(metadata) > 0 && r.err == nil {
+		if err := json.Unmarshal(metadata, &p.Metadata); err != nil {
+			r.err = err
+		}
+	}
+	return p
+}
+
+// appendMeta encodes the metadata of an allocation. Fields are only ever
+// appended, such that records written by older versions decode, with later
+// fields left empty.
+func appendMeta(buf []byte, m AllocationMeta) []byte {
+	buf = appendBytes(buf, []byte(m.Name))
+	buf = appendBytes(buf, []byte(m.Owner))
+	buf = binary.AppendUvarint(buf, uint64(len(m.Labels)))
+	for _, k := range slices.Sorted(maps.Keys(m.Labels)) {
+		buf = appendBytes(buf, []byte(k))
+		buf = appendBytes(buf, []byte(m.Labels[k]))
+	}
+	// Expiry times are written in nanoseconds since the Unix epoch, 0 meaning
+	// the allocation never expires.
+	var expires int64
+	if !m.Expires.IsZero() {
+		expires = m.Expires.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, expires)
+	var pinned uint64
+	if m.Pinned {
+		pinned = 1
+	}
+	return binary.AppendUvarint(buf, pinned)
+}
+
+func readMeta(r *snapshotReader) AllocationMeta {
+	var m AllocationMeta
+	m.Name = string(r.bytes())
+	if len(r.buf) > 0 {
+		m.Owner = string(r.bytes())
+	}
+	if len(r.buf) > 0 {
+		for i, n := uint64(0), r.uvarint(); i < n && r.err == nil; i++ {
+			if m.Labels == nil {
+				m.Labels = map[string]string{}
+			}
+			k := string(r.bytes())
+			m.Labels[k] = string(r.bytes())
+		}
+	}
+	if len(r.buf) > 0 {
+		if expires := r.varint(); expires != 0 {
+			m.Expires = time.Unix(0, expires)
+		}
+	}
+	if len(r.buf) > 0 {
+		m.Pinned = r.uvarint() != 0
+	}
+	return m
+}
+
+// packPrefix encodes p as its address followed by its length. Packed prefixes
+// sort like comparePrefix does.
+func packPrefix(p netip.Prefix) []byte {
+	addr := p.Addr().As4()
+	return append(addr[:], byte(p.Bits()))
+}
+
+func unpackPrefix(k []byte) (netip.Prefix, error) {
+	if len(k) != 5 {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix key %x", k)
+	}
+	return netip.PrefixFrom(netip.AddrFrom4([4]byte(k[:4])), int(k[4])), nil
+}
+
+// appendPrefixes packs sorted prefixes. Each of them is written as the
+// distance between its address and the address of the previous prefix, as a
+// uvarint, followed by its length. Dense allocations take 2 to 4 bytes per
+// prefix.
+func appendPrefixes(buf []byte, prefixes []netip.Prefix) []byte {
+	var prev uint32
+	for _, p := range prefixes {
+		addr := addrBits(p.Addr())
+		buf = binary.AppendUvarint(buf, uint64(addr-prev))
+		buf = append(buf, byte(p.Bits()))
+		prev = addr
+	}
+	return buf
+}
+
+func readPrefixes(r *snapshotReader) []netip.Prefix {
+	n := r.uvarint()
+	// Don't trust n for preallocating, every prefix takes 2 bytes at least.
+	prefixes := make([]netip.Prefix, 0, min(n, uint64(len(r.buf)/2)))
+
+	var addr uint64
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		addr += r.uvarint()
+		bits := r.fixed(1)
+		if r.err != nil {
+			break
+		}
+		if addr > 1<<32-1 {
+			r.err = errors.New("invalid prefix address")
+			break
+		}
+		// Don't mask the prefix, Restore rejects unmasked ones.
+		var a [4]byte
+		binary.BigEndian.PutUint32(a[:], uint32(addr))
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4(a), int(bits[0])))
+	}
+	return prefixes
+}
+
+// snapshotReader decodes a binary snapshot. The first error is kept in err,
+// and reads return zero values once it's set.
+type snapshotReader struct {
+	buf []byte
+	err error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errTruncatedSnapshot
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errTruncatedSnapshot
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// fixed reads exactly n bytes.
+func (r *snapshotReader) fixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errTruncatedSnapshot
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// bytes reads a length-prefixed byte string.
+func (r *snapshotReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.buf)) {
+		r.err = errTruncatedSnapshot
+		return nil
+	}
+	return r.fixed(int(n))
+}
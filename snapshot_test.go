@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func newSnapshotAllocator(t *testing.T) *Allocator {
+	a := mustNewAllocator(t, []Pool{
+		{
+			Name:          "default",
+			Prefix:        netip.MustParsePrefix("10.0.0.0/8"),
+			Size:          24,
+			Labels:        map[string]string{"env": "prod", "zone": "a"},
+			Metadata:      map[string]any{"owner": "netops"},
+			StaticReserve: 10,
+			SizeClasses:   []SizeClass{{Size: 26, Quota: 4}, {Size: 20}},
+		},
+		{Prefix: netip.MustParsePrefix("192.168.0.0/24"), Size: 28, Overflow: true},
+	})
+	_, err := a.AllocateN(1000)
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("172.16.0.0/12"), WithPinned()))
+	_, err = a.AllocateNamed("net1", WithOwner("tenant1"))
+	assert.NilError(t, err)
+	_, err = a.Allocate(WithOwner("tenant2"), WithLabels(map[string]string{"env": "ci", "team": "net"}), WithTTL(time.Hour))
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.64/28")))
+	assert.NilError(t, a.Deallocate(netip.MustParsePrefix("192.168.0.64/28"), WithTombstone()))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.128.0.0/16")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("192.168.0.128/25")))
+	return a
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	a := newSnapshotAllocator(t)
+
+	data, err := a.MarshalBinary()
+	assert.NilError(t, err)
+
+	b := mustNewAllocator(t, nil)
+	assert.NilError(t, b.UnmarshalBinary(data))
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+
+	// The same state is always encoded the same way, whatever the order
+	// labels are iterated in.
+	for range 10 {
+		again, err := a.MarshalBinary()
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(again, data))
+	}
+
+	// Dense allocations take a few bytes each, far less than JSON.
+	js, err := json.Marshal(a)
+	assert.NilError(t, err)
+	assert.Check(t, len(data) < 4*1000)
+	assert.Check(t, len(data)*5 < len(js), "binary: %d bytes, json: %d bytes", len(data), len(js))
+}
+
+func TestBinaryUnknownSection(t *testing.T) {
+	a := newSnapshotAllocator(t)
+	data, err := a.MarshalBinary()
+	assert.NilError(t, err)
+
+	// A section added by a newer version is skipped.
+	data = appendSection(data, 42, []byte("from the future"))
+
+	b := mustNewAllocator(t, nil)
+	assert.NilError(t, b.UnmarshalBinary(data))
+	assert.DeepEqual(t, b.Allocated(), a.Allocated(), cmpPrefix)
+}
+
+func TestBinaryInvalid(t *testing.T) {
+	a := newSnapshotAllocator(t)
+	data, err := a.MarshalBinary()
+	assert.NilError(t, err)
+
+	unmasked := append([]byte(nil), snapshotMagic...)
+	unmasked = binary.AppendUvarint(unmasked, snapshotVersion)
+	unmasked = appendSection(unmasked, sectionAllocations, []byte{1, 0x81, 0x80, 0x80, 0x50, 24})
+
+	testcases := []struct {
+		name   string
+		data   []byte
+		expErr string
+	}{
+		{
+			name:   "bad magic",
+			data:   []byte("JSON"),
+			expErr: "not a subnet allocator snapshot",
+		},
+		{
+			name:   "truncated",
+			data:   data[:len(data)-3],
+			expErr: "truncated snapshot",
+		},
+		{
+			name:   "unmasked prefix",
+			data:   unmasked,
+			expErr: "invalid prefix 10.0.0.1/24",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := mustNewAllocator(t, nil)
+			err := b.UnmarshalBinary(tc.data)
+			assert.Check(t, is.ErrorContains(err, tc.expErr))
+			assert.Equal(t, len(b.Allocated()), 0)
+		})
+	}
+}
+
+func TestBinaryMetaRecordCompat(t *testing.T) {
+	// Records written before owners were added only hold a name, and
+	// those written before labels were added don't hold labels.
+	r := &snapshotReader{buf: appendBytes(nil, []byte("net1"))}
+	assert.DeepEqual(t, readMeta(r), AllocationMeta{Name: "net1"})
+	assert.NilError(t, r.err)
+	r = &snapshotReader{buf: appendBytes(appendBytes(nil, []byte("net1")), []byte("tenant1"))}
+	assert.DeepEqual(t, readMeta(r), AllocationMeta{Name: "net1", Owner: "tenant1"})
+	assert.NilError(t, r.err)
+
+	m := AllocationMeta{Name: "net1", Owner: "tenant1", Labels: map[string]string{"env": "ci"}, Expires: time.Unix(1700000000, 42), Pinned: true}
+	r = &snapshotReader{buf: appendMeta(nil, m)}
+	assert.DeepEqual(t, readMeta(r), m)
+	assert.NilError(t, r.err)
+}
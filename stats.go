@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Stats are utilization counters of the allocator. Counters are the sums of
+// the counters of all pools.
+type Stats struct {
+	Capacity  uint64
+	Allocated int
+	Reserved  uint64
+	Free      uint64
+	Pools     []PoolStats
+}
+
+// PoolStats are utilization counters of a pool. Capacity, Reserved and Free
+// are numbers of subnets of the pool Size.
+type PoolStats struct {
+	Name   string
+	Prefix netip.Prefix
+	// Capacity is the number of subnets of the pool, static reserve
+	// included.
+	Capacity uint64
+	// Allocated is the number of allocations within the pool.
+	Allocated int
+	// Reserved is the number of subnets Allocate can't hand out because of
+	// reserved prefixes only.
+	Reserved uint64
+	// Free is the number of subnets Allocate can still hand out, see
+	// CountFree.
+	Free uint64
+	// LargestFree is the largest free block of the pool, which can be
+	// smaller than a subnet. It's invalid if there's no free address left.
+	LargestFree netip.Prefix
+	// Fragmentation is 0 when free subnets are all contiguous, and gets
+	// closer to 1 as they're scattered between allocations. It's the share
+	// of free subnets that are outside of the largest run of contiguous free
+	// subnets.
+	Fragmentation float64
+}
+
+// Stats returns the utilization counters of the allocator and its pools.
+func (a *Allocator) Stats() Stats {
+	var stats Stats
+	for poolID := range a.pools {
+		ps := a.poolStats(poolID)
+		stats.Capacity += ps.Capacity
+		stats.Allocated += ps.Allocated
+		stats.Reserved += ps.Reserved
+		stats.Free += ps.Free
+		stats.Pools = append(stats.Pools, ps)
+	}
+	return stats
+}
+
+func (a *Allocator) poolStats(poolID int) PoolStats {
+	p := a.pools[poolID]
+	ps := PoolStats{
+		Name:      p.Name,
+		Prefix:    p.Prefix,
+		Allocated: len(a.FindOverlapping(p.Prefix)),
+	}
+	if p.Size < p.Prefix.Bits() || p.Size > 32 {
+		return ps
+	}
+	ps.Capacity = uint64(1) << (p.Size - p.Prefix.Bits())
+
+	var largest, longestRun uint64
+	a.eachGap(poolID, true, func(start, end uint64) {
+		run := blocksBetween(start, end, p.Size)
+		ps.Free += run
+		longestRun = max(longestRun, run)
+		off, blockBits := largestBlock(start, end)
+		if size := uint64(1) << (32 - blockBits); size > largest {
+			largest = size
+			ps.LargestFree = netip.PrefixFrom(Add(p.Prefix.Addr(), off, 0), blockBits)
+		}
+	})
+
+	var unreserved uint64
+	a.eachGap(poolID, false, func(start, end uint64) {
+		unreserved += blocksBetween(start, end, p.Size)
+	})
+	ps.Reserved = unreserved - ps.Free
+
+	if ps.Free > 0 {
+		ps.Fragmentation = 1 - float64(longestRun)/float64(ps.Free)
+	}
+
+	return ps
+}
+
+// ExhaustedError is returned when no pool has a subnet left to hand out. It
+// describes the state of the pools that were considered, such that the cause
+// can be told apart: everything allocated, reserved prefixes taking too much
+// space, or pools too fragmented for the requested size. It matches
+// ErrNoFreePool.
+type ExhaustedError struct {
+	// Size is the size of the requested subnets, or 0 if each pool was asked
+	// for subnets of its own size.
+	Size int
+	// Pools lists the pools that were considered.
+	Pools []PoolStats
+}
+
+func (e *ExhaustedError) Error() string {
+	if len(e.Pools) == 0 {
+		return ErrNoFreePool.Error()
+	}
+
+	var b strings.Builder
+	b.WriteString(ErrNoFreePool.Error())
+	if e.Size != 0 {
+		fmt.Fprintf(&b, " for a /%d", e.Size)
+	}
+	for i, ps := range e.Pools {
+		sep := "; "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(&b, "%spool %s has %d allocations, %d of %d subnets free, %d reserved",
+			sep, ps.Prefix, ps.Allocated, ps.Free, ps.Capacity, ps.Reserved)
+	}
+	return b.String()
+}
+
+func (e *ExhaustedError) Is(target error) bool {
+	return target == ErrNoFreePool
+}
+
+// exhausted returns an ExhaustedError for the pools matching sel.
+func (a *Allocator) exhausted(size int, sel selector) error {
+	a.counters.exhausted++
+	err := &ExhaustedError{Size: size}
+	for poolID, p := range a.pools {
+		if sel.matches(p.Labels) {
+			err.Pools = append(err.Pools, a.poolStats(poolID))
+		}
+	}
+	return err
+}
+
+// CountFree returns the number of free subnets of the pool whose prefix is
+// 'pool', that is the number of subnets FreeSubnets would yield. It's computed
+// from the gaps between allocations and reserved prefixes, so it's cheap even
+// for pools with millions of free subnets.
+func (a *Allocator) CountFree(pool netip.Prefix) uint64 {
+	poolID := slices.IndexFunc(a.pools, func(p Pool) bool {
+		return p.Prefix == pool.Masked()
+	})
+	if poolID == -1 {
+		return 0
+	}
+
+	p := a.pools[poolID]
+	if p.Size < p.Prefix.Bits() || p.Size > 32 {
+		return 0
+	}
+
+	var free uint64
+	a.eachGap(poolID, true, func(start, end uint64) {
+		free += blocksBetween(start, end, p.Size)
+	})
+	return free
+}
+
+// eachGap calls fn with the offsets, from the start of the poolID-th pool, of
+// every range of addresses that's neither allocated nor reserved, in order.
+// Reserved prefixes are only taken into account if withReserved is true.
+// start is inclusive and end is exclusive. Only the part of the pool Allocate
+// hands out is considered.
+func (a *Allocator) eachGap(poolID int, withReserved bool, fn func(start, end uint64)) {
+	p := a.pools[poolID]
+	base := p.Prefix.Addr()
+	limit := dynamicSize(p)
+
+	// Allocations don't overlap with each other, but they may overlap with
+	// reserved prefixes. normalizeReserved sorts all of that and drops the
+	// prefixes contained in others, such that only partial overlaps are left.
+	used := a.FindOverlapping(p.Prefix)
+	if withReserved {
+		used = append(used, a.provideReserved(nil)...)
+		used = append(used, a.permanent...)
+		used = append(used, a.reservedSet.slice()...)
+		used = normalizeReserved(used)
+	}
+
+	var cursor uint64
+	for _, u := range used {
+		if !u.Overlaps(p.Prefix) {
+			continue
+		}
+
+		var start uint64
+		if u.Addr().Compare(base) > 0 {
+			start = Distance(base, u.Addr())
+		}
+		end := Distance(base, lastAddr(u)) + 1
+		if u.Bits() <= p.Prefix.Bits() {
+			end = limit
+		}
+
+		if start >= limit {
+			break
+		}
+		if start > cursor {
+			fn(cursor, start)
+		}
+		cursor = max(cursor, end)
+	}
+
+	if cursor < limit {
+		fn(cursor, limit)
+	}
+}
+
+// blocksBetween returns the number of /bits blocks fully within [start, end).
+func blocksBetween(start, end uint64, bits int) uint64 {
+	size := uint64(1) << (32 - bits)
+	first := (start + size - 1) / size
+	last := end / size
+	if last <= first {
+		return 0
+	}
+	return last - first
+}
+
+// largestBlock returns the largest CIDR block within [start, end), as the
+// offset of its first address and its prefix length. The range can't be
+// empty.
+func largestBlock(start, end uint64) (uint64, int) {
+	var off, largest uint64
+	for start < end {
+		// The biggest block starting at 'start' is limited by its
+		// alignment, and by the end of the range.
+		size := uint64(1) << 32
+		if start != 0 {
+			size = start & -start
+		}
+		for size > end-start {
+			size >>= 1
+		}
+		if size > largest {
+			off, largest = start, size
+		}
+		start += size
+	}
+	return off, 32 - (bits.Len64(largest) - 1)
+}
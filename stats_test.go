@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCountFree(t *testing.T) {
+	testcases := []struct {
+		name      string
+		pool      Pool
+		allocated []netip.Prefix
+		reserved  []netip.Prefix
+		want      uint64
+	}{
+		{
+			name: "empty pool",
+			pool: Pool{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24},
+			want: 1 << 16,
+		},
+		{
+			name: "huge pool",
+			pool: Pool{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Size: 32},
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("255.255.255.255/32"),
+			},
+			want: 1<<32 - 1<<24 - 1,
+		},
+		{
+			name: "partially allocated subnets",
+			pool: Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.1.128/25"),
+				netip.MustParsePrefix("192.168.2.0/32"),
+				netip.MustParsePrefix("192.168.16.0/20"),
+			},
+			reserved: []netip.Prefix{
+				netip.MustParsePrefix("192.168.2.0/23"),
+				netip.MustParsePrefix("192.168.255.255/32"),
+			},
+			want: 256 - 4 - 16 - 1,
+		},
+		{
+			name:      "pool within an allocation",
+			pool:      Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24},
+			allocated: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/15")},
+		},
+		{
+			name: "static reserve",
+			pool: Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24, StaticReserve: 50},
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.200.0/24"),
+			},
+			want: 127,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &Allocator{
+				pools:     []Pool{tc.pool},
+				allocated: newPrefixList(tc.allocated...),
+			}
+			for _, r := range tc.reserved {
+				assert.NilError(t, a.AddReserved(r))
+			}
+
+			assert.Equal(t, a.CountFree(tc.pool.Prefix), tc.want)
+			if tc.want <= 1<<16 {
+				assert.Equal(t, uint64(len(slices.Collect(a.FreeSubnets(tc.pool.Prefix)))), tc.want)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	a := &Allocator{
+		pools: []Pool{
+			{Name: "big", Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 16},
+			{Name: "small", Prefix: netip.MustParsePrefix("192.168.0.0/22"), Size: 24},
+		},
+		allocated: newPrefixList(
+			netip.MustParsePrefix("192.168.0.0/24"),
+			netip.MustParsePrefix("192.168.3.0/25"),
+			netip.MustParsePrefix("10.0.0.0/16"),
+			netip.MustParsePrefix("172.16.0.0/12"),
+		),
+	}
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("192.168.1.0/24")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("192.168.3.0/24")))
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.128.0.0/9")))
+
+	assert.DeepEqual(t, a.Stats(), Stats{
+		Capacity:  4 + 256,
+		Allocated: 3,
+		Reserved:  1 + 128,
+		Free:      1 + 127,
+		Pools: []PoolStats{
+			{
+				Name:        "big",
+				Prefix:      netip.MustParsePrefix("10.0.0.0/8"),
+				Capacity:    256,
+				Allocated:   1,
+				Reserved:    128,
+				Free:        127,
+				LargestFree: netip.MustParsePrefix("10.64.0.0/10"),
+			},
+			{
+				Name:        "small",
+				Prefix:      netip.MustParsePrefix("192.168.0.0/22"),
+				Capacity:    4,
+				Allocated:   2,
+				Reserved:    1,
+				Free:        1,
+				LargestFree: netip.MustParsePrefix("192.168.2.0/24"),
+			},
+		},
+	}, cmpPrefix)
+}
+
+func TestLargestBlock(t *testing.T) {
+	testcases := []struct {
+		start, end uint64
+		off        uint64
+		bits       int
+	}{
+		{start: 0, end: 1 << 32, off: 0, bits: 0},
+		{start: 0, end: 1, off: 0, bits: 32},
+		{start: 1, end: 8, off: 4, bits: 30},
+		{start: 3, end: 13, off: 4, bits: 30},
+		{start: 256, end: 1 << 31, off: 1 << 30, bits: 2},
+	}
+
+	for _, tc := range testcases {
+		off, bits := largestBlock(tc.start, tc.end)
+		assert.Equal(t, off, tc.off, "range [%d, %d)", tc.start, tc.end)
+		assert.Equal(t, bits, tc.bits, "range [%d, %d)", tc.start, tc.end)
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	testcases := []struct {
+		name      string
+		allocated []netip.Prefix
+		want      float64
+	}{
+		{
+			name: "empty pool",
+		},
+		{
+			name: "contiguous allocations",
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/24"),
+				netip.MustParsePrefix("192.168.1.0/24"),
+			},
+		},
+		{
+			name: "scattered allocations",
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("192.168.1.0/28"),
+				netip.MustParsePrefix("192.168.3.0/28"),
+				netip.MustParsePrefix("192.168.5.0/28"),
+			},
+			// Free subnets are .0, .2, .4 and .6 to .7.
+			want: 0.6,
+		},
+		{
+			name: "full pool",
+			allocated: []netip.Prefix{
+				netip.MustParsePrefix("192.168.0.0/21"),
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &Allocator{
+				pools: []Pool{
+					{Prefix: netip.MustParsePrefix("192.168.0.0/21"), Size: 24},
+				},
+				allocated: newPrefixList(tc.allocated...),
+			}
+			assert.Equal(t, a.Stats().Pools[0].Fragmentation, tc.want)
+		})
+	}
+}
+
+func TestExhaustedError(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/23"), Size: 24, Labels: map[string]string{"zone": "eu"}},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24, SizeClasses: []SizeClass{{Size: 23}}},
+	})
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("192.168.1.0/24")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.1.0/24")))
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.2.0/24")))
+
+	_, err := a.Allocate(WithSize(23))
+	assert.ErrorIs(t, err, ErrNoFreePool)
+	assert.Error(t, err, "no free address pools for a /23: "+
+		"pool 10.0.0.0/22 has 2 allocations, 2 of 4 subnets free, 0 reserved; "+
+		"pool 192.168.0.0/23 has 0 allocations, 1 of 2 subnets free, 1 reserved")
+
+	var exhausted *ExhaustedError
+	assert.Assert(t, errors.As(err, &exhausted))
+	assert.Equal(t, exhausted.Size, 23)
+	assert.Equal(t, len(exhausted.Pools), 2)
+
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("192.168.0.0/24")))
+	_, err = a.Allocate(WithSelector("zone=eu"))
+	assert.Error(t, err, "no free address pools: "+
+		"pool 192.168.0.0/23 has 1 allocations, 0 of 2 subnets free, 1 reserved")
+
+	_, err = a.AllocateN(3)
+	assert.Error(t, err, "no free address pools: "+
+		"pool 10.0.0.0/22 has 2 allocations, 2 of 4 subnets free, 0 reserved; "+
+		"pool 192.168.0.0/23 has 1 allocations, 0 of 2 subnets free, 1 reserved")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+)
+
+// Snapshot is the state of an allocator: its pools, the allocated prefixes,
+// the prefixes reserved with AddReserved, and tombstones.
+type Snapshot struct {
+	Pools     []Pool
+	Allocated []netip.Prefix
+	Reserved  []netip.Prefix
+	// Tombstones lists released prefixes that aren't purged yet, see
+	// WithTombstone.
+	Tombstones []netip.Prefix
+	// Meta holds the metadata of allocated prefixes, for those that have
+	// some. It's nil if none has.
+	Meta map[netip.Prefix]AllocationMeta
+}
+
+// Store persists the state of an allocator. Once registered with WithStore,
+// the allocator writes through it on every change, before the change is
+// visible. If the store fails, the change is not applied.
+//
+// A store can be shared by several allocators, e.g. on different hosts. It
+// then returns an error matching ErrStoreConflict when the persisted state was
+// changed by another allocator since it was last loaded. The allocator reloads
+// its state from the store, and Allocate tries again.
+type Store interface {
+	// Load returns the persisted state. The zero Snapshot is returned when
+	// nothing was persisted yet.
+	Load() (Snapshot, error)
+	// SaveAllocation persists a single new allocation.
+	SaveAllocation(p netip.Prefix) error
+	// DeleteAllocation persists a single deallocation.
+	DeleteAllocation(p netip.Prefix) error
+	// SaveSnapshot replaces the whole persisted state. It's used for changes
+	// affecting pools, reservations, metadata of allocations, or several
+	// allocations at once.
+	SaveSnapshot(s Snapshot) error
+}
+
+// HealthChecker is implemented by stores able to tell whether they can be
+// reached, see Server's /readyz. CheckHealth may be called concurrently with
+// the other methods of the store.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// Flusher is implemented by stores buffering writes. Close flushes them before
+// the allocator is closed.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// WithStore makes the allocator persist its state to s. NewAllocator loads
+// the state persisted in s. Pools given to NewAllocator take precedence over
+// the persisted ones, which are only used when no pools are given.
+func WithStore(s Store) Option {
+	return func(a *Allocator) {
+		a.store = s
+	}
+}
+
+// Snapshot returns the current state of the allocator.
+func (a *Allocator) Snapshot() Snapshot {
+	return Snapshot{
+		Pools:      a.Pools(),
+		Allocated:  a.allocated.slice(),
+		Reserved:   a.reservedSet.slice(),
+		Tombstones: a.tombstones.slice(),
+		Meta:       a.persistedMeta(),
+	}
+}
+
+// load restores the state persisted in the store.
+func (a *Allocator) load() error {
+	s, err := a.store.Load()
+	if err != nil {
+		return fmt.Errorf("loading state: %w", err)
+	}
+	if len(a.pools) > 0 {
+		s.Pools = a.pools
+	}
+	if a.readOnly {
+		// The state isn't written back, see WithReadOnly.
+		b, err := a.newState(s)
+		if err != nil {
+			return err
+		}
+		a.swapState(b)
+		return nil
+	}
+	return a.replaceState(s)
+}
+
+// reload replaces the state of the allocator with the one persisted in the
+// store, without writing it back. It's used when another allocator sharing
+// the store changed it.
+func (a *Allocator) reload() error {
+	s, err := a.store.Load()
+	if err != nil {
+		a.reloadErr = fmt.Errorf("reloading state: %w", err)
+		return a.reloadErr
+	}
+	b, err := a.newState(s)
+	if err != nil {
+		a.reloadErr = fmt.Errorf("reloading state: %w", err)
+		return a.reloadErr
+	}
+	a.swapState(b)
+	a.generation++
+	a.reloadErr = nil
+	return nil
+}
+
+// replaceState replaces the pools, allocations and reservations of the
+// allocator, after validating them. On error, the allocator is left untouched.
+func (a *Allocator) replaceState(s Snapshot) error {
+	b, err := a.newState(s)
+	if err != nil {
+		return err
+	}
+	return a.persist(func() error {
+		a.swapState(b)
+		return nil
+	})
+}
+
+// newState validates s, and returns an allocator holding it, with the same
+// options as a. It's built aside, such that a failure doesn't leave a
+// half-restored.
+func (a *Allocator) newState(s Snapshot) (*Allocator, error) {
+	b := &Allocator{
+		permanent:  a.permanent,
+		mergePools: a.mergePools,
+	}
+	b.pools = normalizePools(s.Pools)
+	if b.mergePools {
+		b.pools = mergePools(b.pools)
+	}
+	if err := validatePools(b.pools); err != nil {
+		return nil, err
+	}
+	for _, p := range s.Reserved {
+		if err := b.AddReserved(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.Restore(s.Allocated); err != nil {
+		return nil, err
+	}
+	for _, p := range s.Tombstones {
+		if !p.IsValid() || !p.Addr().Is4() {
+			return nil, fmt.Errorf("%w %s", ErrInvalidPrefix, p)
+		}
+		b.tombstones.insert(p.Masked())
+	}
+	if err := b.restoreMeta(s.Meta); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// swapState moves the state of b, built by newState, to a.
+func (a *Allocator) swapState(b *Allocator) {
+	a.pools = b.pools
+	a.allocated = b.allocated
+	a.reservedSet = b.reservedSet
+	a.tombstones = b.tombstones
+	// Idempotency keys aren't persisted, so they're carried over for
+	// allocations that are still there.
+	for p, m := range a.meta {
+		if m.key == "" || !a.allocated.contains(p) {
+			continue
+		}
+		if b.meta == nil {
+			b.meta = map[netip.Prefix]allocMeta{}
+		}
+		nm := b.meta[p]
+		nm.key = m.key
+		b.meta[p] = nm
+	}
+	a.meta = b.meta
+	a.reindexMeta()
+	a.invalidateIndexes()
+	a.mustCheckInvariants()
+}
+
+// persist runs fn, which changes the state of the allocator, and then saves a
+// snapshot to the store. If saving fails, the change is rolled back. fn must
+// not change anything when it returns an error.
+func (a *Allocator) persist(fn func() error) error {
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	if a.store == nil {
+		if err := fn(); err != nil {
+			a.discardChanges()
+			return err
+		}
+		a.generation++
+		a.notify()
+		return nil
+	}
+
+	prev, prevMeta, prevHistory := a.Snapshot(), maps.Clone(a.meta), slices.Clone(a.history)
+	if err := fn(); err != nil {
+		a.discardChanges()
+		return err
+	}
+	if err := a.store.SaveSnapshot(a.Snapshot()); err != nil {
+		a.pools = prev.Pools
+		a.allocated = newPrefixList(prev.Allocated...)
+		a.reservedSet = newPrefixList(prev.Reserved...)
+		a.tombstones = newPrefixList(prev.Tombstones...)
+		a.meta = prevMeta
+		a.history = prevHistory
+		a.discardChanges()
+		a.reindexMeta()
+		a.invalidateIndexes()
+		return a.storeError(fmt.Errorf("saving state: %w", err))
+	}
+	a.generation++
+	a.notify()
+	return nil
+}
+
+// storeError reloads the state when err reports a conflict with another
+// allocator, such that the next call works on a fresh state. err is returned
+// as is, unless reloading fails.
+func (a *Allocator) storeError(err error) error {
+	if !errors.Is(err, ErrStoreConflict) {
+		return err
+	}
+	if rerr := a.reload(); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	return err
+}
+
+// saveAllocation writes p through the store, if any, before it's allocated.
+func (a *Allocator) saveAllocation(p netip.Prefix) error {
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	if a.store == nil {
+		return nil
+	}
+	if err := a.store.SaveAllocation(p); err != nil {
+		return a.storeError(fmt.Errorf("saving allocation %s: %w", p, err))
+	}
+	return nil
+}
+
+// deleteAllocation writes the deallocation of p through the store, if any,
+// before it's deallocated.
+func (a *Allocator) deleteAllocation(p netip.Prefix) error {
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	if a.store == nil {
+		return nil
+	}
+	if err := a.store.DeleteAllocation(p); err != nil {
+		return a.storeError(fmt.Errorf("deleting allocation %s: %w", p, err))
+	}
+	return nil
+}
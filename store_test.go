@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"gotest.tools/v3/assert"
+)
+
+// memStore is a Store keeping its state in memory. It records the calls it
+// gets, and fails them while fail is set.
+type memStore struct {
+	state Snapshot
+	calls []string
+	fail  bool
+}
+
+var errStore = errors.New("store is down")
+
+func (s *memStore) Load() (Snapshot, error) {
+	return s.state, nil
+}
+
+func (s *memStore) SaveAllocation(p netip.Prefix) error {
+	s.calls = append(s.calls, "save "+p.String())
+	if s.fail {
+		return errStore
+	}
+	s.state.Allocated = append(s.state.Allocated, p)
+	return nil
+}
+
+func (s *memStore) DeleteAllocation(p netip.Prefix) error {
+	s.calls = append(s.calls, "delete "+p.String())
+	if s.fail {
+		return errStore
+	}
+	s.state.Allocated = slices.DeleteFunc(s.state.Allocated, func(q netip.Prefix) bool { return q == p })
+	return nil
+}
+
+func (s *memStore) SaveSnapshot(state Snapshot) error {
+	s.calls = append(s.calls, "snapshot")
+	if s.fail {
+		return errStore
+	}
+	s.state = state
+	return nil
+}
+
+func TestStoreWriteThrough(t *testing.T) {
+	s := &memStore{}
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithStore(s))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.10.0/24")))
+	assert.NilError(t, a.Deallocate(p))
+	_, err = a.AllocateN(2)
+	assert.NilError(t, err)
+	assert.NilError(t, a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")))
+
+	assert.DeepEqual(t, s.calls, []string{
+		"snapshot",
+		"save 10.0.0.0/24",
+		"save 10.0.10.0/24",
+		"delete 10.0.0.0/24",
+		"snapshot",
+		"snapshot",
+	})
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+
+	// A new allocator picks up where the previous one left off.
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.DeepEqual(t, b.Snapshot(), a.Snapshot(), cmpPrefix)
+	p, err = b.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.2.0/24"))
+
+	// Pools given to NewAllocator win over persisted ones.
+	pools = []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 16}}
+	c := mustNewAllocator(t, pools, WithStore(s))
+	assert.DeepEqual(t, c.Pools(), pools, cmpPrefix)
+	assert.DeepEqual(t, c.Allocated(), b.Allocated(), cmpPrefix)
+}
+
+func TestStoreFailure(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+	p, err := a.Allocate(WithIdempotencyKey("req1"))
+	assert.NilError(t, err)
+	before := a.Snapshot()
+
+	s.fail = true
+
+	testcases := []struct {
+		name string
+		op   func() error
+	}{
+		{
+			name: "allocate",
+			op: func() error {
+				_, err := a.Allocate()
+				return err
+			},
+		},
+		{
+			name: "allocate static",
+			op:   func() error { return a.AllocateStatic(netip.MustParsePrefix("10.0.10.0/24")) },
+		},
+		{
+			name: "deallocate",
+			op:   func() error { return a.Deallocate(p) },
+		},
+		{
+			name: "allocate n",
+			op: func() error {
+				_, err := a.AllocateN(3)
+				return err
+			},
+		},
+		{
+			name: "reset",
+			op:   a.Reset,
+		},
+		{
+			name: "add reserved",
+			op:   func() error { return a.AddReserved(netip.MustParsePrefix("10.0.128.0/17")) },
+		},
+		{
+			name: "add pool",
+			op:   func() error { return a.AddPool(Pool{Prefix: netip.MustParsePrefix("192.168.0.0/16"), Size: 24}) },
+		},
+		{
+			name: "remove pool",
+			op:   func() error { return a.RemovePool(netip.MustParsePrefix("10.0.0.0/16"), ReleaseAllocations) },
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.op()
+			assert.ErrorIs(t, err, errStore)
+			assert.DeepEqual(t, a.Snapshot(), before, cmpPrefix, cmpopts.EquateEmpty())
+		})
+	}
+
+	// Indexes are consistent with the rolled back state.
+	s.fail = false
+	assert.NilError(t, a.CheckInvariants(true))
+	again, err := a.Allocate(WithIdempotencyKey("req1"))
+	assert.NilError(t, err)
+	assert.Equal(t, again, p)
+	next, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, next, netip.MustParsePrefix("10.0.1.0/24"))
+}
+
+// sharedStore is a Store shared by several allocators. Each of them gets its
+// own view, which refuses writes when another view wrote in the meantime.
+type sharedStore struct {
+	state Snapshot
+	rev   int
+}
+
+type sharedView struct {
+	shared *sharedStore
+	rev    int
+}
+
+func (v *sharedView) Load() (Snapshot, error) {
+	v.rev = v.shared.rev
+	return v.shared.state, nil
+}
+
+func (v *sharedView) SaveAllocation(p netip.Prefix) error {
+	state := v.shared.state
+	state.Allocated = append(slices.Clone(state.Allocated), p)
+	return v.SaveSnapshot(state)
+}
+
+func (v *sharedView) DeleteAllocation(p netip.Prefix) error {
+	state := v.shared.state
+	state.Allocated = slices.DeleteFunc(slices.Clone(state.Allocated), func(q netip.Prefix) bool { return q == p })
+	return v.SaveSnapshot(state)
+}
+
+func (v *sharedView) SaveSnapshot(state Snapshot) error {
+	if v.rev != v.shared.rev {
+		return ErrStoreConflict
+	}
+	v.shared.state = state
+	v.shared.rev++
+	v.rev = v.shared.rev
+	return nil
+}
+
+func TestStoreConflict(t *testing.T) {
+	s := &sharedStore{}
+	pools := []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}
+	a := mustNewAllocator(t, pools, WithStore(&sharedView{shared: s}))
+	b := mustNewAllocator(t, pools, WithStore(&sharedView{shared: s}))
+
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/24"))
+
+	// b first tries 10.0.0.0/24, and then tries again after reloading.
+	p, err = b.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.1.0/24"))
+
+	// Other methods don't try again, but reload the state.
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.1.0/24"))
+	assert.ErrorIs(t, err, ErrStoreConflict)
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.1.0/24"))
+	assert.ErrorIs(t, err, ErrOverlap)
+	assert.DeepEqual(t, a.Snapshot(), b.Snapshot(), cmpPrefix)
+}
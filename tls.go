@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSConfig configures mutual TLS for Server. Clients must present a
+// certificate signed by one of the CAs of ClientCAFile, and their identity,
+// see ClientIdentity, is recorded as the actor of their requests, see
+// WithActor and ReleasedBy.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM-encoded certificate and key of the
+	// server.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the PEM-encoded CAs client certificates are
+	// verified against.
+	ClientCAFile string
+}
+
+// ServerConfig returns the tls.Config of a server requiring client
+// certificates, e.g. for http.Server.TLSConfig.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" || c.ClientCAFile == "" {
+		return nil, errors.New("mutual TLS needs a certificate, a key and client CAs")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the server certificate: %w", err)
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("loading client CAs: no certificate found in %s", c.ClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientIdentity returns the identity of the client that sent r, as told by
+// its verified certificate. That's its first URI SAN, e.g. a SPIFFE ID, or
+// its common name. It's empty if r wasn't received over mutual TLS.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
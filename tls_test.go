@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate signed by ca, and its key, PEM-encoded.
+func (ca testCA) issue(t *testing.T, tmpl *x509.Certificate) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NilError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// client returns an HTTP client presenting a certificate issued by ca.
+func (ca testCA) client(t *testing.T, tmpl *x509.Certificate) *http.Client {
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	certPEM, keyPEM := ca.issue(t, tmpl)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NilError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}},
+	}}
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	cfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	assert.NilError(t, os.WriteFile(cfg.CertFile, certPEM, 0o600))
+	assert.NilError(t, os.WriteFile(cfg.KeyFile, keyPEM, 0o600))
+	assert.NilError(t, os.WriteFile(cfg.ClientCAFile, ca.pem, 0o600))
+	tlsConfig, err := cfg.ServerConfig()
+	assert.NilError(t, err)
+
+	var admitted []string
+	policy := func(req AdmissionRequest) (string, error) {
+		admitted = append(admitted, req.Actor)
+		return "", nil
+	}
+	s := &auditStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}},
+		WithStore(s), WithAudit(), WithAdmissionPolicy(policy))
+	ts := httptest.NewUnstartedServer(NewServer(a, &sync.Mutex{}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	alice := ca.client(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	resp, err := alice.Post(ts.URL+"/allocations", "application/json", strings.NewReader(`{}`))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusCreated)
+
+	bob := ca.client(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "bob"},
+		URIs:    []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/bob"}},
+	})
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/allocations/10.0.0.0/24", nil)
+	assert.NilError(t, err)
+	resp, err = bob.Do(req)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+
+	assert.DeepEqual(t, admitted, []string{"alice"})
+	assert.Equal(t, len(s.audit), 2)
+	assert.Equal(t, s.audit[0].Actor, "alice")
+	assert.Equal(t, s.audit[1].Actor, "spiffe://example.org/bob")
+
+	// Clients without a certificate are turned away.
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: alice.Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}}
+	anonymous.Transport.(*http.Transport).TLSClientConfig.Certificates = nil
+	_, err = anonymous.Get(ts.URL + "/pools")
+	assert.ErrorContains(t, err, "certificate required")
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	assert.NilError(t, os.WriteFile(empty, nil, 0o600))
+
+	testcases := []struct {
+		name   string
+		cfg    TLSConfig
+		expErr string
+	}{
+		{
+			name:   "missing files",
+			cfg:    TLSConfig{CertFile: "cert.pem"},
+			expErr: "mutual TLS needs a certificate, a key and client CAs",
+		},
+		{
+			name:   "invalid certificate",
+			cfg:    TLSConfig{CertFile: empty, KeyFile: empty, ClientCAFile: empty},
+			expErr: "loading the server certificate: tls: failed to find any PEM data in certificate input",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.cfg.ServerConfig()
+			assert.Error(t, err, tc.expErr)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// WithTombstone leaves a tombstone behind released prefixes: they can't be
+// allocated again, neither by Allocate nor statically, until Purge is called.
+// It allows for two-phase cleanups, e.g. withdrawing the routes to a subnet
+// before it can be reused. Tombstones are persisted.
+func WithTombstone() DeallocateOption {
+	return func(o *deallocateOptions) {
+		o.tombstone = true
+	}
+}
+
+// releaseWith releases p, and leaves a tombstone behind if o asks for it.
+func (a *Allocator) releaseWith(p netip.Prefix, o deallocateOptions) {
+	a.release(p)
+	if o.tombstone {
+		a.tombstones.insert(p)
+	}
+}
+
+// checkTombstones returns an error matching ErrTombstoned if p overlaps with
+// a tombstone.
+func (a *Allocator) checkTombstones(p netip.Prefix) error {
+	var err error
+	a.tombstones.each(func(t netip.Prefix) bool {
+		if t.Overlaps(p) {
+			err = fmt.Errorf("prefix %s overlaps with %s: %w", p, t, ErrTombstoned)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// Tombstones returns the prefixes released with WithTombstone that weren't
+// purged yet, sorted.
+func (a *Allocator) Tombstones() []netip.Prefix {
+	return a.tombstones.slice()
+}
+
+// Purge removes all tombstones at once, such that the prefixes they cover can
+// be allocated again. It returns the purged prefixes, sorted.
+func (a *Allocator) Purge() ([]netip.Prefix, error) {
+	purged := a.tombstones.slice()
+	if len(purged) == 0 {
+		return nil, nil
+	}
+
+	err := a.persist(func() error {
+		a.tombstones = prefixList{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTombstones(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/22"), Size: 24}}, WithStore(s))
+	prefixes, err := a.AllocateN(3)
+	assert.NilError(t, err)
+
+	assert.NilError(t, a.Deallocate(prefixes[0], WithTombstone()))
+	assert.NilError(t, a.DeallocateAll(prefixes[1:2], WithTombstone()))
+	assert.DeepEqual(t, a.Tombstones(), prefixes[:2], cmpPrefix)
+	assert.DeepEqual(t, a.Allocated(), prefixes[2:], cmpPrefix)
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+
+	// Tombstones block both dynamic and static allocations.
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.3.0/24"))
+	_, err = a.Allocate()
+	assert.ErrorIs(t, err, ErrNoFreePool)
+	err = a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/23"))
+	assert.ErrorIs(t, err, ErrTombstoned)
+	assert.Error(t, err, "prefix 10.0.0.0/23 overlaps with 10.0.0.0/24: prefix overlaps with a tombstone")
+
+	// They survive restarts.
+	b := mustNewAllocator(t, nil, WithStore(s))
+	assert.DeepEqual(t, b.Tombstones(), prefixes[:2], cmpPrefix)
+
+	purged, err := a.Purge()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, purged, prefixes[:2], cmpPrefix)
+	assert.Equal(t, len(a.Tombstones()), 0)
+	assert.NilError(t, a.AllocateStatic(netip.MustParsePrefix("10.0.0.0/23")))
+
+	purged, err = a.Purge()
+	assert.NilError(t, err)
+	assert.Equal(t, len(purged), 0)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// trieSlabLen is the number of nodes allocated at once by a prefixTrie.
+const trieSlabLen = 256
+
+// prefixTrie is a binary radix trie of IPv4 prefixes. Lookups walk at most
+// one node per bit of the prefix or address looked up.
+type prefixTrie struct {
+	root trieNode
+	// slab holds preallocated nodes, such that inserts don't hit the heap
+	// for every new node.
+	slab []trieNode
+	// free holds removed nodes, linked through their first child, which are
+	// reused before carving new ones out of slab.
+	free *trieNode
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	// set is true when a prefix ends on this node.
+	set bool
+	// count is the number of prefixes in this subtree, this node included.
+	count int
+}
+
+// insert adds p to the trie. It returns false if p was already there.
+func (t *prefixTrie) insert(p netip.Prefix) bool {
+	if !p.Addr().Is4() {
+		return false
+	}
+	p = p.Masked()
+	addr := addrBits(p.Addr())
+
+	n := &t.root
+	for d := 0; d < p.Bits(); d++ {
+		b := bitAt(addr, d)
+		if n.child[b] == nil {
+			n.child[b] = t.newNode()
+		}
+		n = n.child[b]
+	}
+	if n.set {
+		return false
+	}
+	n.set = true
+
+	n = &t.root
+	for d := 0; d < p.Bits(); d++ {
+		n.count++
+		n = n.child[bitAt(addr, d)]
+	}
+	n.count++
+
+	return true
+}
+
+func (t *prefixTrie) newNode() *trieNode {
+	if n := t.free; n != nil {
+		t.free = n.child[0]
+		*n = trieNode{}
+		return n
+	}
+	if len(t.slab) == 0 {
+		t.slab = make([]trieNode, trieSlabLen)
+	}
+	n := &t.slab[0]
+	t.slab = t.slab[1:]
+	return n
+}
+
+// remove deletes p from the trie. It returns false if p wasn't there.
+func (t *prefixTrie) remove(p netip.Prefix) bool {
+	if !p.Addr().Is4() {
+		return false
+	}
+	p = p.Masked()
+	addr := addrBits(p.Addr())
+
+	n := &t.root
+	for d := 0; d < p.Bits() && n != nil; d++ {
+		n = n.child[bitAt(addr, d)]
+	}
+	if n == nil || !n.set {
+		return false
+	}
+	n.set = false
+
+	n = &t.root
+	for d := 0; d < p.Bits(); d++ {
+		n.count--
+		b := bitAt(addr, d)
+		if n.child[b].count == 1 {
+			// The whole subtree only holds p, drop it.
+			t.freeNodes(n.child[b])
+			n.child[b] = nil
+			return true
+		}
+		n = n.child[b]
+	}
+	n.count--
+
+	return true
+}
+
+// freeNodes puts the nodes of the subtree rooted at n on the free list.
+func (t *prefixTrie) freeNodes(n *trieNode) {
+	for _, c := range n.child {
+		if c != nil {
+			t.freeNodes(c)
+		}
+	}
+	*n = trieNode{child: [2]*trieNode{t.free}}
+	t.free = n
+}
+
+// overlapping returns a prefix of the trie overlapping with p. If a prefix
+// contains p, that one is returned. Otherwise, the lowest prefix contained in
+// p is returned.
+func (t *prefixTrie) overlapping(p netip.Prefix) (netip.Prefix, bool) {
+	if !p.Addr().Is4() {
+		return netip.Prefix{}, false
+	}
+	p = p.Masked()
+	addr := addrBits(p.Addr())
+
+	n := &t.root
+	for d := 0; d < p.Bits(); d++ {
+		if n.set {
+			return prefixFromBits(addr, d), true
+		}
+		n = n.child[bitAt(addr, d)]
+		if n == nil {
+			return netip.Prefix{}, false
+		}
+	}
+	if n.count == 0 {
+		return netip.Prefix{}, false
+	}
+
+	// Something lives under p. Go down to the lowest prefix.
+	d := p.Bits()
+	for !n.set {
+		if c := n.child[0]; c != nil && c.count > 0 {
+			n = c
+		} else {
+			n = n.child[1]
+			addr |= 1 << (31 - d)
+		}
+		d++
+	}
+	return prefixFromBits(addr, d), true
+}
+
+// containing returns the shortest prefix of the trie containing addr.
+func (t *prefixTrie) containing(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.Is4() {
+		return netip.Prefix{}, false
+	}
+	bits := addrBits(addr)
+
+	n := &t.root
+	for d := 0; n != nil; d++ {
+		if n.set {
+			return prefixFromBits(bits, d), true
+		}
+		if d == 32 {
+			break
+		}
+		n = n.child[bitAt(bits, d)]
+	}
+	return netip.Prefix{}, false
+}
+
+func addrBits(addr netip.Addr) uint32 {
+	a := addr.As4()
+	return binary.BigEndian.Uint32(a[:])
+}
+
+func bitAt(addr uint32, d int) int {
+	return int(addr>>(31-d)) & 1
+}
+
+func prefixFromBits(addr uint32, bits int) netip.Prefix {
+	var a [4]byte
+	binary.BigEndian.PutUint32(a[:], addr)
+	return netip.PrefixFrom(netip.AddrFrom4(a), bits).Masked()
+}
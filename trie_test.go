@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTrieOverlapping(t *testing.T) {
+	trie := &prefixTrie{}
+	for _, p := range []string{
+		"10.0.0.0/8",
+		"192.168.0.0/24",
+		"192.168.1.4/30",
+		"192.168.1.128/25",
+	} {
+		assert.Assert(t, trie.insert(netip.MustParsePrefix(p)))
+	}
+
+	testcases := map[string]*struct {
+		prefix     netip.Prefix
+		expOverlap netip.Prefix
+	}{
+		"Contained in an entry": {
+			prefix:     netip.MustParsePrefix("10.20.30.0/24"),
+			expOverlap: netip.MustParsePrefix("10.0.0.0/8"),
+		},
+		"Same as an entry": {
+			prefix:     netip.MustParsePrefix("192.168.0.0/24"),
+			expOverlap: netip.MustParsePrefix("192.168.0.0/24"),
+		},
+		"Containing several entries": {
+			prefix:     netip.MustParsePrefix("192.168.0.0/16"),
+			expOverlap: netip.MustParsePrefix("192.168.0.0/24"),
+		},
+		"Containing entries, lowest isn't on the left-most branch": {
+			prefix:     netip.MustParsePrefix("192.168.1.0/24"),
+			expOverlap: netip.MustParsePrefix("192.168.1.4/30"),
+		},
+		"No overlap": {
+			prefix: netip.MustParsePrefix("192.168.2.0/24"),
+		},
+		"No overlap, sibling of an entry": {
+			prefix: netip.MustParsePrefix("192.168.1.0/30"),
+		},
+	}
+
+	for tcname := range testcases {
+		tc := testcases[tcname]
+		t.Run(tcname, func(t *testing.T) {
+			p, ok := trie.overlapping(tc.prefix)
+			assert.Equal(t, ok, tc.expOverlap.IsValid())
+			assert.Equal(t, p, tc.expOverlap)
+		})
+	}
+}
+
+func TestTrieContaining(t *testing.T) {
+	trie := &prefixTrie{}
+	trie.insert(netip.MustParsePrefix("10.0.0.0/8"))
+	trie.insert(netip.MustParsePrefix("192.168.1.4/32"))
+
+	p, ok := trie.containing(netip.MustParseAddr("10.1.2.3"))
+	assert.Assert(t, ok)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/8"))
+
+	p, ok = trie.containing(netip.MustParseAddr("192.168.1.4"))
+	assert.Assert(t, ok)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.1.4/32"))
+
+	_, ok = trie.containing(netip.MustParseAddr("192.168.1.5"))
+	assert.Assert(t, !ok)
+}
+
+func TestTrieRemove(t *testing.T) {
+	trie := &prefixTrie{}
+	trie.insert(netip.MustParsePrefix("192.168.0.0/16"))
+	trie.insert(netip.MustParsePrefix("192.168.1.0/24"))
+
+	assert.Assert(t, !trie.insert(netip.MustParsePrefix("192.168.1.0/24")))
+	assert.Assert(t, !trie.remove(netip.MustParsePrefix("192.168.2.0/24")))
+
+	assert.Assert(t, trie.remove(netip.MustParsePrefix("192.168.0.0/16")))
+	p, ok := trie.overlapping(netip.MustParsePrefix("192.168.0.0/16"))
+	assert.Assert(t, ok)
+	assert.Equal(t, p, netip.MustParsePrefix("192.168.1.0/24"))
+
+	assert.Assert(t, trie.remove(netip.MustParsePrefix("192.168.1.0/24")))
+	_, ok = trie.overlapping(netip.MustParsePrefix("0.0.0.0/0"))
+	assert.Assert(t, !ok)
+	assert.Equal(t, trie.root.count, 0)
+}
+
+func TestTrieReuseNodes(t *testing.T) {
+	trie := &prefixTrie{}
+	trie.insert(netip.MustParsePrefix("10.0.0.0/8"))
+	trie.insert(netip.MustParsePrefix("192.168.1.0/24"))
+	trie.remove(netip.MustParsePrefix("192.168.1.0/24"))
+	left := len(trie.slab)
+
+	// Removed nodes are reused, rather than carving new ones out of the slab.
+	for i := range 100 {
+		p := netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 168, byte(i), 0}), 24)
+		assert.Assert(t, trie.insert(p))
+		assert.Assert(t, trie.remove(p))
+	}
+	assert.Equal(t, len(trie.slab), left)
+
+	p, ok := trie.overlapping(netip.MustParsePrefix("0.0.0.0/0"))
+	assert.Assert(t, ok)
+	assert.Equal(t, p, netip.MustParsePrefix("10.0.0.0/8"))
+	assert.Equal(t, trie.root.count, 1)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// Tx stages allocations and deallocations, and applies them all at once on
+// Commit, or none of them on Rollback. Staged changes aren't visible to the
+// allocator until then, but they are to the Tx itself: subnets handed out by
+// Tx.Allocate don't overlap with each other.
+//
+// A Tx is optimistic: it doesn't lock the allocator, but Commit fails if the
+// allocator changed since Begin, see Generation.
+type Tx struct {
+	a   *Allocator
+	gen uint64
+	// allocated and released are the staged changes. meta holds the
+	// metadata of staged allocations, for those that have some.
+	allocated []netip.Prefix
+	released  []netip.Prefix
+	meta      map[netip.Prefix]allocMeta
+	// forced holds the staged deallocations releasing pinned allocations,
+	// see WithForce.
+	forced map[netip.Prefix]bool
+	// ops holds the requests that staged changes, for the audit trail, see
+	// WithAudit.
+	ops  map[netip.Prefix]auditOp
+	done bool
+}
+
+// Begin starts a transaction on the current state of the allocator.
+func (a *Allocator) Begin() *Tx {
+	return &Tx{a: a, gen: a.generation}
+}
+
+// check returns an error if tx can't be used anymore.
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.a.checkGeneration(tx.gen)
+}
+
+// Allocate stages the allocation of the subnet Allocate would hand out, and
+// returns it.
+func (tx *Tx) Allocate(opts ...AllocateOption) (netip.Prefix, error) {
+	o := newAllocateOptions(opts)
+	p, err := tx.allocate(o)
+	tx.audit(AuditAllocate, p, o.actor, o.owner, err)
+	return p, err
+}
+
+func (tx *Tx) allocate(o allocateOptions) (netip.Prefix, error) {
+	if err := tx.check(); err != nil {
+		return netip.Prefix{}, err
+	}
+
+	// Subnets staged by this Tx aren't free anymore.
+	o.reserved = append(slices.Clip(o.reserved), tx.allocated...)
+	p, _, err := tx.a.pickAdmitted(o)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	tx.stage(p, tx.a.newMeta(o))
+	return p, nil
+}
+
+// AllocateStatic stages the allocation of p, if it doesn't overlap with any
+// existing allocation nor with subnets already staged. Like with
+// Allocator.AllocateStatic, only options attaching metadata apply.
+func (tx *Tx) AllocateStatic(p netip.Prefix, opts ...AllocateOption) error {
+	o := newAllocateOptions(opts)
+	err := tx.allocateStatic(p, o)
+	tx.audit(AuditAllocateStatic, p.Masked(), o.actor, o.owner, err)
+	return err
+}
+
+func (tx *Tx) allocateStatic(p netip.Prefix, o allocateOptions) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if !p.IsValid() || !p.Addr().Is4() {
+		return fmt.Errorf("%w %s", ErrInvalidPrefix, p)
+	}
+
+	p = p.Masked()
+	if tx.a.trie == nil {
+		tx.a.buildIndexes()
+	}
+	if allocated, ok := tx.a.trie.overlapping(p); ok {
+		return &OverlapError{Prefix: p, Allocated: allocated}
+	}
+	if err := tx.a.checkTombstones(p); err != nil {
+		return err
+	}
+	for _, staged := range tx.allocated {
+		if staged.Overlaps(p) {
+			return &OverlapError{Prefix: p, Allocated: staged}
+		}
+	}
+	if err := tx.a.admitStatic(p, o.owner, o.actor, o.labels); err != nil {
+		return err
+	}
+	if err := tx.a.validateStatic(p); err != nil {
+		return err
+	}
+
+	tx.stage(p, tx.a.newMeta(o))
+	return nil
+}
+
+func (tx *Tx) stage(p netip.Prefix, m allocMeta) {
+	// Idempotency keys only apply to Allocator.Allocate.
+	m.key = ""
+	tx.allocated = append(tx.allocated, p)
+	if !m.AllocationMeta.isZero() {
+		if tx.meta == nil {
+			tx.meta = map[netip.Prefix]allocMeta{}
+		}
+		tx.meta[p] = m
+	}
+}
+
+// Deallocate stages the deallocation of p. If p was allocated by this Tx, the
+// allocation is unstaged instead. Like with Allocator.Deallocate, pinned
+// allocations are only released with WithForce.
+func (tx *Tx) Deallocate(p netip.Prefix, opts ...DeallocateOption) error {
+	o := newDeallocateOptions(opts)
+	owner := tx.a.meta[p].Owner
+	err := tx.deallocate(p, o)
+	tx.audit(AuditDeallocate, p, o.actor, owner, err)
+	return err
+}
+
+func (tx *Tx) deallocate(p netip.Prefix, o deallocateOptions) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+
+	if i := slices.Index(tx.allocated, p); i != -1 {
+		tx.allocated = slices.Delete(tx.allocated, i, i+1)
+		delete(tx.meta, p)
+		delete(tx.ops, p)
+		return nil
+	}
+	if !tx.a.allocated.contains(p) || slices.Contains(tx.released, p) {
+		return fmt.Errorf("prefix %s is %w", p, ErrNotAllocated)
+	}
+	if err := tx.a.checkPinned(p, o); err != nil {
+		return err
+	}
+
+	tx.released = append(tx.released, p)
+	if o.force {
+		if tx.forced == nil {
+			tx.forced = map[netip.Prefix]bool{}
+		}
+		tx.forced[p] = true
+	}
+	return nil
+}
+
+// audit records the staging of p on behalf of actor, see WithAudit. If it
+// failed, the failure is recorded right away. Otherwise, the change is
+// recorded once it's committed.
+func (tx *Tx) audit(action AuditAction, p netip.Prefix, actor, owner string, err error) {
+	a := tx.a
+	if !a.audit {
+		return
+	}
+	if err != nil {
+		a.recordAudit(action, p, actor, owner, err)
+		a.flushAudit()
+		return
+	}
+	if action == AuditDeallocate && !slices.Contains(tx.released, p) {
+		// An allocation staged by tx was unstaged.
+		return
+	}
+	if tx.ops == nil {
+		tx.ops = map[netip.Prefix]auditOp{}
+	}
+	tx.ops[p] = auditOp{action: action, actor: actor}
+}
+
+// Commit applies the staged changes. It fails with an error matching
+// ErrGenerationMismatch, and applies nothing, if the allocator changed since
+// Begin. Either way, tx can't be used afterward.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	err := tx.commit()
+	if err != nil && tx.a.audit {
+		// Nothing was applied, every staged change failed.
+		for _, p := range tx.released {
+			op := tx.ops[p]
+			tx.a.recordAudit(op.action, p, op.actor, tx.a.meta[p].Owner, err)
+		}
+		for _, p := range tx.allocated {
+			op := tx.ops[p]
+			tx.a.recordAudit(op.action, p, op.actor, tx.meta[p].Owner, err)
+		}
+		tx.a.flushAudit()
+	}
+	return err
+}
+
+func (tx *Tx) commit() error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	tx.done = true
+
+	a := tx.a
+	if len(tx.allocated) == 0 && len(tx.released) == 0 {
+		return nil
+	}
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+	for _, p := range tx.released {
+		if err := a.checkPinned(p, deallocateOptions{force: tx.forced[p]}); err != nil {
+			return err
+		}
+	}
+
+	// Owners may release allocations and get new ones in the same Tx, so
+	// quotas are checked against the outcome.
+	type usage struct {
+		n         int
+		addresses int64
+	}
+	deltas := map[string]usage{}
+	for _, p := range tx.allocated {
+		if owner := tx.meta[p].Owner; owner != "" {
+			u := deltas[owner]
+			deltas[owner] = usage{u.n + 1, u.addresses + int64(1)<<(32-p.Bits())}
+		}
+	}
+	for _, p := range tx.released {
+		if owner := a.meta[p].Owner; owner != "" {
+			u := deltas[owner]
+			deltas[owner] = usage{u.n - 1, u.addresses - int64(1)<<(32-p.Bits())}
+		}
+	}
+	for owner, u := range deltas {
+		if err := a.checkOwnerQuota(owner, u.n, u.addresses); err != nil {
+			return err
+		}
+	}
+
+	prev := a.op
+	return a.persist(func() error {
+		for _, p := range tx.released {
+			a.op = tx.ops[p]
+			a.release(p)
+		}
+		for _, p := range tx.allocated {
+			a.op = tx.ops[p]
+			a.insert(p)
+			if m, ok := tx.meta[p]; ok {
+				a.setMeta(p, m)
+			}
+		}
+		a.op = prev
+		return nil
+	})
+}
+
+// Rollback discards the staged changes. It's a no-op if tx was already
+// committed or rolled back, such that it can be deferred.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.allocated, tx.released, tx.meta, tx.forced, tx.ops = nil, nil, nil, nil, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTx(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	old, err := a.Allocate()
+	assert.NilError(t, err)
+
+	tx := a.Begin()
+	p1, err := tx.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p1, netip.MustParsePrefix("10.0.1.0/24"))
+	p2, err := tx.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, p2, netip.MustParsePrefix("10.0.2.0/24"))
+	assert.NilError(t, tx.AllocateStatic(netip.MustParsePrefix("10.0.10.0/24")))
+	assert.NilError(t, tx.Deallocate(old))
+
+	// Staged allocations conflict with each other, but not with the
+	// allocator until committed.
+	err = tx.AllocateStatic(netip.MustParsePrefix("10.0.2.0/23"))
+	assert.ErrorIs(t, err, ErrOverlap)
+	assert.ErrorIs(t, tx.Deallocate(old), ErrNotAllocated)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{old}, cmpPrefix)
+
+	// Deallocating a staged allocation unstages it.
+	assert.NilError(t, tx.Deallocate(p2))
+
+	assert.NilError(t, tx.Commit())
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.10.0/24"),
+	}, cmpPrefix)
+	assert.NilError(t, a.CheckInvariants(true))
+
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	_, err = tx.Allocate()
+	assert.ErrorIs(t, err, ErrTxDone)
+}
+
+func TestTxRollback(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	gen := a.Generation()
+
+	tx := a.Begin()
+	_, err := tx.Allocate()
+	assert.NilError(t, err)
+	tx.Rollback()
+	tx.Rollback()
+
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	assert.Equal(t, len(a.Allocated()), 0)
+	assert.Equal(t, a.Generation(), gen)
+}
+
+func TestTxConflict(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+
+	tx := a.Begin()
+	p, err := tx.Allocate()
+	assert.NilError(t, err)
+
+	// Another caller allocates the same subnet in the meantime.
+	q, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, q, p)
+
+	assert.ErrorIs(t, tx.Commit(), ErrGenerationMismatch)
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{q}, cmpPrefix)
+}
+
+func TestTxStoreFailure(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s))
+
+	tx := a.Begin()
+	_, err := tx.Allocate()
+	assert.NilError(t, err)
+	_, err = tx.Allocate()
+	assert.NilError(t, err)
+
+	s.fail = true
+	assert.ErrorIs(t, tx.Commit(), errStore)
+	assert.Equal(t, len(a.Allocated()), 0)
+	assert.NilError(t, a.CheckInvariants(true))
+}
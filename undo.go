@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+)
+
+// undoEntry is a change Undo can revert: prefixes that were allocated, or
+// prefixes that were released, along with their metadata.
+type undoEntry struct {
+	allocated []netip.Prefix
+	released  map[netip.Prefix]allocMeta
+}
+
+// WithUndo makes the allocator remember the last n changes made by Allocate,
+// AllocateStatic, AllocateN, Deallocate and DeallocateAll, such that Undo can
+// revert them. The undo stack isn't persisted.
+func WithUndo(n int) Option {
+	return func(a *Allocator) {
+		a.undoSize = n
+	}
+}
+
+// pushUndo records e on top of the undo stack, dropping the oldest entry if
+// the stack is full.
+func (a *Allocator) pushUndo(e undoEntry) {
+	if a.undoSize <= 0 {
+		return
+	}
+	a.undo = append(a.undo, e)
+	if n := len(a.undo) - a.undoSize; n > 0 {
+		a.undo = slices.Delete(a.undo, 0, n)
+	}
+}
+
+// Undo reverts the most recent change recorded on the undo stack, see
+// WithUndo: allocated prefixes are released, and released ones are allocated
+// again, along with their metadata. It returns ErrNothingToUndo once the stack
+// is empty.
+//
+// If the change can't be reverted, e.g. because a released prefix was
+// allocated again in the meantime, an error is returned and the stack is left
+// as is.
+func (a *Allocator) Undo() error {
+	if len(a.undo) == 0 {
+		return ErrNothingToUndo
+	}
+	if a.trie == nil {
+		a.buildIndexes()
+	}
+
+	e := a.undo[len(a.undo)-1]
+	type usage struct {
+		n         int
+		addresses int64
+	}
+	deltas := map[string]usage{}
+	for _, p := range e.allocated {
+		if !a.allocated.contains(p) {
+			return fmt.Errorf("can't undo the allocation of %s: prefix is %w", p, ErrNotAllocated)
+		}
+		if owner := a.meta[p].Owner; owner != "" {
+			u := deltas[owner]
+			deltas[owner] = usage{u.n - 1, u.addresses - int64(1)<<(32-p.Bits())}
+		}
+	}
+
+	released := slices.SortedFunc(maps.Keys(e.released), comparePrefix)
+	for _, p := range released {
+		if allocated, ok := a.trie.overlapping(p); ok {
+			return fmt.Errorf("can't undo the release of %s: %w", p, &OverlapError{Prefix: p, Allocated: allocated})
+		}
+		m := e.released[p]
+		if other, ok := a.names[m.Name]; ok && m.Name != "" {
+			return fmt.Errorf("can't undo the release of %s: name %q is bound to %s", p, m.Name, other)
+		}
+		if m.Owner != "" {
+			u := deltas[m.Owner]
+			deltas[m.Owner] = usage{u.n + 1, u.addresses + int64(1)<<(32-p.Bits())}
+		}
+	}
+	for owner, u := range deltas {
+		if err := a.checkOwnerQuota(owner, u.n, u.addresses); err != nil {
+			return err
+		}
+	}
+
+	err := a.persist(func() error {
+		for _, p := range e.allocated {
+			a.release(p)
+		}
+		for _, p := range released {
+			// The release of p may have left a tombstone behind.
+			a.tombstones.remove(p)
+			a.insert(p)
+			m := e.released[p]
+			if _, ok := a.keys[m.key]; ok {
+				// The idempotency key was used again since.
+				m.key = ""
+			}
+			if !m.AllocationMeta.isZero() || m.key != "" {
+				a.setMeta(p, m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.undo = a.undo[:len(a.undo)-1]
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestUndo(t *testing.T) {
+	s := &memStore{}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithStore(s), WithUndo(3))
+
+	p1, err := a.Allocate(WithOwner("c1"), WithLabels(map[string]string{"env": "prod"}))
+	assert.NilError(t, err)
+	prefixes, err := a.AllocateN(2)
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p1))
+	before := a.Snapshot()
+	assert.NilError(t, a.DeallocateAll(prefixes))
+
+	// The release of p1 is reverted along with its metadata.
+	assert.NilError(t, a.Undo())
+	assert.DeepEqual(t, a.Snapshot(), before, cmpPrefix)
+	assert.NilError(t, a.Undo())
+	m, ok := a.Metadata(p1)
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, m, AllocationMeta{Owner: "c1", Labels: map[string]string{"env": "prod"}})
+	assert.DeepEqual(t, s.state, a.Snapshot(), cmpPrefix)
+
+	assert.NilError(t, a.Undo())
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p1}, cmpPrefix)
+	assert.NilError(t, a.CheckInvariants(true))
+
+	// Only the last 3 changes are kept.
+	assert.ErrorIs(t, a.Undo(), ErrNothingToUndo)
+}
+
+func TestUndoConflict(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}}, WithUndo(10))
+	p, err := a.Allocate()
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p))
+
+	// Transactions aren't recorded on the undo stack.
+	commit := func(fn func(tx *Tx) error) {
+		tx := a.Begin()
+		assert.NilError(t, fn(tx))
+		assert.NilError(t, tx.Commit())
+	}
+	commit(func(tx *Tx) error { return tx.AllocateStatic(netip.MustParsePrefix("10.0.0.0/23")) })
+
+	err = a.Undo()
+	assert.ErrorIs(t, err, ErrOverlap)
+	assert.Error(t, err, "can't undo the release of 10.0.0.0/24: prefix 10.0.0.0/24 overlaps with allocated prefix 10.0.0.0/23")
+
+	// The stack is left as is, so trying again works once the conflict is
+	// gone.
+	commit(func(tx *Tx) error { return tx.Deallocate(netip.MustParsePrefix("10.0.0.0/23")) })
+	assert.NilError(t, a.Undo())
+	assert.DeepEqual(t, a.Allocated(), []netip.Prefix{p}, cmpPrefix)
+	assert.NilError(t, a.Undo())
+	assert.Equal(t, len(a.Allocated()), 0)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// EventKind tells what happened to an allocation, see Event.
+type EventKind int
+
+const (
+	// EventAllocated reports a new allocation.
+	EventAllocated EventKind = iota
+	// EventReleased reports an allocation that was released.
+	EventReleased
+	// EventExpired reports a lease that was released after it expired, see
+	// WithTTL.
+	EventExpired
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventAllocated:
+		return "allocated"
+	case EventReleased:
+		return "released"
+	case EventExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Event is a change to the allocations, reported by Watch.
+type Event struct {
+	Kind       EventKind
+	Allocation Allocation
+	Meta       AllocationMeta
+	// Generation is the generation of the allocator once the change was
+	// applied, see Generation.
+	Generation uint64
+}
+
+// watchBufferSize is the number of events a watcher can lag behind before
+// it's dropped.
+const watchBufferSize = 256
+
+// watcher is a channel returned by Watch. It's closed when the context passed
+// to Watch is done, or when the watcher falls behind.
+type watcher struct {
+	mu     sync.Mutex
+	ch     chan Event
+	closed bool
+	stop   func() bool
+}
+
+// Watch returns a channel reporting every change made to the allocations
+// through the allocator, see OnAllocate, until ctx is done. Events are
+// reported in order, and the channel is closed once ctx is done, or the
+// allocator is closed.
+//
+// The channel is buffered, but the allocator doesn't wait for the receiver:
+// if the receiver falls too far behind, the channel is closed early. A
+// receiver maintaining a view of the allocations should then start over from
+// a fresh Snapshot, and compare generations to skip events it already knows
+// about.
+func (a *Allocator) Watch(ctx context.Context) <-chan Event {
+	w := &watcher{ch: make(chan Event, watchBufferSize)}
+	if a.closed {
+		w.close()
+		return w.ch
+	}
+
+	a.watchersMu.Lock()
+	a.watchers = append(a.watchers, w)
+	a.watchersMu.Unlock()
+	w.stop = context.AfterFunc(ctx, func() {
+		a.removeWatcher(w)
+		w.close()
+	})
+	return w.ch
+}
+
+// removeWatcher forgets about w, once the context passed to Watch is done,
+// such that idle allocators don't pile up watchers nobody listens to.
+func (a *Allocator) removeWatcher(w *watcher) {
+	a.watchersMu.Lock()
+	defer a.watchersMu.Unlock()
+	a.watchers = slices.DeleteFunc(a.watchers, func(other *watcher) bool {
+		return other == w
+	})
+}
+
+// watched tells whether anybody is watching the allocator.
+func (a *Allocator) watched() bool {
+	a.watchersMu.Lock()
+	defer a.watchersMu.Unlock()
+	return len(a.watchers) > 0
+}
+
+// send sends ev to w without blocking. It returns false if w is closed.
+func (w *watcher) send(ev Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.ch <- ev:
+		return true
+	default:
+		// The receiver is too slow.
+		w.closed = true
+		close(w.ch)
+		w.stop()
+		return false
+	}
+}
+
+func (w *watcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestWatch(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+	a.now = clock.now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := a.Watch(ctx)
+
+	p1, err := a.Allocate(WithOwner("c1"))
+	assert.NilError(t, err)
+	p2, err := a.Allocate(WithTTL(time.Minute))
+	assert.NilError(t, err)
+	assert.NilError(t, a.Deallocate(p1))
+	clock.t = clock.t.Add(time.Hour)
+	_, err = a.ReclaimExpired()
+	assert.NilError(t, err)
+
+	type event struct {
+		Kind       EventKind
+		Prefix     netip.Prefix
+		Owner      string
+		Generation uint64
+	}
+	var got []event
+	for range 4 {
+		ev := <-ch
+		got = append(got, event{ev.Kind, ev.Allocation.Prefix, ev.Meta.Owner, ev.Generation})
+	}
+	assert.DeepEqual(t, got, []event{
+		{EventAllocated, p1, "c1", 1},
+		{EventAllocated, p2, "", 2},
+		{EventReleased, p1, "c1", 3},
+		{EventExpired, p2, "", 4},
+	}, cmpPrefix)
+	assert.Equal(t, a.Generation(), uint64(4))
+
+	cancel()
+	_, ok := <-ch
+	assert.Check(t, !ok)
+	_, err = a.Allocate()
+	assert.NilError(t, err)
+	assert.Equal(t, len(a.watchers), 0)
+}
+
+func TestWatchCancel(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/16"), Size: 24}})
+
+	// Watchers are removed as soon as their context is done, even if the
+	// allocator never changes.
+	for range 10 {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := a.Watch(ctx)
+		cancel()
+		_, ok := <-ch
+		assert.Check(t, !ok)
+	}
+	a.watchersMu.Lock()
+	defer a.watchersMu.Unlock()
+	assert.Equal(t, len(a.watchers), 0)
+}
+
+func TestWatchSlowReceiver(t *testing.T) {
+	a := mustNewAllocator(t, []Pool{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Size: 24}})
+	ch := a.Watch(context.Background())
+
+	_, err := a.AllocateN(watchBufferSize + 1)
+	assert.NilError(t, err)
+
+	// The channel is closed once the buffer is full.
+	var n int
+	for range ch {
+		n++
+	}
+	assert.Equal(t, n, watchBufferSize)
+}